@@ -25,11 +25,16 @@ func main() {
 	ctx := context.Background()
 	defer ctx.Done()
 
-	password.JwtInit(pgPool, ctx)
+	kek, err := env.GetKeyEncryptionKey()
+	if err != nil {
+		log.Fatal("failed to load key-encryption key, msg:", err)
+	}
+
+	password.JwtInit(pgPool, ctx, env.JWT_SIGNING_ALG, kek)
 
 	router := server.SetupRouter()
 
-	factory.InitFactory(router, pgPool, rdClient, ctx)
+	factory.InitFactory(router, env, kek, pgPool, rdClient, ctx)
 
 	server.StartServer(env.SERVER_PORT, router)
 }
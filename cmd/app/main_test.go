@@ -15,7 +15,7 @@ func TestMain(m *testing.M) {
 	ctx := testUtils.GetContext()
 	defer ctx.Done()
 
-	password.JwtInit(pgPool, ctx)
+	password.JwtInit(pgPool, ctx, password.DefaultSigningAlg, testUtils.GetKeyEncryptionKey())
 
 	os.Exit(m.Run())
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	authRepository "github.com/dwiw96/ran-user-management/internal/features/users/repository"
+	pg "github.com/dwiw96/ran-user-management/pkg/driver/postgresql"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+)
+
+const usage = `manage oauth clients that call oauth endpoints
+
+usage:
+	clients list                  list all clients
+	clients create [-public] [-redirect-uri <uri>]... [-grant-type <type>]... [-scope <scope>]... [-audience <audience>]... <name>
+	                              register new client, the client secret is
+	                              only printed once and can't be read again.
+	                              Public client (e.g. single page app) doesn't
+	                              have client secret. Grant type is
+	                              authorization_code (default),
+	                              client_credentials or
+	                              urn:ietf:params:oauth:grant-type:token-exchange,
+	                              client with client_credentials is service
+	                              account that can only request the allowed
+	                              scopes, client with token exchange can only
+	                              request token for the allowed audiences,
+	                              client with authorization_code can use
+	                              refresh_token too.
+	                              Redirect uri, grant type, scope and audience
+	                              can be set many times
+	clients revoke <client_id>    revoke the client`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	env := cfg.GetEnvConfig()
+	pgPool := pg.ConnectToPg(env)
+	defer pgPool.Close()
+
+	kek, err := env.GetKeyEncryptionKey()
+	if err != nil {
+		log.Fatal("failed to load key-encryption key, msg:", err)
+	}
+
+	ctx := context.Background()
+	repo := authRepository.NewUsersRepository(pgPool, pgPool, kek)
+
+	switch os.Args[1] {
+	case "list":
+		err = listClients(ctx, repo)
+	case "create":
+		err = createClient(ctx, repo, os.Args[2:])
+	case "revoke":
+		if len(os.Args) < 3 {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+		err = repo.RevokeOAuthClient(ctx, os.Args[2])
+		if err == nil {
+			log.Println("client revoked, client_id:", os.Args[2])
+		}
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func listClients(ctx context.Context, repo pUsers.IRepository) error {
+	clients, err := repo.ListOAuthClients(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range clients {
+		status := "active"
+		if v.RevokedAt.Valid {
+			status = "revoked"
+		}
+		clientType := "confidential"
+		if v.IsPublic {
+			clientType = "public"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\tgrant_types=%s\tscopes=%s\taudiences=%s\tredirect_uris=%s\n", v.ClientID, v.Name, clientType, status, v.CreatedAt.Time.Format("2006/01/02 15:04:05"),
+			strings.Join(v.GrantTypes, ","), strings.Join(v.AllowedScopes, ","), strings.Join(v.AllowedAudiences, ","), strings.Join(v.RedirectURIs, ","))
+	}
+
+	return nil
+}
+
+// listFlag is flag that can be set many times, every value is checked with validate
+type listFlag struct {
+	values   []string
+	validate func(value string) error
+}
+
+func (l *listFlag) String() string {
+	return strings.Join(l.values, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	err := l.validate(value)
+	if err != nil {
+		return err
+	}
+
+	l.values = append(l.values, value)
+	return nil
+}
+
+func validateRedirectURI(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return fmt.Errorf("redirect uri %q must be absolute uri without fragment", value)
+	}
+
+	return nil
+}
+
+func validateGrantType(value string) error {
+	if value != pUsers.GrantTypeAuthorizationCode && value != pUsers.GrantTypeClientCredentials && value != pUsers.GrantTypeTokenExchange {
+		return fmt.Errorf("grant type %q is not supported", value)
+	}
+
+	return nil
+}
+
+func validateScope(value string) error {
+	if value == "" || strings.ContainsAny(value, " \t\"\\") {
+		return fmt.Errorf("scope %q is not valid", value)
+	}
+
+	return nil
+}
+
+func validateAudience(value string) error {
+	if value == "" || strings.ContainsAny(value, " \t") {
+		return fmt.Errorf("audience %q is not valid", value)
+	}
+
+	return nil
+}
+
+func createClient(ctx context.Context, repo pUsers.IRepository, args []string) error {
+	uris := &listFlag{validate: validateRedirectURI}
+	grantTypes := &listFlag{validate: validateGrantType}
+	scopes := &listFlag{validate: validateScope}
+	audiences := &listFlag{validate: validateAudience}
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	isPublic := flags.Bool("public", false, "client doesn't have client secret")
+	flags.Var(uris, "redirect-uri", "redirect uri of authorization code flow")
+	flags.Var(grantTypes, "grant-type", "grant type that the client can use")
+	flags.Var(scopes, "scope", "scope that the client can request as service account")
+	flags.Var(audiences, "audience", "audience that the client can request in token exchange")
+	flags.Parse(args)
+
+	name := strings.Join(flags.Args(), " ")
+	if name == "" {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	clientID, clientSecret, err := password.GenerateClientCredential()
+	if err != nil {
+		return err
+	}
+
+	arg := pUsers.CreateOAuthClientParams{
+		ClientID:         clientID,
+		Name:             name,
+		RedirectURIs:     uris.values,
+		IsPublic:         *isPublic,
+		GrantTypes:       grantTypes.values,
+		AllowedScopes:    scopes.values,
+		AllowedAudiences: audiences.values,
+	}
+	if !arg.IsPublic {
+		arg.ClientSecretHash = password.HashClientSecret(clientSecret)
+	}
+	_, err = repo.CreateOAuthClient(ctx, arg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("client_id:     %s\n", clientID)
+	if !arg.IsPublic {
+		fmt.Printf("client_secret: %s\n", clientSecret)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	authRepository "github.com/dwiw96/ran-user-management/internal/features/users/repository"
+	pg "github.com/dwiw96/ran-user-management/pkg/driver/postgresql"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const usage = `manage jwt signing keys
+
+usage:
+	keys list           list all keys
+	keys rotate [alg]   generate new active key (RS256, PS256, ES256 or EdDSA, default is
+	                    the algorithm of the current active key), the current
+	                    active key become verifying key
+	keys retire <kid>   stop verifying token signed with the verifying key
+	keys rewrap         re-encrypt all keys and TOTP secrets with the new key-encryption key that is
+	                    read from NEW_JWT_KEK or NEW_JWT_KEK_FILE, then the service
+	                    must be started with the new key-encryption key`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	env := cfg.GetEnvConfig()
+	pgPool := pg.ConnectToPg(env)
+	defer pgPool.Close()
+
+	kek, err := env.GetKeyEncryptionKey()
+	if err != nil {
+		log.Fatal("failed to load key-encryption key, msg:", err)
+	}
+
+	ctx := context.Background()
+	repo := authRepository.NewUsersRepository(pgPool, pgPool, kek)
+
+	switch os.Args[1] {
+	case "list":
+		err = listKeys(ctx, repo)
+	case "rotate":
+		var alg string
+		if len(os.Args) > 2 {
+			alg = os.Args[2]
+		}
+		err = rotateKey(ctx, repo, alg)
+	case "retire":
+		if len(os.Args) < 3 {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+		err = repo.RetireSigningKey(ctx, os.Args[2])
+		if err == nil {
+			log.Println("key retired, kid:", os.Args[2])
+		}
+	case "rewrap":
+		err = rewrapKeys(ctx, pgPool, kek)
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func listKeys(ctx context.Context, repo pUsers.IRepository) error {
+	keys, err := repo.ListSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range keys {
+		fmt.Printf("%s\t%s\t%s\t%s\n", v.Kid, v.Alg, v.Status, v.CreatedAt.Time.Format("2006/01/02 15:04:05"))
+	}
+
+	return nil
+}
+
+func rotateKey(ctx context.Context, repo pUsers.IRepository, alg string) error {
+	if alg == "" {
+		activeKey, err := repo.LoadKey(ctx)
+		if err != nil {
+			return err
+		}
+		alg = activeKey.Alg
+	}
+
+	privateKey, kid, err := password.GenerateSigningKey(alg)
+	if err != nil {
+		return err
+	}
+
+	arg := pUsers.InsertSigningKeyParams{
+		Kid:        kid,
+		Alg:        alg,
+		PrivateKey: privateKey,
+	}
+	key, err := repo.RotateSigningKey(ctx, arg)
+	if err != nil {
+		return err
+	}
+
+	log.Println("key rotated, new active kid:", key.Kid)
+
+	return nil
+}
+
+func rewrapKeys(ctx context.Context, pgPool *pgxpool.Pool, kek *password.KeyEncryptionKey) error {
+	newKEK, err := password.LoadKeyEncryptionKey(os.Getenv("NEW_JWT_KEK"), os.Getenv("NEW_JWT_KEK_FILE"))
+	if err != nil {
+		return fmt.Errorf("failed to load new key-encryption key, msg: %v", err)
+	}
+
+	count, err := password.RewrapKeys(pgPool, ctx, kek, newKEK)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d keys re-encrypted with key-encryption key %s\n", count, newKEK.ID)
+
+	return nil
+}
@@ -2,11 +2,17 @@ package config
 
 import (
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
+	mailer "github.com/dwiw96/ran-user-management/pkg/mailer"
 	conv "github.com/dwiw96/ran-user-management/pkg/utils/converter"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 
 	"github.com/joho/godotenv"
 )
@@ -21,6 +27,74 @@ type EnvConfig struct {
 	REDIS_HOST     string
 	REDIS_PASSWORD string
 	REDIS_DB       int
+
+	ACCESS_TOKEN_TTL          time.Duration
+	REFRESH_TOKEN_TTL         time.Duration
+	SESSION_ABSOLUTE_LIFETIME time.Duration
+	SESSION_IDLE_TIMEOUT      time.Duration
+	TOKEN_TTL_OVERRIDES       map[string]TokenLifetime
+
+	JWT_SIGNING_ALG string
+	// key-encryption key of jwt private key, base64 encoded in JWT_KEK or
+	// saved in the file JWT_KEK_FILE
+	JWT_KEK      string
+	JWT_KEK_FILE string
+
+	// issuer of OpenID Connect, it's the base url of the service that is
+	// published in discovery document and iss claim of ID token
+	OIDC_ISSUER string
+	// audience of access token that is accepted by this service, access
+	// token for other audience is rejected
+	JWT_AUDIENCE string
+
+	// mailer that send email, it's smtp, file or memory
+	MAILER        string
+	SMTP_HOST     string
+	SMTP_PORT     string
+	SMTP_USERNAME string
+	SMTP_PASSWORD string
+	MAIL_FROM     string
+	// directory that file mailer save the email in
+	MAIL_FILE_DIR string
+
+	// login is refused until the email of the user is verified
+	REQUIRE_EMAIL_VERIFICATION bool
+	EMAIL_VERIFICATION_TTL     time.Duration
+	// page that the link in verification email open, the token is added as
+	// token query
+	EMAIL_VERIFICATION_URL string
+
+	PASSWORD_RESET_TTL time.Duration
+	// page that the link in password reset email open, the token is added as
+	// token query
+	PASSWORD_RESET_URL string
+
+	// passwordless login by email, see MagicLinkConfig
+	MAGIC_LINK_TTL          time.Duration
+	MAGIC_LINK_MAX_ATTEMPTS int64
+	// page that the link in magic link email open, the token is added as
+	// token query
+	MAGIC_LINK_URL string
+
+	// limit of failed login, see LoginProtectionConfig
+	LOGIN_FAILURE_WINDOW   time.Duration
+	LOGIN_DELAY_AFTER      int64
+	LOGIN_MAX_DELAY        time.Duration
+	LOGIN_LOCKOUT_AFTER    int64
+	LOGIN_LOCKOUT_DURATION time.Duration
+	LOGIN_IP_LIMIT         int64
+
+	// rate limit of route group that override DefaultRateLimits, see
+	// ParseRateLimits
+	RATE_LIMITS RateLimitConfig
+
+	// passkey config, see WebAuthnConfig. The default of RP ID and origins is
+	// the host and origin of OIDC_ISSUER.
+	WEBAUTHN_RP_ID             string
+	WEBAUTHN_RP_NAME           string
+	WEBAUTHN_ORIGINS           []string
+	WEBAUTHN_TIMEOUT           time.Duration
+	WEBAUTHN_USER_VERIFICATION string
 }
 
 func GetEnvConfig() *EnvConfig {
@@ -42,9 +116,305 @@ func GetEnvConfig() *EnvConfig {
 		log.Fatal("get env config, err:", err)
 	}
 
+	resEnvConfig.ACCESS_TOKEN_TTL, err = parseDuration(os.Getenv("ACCESS_TOKEN_TTL"), DefaultTokenLifetime.AccessTokenTTL)
+	if err != nil {
+		log.Fatal("get env config ACCESS_TOKEN_TTL, err:", err)
+	}
+	resEnvConfig.REFRESH_TOKEN_TTL, err = parseDuration(os.Getenv("REFRESH_TOKEN_TTL"), DefaultTokenLifetime.RefreshTokenTTL)
+	if err != nil {
+		log.Fatal("get env config REFRESH_TOKEN_TTL, err:", err)
+	}
+	resEnvConfig.SESSION_ABSOLUTE_LIFETIME, err = parseDuration(os.Getenv("SESSION_ABSOLUTE_LIFETIME"), DefaultTokenLifetime.AbsoluteLifetime)
+	if err != nil {
+		log.Fatal("get env config SESSION_ABSOLUTE_LIFETIME, err:", err)
+	}
+	resEnvConfig.SESSION_IDLE_TIMEOUT, err = parseDuration(os.Getenv("SESSION_IDLE_TIMEOUT"), DefaultTokenLifetime.IdleTimeout)
+	if err != nil {
+		log.Fatal("get env config SESSION_IDLE_TIMEOUT, err:", err)
+	}
+	resEnvConfig.TOKEN_TTL_OVERRIDES, err = ParseTokenLifetimeOverrides(os.Getenv("TOKEN_TTL_OVERRIDES"), resEnvConfig.defaultTokenLifetime())
+	if err != nil {
+		log.Fatal("get env config TOKEN_TTL_OVERRIDES, err:", err)
+	}
+
+	resEnvConfig.JWT_SIGNING_ALG = os.Getenv("JWT_SIGNING_ALG")
+	switch resEnvConfig.JWT_SIGNING_ALG {
+	case "":
+		resEnvConfig.JWT_SIGNING_ALG = password.DefaultSigningAlg
+	case password.SigningAlgRS256, password.SigningAlgPS256, password.SigningAlgES256, password.SigningAlgEdDSA:
+	default:
+		log.Fatal("get env config JWT_SIGNING_ALG, err: algorithm is not supported, ", resEnvConfig.JWT_SIGNING_ALG)
+	}
+
+	resEnvConfig.JWT_KEK = os.Getenv("JWT_KEK")
+	resEnvConfig.JWT_KEK_FILE = os.Getenv("JWT_KEK_FILE")
+
+	resEnvConfig.OIDC_ISSUER = strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if resEnvConfig.OIDC_ISSUER == "" {
+		resEnvConfig.OIDC_ISSUER = "http://localhost" + resEnvConfig.SERVER_PORT
+	}
+	resEnvConfig.JWT_AUDIENCE = os.Getenv("JWT_AUDIENCE")
+	if resEnvConfig.JWT_AUDIENCE == "" {
+		resEnvConfig.JWT_AUDIENCE = resEnvConfig.OIDC_ISSUER
+	}
+
+	resEnvConfig.MAILER = os.Getenv("MAILER")
+	switch resEnvConfig.MAILER {
+	case "":
+		resEnvConfig.MAILER = mailer.DriverFile
+	case mailer.DriverSMTP, mailer.DriverFile, mailer.DriverMemory:
+	default:
+		log.Fatal("get env config MAILER, err: mailer is not supported, ", resEnvConfig.MAILER)
+	}
+	resEnvConfig.SMTP_HOST = os.Getenv("SMTP_HOST")
+	resEnvConfig.SMTP_PORT = os.Getenv("SMTP_PORT")
+	resEnvConfig.SMTP_USERNAME = os.Getenv("SMTP_USERNAME")
+	resEnvConfig.SMTP_PASSWORD = os.Getenv("SMTP_PASSWORD")
+	resEnvConfig.MAIL_FROM = os.Getenv("MAIL_FROM")
+	resEnvConfig.MAIL_FILE_DIR = os.Getenv("MAIL_FILE_DIR")
+	if resEnvConfig.MAIL_FILE_DIR == "" {
+		resEnvConfig.MAIL_FILE_DIR = "mails"
+	}
+
+	resEnvConfig.REQUIRE_EMAIL_VERIFICATION, err = parseBool(os.Getenv("REQUIRE_EMAIL_VERIFICATION"), false)
+	if err != nil {
+		log.Fatal("get env config REQUIRE_EMAIL_VERIFICATION, err:", err)
+	}
+	resEnvConfig.EMAIL_VERIFICATION_TTL, err = parseDuration(os.Getenv("EMAIL_VERIFICATION_TTL"), DefaultEmailVerificationTTL)
+	if err != nil {
+		log.Fatal("get env config EMAIL_VERIFICATION_TTL, err:", err)
+	}
+	resEnvConfig.EMAIL_VERIFICATION_URL = os.Getenv("EMAIL_VERIFICATION_URL")
+	if resEnvConfig.EMAIL_VERIFICATION_URL == "" {
+		resEnvConfig.EMAIL_VERIFICATION_URL = resEnvConfig.OIDC_ISSUER + "/verify_email"
+	}
+
+	resEnvConfig.PASSWORD_RESET_TTL, err = parseDuration(os.Getenv("PASSWORD_RESET_TTL"), DefaultPasswordResetTTL)
+	if err != nil {
+		log.Fatal("get env config PASSWORD_RESET_TTL, err:", err)
+	}
+	resEnvConfig.PASSWORD_RESET_URL = os.Getenv("PASSWORD_RESET_URL")
+	if resEnvConfig.PASSWORD_RESET_URL == "" {
+		resEnvConfig.PASSWORD_RESET_URL = resEnvConfig.OIDC_ISSUER + "/reset_password"
+	}
+
+	resEnvConfig.MAGIC_LINK_TTL, err = parseDuration(os.Getenv("MAGIC_LINK_TTL"), DefaultMagicLink.TokenTTL)
+	if err != nil {
+		log.Fatal("get env config MAGIC_LINK_TTL, err:", err)
+	}
+	resEnvConfig.MAGIC_LINK_MAX_ATTEMPTS, err = parseInt(os.Getenv("MAGIC_LINK_MAX_ATTEMPTS"), DefaultMagicLink.MaxAttempts)
+	if err != nil {
+		log.Fatal("get env config MAGIC_LINK_MAX_ATTEMPTS, err:", err)
+	}
+	if resEnvConfig.MAGIC_LINK_MAX_ATTEMPTS < 1 {
+		log.Fatal("get env config MAGIC_LINK_MAX_ATTEMPTS, err: value must be positive, ", resEnvConfig.MAGIC_LINK_MAX_ATTEMPTS)
+	}
+	resEnvConfig.MAGIC_LINK_URL = os.Getenv("MAGIC_LINK_URL")
+	if resEnvConfig.MAGIC_LINK_URL == "" {
+		resEnvConfig.MAGIC_LINK_URL = resEnvConfig.OIDC_ISSUER + "/magic_login"
+	}
+
+	resEnvConfig.LOGIN_FAILURE_WINDOW, err = parseDuration(os.Getenv("LOGIN_FAILURE_WINDOW"), DefaultLoginProtection.Window)
+	if err != nil {
+		log.Fatal("get env config LOGIN_FAILURE_WINDOW, err:", err)
+	}
+	resEnvConfig.LOGIN_DELAY_AFTER, err = parseInt(os.Getenv("LOGIN_DELAY_AFTER"), DefaultLoginProtection.DelayAfter)
+	if err != nil {
+		log.Fatal("get env config LOGIN_DELAY_AFTER, err:", err)
+	}
+	resEnvConfig.LOGIN_MAX_DELAY, err = parseDuration(os.Getenv("LOGIN_MAX_DELAY"), DefaultLoginProtection.MaxDelay)
+	if err != nil {
+		log.Fatal("get env config LOGIN_MAX_DELAY, err:", err)
+	}
+	resEnvConfig.LOGIN_LOCKOUT_AFTER, err = parseInt(os.Getenv("LOGIN_LOCKOUT_AFTER"), DefaultLoginProtection.LockoutAfter)
+	if err != nil {
+		log.Fatal("get env config LOGIN_LOCKOUT_AFTER, err:", err)
+	}
+	resEnvConfig.LOGIN_LOCKOUT_DURATION, err = parseDuration(os.Getenv("LOGIN_LOCKOUT_DURATION"), DefaultLoginProtection.LockoutDuration)
+	if err != nil {
+		log.Fatal("get env config LOGIN_LOCKOUT_DURATION, err:", err)
+	}
+	resEnvConfig.LOGIN_IP_LIMIT, err = parseInt(os.Getenv("LOGIN_IP_LIMIT"), DefaultLoginProtection.IPLimit)
+	if err != nil {
+		log.Fatal("get env config LOGIN_IP_LIMIT, err:", err)
+	}
+
+	resEnvConfig.RATE_LIMITS, err = ParseRateLimits(os.Getenv("RATE_LIMITS"), DefaultRateLimits)
+	if err != nil {
+		log.Fatal("get env config RATE_LIMITS, err:", err)
+	}
+
+	issuer, err := url.Parse(resEnvConfig.OIDC_ISSUER)
+	if err != nil {
+		log.Fatal("get env config OIDC_ISSUER, err:", err)
+	}
+	resEnvConfig.WEBAUTHN_RP_ID = os.Getenv("WEBAUTHN_RP_ID")
+	if resEnvConfig.WEBAUTHN_RP_ID == "" {
+		resEnvConfig.WEBAUTHN_RP_ID = issuer.Hostname()
+	}
+	resEnvConfig.WEBAUTHN_RP_NAME = os.Getenv("WEBAUTHN_RP_NAME")
+	if resEnvConfig.WEBAUTHN_RP_NAME == "" {
+		resEnvConfig.WEBAUTHN_RP_NAME = resEnvConfig.WEBAUTHN_RP_ID
+	}
+	resEnvConfig.WEBAUTHN_ORIGINS, err = ParseWebAuthnOrigins(os.Getenv("WEBAUTHN_ORIGINS"))
+	if err != nil {
+		log.Fatal("get env config WEBAUTHN_ORIGINS, err:", err)
+	}
+	if len(resEnvConfig.WEBAUTHN_ORIGINS) == 0 {
+		resEnvConfig.WEBAUTHN_ORIGINS = []string{issuer.Scheme + "://" + issuer.Host}
+	}
+	resEnvConfig.WEBAUTHN_TIMEOUT, err = parseDuration(os.Getenv("WEBAUTHN_TIMEOUT"), DefaultWebAuthnTimeout)
+	if err != nil {
+		log.Fatal("get env config WEBAUTHN_TIMEOUT, err:", err)
+	}
+	resEnvConfig.WEBAUTHN_USER_VERIFICATION = os.Getenv("WEBAUTHN_USER_VERIFICATION")
+	switch resEnvConfig.WEBAUTHN_USER_VERIFICATION {
+	case "":
+		resEnvConfig.WEBAUTHN_USER_VERIFICATION = UserVerificationPreferred
+	case UserVerificationRequired, UserVerificationPreferred, UserVerificationDiscouraged:
+	default:
+		log.Fatal("get env config WEBAUTHN_USER_VERIFICATION, err: value is not supported, ", resEnvConfig.WEBAUTHN_USER_VERIFICATION)
+	}
+
 	return &resEnvConfig
 }
 
+func (e *EnvConfig) defaultTokenLifetime() TokenLifetime {
+	return TokenLifetime{
+		AccessTokenTTL:   e.ACCESS_TOKEN_TTL,
+		RefreshTokenTTL:  e.REFRESH_TOKEN_TTL,
+		AbsoluteLifetime: e.SESSION_ABSOLUTE_LIFETIME,
+		IdleTimeout:      e.SESSION_IDLE_TIMEOUT,
+	}
+}
+
+// GetTokenLifetimeConfig return token lifetime config to be used by the service.
+func (e *EnvConfig) GetTokenLifetimeConfig() TokenLifetimeConfig {
+	return TokenLifetimeConfig{
+		Default:   e.defaultTokenLifetime(),
+		Overrides: e.TOKEN_TTL_OVERRIDES,
+	}
+}
+
+// DefaultEmailVerificationTTL is lifetime of email verification token
+const DefaultEmailVerificationTTL = 24 * time.Hour
+
+// EmailVerificationConfig is config of email verification that is used by the service.
+//   - Required refuse login and token of the user that doesn't verify the email.
+//   - TokenTTL is lifetime of verification token.
+//   - URL is the page that the link in verification email open.
+type EmailVerificationConfig struct {
+	Required bool
+	TokenTTL time.Duration
+	URL      string
+}
+
+// GetEmailVerificationConfig return email verification config to be used by the service.
+func (e *EnvConfig) GetEmailVerificationConfig() EmailVerificationConfig {
+	return EmailVerificationConfig{
+		Required: e.REQUIRE_EMAIL_VERIFICATION,
+		TokenTTL: e.EMAIL_VERIFICATION_TTL,
+		URL:      e.EMAIL_VERIFICATION_URL,
+	}
+}
+
+// DefaultPasswordResetTTL is lifetime of password reset token, it's short
+// because the token can take over the account
+const DefaultPasswordResetTTL = 15 * time.Minute
+
+// PasswordResetConfig is config of password reset that is used by the service.
+//   - TokenTTL is lifetime of reset token.
+//   - URL is the page that the link in password reset email open.
+type PasswordResetConfig struct {
+	TokenTTL time.Duration
+	URL      string
+}
+
+// GetPasswordResetConfig return password reset config to be used by the service.
+func (e *EnvConfig) GetPasswordResetConfig() PasswordResetConfig {
+	return PasswordResetConfig{
+		TokenTTL: e.PASSWORD_RESET_TTL,
+		URL:      e.PASSWORD_RESET_URL,
+	}
+}
+
+// DefaultMagicLink is default config of magic link login, the link and code
+// are short lived because they log the user in without password
+var DefaultMagicLink = MagicLinkConfig{
+	TokenTTL:    10 * time.Minute,
+	MaxAttempts: 5,
+}
+
+// MagicLinkConfig is config of passwordless login by email that is used by
+// the service.
+//   - TokenTTL is lifetime of the link and the code.
+//   - MaxAttempts is number of wrong code before the code can't be used.
+//   - URL is the page that the link in magic link email open.
+type MagicLinkConfig struct {
+	TokenTTL    time.Duration
+	MaxAttempts int64
+	URL         string
+}
+
+// GetMagicLinkConfig return magic link config to be used by the service.
+func (e *EnvConfig) GetMagicLinkConfig() MagicLinkConfig {
+	return MagicLinkConfig{
+		TokenTTL:    e.MAGIC_LINK_TTL,
+		MaxAttempts: e.MAGIC_LINK_MAX_ATTEMPTS,
+		URL:         e.MAGIC_LINK_URL,
+	}
+}
+
+// GetLoginProtectionConfig return limit of failed login to be used by the service.
+func (e *EnvConfig) GetLoginProtectionConfig() LoginProtectionConfig {
+	return LoginProtectionConfig{
+		Window:          e.LOGIN_FAILURE_WINDOW,
+		DelayAfter:      e.LOGIN_DELAY_AFTER,
+		BaseDelay:       DefaultLoginProtection.BaseDelay,
+		MaxDelay:        e.LOGIN_MAX_DELAY,
+		LockoutAfter:    e.LOGIN_LOCKOUT_AFTER,
+		LockoutDuration: e.LOGIN_LOCKOUT_DURATION,
+		IPLimit:         e.LOGIN_IP_LIMIT,
+	}
+}
+
+// GetWebAuthnConfig return passkey config to be used by the service.
+func (e *EnvConfig) GetWebAuthnConfig() WebAuthnConfig {
+	return WebAuthnConfig{
+		RPID:             e.WEBAUTHN_RP_ID,
+		RPName:           e.WEBAUTHN_RP_NAME,
+		Origins:          e.WEBAUTHN_ORIGINS,
+		Timeout:          e.WEBAUTHN_TIMEOUT,
+		UserVerification: e.WEBAUTHN_USER_VERIFICATION,
+	}
+}
+
+// GetMailer return the mailer of MAILER config
+func (e *EnvConfig) GetMailer() mailer.Mailer {
+	switch e.MAILER {
+	case mailer.DriverSMTP:
+		return mailer.NewSMTPMailer(e.SMTP_HOST, e.SMTP_PORT, e.SMTP_USERNAME, e.SMTP_PASSWORD, e.MAIL_FROM)
+	case mailer.DriverMemory:
+		return mailer.NewMemoryMailer()
+	default:
+		return mailer.NewFileMailer(e.MAIL_FILE_DIR, e.MAIL_FROM)
+	}
+}
+
+// GetKeyEncryptionKey return the key-encryption key of jwt private key
+func (e *EnvConfig) GetKeyEncryptionKey() (*password.KeyEncryptionKey, error) {
+	return password.LoadKeyEncryptionKey(e.JWT_KEK, e.JWT_KEK_FILE)
+}
+
+// parseBool return def when s is empty
+func parseBool(s string, def bool) (bool, error) {
+	if strings.TrimSpace(s) == "" {
+		return def, nil
+	}
+
+	return strconv.ParseBool(s)
+}
+
 func initEnvConfig() {
 	_, b, _, _ := runtime.Caller(0)
 	basePath := filepath.Dir(b)
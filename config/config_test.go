@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -23,6 +24,46 @@ func TestGetEnvConfig(t *testing.T) {
 		REDIS_HOST:     "redis:6379",
 		REDIS_PASSWORD: "user",
 		REDIS_DB:       0,
+
+		ACCESS_TOKEN_TTL:          60 * time.Minute,
+		REFRESH_TOKEN_TTL:         168 * time.Hour,
+		SESSION_ABSOLUTE_LIFETIME: 720 * time.Hour,
+		SESSION_IDLE_TIMEOUT:      24 * time.Hour,
+
+		JWT_SIGNING_ALG: "RS256",
+		JWT_KEK:         "5h0/sfsbPB6dwbVcfF5a0pcbQSCjU4O2AOKjTOKlg6w=",
+
+		OIDC_ISSUER:  "http://localhost:8080",
+		JWT_AUDIENCE: "ran-user-management",
+
+		MAILER:        "file",
+		SMTP_PORT:     "587",
+		MAIL_FROM:     "no-reply@ran-user-management.local",
+		MAIL_FILE_DIR: "mails",
+
+		EMAIL_VERIFICATION_TTL: 24 * time.Hour,
+		EMAIL_VERIFICATION_URL: "http://localhost:8080/verify_email",
+
+		PASSWORD_RESET_TTL: 15 * time.Minute,
+		PASSWORD_RESET_URL: "http://localhost:8080/reset_password",
+
+		MAGIC_LINK_TTL:          10 * time.Minute,
+		MAGIC_LINK_MAX_ATTEMPTS: 5,
+		MAGIC_LINK_URL:          "http://localhost:8080/magic_login",
+
+		LOGIN_FAILURE_WINDOW:   15 * time.Minute,
+		LOGIN_DELAY_AFTER:      3,
+		LOGIN_MAX_DELAY:        30 * time.Second,
+		LOGIN_LOCKOUT_AFTER:    10,
+		LOGIN_LOCKOUT_DURATION: 15 * time.Minute,
+		LOGIN_IP_LIMIT:         50,
+		RATE_LIMITS:            DefaultRateLimits,
+
+		WEBAUTHN_RP_ID:             "localhost",
+		WEBAUTHN_RP_NAME:           "ran-user-management",
+		WEBAUTHN_ORIGINS:           []string{"http://localhost:8080"},
+		WEBAUTHN_TIMEOUT:           5 * time.Minute,
+		WEBAUTHN_USER_VERIFICATION: UserVerificationPreferred,
 	}
 	res := GetEnvConfig()
 	require.NotNil(t, res)
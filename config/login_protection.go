@@ -0,0 +1,64 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoginProtectionConfig is the limit of failed login, failed login is counted
+// in sliding window by email, by IP and by email and IP.
+//   - Window is the time that failed login is counted, older failure is forgotten.
+//   - DelayAfter is number of failures of the email from one IP before the next
+//     login is delayed, the delay is doubled every failure after it.
+//   - BaseDelay and MaxDelay is the first and the longest delay.
+//   - LockoutAfter is number of failures of the email from any IP before the
+//     account is locked for LockoutDuration.
+//   - IPLimit is number of failures from one IP for any email before login
+//     from the IP is refused, it stop one IP from guessing many accounts.
+type LoginProtectionConfig struct {
+	Window          time.Duration
+	DelayAfter      int64
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int64
+	LockoutDuration time.Duration
+	IPLimit         int64
+}
+
+var DefaultLoginProtection = LoginProtectionConfig{
+	Window:          15 * time.Minute,
+	DelayAfter:      3,
+	BaseDelay:       time.Second,
+	MaxDelay:        30 * time.Second,
+	LockoutAfter:    10,
+	LockoutDuration: 15 * time.Minute,
+	IPLimit:         50,
+}
+
+// Delay return how long the next login must wait after the last failure, 0
+// means the login doesn't need to wait.
+func (l LoginProtectionConfig) Delay(failures int64) time.Duration {
+	if l.DelayAfter <= 0 || failures < l.DelayAfter {
+		return 0
+	}
+
+	delay := l.BaseDelay
+	for i := l.DelayAfter; i < failures && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+
+	return delay
+}
+
+// parseInt return def when s is empty.
+func parseInt(s string, def int64) (int64, error) {
+	if strings.TrimSpace(s) == "" {
+		return def, nil
+	}
+
+	return strconv.ParseInt(s, 10, 64)
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginProtectionDelay(t *testing.T) {
+	arg := DefaultLoginProtection
+
+	testCases := []struct {
+		desc     string
+		failures int64
+		ans      time.Duration
+	}{
+		{
+			desc:     "no_delay",
+			failures: arg.DelayAfter - 1,
+			ans:      0,
+		}, {
+			desc:     "first_delay",
+			failures: arg.DelayAfter,
+			ans:      arg.BaseDelay,
+		}, {
+			desc:     "doubled_delay",
+			failures: arg.DelayAfter + 2,
+			ans:      4 * arg.BaseDelay,
+		}, {
+			desc:     "max_delay",
+			failures: arg.DelayAfter + 100,
+			ans:      arg.MaxDelay,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.ans, arg.Delay(tC.failures))
+		})
+	}
+
+	// delay is disabled
+	arg.DelayAfter = 0
+	assert.Zero(t, arg.Delay(100))
+}
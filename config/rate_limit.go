@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// name of route group that has its own rate limit
+const (
+	// signup, login, email verification and password reset, limited by IP
+	RateLimitGroupAuth = "auth"
+	// oauth endpoints that authenticate the client, limited by client ID
+	RateLimitGroupOAuth = "oauth"
+	// endpoints that need access token, limited by user ID
+	RateLimitGroupUsers = "users"
+)
+
+// RateLimit allow Limit requests every Period, the requests is spread evenly
+// in the period and Burst requests can be sent at once. Limit 0 means the
+// requests is not limited.
+type RateLimit struct {
+	Limit  int64
+	Period time.Duration
+	Burst  int64
+}
+
+// RateLimitConfig is the rate limit of every route group, route group that
+// doesn't have rate limit is not limited.
+type RateLimitConfig map[string]RateLimit
+
+var DefaultRateLimits = RateLimitConfig{
+	RateLimitGroupAuth:  {Limit: 20, Period: time.Minute, Burst: 10},
+	RateLimitGroupOAuth: {Limit: 300, Period: time.Minute, Burst: 60},
+	RateLimitGroupUsers: {Limit: 300, Period: time.Minute, Burst: 60},
+}
+
+// ParseRateLimits parse rate limit of route group with format:
+//
+//	auth=limit:10,period:1m,burst:5;users=limit:600
+//
+// Names of the rate limit are limit, period and burst, rate limit that not
+// set is inherited from base. Route group that is not in s keep its rate
+// limit in base.
+func ParseRateLimits(s string, base RateLimitConfig) (RateLimitConfig, error) {
+	res := make(RateLimitConfig, len(base))
+	for k, v := range base {
+		res[k] = v
+	}
+
+	for _, entry := range strings.Split(strings.TrimSpace(s), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		group, values, isOk := strings.Cut(entry, "=")
+		group = strings.TrimSpace(group)
+		if !isOk || group == "" {
+			return nil, fmt.Errorf("rate limit %q is wrong, format is group=name:value", entry)
+		}
+
+		limit := res[group]
+		for _, value := range strings.Split(values, ",") {
+			name, valueStr, isOk := strings.Cut(strings.TrimSpace(value), ":")
+			if !isOk {
+				return nil, fmt.Errorf("rate limit %q of %s is wrong, format is name:value", value, group)
+			}
+			valueStr = strings.TrimSpace(valueStr)
+
+			var err error
+			switch strings.TrimSpace(name) {
+			case "limit":
+				limit.Limit, err = strconv.ParseInt(valueStr, 10, 64)
+			case "period":
+				limit.Period, err = time.ParseDuration(valueStr)
+			case "burst":
+				limit.Burst, err = strconv.ParseInt(valueStr, 10, 64)
+			default:
+				return nil, fmt.Errorf("unknown rate limit %q of %s", name, group)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("rate limit %q of %s is wrong, msg: %v", value, group, err)
+			}
+		}
+
+		if limit.Limit < 0 || limit.Burst < 0 || (limit.Limit > 0 && limit.Period <= 0) {
+			return nil, fmt.Errorf("rate limit of %s must be positive", group)
+		}
+		res[group] = limit
+	}
+
+	return res, nil
+}
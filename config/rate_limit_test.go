@@ -0,0 +1,78 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	base := DefaultRateLimits
+
+	testCases := []struct {
+		desc  string
+		input string
+		ans   RateLimitConfig
+		err   bool
+	}{
+		{
+			desc:  "success_empty",
+			input: "",
+			ans:   base,
+		}, {
+			desc:  "success",
+			input: "auth=limit:10,period:30s; users=burst:100; export=limit:5,period:1h",
+			ans: RateLimitConfig{
+				RateLimitGroupAuth:  {Limit: 10, Period: 30 * time.Second, Burst: base[RateLimitGroupAuth].Burst},
+				RateLimitGroupOAuth: base[RateLimitGroupOAuth],
+				RateLimitGroupUsers: {Limit: base[RateLimitGroupUsers].Limit, Period: base[RateLimitGroupUsers].Period, Burst: 100},
+				"export":            {Limit: 5, Period: time.Hour},
+			},
+		}, {
+			desc:  "success_disable",
+			input: "oauth=limit:0",
+			ans: RateLimitConfig{
+				RateLimitGroupAuth:  base[RateLimitGroupAuth],
+				RateLimitGroupOAuth: {Period: base[RateLimitGroupOAuth].Period, Burst: base[RateLimitGroupOAuth].Burst},
+				RateLimitGroupUsers: base[RateLimitGroupUsers],
+			},
+		}, {
+			desc:  "failed_no_group",
+			input: "limit:10",
+			err:   true,
+		}, {
+			desc:  "failed_unknown_name",
+			input: "auth=rate:10",
+			err:   true,
+		}, {
+			desc:  "failed_wrong_value",
+			input: "auth=limit:ten",
+			err:   true,
+		}, {
+			desc:  "failed_negative",
+			input: "auth=burst:-1",
+			err:   true,
+		}, {
+			desc:  "failed_without_period",
+			input: "export=limit:5",
+			err:   true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, err := ParseRateLimits(tC.input, base)
+			if !tC.err {
+				require.NoError(t, err)
+				assert.Equal(t, tC.ans, res)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+
+	// base is not changed
+	assert.Equal(t, int64(20), base[RateLimitGroupAuth].Limit)
+}
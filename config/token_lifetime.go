@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenLifetime is lifetime of access token and session (refresh token).
+//   - AccessTokenTTL is lifetime of access token.
+//   - RefreshTokenTTL is lifetime of refresh token, it's renewed every rotation.
+//   - AbsoluteLifetime is max lifetime of session since login, it's never renewed.
+//   - IdleTimeout is max time session can be unused, 0 means disabled.
+type TokenLifetime struct {
+	AccessTokenTTL   time.Duration
+	RefreshTokenTTL  time.Duration
+	AbsoluteLifetime time.Duration
+	IdleTimeout      time.Duration
+}
+
+// TokenLifetimeConfig hold default lifetime and the overrides for some client or role,
+// the key of overrides is made by ClientLifetimeKey or RoleLifetimeKey.
+type TokenLifetimeConfig struct {
+	Default   TokenLifetime
+	Overrides map[string]TokenLifetime
+}
+
+var DefaultTokenLifetime = TokenLifetime{
+	AccessTokenTTL:   60 * time.Minute,
+	RefreshTokenTTL:  7 * 24 * time.Hour,
+	AbsoluteLifetime: 30 * 24 * time.Hour,
+	IdleTimeout:      24 * time.Hour,
+}
+
+func ClientLifetimeKey(clientID string) string {
+	return "client:" + clientID
+}
+
+func RoleLifetimeKey(role string) string {
+	return "role:" + role
+}
+
+// Get return lifetime of the keys and the key of the lifetime. The keys is
+// ordered from the most specific, lifetime of the first key that has override
+// is used and the overrides of the next keys cap it, so client can't extend
+// the lifetime that is limited for the role. The returned key join the keys
+// that have override by comma, Get return the same lifetime for it. When there
+// is no override for the keys, default lifetime and empty key is returned.
+func (c TokenLifetimeConfig) Get(keys ...string) (key string, lifetime TokenLifetime) {
+	var found []string
+	for _, v := range keys {
+		for _, k := range strings.Split(v, ",") {
+			override, isExists := c.Overrides[k]
+			if !isExists {
+				continue
+			}
+
+			if len(found) == 0 {
+				lifetime = override
+			} else {
+				lifetime = lifetime.capBy(override)
+			}
+			found = append(found, k)
+		}
+	}
+
+	if len(found) == 0 {
+		return "", c.Default
+	}
+
+	return strings.Join(found, ","), lifetime
+}
+
+// capBy return the shorter lifetime of l and limit for every lifetime, idle
+// timeout 0 is disabled so it's longer than any timeout.
+func (l TokenLifetime) capBy(limit TokenLifetime) TokenLifetime {
+	l.AccessTokenTTL = min(l.AccessTokenTTL, limit.AccessTokenTTL)
+	l.RefreshTokenTTL = min(l.RefreshTokenTTL, limit.RefreshTokenTTL)
+	l.AbsoluteLifetime = min(l.AbsoluteLifetime, limit.AbsoluteLifetime)
+	if limit.IdleTimeout > 0 && (l.IdleTimeout == 0 || limit.IdleTimeout < l.IdleTimeout) {
+		l.IdleTimeout = limit.IdleTimeout
+	}
+
+	return l
+}
+
+// ParseTokenLifetimeOverrides parse overrides with format:
+//
+//	client:mobile=access:15m,refresh:720h;role:admin=access:5m,idle:30m
+//
+// Names of the lifetime are access, refresh, absolute and idle, lifetime that
+// not set is inherited from base.
+func ParseTokenLifetimeOverrides(s string, base TokenLifetime) (map[string]TokenLifetime, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	res := make(map[string]TokenLifetime)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, values, isOk := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !isOk || key == "" {
+			return nil, fmt.Errorf("token lifetime override %q is wrong, format is key=name:duration", entry)
+		}
+
+		lifetime := base
+		for _, value := range strings.Split(values, ",") {
+			name, durationStr, isOk := strings.Cut(strings.TrimSpace(value), ":")
+			if !isOk {
+				return nil, fmt.Errorf("token lifetime %q of %s is wrong, format is name:duration", value, key)
+			}
+
+			duration, err := time.ParseDuration(strings.TrimSpace(durationStr))
+			if err != nil {
+				return nil, fmt.Errorf("token lifetime %q of %s is wrong, msg: %v", value, key, err)
+			}
+
+			switch strings.TrimSpace(name) {
+			case "access":
+				lifetime.AccessTokenTTL = duration
+			case "refresh":
+				lifetime.RefreshTokenTTL = duration
+			case "absolute":
+				lifetime.AbsoluteLifetime = duration
+			case "idle":
+				lifetime.IdleTimeout = duration
+			default:
+				return nil, fmt.Errorf("unknown token lifetime %q of %s", name, key)
+			}
+		}
+
+		res[key] = lifetime
+	}
+
+	return res, nil
+}
+
+// parseDuration return def when s is empty.
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if strings.TrimSpace(s) == "" {
+		return def, nil
+	}
+
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTokenLifetimeOverrides(t *testing.T) {
+	base := DefaultTokenLifetime
+
+	testCases := []struct {
+		desc  string
+		input string
+		ans   map[string]TokenLifetime
+		err   bool
+	}{
+		{
+			desc:  "success_empty",
+			input: "",
+			ans:   nil,
+			err:   false,
+		}, {
+			desc:  "success",
+			input: "client:mobile=access:15m,refresh:720h; role:admin=access:5m,idle:30m,absolute:12h",
+			ans: map[string]TokenLifetime{
+				"client:mobile": {
+					AccessTokenTTL:   15 * time.Minute,
+					RefreshTokenTTL:  720 * time.Hour,
+					AbsoluteLifetime: base.AbsoluteLifetime,
+					IdleTimeout:      base.IdleTimeout,
+				},
+				"role:admin": {
+					AccessTokenTTL:   5 * time.Minute,
+					RefreshTokenTTL:  base.RefreshTokenTTL,
+					AbsoluteLifetime: 12 * time.Hour,
+					IdleTimeout:      30 * time.Minute,
+				},
+			},
+			err: false,
+		}, {
+			desc:  "failed_no_key",
+			input: "access:15m",
+			err:   true,
+		}, {
+			desc:  "failed_unknown_name",
+			input: "role:admin=session:15m",
+			err:   true,
+		}, {
+			desc:  "failed_wrong_duration",
+			input: "role:admin=access:15 minutes",
+			err:   true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, err := ParseTokenLifetimeOverrides(tC.input, base)
+			if !tC.err {
+				require.NoError(t, err)
+				assert.Equal(t, tC.ans, res)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestTokenLifetimeConfigGet(t *testing.T) {
+	admin := TokenLifetime{
+		AccessTokenTTL:   5 * time.Minute,
+		RefreshTokenTTL:  time.Hour,
+		AbsoluteLifetime: 12 * time.Hour,
+		IdleTimeout:      30 * time.Minute,
+	}
+	mobile := TokenLifetime{
+		AccessTokenTTL:   15 * time.Minute,
+		RefreshTokenTTL:  720 * time.Hour,
+		AbsoluteLifetime: 2160 * time.Hour,
+	}
+	lifetimeConfig := TokenLifetimeConfig{
+		Default: DefaultTokenLifetime,
+		Overrides: map[string]TokenLifetime{
+			RoleLifetimeKey("admin"):    admin,
+			ClientLifetimeKey("mobile"): mobile,
+		},
+	}
+
+	key, res := lifetimeConfig.Get(ClientLifetimeKey("mobile"), RoleLifetimeKey("user"))
+	assert.Equal(t, "client:mobile", key)
+	assert.Equal(t, mobile, res)
+
+	// role limit cap the client
+	key, res = lifetimeConfig.Get(ClientLifetimeKey("mobile"), RoleLifetimeKey("admin"))
+	assert.Equal(t, "client:mobile,role:admin", key)
+	assert.Equal(t, admin, res)
+
+	// saved key return the same lifetime
+	savedKey, savedRes := lifetimeConfig.Get(key)
+	assert.Equal(t, key, savedKey)
+	assert.Equal(t, res, savedRes)
+
+	key, res = lifetimeConfig.Get(ClientLifetimeKey("web"), RoleLifetimeKey("admin"))
+	assert.Equal(t, "role:admin", key)
+	assert.Equal(t, admin, res)
+
+	key, res = lifetimeConfig.Get(ClientLifetimeKey("web"), RoleLifetimeKey("user"))
+	assert.Empty(t, key)
+	assert.Equal(t, DefaultTokenLifetime, res)
+}
+
+func TestTokenLifetimeCapBy(t *testing.T) {
+	lifetime := TokenLifetime{
+		AccessTokenTTL:   time.Hour,
+		RefreshTokenTTL:  time.Hour,
+		AbsoluteLifetime: 24 * time.Hour,
+	}
+
+	res := lifetime.capBy(TokenLifetime{
+		AccessTokenTTL:   5 * time.Minute,
+		RefreshTokenTTL:  2 * time.Hour,
+		AbsoluteLifetime: 12 * time.Hour,
+		IdleTimeout:      30 * time.Minute,
+	})
+	assert.Equal(t, TokenLifetime{
+		AccessTokenTTL:   5 * time.Minute,
+		RefreshTokenTTL:  time.Hour,
+		AbsoluteLifetime: 12 * time.Hour,
+		IdleTimeout:      30 * time.Minute,
+	}, res)
+
+	// disabled idle timeout doesn't cap
+	lifetime.IdleTimeout = 10 * time.Minute
+	res = lifetime.capBy(TokenLifetime{AccessTokenTTL: time.Hour, RefreshTokenTTL: time.Hour, AbsoluteLifetime: 24 * time.Hour})
+	assert.Equal(t, lifetime, res)
+}
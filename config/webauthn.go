@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// user verification requirement of WebAuthn, see WebAuthnConfig
+const (
+	UserVerificationRequired    = "required"
+	UserVerificationPreferred   = "preferred"
+	UserVerificationDiscouraged = "discouraged"
+)
+
+// DefaultWebAuthnTimeout is lifetime of the challenge of passkey registration
+// and login
+const DefaultWebAuthnTimeout = 5 * time.Minute
+
+// WebAuthnConfig is config of passkey that is used by the service.
+//   - RPID is the domain that the passkey is bound to, the origin must be the
+//     domain or its subdomain.
+//   - RPName is the name of the service that is shown by the authenticator.
+//   - Origins is the pages that are allowed to create and use the passkey.
+//   - Timeout is lifetime of the challenge.
+//   - UserVerification is sent to the authenticator, assertion without user
+//     verification is rejected when it's required.
+type WebAuthnConfig struct {
+	RPID             string
+	RPName           string
+	Origins          []string
+	Timeout          time.Duration
+	UserVerification string
+}
+
+// ParseWebAuthnOrigins parse comma separated origins, the origin is scheme,
+// host and port without path.
+func ParseWebAuthnOrigins(s string) (origins []string, err error) {
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		origin, err := url.Parse(v)
+		if err != nil || origin.Scheme == "" || origin.Host == "" || strings.TrimSuffix(origin.Path, "/") != "" {
+			return nil, fmt.Errorf("origin %q is not valid", v)
+		}
+		origins = append(origins, origin.Scheme+"://"+origin.Host)
+	}
+
+	return origins, nil
+}
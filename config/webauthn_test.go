@@ -0,0 +1,46 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWebAuthnOrigins(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		input string
+		ans   []string
+		err   bool
+	}{
+		{
+			desc:  "success_empty",
+			input: "",
+		}, {
+			desc:  "success",
+			input: "https://ran.com, https://app.ran.com:8443/,",
+			ans:   []string{"https://ran.com", "https://app.ran.com:8443"},
+		}, {
+			desc:  "failed_without_scheme",
+			input: "ran.com",
+			err:   true,
+		}, {
+			desc:  "failed_with_path",
+			input: "https://ran.com/login",
+			err:   true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, err := ParseWebAuthnOrigins(tC.input)
+			if tC.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tC.ans, res)
+		})
+	}
+}
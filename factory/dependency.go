@@ -7,15 +7,19 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 
+	cfg "github.com/dwiw96/ran-user-management/config"
 	authCache "github.com/dwiw96/ran-user-management/internal/features/users/cache"
 	authHandler "github.com/dwiw96/ran-user-management/internal/features/users/handler"
 	authRepository "github.com/dwiw96/ran-user-management/internal/features/users/repository"
 	authService "github.com/dwiw96/ran-user-management/internal/features/users/service"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 )
 
-func InitFactory(router *gin.Engine, pool *pgxpool.Pool, rdClient *redis.Client, ctx context.Context) {
-	iAuthRepo := authRepository.NewUsersRepository(pool, pool)
+func InitFactory(router *gin.Engine, env *cfg.EnvConfig, kek *password.KeyEncryptionKey, pool *pgxpool.Pool, rdClient *redis.Client, ctx context.Context) {
+	iAuthRepo := authRepository.NewUsersRepository(pool, pool, kek)
 	iAuthCache := authCache.NewUsersCache(rdClient, ctx)
-	iAuthService := authService.NewUsersService(iAuthRepo, iAuthCache, ctx)
-	authHandler.NewUsersHandler(router, iAuthService, pool, rdClient, ctx)
+	iAuthService := authService.NewUsersService(iAuthRepo, iAuthCache, env.GetMailer(), env.GetTokenLifetimeConfig(), env.GetEmailVerificationConfig(), env.GetPasswordResetConfig(), env.GetMagicLinkConfig(), env.GetLoginProtectionConfig(), env.GetWebAuthnConfig(), env.OIDC_ISSUER, env.JWT_AUDIENCE, ctx)
+	rateLimiter := middleware.NewRateLimiter(rdClient, env.RATE_LIMITS)
+	authHandler.NewUsersHandler(router, iAuthService, pool, rdClient, rateLimiter, kek, env.JWT_AUDIENCE, ctx)
 }
@@ -2,9 +2,15 @@ package chache
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 
 	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
@@ -50,3 +56,511 @@ func (r *usersCache) CheckBlockedToken(payload pUsers.JwtPayload) error {
 
 	return nil
 }
+
+func authorizationCodeKey(codeHash []byte) string {
+	return "oauth_code " + hex.EncodeToString(codeHash)
+}
+
+// CachingAuthorizationCode save the authorization code by its digest until
+// it's exchanged or expired.
+func (c *usersCache) CachingAuthorizationCode(codeHash []byte, arg pUsers.AuthorizationCode, ttl time.Duration) error {
+	value, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("failed to encode authorization code, msg: %v", err)
+	}
+
+	err = c.client.Set(c.ctx, authorizationCodeKey(codeHash), value, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("failed to caching authorization code, msg: %v", err)
+	}
+
+	return nil
+}
+
+// GetAuthorizationCode return and delete the authorization code in one
+// command, so the code can only be used once. Nil code is returned when the
+// code is not found, used or expired.
+func (c *usersCache) GetAuthorizationCode(codeHash []byte) (*pUsers.AuthorizationCode, error) {
+	value, err := c.client.GetDel(c.ctx, authorizationCodeKey(codeHash)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get authorization code, msg: %v", err)
+	}
+
+	var res pUsers.AuthorizationCode
+	err = json.Unmarshal(value, &res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode authorization code, msg: %v", err)
+	}
+
+	return &res, nil
+}
+
+// CachingDPoPProof save jti of DPoP proof for ttl, isNew is false when the
+// proof has been used before (replay).
+func (c *usersCache) CachingDPoPProof(jti string, ttl time.Duration) (isNew bool, err error) {
+	isNew, err = c.client.SetNX(c.ctx, "dpop "+jti, 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to caching dpop proof, msg: %v", err)
+	}
+
+	return isNew, nil
+}
+
+func emailVerificationKey(userID int32) string {
+	return fmt.Sprint("email_verification ", userID)
+}
+
+// CachingEmailVerification save jti of the latest verification token of the
+// user, token that is sent before it can't be used anymore.
+func (c *usersCache) CachingEmailVerification(userID int32, jti string, ttl time.Duration) error {
+	err := c.client.Set(c.ctx, emailVerificationKey(userID), jti, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("failed to caching email verification, msg: %v", err)
+	}
+
+	return nil
+}
+
+// deleteIfEqual delete the key only when its value is the argument, so
+// checking and deleting the value is atomic
+var deleteIfEqual = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// DeleteEmailVerification delete jti of verification token of the user, so
+// the token can only be used once. isDeleted is false when the jti is not the
+// latest token, used or expired.
+func (c *usersCache) DeleteEmailVerification(userID int32, jti string) (isDeleted bool, err error) {
+	res, err := deleteIfEqual.Run(c.ctx, c.client, []string{emailVerificationKey(userID)}, jti).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete email verification, msg: %v", err)
+	}
+
+	return res == 1, nil
+}
+
+func passwordResetKey(tokenHash []byte) string {
+	return "password_reset " + hex.EncodeToString(tokenHash)
+}
+
+func passwordResetUserKey(userID int32) string {
+	return fmt.Sprint("password_reset_user ", userID)
+}
+
+// CachingPasswordReset save the reset token by its digest, and delete the
+// token that is sent to the user before, so only the latest token can be used.
+func (c *usersCache) CachingPasswordReset(tokenHash []byte, arg pUsers.PasswordReset, ttl time.Duration) error {
+	value, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("failed to encode password reset, msg: %v", err)
+	}
+
+	oldTokenHash, err := c.client.SetArgs(c.ctx, passwordResetUserKey(arg.UserID), hex.EncodeToString(tokenHash), redis.SetArgs{TTL: ttl, Get: true}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to caching password reset, msg: %v", err)
+	}
+
+	_, err = c.client.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		if oldTokenHash != "" {
+			pipe.Del(c.ctx, "password_reset "+oldTokenHash)
+		}
+		pipe.Set(c.ctx, passwordResetKey(tokenHash), value, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to caching password reset, msg: %v", err)
+	}
+
+	return nil
+}
+
+// GetPasswordReset return the password reset of the token, nil is returned
+// when the token is not found, used, replaced by newer token or expired.
+func (c *usersCache) GetPasswordReset(tokenHash []byte) (*pUsers.PasswordReset, error) {
+	value, err := c.client.Get(c.ctx, passwordResetKey(tokenHash)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get password reset, msg: %v", err)
+	}
+
+	var res pUsers.PasswordReset
+	err = json.Unmarshal(value, &res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode password reset, msg: %v", err)
+	}
+
+	return &res, nil
+}
+
+// DeletePasswordReset delete the password reset of the token, so the token can
+// only be used once. isDeleted is false when it's already used, replaced or
+// expired.
+func (c *usersCache) DeletePasswordReset(tokenHash []byte, userID int32) (isDeleted bool, err error) {
+	res, err := c.client.Del(c.ctx, passwordResetKey(tokenHash)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete password reset, msg: %v", err)
+	}
+
+	err = deleteIfEqual.Run(c.ctx, c.client, []string{passwordResetUserKey(userID)}, hex.EncodeToString(tokenHash)).Err()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete password reset, msg: %v", err)
+	}
+
+	return res == 1, nil
+}
+
+// loginFailureKeys return the keys of sliding window of failed login by email,
+// by IP and by email and IP. The windows of IP is not used when IP is unknown.
+func loginFailureKeys(arg pUsers.LoginAttempt) []string {
+	email := strings.ToLower(strings.TrimSpace(arg.Email))
+	keys := []string{"login_failure email " + email}
+	if arg.IPAddress != "" {
+		keys = append(keys, "login_failure ip "+arg.IPAddress, "login_failure email_ip "+email+" "+arg.IPAddress)
+	}
+
+	return keys
+}
+
+// slidingWindow remove failure that is older than the window from every key,
+// add new failure when ARGV[3] is 1, and return the count, the oldest and the
+// latest failure of every key. Failure is saved in sorted set with its time
+// in milliseconds as the score.
+var slidingWindow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local res = {}
+for _, key in ipairs(KEYS) do
+	redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+	if ARGV[3] == "1" then
+		redis.call("ZADD", key, now, ARGV[4])
+		redis.call("PEXPIRE", key, window)
+	end
+	local oldest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+	local latest = redis.call("ZRANGE", key, -1, -1, "WITHSCORES")
+	table.insert(res, redis.call("ZCARD", key))
+	table.insert(res, oldest[2] or "0")
+	table.insert(res, latest[2] or "0")
+end
+return res
+`)
+
+func (c *usersCache) runLoginFailureWindow(arg pUsers.LoginAttempt, window time.Duration, add bool) (*pUsers.LoginFailures, error) {
+	keys := loginFailureKeys(arg)
+	isAdd := "0"
+	if add {
+		isAdd = "1"
+	}
+
+	values, err := slidingWindow.Run(c.ctx, c.client, keys, time.Now().UnixMilli(), window.Milliseconds(), isAdd, uuid.NewString()).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count failed login, msg: %v", err)
+	}
+	if len(values) != 3*len(keys) {
+		return nil, fmt.Errorf("failed to count failed login, msg: unexpected result")
+	}
+
+	windows := make([]pUsers.LoginFailureWindow, len(keys))
+	for i := range windows {
+		count, _ := values[3*i].(int64)
+		windows[i].Count = count
+		windows[i].Oldest = scoreToTime(values[3*i+1])
+		windows[i].Latest = scoreToTime(values[3*i+2])
+	}
+
+	res := &pUsers.LoginFailures{Email: windows[0]}
+	if len(windows) == 3 {
+		res.IP = windows[1]
+		res.EmailIP = windows[2]
+	}
+
+	return res, nil
+}
+
+// scoreToTime convert score of sorted set in milliseconds into time, zero time
+// is returned when the key is empty
+func scoreToTime(score interface{}) time.Time {
+	s, _ := score.(string)
+	ms, err := strconv.ParseFloat(s, 64)
+	if err != nil || ms == 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(int64(ms)).UTC()
+}
+
+// AddLoginFailure add failed login into every window of the login attempt and
+// return the failures in the windows.
+func (c *usersCache) AddLoginFailure(arg pUsers.LoginAttempt, window time.Duration) (*pUsers.LoginFailures, error) {
+	return c.runLoginFailureWindow(arg, window, true)
+}
+
+// GetLoginFailures return failed login in every window of the login attempt.
+func (c *usersCache) GetLoginFailures(arg pUsers.LoginAttempt, window time.Duration) (*pUsers.LoginFailures, error) {
+	return c.runLoginFailureWindow(arg, window, false)
+}
+
+// DeleteLoginFailures forget failed login of the email and of the email from
+// the IP, failed login of the IP is kept because the IP may guess other email.
+func (c *usersCache) DeleteLoginFailures(arg pUsers.LoginAttempt) error {
+	keys := loginFailureKeys(arg)
+	if len(keys) == 3 {
+		keys = []string{keys[0], keys[2]}
+	}
+
+	err := c.client.Del(c.ctx, keys...).Err()
+	if err != nil {
+		return fmt.Errorf("failed to delete failed login, msg: %v", err)
+	}
+
+	return nil
+}
+
+func mfaChallengeKey(tokenHash []byte) string {
+	return "mfa_challenge " + hex.EncodeToString(tokenHash)
+}
+
+func mfaChallengeFailureKey(tokenHash []byte) string {
+	return "mfa_challenge_failure " + hex.EncodeToString(tokenHash)
+}
+
+// CachingMFAChallenge save the login that wait for the second factor by the
+// digest of mfa token.
+func (c *usersCache) CachingMFAChallenge(tokenHash []byte, arg pUsers.MFAChallenge, ttl time.Duration) error {
+	value, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("failed to encode mfa challenge, msg: %v", err)
+	}
+
+	err = c.client.Set(c.ctx, mfaChallengeKey(tokenHash), value, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("failed to caching mfa challenge, msg: %v", err)
+	}
+
+	return nil
+}
+
+// GetMFAChallenge return the login of the mfa token, nil is returned when the
+// token is not found, used or expired.
+func (c *usersCache) GetMFAChallenge(tokenHash []byte) (*pUsers.MFAChallenge, error) {
+	value, err := c.client.Get(c.ctx, mfaChallengeKey(tokenHash)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get mfa challenge, msg: %v", err)
+	}
+
+	var res pUsers.MFAChallenge
+	err = json.Unmarshal(value, &res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode mfa challenge, msg: %v", err)
+	}
+
+	return &res, nil
+}
+
+// AddMFAChallengeFailure count wrong code of the mfa token and return the
+// number of wrong code, the counter expire with the token.
+func (c *usersCache) AddMFAChallengeFailure(tokenHash []byte, ttl time.Duration) (count int64, err error) {
+	key := mfaChallengeFailureKey(tokenHash)
+	var incr *redis.IntCmd
+	_, err = c.client.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(c.ctx, key)
+		pipe.Expire(c.ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count wrong mfa code, msg: %v", err)
+	}
+
+	return incr.Val(), nil
+}
+
+// DeleteMFAChallenge delete the mfa token, so the token can only be used once.
+// isDeleted is false when the token is already used or expired.
+func (c *usersCache) DeleteMFAChallenge(tokenHash []byte) (isDeleted bool, err error) {
+	var del *redis.IntCmd
+	_, err = c.client.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(c.ctx, mfaChallengeKey(tokenHash))
+		pipe.Del(c.ctx, mfaChallengeFailureKey(tokenHash))
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete mfa challenge, msg: %v", err)
+	}
+
+	return del.Val() == 1, nil
+}
+
+func webAuthnSessionKey(challenge []byte) string {
+	return "webauthn_session " + hex.EncodeToString(challenge)
+}
+
+// CachingWebAuthnSession save the passkey ceremony by its challenge.
+func (c *usersCache) CachingWebAuthnSession(challenge []byte, arg pUsers.WebAuthnSession, ttl time.Duration) error {
+	value, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("failed to encode webauthn session, msg: %v", err)
+	}
+
+	err = c.client.Set(c.ctx, webAuthnSessionKey(challenge), value, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("failed to caching webauthn session, msg: %v", err)
+	}
+
+	return nil
+}
+
+// TakeWebAuthnSession return and delete the ceremony of the challenge, so the
+// challenge can only be used once. nil is returned when the challenge is not
+// found, used or expired.
+func (c *usersCache) TakeWebAuthnSession(challenge []byte) (*pUsers.WebAuthnSession, error) {
+	key := webAuthnSessionKey(challenge)
+	var get *redis.StringCmd
+	var del *redis.IntCmd
+	_, err := c.client.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(c.ctx, key)
+		del = pipe.Del(c.ctx, key)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to get webauthn session, msg: %v", err)
+	}
+	if del.Val() != 1 {
+		return nil, nil
+	}
+
+	var res pUsers.WebAuthnSession
+	err = json.Unmarshal([]byte(get.Val()), &res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode webauthn session, msg: %v", err)
+	}
+
+	return &res, nil
+}
+
+func magicLoginKey(tokenHash []byte) string {
+	return "magic_login " + hex.EncodeToString(tokenHash)
+}
+
+func magicLoginUserKey(userID int32) string {
+	return fmt.Sprint("magic_login_user ", userID)
+}
+
+func magicLoginFailureKey(tokenHash []byte) string {
+	return "magic_login_failure " + hex.EncodeToString(tokenHash)
+}
+
+// CachingMagicLogin save the magic login by the digest of the link token, and
+// delete the magic login that is sent to the user before, so only the latest
+// link and code can be used.
+func (c *usersCache) CachingMagicLogin(tokenHash []byte, arg pUsers.MagicLogin, ttl time.Duration) error {
+	value, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("failed to encode magic login, msg: %v", err)
+	}
+
+	oldTokenHash, err := c.client.SetArgs(c.ctx, magicLoginUserKey(arg.UserID), hex.EncodeToString(tokenHash), redis.SetArgs{TTL: ttl, Get: true}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to caching magic login, msg: %v", err)
+	}
+
+	_, err = c.client.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		if oldTokenHash != "" {
+			pipe.Del(c.ctx, "magic_login "+oldTokenHash, "magic_login_failure "+oldTokenHash)
+		}
+		pipe.Set(c.ctx, magicLoginKey(tokenHash), value, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to caching magic login, msg: %v", err)
+	}
+
+	return nil
+}
+
+// GetMagicLogin return the magic login of the token, nil is returned when the
+// token is not found, used, replaced by newer token or expired.
+func (c *usersCache) GetMagicLogin(tokenHash []byte) (*pUsers.MagicLogin, error) {
+	value, err := c.client.Get(c.ctx, magicLoginKey(tokenHash)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get magic login, msg: %v", err)
+	}
+
+	var res pUsers.MagicLogin
+	err = json.Unmarshal(value, &res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode magic login, msg: %v", err)
+	}
+
+	return &res, nil
+}
+
+// GetUserMagicLogin return the digest of the latest link token that is sent
+// to the user, nil is returned when there is no magic login.
+func (c *usersCache) GetUserMagicLogin(userID int32) (tokenHash []byte, err error) {
+	value, err := c.client.Get(c.ctx, magicLoginUserKey(userID)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get magic login, msg: %v", err)
+	}
+
+	tokenHash, err = hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode magic login, msg: %v", err)
+	}
+
+	return tokenHash, nil
+}
+
+// AddMagicLoginFailure count wrong code of the magic login and return the
+// number of wrong code, the counter expire with the token.
+func (c *usersCache) AddMagicLoginFailure(tokenHash []byte, ttl time.Duration) (count int64, err error) {
+	key := magicLoginFailureKey(tokenHash)
+	var incr *redis.IntCmd
+	_, err = c.client.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(c.ctx, key)
+		pipe.Expire(c.ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count wrong login code, msg: %v", err)
+	}
+
+	return incr.Val(), nil
+}
+
+// DeleteMagicLogin delete the magic login, so the link and the code can only
+// be used once. isDeleted is false when it's already used, replaced or
+// expired.
+func (c *usersCache) DeleteMagicLogin(tokenHash []byte, userID int32) (isDeleted bool, err error) {
+	var del *redis.IntCmd
+	_, err = c.client.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(c.ctx, magicLoginKey(tokenHash))
+		pipe.Del(c.ctx, magicLoginFailureKey(tokenHash))
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete magic login, msg: %v", err)
+	}
+
+	err = deleteIfEqual.Run(c.ctx, c.client, []string{magicLoginUserKey(userID)}, hex.EncodeToString(tokenHash)).Err()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete magic login, msg: %v", err)
+	}
+
+	return del.Val() == 1, nil
+}
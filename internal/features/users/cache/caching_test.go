@@ -2,9 +2,9 @@ package chache
 
 import (
 	"context"
-	"crypto/rsa"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,7 +25,7 @@ var (
 	poolTest  *pgxpool.Pool
 	client    *redis.Client
 	ctx       context.Context
-	key       *rsa.PrivateKey
+	key       *auth.SigningKey
 )
 
 func TestMain(m *testing.M) {
@@ -36,7 +36,7 @@ func TestMain(m *testing.M) {
 
 	schemaCleanup := testUtils.SetupDB("test_cache_users")
 
-	password.JwtInit(poolTest, ctx)
+	password.JwtInit(poolTest, ctx, password.DefaultSigningAlg, testUtils.GetKeyEncryptionKey())
 
 	client = testUtils.GetRedisClient()
 	defer client.Close()
@@ -55,7 +55,7 @@ func TestMain(m *testing.M) {
 
 func createToken(t *testing.T) (payload *auth.JwtPayload) {
 	var err error
-	key, err = middleware.LoadKey(ctx, poolTest)
+	key, err = middleware.LoadKey(ctx, poolTest, testUtils.GetKeyEncryptionKey())
 	require.NoError(t, err)
 	require.NotNil(t, key)
 
@@ -64,11 +64,11 @@ func createToken(t *testing.T) (payload *auth.JwtPayload) {
 		Username: generator.CreateRandomString(5) + " " + generator.CreateRandomString(7),
 		Email:    generator.CreateRandomEmail(generator.CreateRandomString(5)),
 	}
-	token, err := middleware.CreateToken(user, 5, key)
+	token, _, err := middleware.CreateToken(user, 0, auth.SessionClaims{}, 5*time.Minute, key)
 	require.NoError(t, err)
 	require.NotZero(t, len(token))
 
-	payload, err = middleware.ReadToken(token, key)
+	payload, err = middleware.ReadToken(token, middleware.NewKeySet(*key))
 	require.NoError(t, err)
 
 	return
@@ -155,3 +155,364 @@ func TestCheckBlockedToken(t *testing.T) {
 		})
 	}
 }
+
+func TestCachingAuthorizationCode(t *testing.T) {
+	code, err := password.GenerateAuthorizationCode()
+	require.NoError(t, err)
+	codeHash := password.HashRefreshToken(code)
+
+	arg := auth.AuthorizationCode{
+		ClientID:            generator.CreateRandomString(10),
+		RedirectURI:         "https://example.com/callback",
+		UserID:              int32(generator.RandomInt(1, 100)),
+		Scope:               "openid profile",
+		CodeChallenge:       password.CodeChallengeS256(code),
+		CodeChallengeMethod: password.CodeChallengeMethodS256,
+	}
+	err = cacheTest.CachingAuthorizationCode(codeHash, arg, time.Minute)
+	require.NoError(t, err)
+
+	// code is not saved in plaintext
+	exists, err := client.Exists(ctx, "oauth_code "+code).Result()
+	require.NoError(t, err)
+	assert.Zero(t, exists)
+
+	res, err := cacheTest.GetAuthorizationCode(codeHash)
+	require.NoError(t, err)
+	assert.Equal(t, arg, *res)
+
+	// code can only be used once
+	res, err = cacheTest.GetAuthorizationCode(codeHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	err = cacheTest.CachingAuthorizationCode(codeHash, arg, time.Second)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	res, err = cacheTest.GetAuthorizationCode(codeHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestCachingDPoPProof(t *testing.T) {
+	jti := generator.CreateRandomString(20)
+
+	isNew, err := cacheTest.CachingDPoPProof(jti, time.Second)
+	require.NoError(t, err)
+	assert.True(t, isNew)
+
+	// the same proof is replayed
+	isNew, err = cacheTest.CachingDPoPProof(jti, time.Second)
+	require.NoError(t, err)
+	assert.False(t, isNew)
+
+	isNew, err = cacheTest.CachingDPoPProof(generator.CreateRandomString(20), time.Second)
+	require.NoError(t, err)
+	assert.True(t, isNew)
+
+	time.Sleep(2 * time.Second)
+	isNew, err = cacheTest.CachingDPoPProof(jti, time.Second)
+	require.NoError(t, err)
+	assert.True(t, isNew)
+}
+
+func TestEmailVerification(t *testing.T) {
+	userID := generator.RandomInt32(1, 100)
+	jti := generator.CreateRandomString(20)
+
+	err := cacheTest.CachingEmailVerification(userID, jti, time.Minute)
+	require.NoError(t, err)
+
+	// token that is not the latest can't be used
+	isDeleted, err := cacheTest.DeleteEmailVerification(userID, generator.CreateRandomString(20))
+	require.NoError(t, err)
+	assert.False(t, isDeleted)
+
+	isDeleted, err = cacheTest.DeleteEmailVerification(userID, jti)
+	require.NoError(t, err)
+	assert.True(t, isDeleted)
+
+	// token can only be used once
+	isDeleted, err = cacheTest.DeleteEmailVerification(userID, jti)
+	require.NoError(t, err)
+	assert.False(t, isDeleted)
+
+	// new token replace the old one
+	newJTI := generator.CreateRandomString(20)
+	err = cacheTest.CachingEmailVerification(userID, jti, time.Minute)
+	require.NoError(t, err)
+	err = cacheTest.CachingEmailVerification(userID, newJTI, time.Minute)
+	require.NoError(t, err)
+	isDeleted, err = cacheTest.DeleteEmailVerification(userID, jti)
+	require.NoError(t, err)
+	assert.False(t, isDeleted)
+	isDeleted, err = cacheTest.DeleteEmailVerification(userID, newJTI)
+	require.NoError(t, err)
+	assert.True(t, isDeleted)
+}
+
+func TestPasswordReset(t *testing.T) {
+	token, err := password.GenerateRefreshToken()
+	require.NoError(t, err)
+	tokenHash := password.HashRefreshToken(token)
+
+	arg := auth.PasswordReset{
+		UserID: generator.RandomInt32(1, 100),
+		Email:  generator.CreateRandomEmail(generator.CreateRandomString(5)),
+	}
+	err = cacheTest.CachingPasswordReset(tokenHash, arg, time.Minute)
+	require.NoError(t, err)
+
+	res, err := cacheTest.GetPasswordReset(tokenHash)
+	require.NoError(t, err)
+	assert.Equal(t, arg, *res)
+
+	// token is not deleted when it's read
+	res, err = cacheTest.GetPasswordReset(tokenHash)
+	require.NoError(t, err)
+	assert.Equal(t, arg, *res)
+
+	// token can only be used once
+	isDeleted, err := cacheTest.DeletePasswordReset(tokenHash, arg.UserID)
+	require.NoError(t, err)
+	assert.True(t, isDeleted)
+	res, err = cacheTest.GetPasswordReset(tokenHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	isDeleted, err = cacheTest.DeletePasswordReset(tokenHash, arg.UserID)
+	require.NoError(t, err)
+	assert.False(t, isDeleted)
+
+	// new token replace the old one
+	err = cacheTest.CachingPasswordReset(tokenHash, arg, time.Minute)
+	require.NoError(t, err)
+	newToken, err := password.GenerateRefreshToken()
+	require.NoError(t, err)
+	newTokenHash := password.HashRefreshToken(newToken)
+	err = cacheTest.CachingPasswordReset(newTokenHash, arg, time.Minute)
+	require.NoError(t, err)
+
+	res, err = cacheTest.GetPasswordReset(tokenHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	res, err = cacheTest.GetPasswordReset(newTokenHash)
+	require.NoError(t, err)
+	assert.Equal(t, arg, *res)
+
+	err = cacheTest.CachingPasswordReset(tokenHash, arg, time.Second)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	res, err = cacheTest.GetPasswordReset(tokenHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestLoginFailures(t *testing.T) {
+	arg := auth.LoginAttempt{
+		Email:     generator.CreateRandomEmail(generator.CreateRandomString(5)),
+		IPAddress: fmt.Sprintf("10.0.%d.%d", generator.RandomInt(0, 255), generator.RandomInt(0, 255)),
+	}
+	otherEmail := auth.LoginAttempt{
+		Email:     generator.CreateRandomEmail(generator.CreateRandomString(5)),
+		IPAddress: arg.IPAddress,
+	}
+
+	res, err := cacheTest.GetLoginFailures(arg, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, auth.LoginFailures{}, *res)
+
+	for i := 1; i <= 3; i++ {
+		res, err = cacheTest.AddLoginFailure(arg, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, int64(i), res.Email.Count)
+		assert.Equal(t, int64(i), res.IP.Count)
+		assert.Equal(t, int64(i), res.EmailIP.Count)
+		assert.WithinDuration(t, time.Now(), res.EmailIP.Latest, time.Second)
+		assert.False(t, res.EmailIP.Oldest.After(res.EmailIP.Latest))
+	}
+
+	// failure of other email from the same IP is counted in IP window
+	res, err = cacheTest.AddLoginFailure(otherEmail, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Email.Count)
+	assert.Equal(t, int64(4), res.IP.Count)
+	assert.Equal(t, int64(1), res.EmailIP.Count)
+
+	// email is not case sensitive
+	res, err = cacheTest.GetLoginFailures(auth.LoginAttempt{Email: strings.ToUpper(arg.Email), IPAddress: arg.IPAddress}, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), res.Email.Count)
+
+	// failure of the IP is kept
+	err = cacheTest.DeleteLoginFailures(arg)
+	require.NoError(t, err)
+	res, err = cacheTest.GetLoginFailures(arg, time.Minute)
+	require.NoError(t, err)
+	assert.Zero(t, res.Email.Count)
+	assert.Zero(t, res.EmailIP.Count)
+	assert.Equal(t, int64(4), res.IP.Count)
+
+	// failure older than the window is forgotten
+	_, err = cacheTest.AddLoginFailure(arg, time.Second)
+	require.NoError(t, err)
+	time.Sleep(1500 * time.Millisecond)
+	res, err = cacheTest.GetLoginFailures(arg, time.Second)
+	require.NoError(t, err)
+	assert.Zero(t, res.Email.Count)
+	assert.True(t, res.Email.Latest.IsZero())
+
+	// IP window is not used when IP is unknown
+	res, err = cacheTest.AddLoginFailure(auth.LoginAttempt{Email: arg.Email}, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Email.Count)
+	assert.Zero(t, res.IP.Count)
+}
+
+func TestMFAChallenge(t *testing.T) {
+	token, err := password.GenerateRefreshToken()
+	require.NoError(t, err)
+	tokenHash := password.HashRefreshToken(token)
+
+	arg := auth.MFAChallenge{
+		UserID:     generator.RandomInt32(1, 100),
+		Email:      generator.CreateRandomEmail(generator.CreateRandomString(5)),
+		DeviceName: generator.CreateRandomString(10),
+		Scope:      "users:read users:write",
+	}
+	err = cacheTest.CachingMFAChallenge(tokenHash, arg, time.Minute)
+	require.NoError(t, err)
+
+	res, err := cacheTest.GetMFAChallenge(tokenHash)
+	require.NoError(t, err)
+	assert.Equal(t, arg, *res)
+
+	for i := int64(1); i <= 3; i++ {
+		count, err := cacheTest.AddMFAChallengeFailure(tokenHash, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+
+	// token can only be used once
+	isDeleted, err := cacheTest.DeleteMFAChallenge(tokenHash)
+	require.NoError(t, err)
+	assert.True(t, isDeleted)
+	isDeleted, err = cacheTest.DeleteMFAChallenge(tokenHash)
+	require.NoError(t, err)
+	assert.False(t, isDeleted)
+
+	res, err = cacheTest.GetMFAChallenge(tokenHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	// failures are deleted with the token
+	count, err := cacheTest.AddMFAChallengeFailure(tokenHash, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	err = cacheTest.CachingMFAChallenge(tokenHash, arg, time.Second)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	res, err = cacheTest.GetMFAChallenge(tokenHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestWebAuthnSession(t *testing.T) {
+	challenge, err := password.GenerateWebAuthnChallenge()
+	require.NoError(t, err)
+
+	arg := auth.WebAuthnSession{
+		Ceremony:   password.WebAuthnCeremonyGet,
+		DeviceName: generator.CreateRandomString(10),
+		Scope:      "users:read",
+	}
+	err = cacheTest.CachingWebAuthnSession(challenge, arg, time.Minute)
+	require.NoError(t, err)
+
+	res, err := cacheTest.TakeWebAuthnSession(challenge)
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, arg, *res)
+
+	// challenge can only be used once
+	res, err = cacheTest.TakeWebAuthnSession(challenge)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	err = cacheTest.CachingWebAuthnSession(challenge, arg, time.Second)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	res, err = cacheTest.TakeWebAuthnSession(challenge)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestMagicLogin(t *testing.T) {
+	token, err := password.GenerateRefreshToken()
+	require.NoError(t, err)
+	tokenHash := password.HashRefreshToken(token)
+
+	arg := auth.MagicLogin{
+		UserID:     generator.RandomInt32(1, 100),
+		Email:      generator.CreateRandomEmail(generator.CreateRandomString(5)),
+		CodeHash:   password.HashLoginCode(tokenHash, "123456"),
+		DeviceName: generator.CreateRandomString(10),
+		Scope:      "users:read users:write",
+	}
+	err = cacheTest.CachingMagicLogin(tokenHash, arg, time.Minute)
+	require.NoError(t, err)
+
+	res, err := cacheTest.GetMagicLogin(tokenHash)
+	require.NoError(t, err)
+	assert.Equal(t, arg, *res)
+	userTokenHash, err := cacheTest.GetUserMagicLogin(arg.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, tokenHash, userTokenHash)
+
+	for i := int64(1); i <= 3; i++ {
+		count, err := cacheTest.AddMagicLoginFailure(tokenHash, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+
+	// new token replace the old one and its failures
+	newToken, err := password.GenerateRefreshToken()
+	require.NoError(t, err)
+	newTokenHash := password.HashRefreshToken(newToken)
+	err = cacheTest.CachingMagicLogin(newTokenHash, arg, time.Minute)
+	require.NoError(t, err)
+
+	res, err = cacheTest.GetMagicLogin(tokenHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	userTokenHash, err = cacheTest.GetUserMagicLogin(arg.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, newTokenHash, userTokenHash)
+
+	count, err := cacheTest.AddMagicLoginFailure(newTokenHash, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	// deleting the replaced token doesn't delete the latest one
+	isDeleted, err := cacheTest.DeleteMagicLogin(tokenHash, arg.UserID)
+	require.NoError(t, err)
+	assert.False(t, isDeleted)
+	userTokenHash, err = cacheTest.GetUserMagicLogin(arg.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, newTokenHash, userTokenHash)
+
+	// token can only be used once
+	isDeleted, err = cacheTest.DeleteMagicLogin(newTokenHash, arg.UserID)
+	require.NoError(t, err)
+	assert.True(t, isDeleted)
+	isDeleted, err = cacheTest.DeleteMagicLogin(newTokenHash, arg.UserID)
+	require.NoError(t, err)
+	assert.False(t, isDeleted)
+
+	res, err = cacheTest.GetMagicLogin(newTokenHash)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	userTokenHash, err = cacheTest.GetUserMagicLogin(arg.UserID)
+	require.NoError(t, err)
+	assert.Nil(t, userTokenHash)
+}
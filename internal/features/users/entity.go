@@ -2,8 +2,9 @@ package users
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"errors"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
@@ -14,6 +15,37 @@ var (
 	ErrNoRowsAffected = errors.New("no rows affected")
 )
 
+// type of security event
+const (
+	SecurityEventRefreshTokenReuse = "refresh_token_reuse"
+	SecurityEventTokenExchange     = "token_exchange"
+	SecurityEventPasswordReset     = "password_reset"
+	SecurityEventPasswordChange    = "password_change"
+	SecurityEventAccountLocked     = "account_locked"
+	SecurityEventAccountUnlocked   = "account_unlocked"
+	SecurityEventMFAEnabled        = "mfa_enabled"
+	SecurityEventMFADisabled       = "mfa_disabled"
+	SecurityEventRecoveryCodeUsed  = "mfa_recovery_code_used"
+	SecurityEventPasskeyAdded      = "passkey_added"
+	SecurityEventPasskeyDeleted    = "passkey_deleted"
+	SecurityEventPasskeyCloned     = "passkey_cloned"
+)
+
+// role of the user
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// status of jwt signing key in sec_m. Only one key is active and used to sign
+// new token, verifying key is only used to verify token that signed before the
+// key is rotated, and retired key is not used anymore.
+const (
+	SigningKeyStatusActive    = "active"
+	SigningKeyStatusVerifying = "verifying"
+	SigningKeyStatusRetired   = "retired"
+)
+
 // database model for users table
 type User struct {
 	ID             int32
@@ -23,6 +55,19 @@ type User struct {
 	CreatedAt      pgtype.Timestamp
 	IsDeleted      pgtype.Bool
 	DeletedAt      pgtype.Timestamp
+	Role           string
+	// null until the user open the link in verification email
+	EmailVerifiedAt pgtype.Timestamp
+	// login is refused until the time after too many failed login
+	LockedUntil pgtype.Timestamp
+}
+
+// UserProfile is the profile of the user of the access token, it's returned
+// only to the user
+type UserProfile struct {
+	User       *User
+	Roles      []string
+	MFAEnabled bool
 }
 
 // params for repository method
@@ -43,6 +88,106 @@ type SoftDeleteUserParams struct {
 	Email string
 }
 
+// email is the email that the verification token is sent to, the user is
+// not verified when the email is changed after the token is sent
+type VerifyUserEmailParams struct {
+	ID    int32
+	Email string
+}
+
+type UpdateUserPasswordParams struct {
+	ID             int32
+	HashedPassword string
+}
+
+type LockUserParams struct {
+	ID          int32
+	LockedUntil pgtype.Timestamp
+}
+
+// database model for user_totp table, Secret is decrypted by the repository.
+// MFA is enabled after the secret is confirmed with the first code.
+type UserTOTP struct {
+	UserID int32
+	Secret []byte
+	// the last time step that the code is accepted
+	LastUsedStep int64
+	ConfirmedAt  pgtype.Timestamp
+	CreatedAt    pgtype.Timestamp
+}
+
+// secret replace the unconfirmed secret of the user, confirmed secret is not
+// replaced
+type UpsertTOTPParams struct {
+	UserID int32
+	Secret []byte
+}
+
+// LastUsedStep is the time step of the code that confirm the secret, the
+// recovery codes replace the old ones
+type ConfirmTOTPParams struct {
+	UserID             int32
+	LastUsedStep       int64
+	RecoveryCodeHashes [][]byte
+}
+
+type UpdateTOTPLastUsedStepParams struct {
+	UserID       int32
+	LastUsedStep int64
+}
+
+type UseRecoveryCodeParams struct {
+	UserID   int32
+	CodeHash []byte
+}
+
+// database model for webauthn_credentials table, PublicKey is COSE key and
+// Transports is the hint of how the browser reach the authenticator
+type WebAuthnCredential struct {
+	ID             int32
+	UserID         int32
+	CredentialID   []byte
+	PublicKey      []byte
+	SignCount      int64
+	Transports     []string
+	Name           string
+	AAGUID         []byte
+	BackupEligible bool
+	LastUsedAt     pgtype.Timestamp
+	CreatedAt      pgtype.Timestamp
+}
+
+type InsertWebAuthnCredentialParams struct {
+	UserID         int32
+	CredentialID   []byte
+	PublicKey      []byte
+	SignCount      int64
+	Transports     []string
+	Name           string
+	AAGUID         []byte
+	BackupEligible bool
+}
+
+// SignCount is the sign count of the assertion, it's only saved when it's
+// bigger than the saved one or it's 0
+type UpdateWebAuthnCredentialUsageParams struct {
+	ID        int32
+	SignCount int64
+}
+
+type DeleteWebAuthnCredentialParams struct {
+	ID     int32
+	UserID int32
+}
+
+// session with SessionID is the session that change the password, it's kept
+// while other sessions are deleted
+type ChangePasswordParams struct {
+	ID             int32
+	HashedPassword string
+	SessionID      int32
+}
+
 // params for service method
 type SignupRequest struct {
 	Username string `json:"username"`
@@ -50,57 +195,797 @@ type SignupRequest struct {
 	Password string `json:"password"`
 }
 
+// field that is empty is not changed
+type UpdateProfileRequest struct {
+	Username string `json:"username"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// TOTPEnrollment is the TOTP secret that is added into authenticator app, URI
+// is otpauth URI that is shown as QR code
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// MFARequest is the second step of login, Code is TOTP code or recovery code
+type MFARequest struct {
+	MFAToken  string
+	Code      string
+	UserAgent string
+	IPAddress string
+	// tokens are bound to the key of DPoP proof when it's sent
+	DPoP DPoPRequest
+}
+
+// MagicLoginStartRequest send magic link and code to the email, the session
+// is created for the client, device and scope of this request
+type MagicLoginStartRequest struct {
+	Email      string
+	DeviceName string
+	Scope      string
+}
+
+// MagicLoginRequest is login with the token of magic link, or with the email
+// and the code when the link is opened in other device
+type MagicLoginRequest struct {
+	Token     string
+	Email     string
+	Code      string
+	UserAgent string
+	IPAddress string
+	// tokens are bound to the key of DPoP proof when it's sent
+	DPoP DPoPRequest
+}
+
+// PasskeyRegistrationRequest is the response of navigator.credentials.create(),
+// Name is the name that the user give to the passkey
+type PasskeyRegistrationRequest struct {
+	Name              string
+	CredentialID      []byte
+	ClientDataJSON    []byte
+	AttestationObject []byte
+	Transports        []string
+}
+
+// PasskeyLoginStartRequest is the client and device of passkey login, it's
+// like LoginRequest without email and password
+type PasskeyLoginStartRequest struct {
+	DeviceName string
+	Scope      string
+}
+
+// PasskeyLoginRequest is the response of navigator.credentials.get(),
+// UserHandle is optional
+type PasskeyLoginRequest struct {
+	CredentialID      []byte
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	UserHandle        []byte
+	UserAgent         string
+	IPAddress         string
+	// tokens are bound to the key of DPoP proof when it's sent
+	DPoP DPoPRequest
+}
+
 type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
+	UserAgent  string `json:"user_agent"`
+	IPAddress  string `json:"ip_address"`
+	// space separated scopes that is requested, all scopes of the role of the
+	// user is granted when it's empty
+	Scope string `json:"scope"`
+	// tokens are bound to the key of DPoP proof when it's sent
+	DPoP DPoPRequest `json:"-"`
+}
+
+// DPoPRequest is DPoP proof in DPoP header and the request that the proof is
+// sent with, Proof is empty when the client doesn't use DPoP.
+type DPoPRequest struct {
+	Proof  string
+	Method string
+	URL    string
+}
+
+// claims of DPoP proof JWT (RFC 9449 section 4.2), jti and iat is in the
+// registered claims
+type DPoPProofPayload struct {
+	jwt.RegisteredClaims
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	// hash of the access token, only when the proof is sent with access token
+	ATH string `json:"ath,omitempty"`
+	// thumbprint of the public key in the proof header, it's not a claim
+	JKT string `json:"-"`
 }
 
 // param for jwt
 type JwtPayload struct {
 	jwt.RegisteredClaims
-	ID      uuid.UUID `json:"id"`
-	UserID  int32     `json:"user_id"`
-	Iss     string    `json:"iss"`
-	Name    string    `json:"name"`
-	Email   string    `json:"email"`
-	Address string    `json:"address,omitempty"`
-	Iat     int64     `json:"iat"`
-	Exp     int64     `json:"exp"`
+	ID        uuid.UUID `json:"id"`
+	UserID    int32     `json:"user_id"`
+	SessionID int32     `json:"sid"`
+	Iss       string    `json:"iss"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Address   string    `json:"address,omitempty"`
+	Iat       int64     `json:"iat"`
+	Exp       int64     `json:"exp"`
+	// oauth client that the token is issued to
+	ClientID string `json:"client_id,omitempty"`
+	// space separated scopes
+	Scope string `json:"scope,omitempty"`
+	// time when the user is authenticated and the methods that are used, they
+	// don't change when the token is refreshed
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	// service that act on behalf of the user, the token is issued by token exchange
+	Act *Actor `json:"act,omitempty"`
+	// key that the token is bound to, the token can only be used with DPoP proof
+	Cnf *Confirmation `json:"cnf,omitempty"`
+}
+
+// Confirmation is cnf claim (RFC 7800), JKT is the JWK thumbprint of the DPoP
+// key that the token is bound to (RFC 9449 section 6.1).
+type Confirmation struct {
+	JKT string `json:"jkt"`
+}
+
+// Actor is act claim of token exchange (RFC 8693 section 4.1), Act is the
+// actor of the token that is exchanged when the token is exchanged again.
+type Actor struct {
+	Sub string `json:"sub"`
+	Act *Actor `json:"act,omitempty"`
+}
+
+// IsServiceAccount return true when the token is issued to oauth client with
+// client_credentials grant, the subject of the token is the client instead of
+// user.
+func (p *JwtPayload) IsServiceAccount() bool {
+	return p.UserID == 0 && p.ClientID != ""
+}
+
+// SessionClaims return claims of the token that is not from the user, they're
+// copied to new access token when the token is refreshed.
+func (p *JwtPayload) SessionClaims() SessionClaims {
+	return SessionClaims{
+		ClientID: p.ClientID,
+		Scope:    p.Scope,
+		Audience: p.Audience,
+		AuthTime: p.AuthTime,
+		AMR:      p.AMR,
+		Act:      p.Act,
+		Cnf:      p.Cnf,
+	}
+}
+
+// claims of access token that belong to the session instead of the user
+type SessionClaims struct {
+	ClientID string
+	Scope    string
+	Audience []string
+	AuthTime int64
+	AMR      []string
+	Act      *Actor
+	Cnf      *Confirmation
+}
+
+// payload of email verification token, sub is the user id and jti is saved
+// in cache until the token is used, so the token can only be used once
+type EmailVerificationPayload struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+}
+
+// PasswordReset is saved in cache by the digest of reset token until the
+// token is used or expired, the password is not reset when the email of the
+// user is changed after the token is sent
+type PasswordReset struct {
+	UserID int32  `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// payload of OpenID Connect ID token, registered claims is used as it is
+// because the token is read by the client instead of this service
+type IDTokenPayload struct {
+	jwt.RegisteredClaims
+	Nonce    string   `json:"nonce,omitempty"`
+	AuthTime int64    `json:"auth_time"`
+	AMR      []string `json:"amr,omitempty"`
 }
 
-// param for refresh token
+// param for refresh token, every row is one session (device) of the user
 type RefreshTokenWhitelist struct {
-	ID           int32
-	UserID       int32
-	RefreshToken pgtype.UUID
-	ExpiresAt    pgtype.Timestamp
-	CreatedAt    pgtype.Timestamp
+	ID               int32
+	UserID           int32
+	RefreshTokenHash []byte
+	ExpiresAt        pgtype.Timestamp
+	CreatedAt        pgtype.Timestamp
+	DeviceName       string
+	UserAgent        string
+	IPAddress        string
+	LastUsedAt       pgtype.Timestamp
+	// live access token of the session, used to blocklist it when the session is revoked
+	AccessTokenID        pgtype.UUID
+	AccessTokenExpiresAt pgtype.Timestamp
+	// all refresh tokens rotated from the same login share one family
+	FamilyID pgtype.UUID
+	// key of token lifetime override used by the session, empty is default lifetime
+	LifetimeKey       string
+	AbsoluteExpiresAt pgtype.Timestamp
+	// oauth client that the session is issued to, empty is first party login
+	ClientID string
+	// claims of the session that are kept in every refreshed access token
+	Scope    string
+	AuthTime pgtype.Timestamp
+	AMR      []string
 }
 
+// refresh token is never saved in plaintext, only its SHA-256 digest
 type InsertRefreshTokenParams struct {
-	UserID       int32
-	RefreshToken pgtype.UUID
+	UserID           int32
+	RefreshTokenHash []byte
+	DeviceName       string
+	UserAgent        string
+	IPAddress        string
+	FamilyID         pgtype.UUID
+	LifetimeKey      string
+	RefreshTokenTTL  time.Duration
+	AbsoluteLifetime time.Duration
+	ClientID         string
+	Scope            string
+	AuthTime         pgtype.Timestamp
+	AMR              []string
 }
 
 type GetRefreshTokenParams struct {
-	UserID       int32
-	RefreshToken pgtype.UUID
+	UserID           int32
+	RefreshTokenHash []byte
+}
+
+type DeleteRefreshTokenByIDParams struct {
+	ID     int32
+	UserID int32
+}
+
+type UpdateRefreshTokenParams struct {
+	ID                   int32
+	UserID               int32
+	FamilyID             pgtype.UUID
+	RefreshTokenHash     []byte
+	NewRefreshTokenHash  []byte
+	AccessTokenID        pgtype.UUID
+	AccessTokenExpiresAt pgtype.Timestamp
+	RefreshTokenTTL      time.Duration
+}
+
+// refresh token that already rotated, kept to detect reuse
+type RefreshTokenHistory struct {
+	ID               int32
+	UserID           int32
+	FamilyID         pgtype.UUID
+	RefreshTokenHash []byte
+	RotatedAt        pgtype.Timestamp
+}
+
+type RevokeRefreshTokenFamilyParams struct {
+	UserID   int32
+	FamilyID pgtype.UUID
+}
+
+type InsertSecurityEventParams struct {
+	UserID      pgtype.Int4
+	EventType   string
+	Description string
+}
+
+type UpdateSessionAccessTokenParams struct {
+	ID                   int32
+	UserID               int32
+	AccessTokenID        pgtype.UUID
+	AccessTokenExpiresAt pgtype.Timestamp
+}
+
+// database model for sec_m table
+type SigningKey struct {
+	Kid        string
+	Alg        string
+	PrivateKey crypto.Signer
+	Status     string
+	CreatedAt  pgtype.Timestamp
+	RetiredAt  pgtype.Timestamp
+}
+
+type InsertSigningKeyParams struct {
+	Kid        string
+	Alg        string
+	PrivateKey crypto.Signer
+}
+
+// public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// RSA key
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// type of token that is sent to oauth endpoint, the hint is only used to
+// lookup the token first (RFC 7009 and RFC 7662)
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// error code of oauth endpoint (RFC 6749 section 5.2)
+const (
+	OAuthErrInvalidRequest          = "invalid_request"
+	OAuthErrInvalidClient           = "invalid_client"
+	OAuthErrServerError             = "server_error"
+	OAuthErrInvalidGrant            = "invalid_grant"
+	OAuthErrAccessDenied            = "access_denied"
+	OAuthErrUnauthorizedClient      = "unauthorized_client"
+	OAuthErrUnsupportedGrantType    = "unsupported_grant_type"
+	OAuthErrUnsupportedResponseType = "unsupported_response_type"
+	OAuthErrInvalidScope            = "invalid_scope"
+	// requested audience of token exchange is not allowed (RFC 8693 section 2.2.2)
+	OAuthErrInvalidTarget = "invalid_target"
+	// error code of resource that is accessed with bearer token (RFC 6750)
+	OAuthErrInvalidToken      = "invalid_token"
+	OAuthErrInsufficientScope = "insufficient_scope"
+	// DPoP proof is invalid (RFC 9449 section 5 and 7.1)
+	OAuthErrInvalidDPoPProof = "invalid_dpop_proof"
+)
+
+// authorization scheme of access token, token that is bound to DPoP key is
+// sent with DPoP scheme (RFC 9449 section 7.1)
+const (
+	AuthSchemeBearer = "Bearer"
+	AuthSchemeDPoP   = "DPoP"
+)
+
+// grant type of oauth token endpoint
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// refresh_token grant is allowed for every client that can use
+	// authorization_code, because only that grant issue refresh token
+	GrantTypeRefreshToken = "refresh_token"
+)
+
+// type of token in token exchange (RFC 8693 section 3), only access token
+// can be exchanged and issued
+const (
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// response type of oauth authorization endpoint, only authorization code is
+// supported (OAuth 2.1)
+const (
+	ResponseTypeCode = "code"
+)
+
+// scope of the endpoints of this service, the scopes that the user can be
+// granted depend on the role of the user
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	ScopeAdmin      = "admin"
+)
+
+// scope of OpenID Connect, openid scope make token endpoint issue ID token
+// and the other scopes decide the claims of userinfo
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// authentication method reference of amr claim (RFC 8176)
+const (
+	AMRPassword    = "pwd"
+	AMROTP         = "otp"
+	AMRHardwareKey = "hwk"
+	AMRSoftwareKey = "swk"
+	AMRMultiFactor = "mfa"
+)
+
+// OAuthError is error that is sent by oauth endpoint in RFC 6749 format
+// instead of the response envelope
+type OAuthError struct {
+	ErrorCode   string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Description
+}
+
+// LoginAttempt is the email and IP address of login, failed login is counted
+// by email, by IP address and by both of them
+type LoginAttempt struct {
+	Email     string
+	IPAddress string
+}
+
+// LoginFailureWindow is failed login in the sliding window of one key, Oldest
+// and Latest is zero when there is no failure
+type LoginFailureWindow struct {
+	Count  int64
+	Oldest time.Time
+	Latest time.Time
+}
+
+// LoginFailures is failed login of the login attempt in every window
+type LoginFailures struct {
+	Email   LoginFailureWindow
+	IP      LoginFailureWindow
+	EmailIP LoginFailureWindow
+}
+
+// MFAChallenge is login that the first factor is verified and wait for the
+// second factor, it's saved in cache by the digest of mfa token. AMR is the
+// method of the first factor, it's password when it's empty
+type MFAChallenge struct {
+	UserID     int32    `json:"user_id"`
+	Email      string   `json:"email"`
+	DeviceName string   `json:"device_name"`
+	Scope      string   `json:"scope"`
+	AMR        []string `json:"amr,omitempty"`
+}
+
+// MagicLogin is passwordless login that wait for the link or the code in the
+// email, it's saved in cache by the digest of the link token. CodeHash is
+// keyed by the digest of the token, see password.HashLoginCode
+type MagicLogin struct {
+	UserID     int32  `json:"user_id"`
+	Email      string `json:"email"`
+	CodeHash   []byte `json:"code_hash"`
+	DeviceName string `json:"device_name"`
+	Scope      string `json:"scope"`
+}
+
+// WebAuthnSession is passkey ceremony that wait for the response of the
+// authenticator, it's saved in cache by the challenge. UserID is the user
+// that register the passkey, login doesn't know the user until the response.
+type WebAuthnSession struct {
+	Ceremony   string `json:"ceremony"`
+	UserID     int32  `json:"user_id,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+}
+
+// options of navigator.credentials.create() and navigator.credentials.get()
+// in WebAuthn JSON format, binary is base64url
+type PasskeyRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type PasskeyUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type PasskeyCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type PasskeyCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type PasskeyAuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+type PasskeyCreationOptions struct {
+	Challenge              string                        `json:"challenge"`
+	RP                     PasskeyRelyingParty           `json:"rp"`
+	User                   PasskeyUser                   `json:"user"`
+	PubKeyCredParams       []PasskeyCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                         `json:"timeout"`
+	ExcludeCredentials     []PasskeyCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection PasskeyAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                        `json:"attestation"`
+}
+
+type PasskeyRequestOptions struct {
+	Challenge        string                        `json:"challenge"`
+	RPID             string                        `json:"rpId"`
+	Timeout          int64                         `json:"timeout"`
+	AllowCredentials []PasskeyCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                        `json:"userVerification"`
+}
+
+// MFARequiredError is returned by LogIn instead of tokens when the user enable
+// MFA, the login is continued by sending MFAToken and the code to VerifyMFA.
+type MFARequiredError struct {
+	MFAToken  string
+	ExpiresIn time.Duration
+}
+
+func (e *MFARequiredError) Error() string {
+	return "mfa is required"
+}
+
+// LoginThrottledError is returned when login is refused because of too many
+// failed login, Locked is true when the account is locked instead of the
+// login is delayed. The login can be tried again after RetryAfter.
+type LoginThrottledError struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return "account is locked because of too many failed login, please try again later"
+	}
+	return "too many failed login, please try again later"
+}
+
+// database model for oauth_clients table, client secret is saved as its
+// SHA-256 digest
+type OAuthClient struct {
+	ID               int32
+	ClientID         string
+	ClientSecretHash []byte
+	Name             string
+	CreatedAt        pgtype.Timestamp
+	RevokedAt        pgtype.Timestamp
+	// redirect uri in authorization request must be exactly one of these
+	RedirectURIs []string
+	// public client doesn't have client secret
+	IsPublic bool
+	// grant types that the client can use in token endpoint
+	GrantTypes []string
+	// scopes that the client can request as service account
+	AllowedScopes []string
+	// audiences that the client can request in token exchange
+	AllowedAudiences []string
+}
+
+// GrantTypes is default to authorization_code when it's empty
+type CreateOAuthClientParams struct {
+	ClientID         string
+	ClientSecretHash []byte
+	Name             string
+	RedirectURIs     []string
+	IsPublic         bool
+	GrantTypes       []string
+	AllowedScopes    []string
+	AllowedAudiences []string
+}
+
+// database model for oauth_consents table, scope is space separated scopes
+// that the user allowed the client to access
+type OAuthConsent struct {
+	ID        int32
+	UserID    int32
+	ClientID  string
+	Scope     string
+	CreatedAt pgtype.Timestamp
+	UpdatedAt pgtype.Timestamp
+}
+
+type UpsertOAuthConsentParams struct {
+	UserID   int32
+	ClientID string
+	Scope    string
+}
+
+type GetOAuthConsentParams struct {
+	UserID   int32
+	ClientID string
+}
+
+// credential of oauth client that call oauth endpoint
+type ClientCredential struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// authorization request of authorization code flow, Approve is nil when the
+// user is not asked for consent yet
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+	Approve             *bool
+}
+
+// RedirectTo is redirect uri with authorization response, it's empty when
+// consent of the user is required
+type AuthorizeResponse struct {
+	ConsentRequired bool
+	ClientName      string
+	Scope           string
+	RedirectTo      string
+}
+
+// authorization code that is saved in cache until it's exchanged for token
+type AuthorizationCode struct {
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	UserID              int32  `json:"user_id"`
+	Scope               string `json:"scope"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	// claims of ID token, they're taken from the authorization request and
+	// the access token of the user
+	Nonce    string   `json:"nonce,omitempty"`
+	AuthTime int64    `json:"auth_time"`
+	AMR      []string `json:"amr,omitempty"`
+}
+
+// request of oauth token endpoint, only the params of the grant type is set
+type TokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	Scope        string
+	UserAgent    string
+	IPAddress    string
+	// param of refresh_token grant
+	RefreshToken string
+	// params of token exchange
+	SubjectToken       string
+	SubjectTokenType   string
+	RequestedTokenType string
+	Audience           string
+	// subject token that is bound to DPoP key can only be exchanged with proof
+	// of the key
+	DPoP DPoPRequest
+}
+
+// successful response of oauth token endpoint (RFC 6749 section 5.1)
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	// type of the token that is issued by token exchange
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// token introspection response (RFC 7662), only active is sent when the token
+// is not active
+type IntrospectionResponse struct {
+	Active    bool          `json:"active"`
+	Scope     string        `json:"scope,omitempty"`
+	ClientID  string        `json:"client_id,omitempty"`
+	Username  string        `json:"username,omitempty"`
+	TokenType string        `json:"token_type,omitempty"`
+	Exp       int64         `json:"exp,omitempty"`
+	Iat       int64         `json:"iat,omitempty"`
+	Sub       string        `json:"sub,omitempty"`
+	Aud       []string      `json:"aud,omitempty"`
+	Iss       string        `json:"iss,omitempty"`
+	Jti       string        `json:"jti,omitempty"`
+	SessionID int32         `json:"sid,omitempty"`
+	Act       *Actor        `json:"act,omitempty"`
+	Cnf       *Confirmation `json:"cnf,omitempty"`
+}
+
+// OpenID Provider metadata that is published in discovery document
+// (OpenID Connect Discovery 1.0 section 3)
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	DPoPSigningAlgValuesSupported     []string `json:"dpop_signing_alg_values_supported"`
+}
+
+// claims of userinfo endpoint, only sub is always sent and the other claims
+// depend on the granted scopes
+type UserInfo struct {
+	Sub               string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
 }
 
 type IRepository interface {
 	CreateUser(ctx context.Context, arg CreateUserParams) (*User, error)
 	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUserByID(ctx context.Context, id int32) (*User, error)
 	UpdateUser(ctx context.Context, arg UpdateUserParams) (*User, error)
 	SoftDeleteUser(ctx context.Context, arg SoftDeleteUserParams) error
 
-	LoadKey(ctx context.Context) (*rsa.PrivateKey, error)
-	InsertRefreshToken(ctx context.Context, arg InsertRefreshTokenParams) error
+	LoadKey(ctx context.Context) (*SigningKey, error)
+	ListSigningKeys(ctx context.Context) ([]SigningKey, error)
+	ListVerificationKeys(ctx context.Context) ([]SigningKey, error)
+	RotateSigningKey(ctx context.Context, arg InsertSigningKeyParams) (*SigningKey, error)
+	RetireSigningKey(ctx context.Context, kid string) error
+	InsertRefreshToken(ctx context.Context, arg InsertRefreshTokenParams) (*RefreshTokenWhitelist, error)
 	GetRefreshToken(ctx context.Context, arg GetRefreshTokenParams) (*RefreshTokenWhitelist, error)
 	DeleteRefreshToken(ctx context.Context, userID int32) (err error)
-	UpdateRefreshToken(ctx context.Context, userID int32, refreshToken uuid.UUID) error
+	DeleteRefreshTokenByID(ctx context.Context, arg DeleteRefreshTokenByIDParams) (*RefreshTokenWhitelist, error)
+	DeleteOtherRefreshToken(ctx context.Context, arg DeleteRefreshTokenByIDParams) ([]RefreshTokenWhitelist, error)
+	DeleteAllRefreshToken(ctx context.Context, userID int32) ([]RefreshTokenWhitelist, error)
+	UpdateRefreshToken(ctx context.Context, arg UpdateRefreshTokenParams) error
+	UpdateSessionAccessToken(ctx context.Context, arg UpdateSessionAccessTokenParams) error
+	ListRefreshTokenByUserID(ctx context.Context, userID int32) ([]RefreshTokenWhitelist, error)
+	GetRotatedRefreshToken(ctx context.Context, arg GetRefreshTokenParams) (*RefreshTokenHistory, error)
+	GetRotatedRefreshTokenByHash(ctx context.Context, refreshTokenHash []byte) (*RefreshTokenHistory, error)
+	RevokeRefreshTokenFamily(ctx context.Context, arg RevokeRefreshTokenFamilyParams) ([]RefreshTokenWhitelist, error)
+	InsertSecurityEvent(ctx context.Context, arg InsertSecurityEventParams) error
+	GetRefreshTokenByHash(ctx context.Context, refreshTokenHash []byte) (*RefreshTokenWhitelist, error)
+
+	CreateOAuthClient(ctx context.Context, arg CreateOAuthClientParams) (*OAuthClient, error)
+	GetOAuthClient(ctx context.Context, clientID string) (*OAuthClient, error)
+	ListOAuthClients(ctx context.Context) ([]OAuthClient, error)
+	RevokeOAuthClient(ctx context.Context, clientID string) error
+	GetOAuthConsent(ctx context.Context, arg GetOAuthConsentParams) (*OAuthConsent, error)
+	UpsertOAuthConsent(ctx context.Context, arg UpsertOAuthConsentParams) (*OAuthConsent, error)
 
 	UpdateUserIsDeleted(ctx context.Context, arg CreateUserParams) (*User, error)
+	VerifyUserEmail(ctx context.Context, arg VerifyUserEmailParams) (*User, error)
+	UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) (*User, error)
+	LockUser(ctx context.Context, arg LockUserParams) error
+	UnlockUser(ctx context.Context, id int32) error
 	DeleteUserTx(ctx context.Context, arg SoftDeleteUserParams) (err error)
+	ResetPasswordTx(ctx context.Context, arg UpdateUserPasswordParams) (sessions []RefreshTokenWhitelist, err error)
+	ChangePasswordTx(ctx context.Context, arg ChangePasswordParams) (sessions []RefreshTokenWhitelist, err error)
+
+	UpsertTOTP(ctx context.Context, arg UpsertTOTPParams) error
+	GetTOTP(ctx context.Context, userID int32) (*UserTOTP, error)
+	UpdateTOTPLastUsedStep(ctx context.Context, arg UpdateTOTPLastUsedStepParams) error
+	UseRecoveryCode(ctx context.Context, arg UseRecoveryCodeParams) error
+	DeleteTOTP(ctx context.Context, userID int32) error
+	ConfirmTOTPTx(ctx context.Context, arg ConfirmTOTPParams) error
+
+	InsertWebAuthnCredential(ctx context.Context, arg InsertWebAuthnCredentialParams) (*WebAuthnCredential, error)
+	GetWebAuthnCredential(ctx context.Context, credentialID []byte) (*WebAuthnCredential, error)
+	ListWebAuthnCredentials(ctx context.Context, userID int32) ([]WebAuthnCredential, error)
+	UpdateWebAuthnCredentialUsage(ctx context.Context, arg UpdateWebAuthnCredentialUsageParams) error
+	DeleteWebAuthnCredential(ctx context.Context, arg DeleteWebAuthnCredentialParams) error
+	DeleteUserWebAuthnCredentials(ctx context.Context, userID int32) error
 }
 
 type IService interface {
@@ -108,10 +993,66 @@ type IService interface {
 	LogIn(input LoginRequest) (user *User, accessToken, refreshToken string, code int, err error)
 	LogOut(payload JwtPayload) error
 	DeleteUser(arg SoftDeleteUserParams) (code int, err error)
-	RefreshToken(refreshToken, accessToken string) (newRefreshToken, newAccessToken string, code int, err error)
+	RefreshToken(refreshToken, accessToken string, dpop DPoPRequest) (newRefreshToken, newAccessToken string, code int, err error)
+	ListSessions(payload JwtPayload) (sessions []RefreshTokenWhitelist, code int, err error)
+	RevokeSession(payload JwtPayload, sessionID int32) (code int, err error)
+	LogOutOtherSessions(payload JwtPayload) (code int, err error)
+	GetJWKS() (jwks *JWKSet, code int, err error)
+	ListSigningKeys(payload JwtPayload) (keys []SigningKey, code int, err error)
+	RotateSigningKey(payload JwtPayload, alg string) (key *SigningKey, code int, err error)
+	RetireSigningKey(payload JwtPayload, kid string) (code int, err error)
+	IntrospectToken(client ClientCredential, token, tokenTypeHint string) (res *IntrospectionResponse, code int, err error)
+	RevokeToken(client ClientCredential, token, tokenTypeHint string) (code int, err error)
+	Authorize(payload JwtPayload, input AuthorizeRequest) (res *AuthorizeResponse, code int, err error)
+	Token(client ClientCredential, input TokenRequest) (res *TokenResponse, code int, err error)
+	GetOpenIDConfiguration() (res *OpenIDConfiguration, code int, err error)
+	UserInfo(payload JwtPayload) (res *UserInfo, code int, err error)
+	VerifyEmail(token string) (code int, err error)
+	ResendVerification(email string) (code int, err error)
+	ForgotPassword(email string) (code int, err error)
+	ResetPassword(token, newPassword string) (code int, err error)
+	UpdateProfile(payload JwtPayload, input UpdateProfileRequest) (user *User, code int, err error)
+	ChangePassword(payload JwtPayload, input ChangePasswordRequest) (code int, err error)
+	GetProfile(payload JwtPayload) (profile *UserProfile, code int, err error)
+	GetUser(userID int32) (user *User, code int, err error)
+	UnlockUser(payload JwtPayload, userID int32) (code int, err error)
+	EnrollTOTP(payload JwtPayload) (enrollment *TOTPEnrollment, code int, err error)
+	ConfirmTOTP(payload JwtPayload, totpCode string) (recoveryCodes []string, code int, err error)
+	DisableTOTP(payload JwtPayload, mfaCode string) (code int, err error)
+	VerifyMFA(input MFARequest) (user *User, accessToken, refreshToken string, code int, err error)
+	StartPasskeyRegistration(payload JwtPayload) (options *PasskeyCreationOptions, code int, err error)
+	FinishPasskeyRegistration(payload JwtPayload, input PasskeyRegistrationRequest) (credential *WebAuthnCredential, code int, err error)
+	ListPasskeys(payload JwtPayload) (credentials []WebAuthnCredential, code int, err error)
+	DeletePasskey(payload JwtPayload, id int32) (code int, err error)
+	StartPasskeyLogin(input PasskeyLoginStartRequest) (options *PasskeyRequestOptions, code int, err error)
+	FinishPasskeyLogin(input PasskeyLoginRequest) (user *User, accessToken, refreshToken string, code int, err error)
+	StartMagicLogin(input MagicLoginStartRequest) (code int, err error)
+	VerifyMagicLogin(input MagicLoginRequest) (user *User, accessToken, refreshToken string, code int, err error)
 }
 
 type ICache interface {
 	CachingBlockedToken(payload JwtPayload) error
 	CheckBlockedToken(payload JwtPayload) error
+	CachingAuthorizationCode(codeHash []byte, arg AuthorizationCode, ttl time.Duration) error
+	GetAuthorizationCode(codeHash []byte) (*AuthorizationCode, error)
+	CachingDPoPProof(jti string, ttl time.Duration) (isNew bool, err error)
+	CachingEmailVerification(userID int32, jti string, ttl time.Duration) error
+	DeleteEmailVerification(userID int32, jti string) (isDeleted bool, err error)
+	CachingPasswordReset(tokenHash []byte, arg PasswordReset, ttl time.Duration) error
+	GetPasswordReset(tokenHash []byte) (*PasswordReset, error)
+	DeletePasswordReset(tokenHash []byte, userID int32) (isDeleted bool, err error)
+	AddLoginFailure(arg LoginAttempt, window time.Duration) (*LoginFailures, error)
+	GetLoginFailures(arg LoginAttempt, window time.Duration) (*LoginFailures, error)
+	DeleteLoginFailures(arg LoginAttempt) error
+	CachingMFAChallenge(tokenHash []byte, arg MFAChallenge, ttl time.Duration) error
+	GetMFAChallenge(tokenHash []byte) (*MFAChallenge, error)
+	AddMFAChallengeFailure(tokenHash []byte, ttl time.Duration) (count int64, err error)
+	DeleteMFAChallenge(tokenHash []byte) (isDeleted bool, err error)
+	CachingWebAuthnSession(challenge []byte, arg WebAuthnSession, ttl time.Duration) error
+	TakeWebAuthnSession(challenge []byte) (*WebAuthnSession, error)
+	CachingMagicLogin(tokenHash []byte, arg MagicLogin, ttl time.Duration) error
+	GetMagicLogin(tokenHash []byte) (*MagicLogin, error)
+	GetUserMagicLogin(userID int32) (tokenHash []byte, err error)
+	AddMagicLoginFailure(tokenHash []byte, ttl time.Duration) (count int64, err error)
+	DeleteMagicLogin(tokenHash []byte, userID int32) (isDeleted bool, err error)
 }
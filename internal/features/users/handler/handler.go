@@ -2,12 +2,18 @@ package delivery
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
 
+	cfg "github.com/dwiw96/ran-user-management/config"
 	auth "github.com/dwiw96/ran-user-management/internal/features/users"
 	mid "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 	responses "github.com/dwiw96/ran-user-management/pkg/utils/responses"
 
+	conv "github.com/dwiw96/ran-user-management/pkg/utils/converter"
+
 	"github.com/go-playground/locales/en"
 	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
@@ -25,7 +31,7 @@ type usersHandler struct {
 	trans    ut.Translator
 }
 
-func NewUsersHandler(router *gin.Engine, service auth.IService, pool *pgxpool.Pool, client *redis.Client, ctx context.Context) {
+func NewUsersHandler(router *gin.Engine, service auth.IService, pool *pgxpool.Pool, client *redis.Client, limiter *mid.RateLimiter, kek *password.KeyEncryptionKey, audience string, ctx context.Context) {
 	handler := &usersHandler{
 		router:   router,
 		service:  service,
@@ -41,15 +47,73 @@ func NewUsersHandler(router *gin.Engine, service auth.IService, pool *pgxpool.Po
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, "user management")
 	})
-	router.POST("/api/v1/auth/signup", handler.signUp)
-	router.POST("/api/v1/auth/login", handler.logIn)
+	router.GET("/.well-known/jwks.json", handler.jwks)
+	router.GET("/.well-known/openid-configuration", handler.openIDConfiguration)
+
+	public := router.Group("/", limiter.Limit(cfg.RateLimitGroupAuth, mid.RateLimitByIP))
+	{
+		public.POST("/api/v1/auth/signup", handler.signUp)
+		public.POST("/api/v1/auth/login", handler.logIn)
+		public.POST("/api/v1/auth/verify_email", handler.verifyEmail)
+		public.POST("/api/v1/auth/resend_verification", handler.resendVerification)
+		public.POST("/api/v1/auth/password/forgot", handler.forgotPassword)
+		public.POST("/api/v1/auth/password/reset", handler.resetPassword)
+		public.POST("/api/v1/auth/mfa/verify", handler.verifyMFA)
+		public.POST("/api/v1/auth/passkey/login/start", handler.startPasskeyLogin)
+		public.POST("/api/v1/auth/passkey/login/finish", handler.finishPasskeyLogin)
+		public.POST("/api/v1/auth/magic/start", handler.startMagicLogin)
+		public.POST("/api/v1/auth/magic/verify", handler.verifyMagicLogin)
+	}
+
+	// oauth endpoints authenticate the client with client credential instead of access token
+	oauth := router.Group("/", limiter.Limit(cfg.RateLimitGroupOAuth, mid.RateLimitByClient))
+	{
+		oauth.POST("/api/v1/oauth/introspect", handler.introspect)
+		oauth.POST("/api/v1/oauth/revoke", handler.revoke)
+		oauth.POST("/api/v1/oauth/token", handler.token)
+	}
 
 	authorized := router.Group("/")
-	authorized.Use(mid.AuthMiddleware(ctx, pool, client))
+	authorized.Use(mid.AuthMiddleware(ctx, pool, client, kek, audience), limiter.Limit(cfg.RateLimitGroupUsers, mid.RateLimitByUser))
 	{
 		authorized.POST("/api/v1/auth/logout", handler.logOut)
-		authorized.DELETE("/api/v1/auth/delete_user", handler.deleteUser)
 		authorized.POST("/api/v1/auth/refresh_token", handler.refreshToken)
+		// userinfo check openid scope by itself to send oauth error
+		authorized.GET("/api/v1/oauth/userinfo", handler.userInfo)
+		authorized.POST("/api/v1/oauth/userinfo", handler.userInfo)
+	}
+
+	usersRead := authorized.Group("/", mid.RequireScopes(auth.ScopeUsersRead))
+	{
+		usersRead.GET("/api/v1/auth/sessions", handler.listSessions)
+		usersRead.GET("/api/v1/users/me", handler.getProfile)
+		usersRead.GET("/api/v1/users/:id", handler.getUser)
+		usersRead.GET("/api/v1/users/me/passkeys", handler.listPasskeys)
+	}
+
+	usersWrite := authorized.Group("/", mid.RequireScopes(auth.ScopeUsersWrite))
+	{
+		usersWrite.DELETE("/api/v1/auth/delete_user", handler.deleteUser)
+		usersWrite.DELETE("/api/v1/auth/sessions/:id", handler.revokeSession)
+		usersWrite.POST("/api/v1/auth/logout_others", handler.logOutOthers)
+		usersWrite.PATCH("/api/v1/users/me", handler.updateProfile)
+		usersWrite.POST("/api/v1/users/me/password", handler.changePassword)
+		usersWrite.POST("/api/v1/users/me/mfa/totp", handler.enrollTOTP)
+		usersWrite.POST("/api/v1/users/me/mfa/totp/confirm", handler.confirmTOTP)
+		usersWrite.DELETE("/api/v1/users/me/mfa/totp", handler.disableTOTP)
+		usersWrite.POST("/api/v1/users/me/passkeys/register/start", handler.startPasskeyRegistration)
+		usersWrite.POST("/api/v1/users/me/passkeys/register/finish", handler.finishPasskeyRegistration)
+		usersWrite.DELETE("/api/v1/users/me/passkeys/:id", handler.deletePasskey)
+		usersWrite.GET("/api/v1/oauth/authorize", handler.authorize)
+		usersWrite.POST("/api/v1/oauth/authorize", handler.authorize)
+	}
+
+	admin := authorized.Group("/", mid.RequireScopes(auth.ScopeAdmin))
+	{
+		admin.GET("/api/v1/admin/keys", handler.listSigningKeys)
+		admin.POST("/api/v1/admin/keys/rotate", handler.rotateSigningKey)
+		admin.POST("/api/v1/admin/keys/:kid/retire", handler.retireSigningKey)
+		admin.POST("/api/v1/admin/users/:id/unlock", handler.unlockUser)
 	}
 }
 
@@ -110,8 +174,17 @@ func (d *usersHandler) logIn(c *gin.Context) {
 		return
 	}
 
-	user, accessToken, refreshToken, code, err := d.service.LogIn(auth.LoginRequest(request))
+	loginInput := toLoginRequest(request, c.Request.UserAgent(), c.ClientIP())
+	loginInput.DPoP = toDPoPRequest(c)
+	user, accessToken, refreshToken, code, err := d.service.LogIn(loginInput)
 	if err != nil {
+		var mfaErr *auth.MFARequiredError
+		if errors.As(err, &mfaErr) {
+			response := responses.SuccessWithDataResponse(toMFARequiredResponse(mfaErr), 200, "mfa required")
+			c.IndentedJSON(200, response)
+			return
+		}
+		setRetryAfter(c, err)
 		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
 		return
 	}
@@ -122,6 +195,114 @@ func (d *usersHandler) logIn(c *gin.Context) {
 	c.IndentedJSON(200, response)
 }
 
+func (d *usersHandler) verifyEmail(c *gin.Context) {
+	var request verifyEmailRequest
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.VerifyEmail(request.Token)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("email verified")
+	c.IndentedJSON(200, response)
+}
+
+// resendVerification always return success for email that is not registered,
+// so it can't be used to find registered email
+func (d *usersHandler) resendVerification(c *gin.Context) {
+	var request resendVerificationRequest
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.ResendVerification(request.Email)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("verification email is sent if the email is registered and not verified")
+	c.IndentedJSON(200, response)
+}
+
+// forgotPassword always return success for email that is not registered, so
+// it can't be used to find registered email
+func (d *usersHandler) forgotPassword(c *gin.Context) {
+	var request forgotPasswordRequest
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.ForgotPassword(request.Email)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("password reset email is sent if the email is registered")
+	c.IndentedJSON(200, response)
+}
+
+func (d *usersHandler) resetPassword(c *gin.Context) {
+	var request resetPasswordRequest
+
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.ResetPassword(request.Token, request.Password)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("password is reset, please login again")
+	c.IndentedJSON(200, response)
+}
+
 func (d *usersHandler) logOut(c *gin.Context) {
 	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
 
@@ -154,7 +335,7 @@ func (d *usersHandler) refreshToken(c *gin.Context) {
 		return
 	}
 
-	newRefreshToken, newAccessToken, code, err := d.service.RefreshToken(request.RefreshToken, request.AccessToken)
+	newRefreshToken, newAccessToken, code, err := d.service.RefreshToken(request.RefreshToken, request.AccessToken, toDPoPRequest(c))
 	if err != nil {
 		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
 		return
@@ -190,3 +371,152 @@ func (d *usersHandler) deleteUser(c *gin.Context) {
 	response := responses.SuccessResponse("user deleted")
 	c.IndentedJSON(code, response)
 }
+
+func (d *usersHandler) listSessions(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	sessions, code, err := d.service.ListSessions(*authPayload)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	respBody := toSessionsResponse(sessions, authPayload.SessionID)
+
+	response := responses.SuccessWithDataResponse(respBody, 200, "list sessions success")
+	c.IndentedJSON(200, response)
+}
+
+func (d *usersHandler) revokeSession(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	sessionID, err := conv.ConvertStrToInt32(c.Param("id"))
+	if err != nil {
+		responses.ErrorJSON(c, 400, []string{"session id is not valid"}, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.RevokeSession(*authPayload, sessionID)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("session revoked")
+	c.IndentedJSON(code, response)
+}
+
+func (d *usersHandler) logOutOthers(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.LogOutOtherSessions(*authPayload)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("other sessions logged out")
+	c.IndentedJSON(code, response)
+}
+
+// jwks publish the public keys in JWK Set format (RFC 7517), the body is not
+// wrapped in response envelope so it can be read by any jwt library.
+func (d *usersHandler) jwks(c *gin.Context) {
+	jwks, code, err := d.service.GetJWKS()
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, jwks)
+}
+
+func (d *usersHandler) listSigningKeys(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	keys, code, err := d.service.ListSigningKeys(*authPayload)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	respBody := toSigningKeysResponse(keys)
+
+	response := responses.SuccessWithDataResponse(respBody, 200, "list signing keys success")
+	c.IndentedJSON(200, response)
+}
+
+func (d *usersHandler) rotateSigningKey(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	var request rotateSigningKeyRequest
+
+	// request body is optional
+	err := c.ShouldBindJSON(&request)
+	if err != nil && !errors.Is(err, io.EOF) {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	key, code, err := d.service.RotateSigningKey(*authPayload, request.Alg)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	respBody := toSigningKeyResponse(*key)
+
+	response := responses.SuccessWithDataResponse(respBody, 200, "signing key rotated")
+	c.IndentedJSON(200, response)
+}
+
+func (d *usersHandler) retireSigningKey(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.RetireSigningKey(*authPayload, c.Param("kid"))
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("signing key retired")
+	c.IndentedJSON(code, response)
+}
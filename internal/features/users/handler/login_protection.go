@@ -0,0 +1,52 @@
+package delivery
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	responses "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	conv "github.com/dwiw96/ran-user-management/pkg/utils/converter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setRetryAfter set Retry-After header in seconds when the login is throttled
+// or the user is locked
+func setRetryAfter(c *gin.Context, err error) {
+	var throttledErr *auth.LoginThrottledError
+	if !errors.As(err, &throttledErr) {
+		return
+	}
+
+	seconds := int64(math.Ceil(throttledErr.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+func (d *usersHandler) unlockUser(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	userID, err := conv.ConvertStrToInt32(c.Param("id"))
+	if err != nil {
+		responses.ErrorJSON(c, 400, []string{"user id is not valid"}, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.UnlockUser(*authPayload, userID)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("user unlocked")
+	c.IndentedJSON(code, response)
+}
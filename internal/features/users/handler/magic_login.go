@@ -0,0 +1,72 @@
+package delivery
+
+import (
+	"errors"
+
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	responses "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startMagicLogin always return success for email that is not registered, so
+// it can't be used to find registered email
+func (d *usersHandler) startMagicLogin(c *gin.Context) {
+	var request magicLoginStartRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.StartMagicLogin(toMagicLoginStartRequest(request))
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("login link is sent if the email is registered")
+	c.IndentedJSON(200, response)
+}
+
+// verifyMagicLogin login with the token of the link or the code in the email
+func (d *usersHandler) verifyMagicLogin(c *gin.Context) {
+	var request magicLoginRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	input := toMagicLoginRequest(request, c.Request.UserAgent(), c.ClientIP())
+	input.DPoP = toDPoPRequest(c)
+	user, accessToken, refreshToken, code, err := d.service.VerifyMagicLogin(input)
+	if err != nil {
+		var mfaErr *auth.MFARequiredError
+		if errors.As(err, &mfaErr) {
+			response := responses.SuccessWithDataResponse(toMFARequiredResponse(mfaErr), 200, "mfa required")
+			c.IndentedJSON(200, response)
+			return
+		}
+		setRetryAfter(c, err)
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(toLoginResponse(user, accessToken, refreshToken), 200, "Login success")
+	c.IndentedJSON(200, response)
+}
@@ -0,0 +1,124 @@
+package delivery
+
+import (
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	responses "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	"github.com/gin-gonic/gin"
+)
+
+// verifyMFA is the second step of login, it's used when login return mfa token
+func (d *usersHandler) verifyMFA(c *gin.Context) {
+	var request verifyMFARequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	input := toMFARequest(request, c.Request.UserAgent(), c.ClientIP())
+	input.DPoP = toDPoPRequest(c)
+	user, accessToken, refreshToken, code, err := d.service.VerifyMFA(input)
+	if err != nil {
+		setRetryAfter(c, err)
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(toLoginResponse(user, accessToken, refreshToken), 200, "Login success")
+	c.IndentedJSON(200, response)
+}
+
+// enrollTOTP return the secret that is added to authenticator app, MFA is
+// enabled after the secret is confirmed
+func (d *usersHandler) enrollTOTP(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	enrollment, code, err := d.service.EnrollTOTP(*authPayload)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	respBody := totpEnrollmentResponse{
+		Secret:     enrollment.Secret,
+		OTPAuthURI: enrollment.URI,
+	}
+
+	response := responses.SuccessWithDataResponse(respBody, code, "totp enrolled")
+	c.IndentedJSON(code, response)
+}
+
+// confirmTOTP return the recovery codes, they are only shown once
+func (d *usersHandler) confirmTOTP(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	var request mfaCodeRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	recoveryCodes, code, err := d.service.ConfirmTOTP(*authPayload, request.Code)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(recoveryCodesResponse{RecoveryCodes: recoveryCodes}, code, "mfa enabled")
+	c.IndentedJSON(code, response)
+}
+
+func (d *usersHandler) disableTOTP(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	var request mfaCodeRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.DisableTOTP(*authPayload, request.Code)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("mfa disabled")
+	c.IndentedJSON(code, response)
+}
@@ -0,0 +1,172 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	responses "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientCredential read the credential of oauth client from HTTP Basic
+// authentication, or from client_id and client_secret in the request body
+// (RFC 6749 section 2.3.1).
+func clientCredential(c *gin.Context) auth.ClientCredential {
+	clientID, clientSecret, ok := c.Request.BasicAuth()
+	if ok {
+		// client id and secret is form-urlencoded before it's encoded in basic auth
+		if v, err := url.QueryUnescape(clientID); err == nil {
+			clientID = v
+		}
+		if v, err := url.QueryUnescape(clientSecret); err == nil {
+			clientSecret = v
+		}
+
+		return auth.ClientCredential{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}
+	}
+
+	return auth.ClientCredential{
+		ClientID:     c.PostForm("client_id"),
+		ClientSecret: c.PostForm("client_secret"),
+	}
+}
+
+// oauthErrorJSON send error in RFC 6749 format, error that is not OAuthError is
+// sent as server_error.
+func oauthErrorJSON(c *gin.Context, code int, err error) {
+	var oauthErr *auth.OAuthError
+	if !errors.As(err, &oauthErr) {
+		oauthErr = &auth.OAuthError{
+			ErrorCode:   auth.OAuthErrServerError,
+			Description: err.Error(),
+		}
+	}
+
+	switch oauthErr.ErrorCode {
+	case auth.OAuthErrInvalidClient:
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	case auth.OAuthErrInvalidToken, auth.OAuthErrInsufficientScope:
+		// error of resource that is accessed with bearer token (RFC 6750 section 3)
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error=%q`, oauthErr.ErrorCode))
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(code, gin.H{
+		"error":             oauthErr.ErrorCode,
+		"error_description": oauthErr.Description,
+	})
+}
+
+// introspect is token introspection endpoint (RFC 7662), the request is form
+// encoded and the response is not wrapped in response envelope.
+func (d *usersHandler) introspect(c *gin.Context) {
+	var request introspectRequest
+
+	err := c.ShouldBind(&request)
+	if err != nil {
+		oauthErrorJSON(c, 400, &auth.OAuthError{ErrorCode: auth.OAuthErrInvalidRequest, Description: err.Error()})
+		return
+	}
+
+	res, code, err := d.service.IntrospectToken(clientCredential(c), request.Token, request.TokenTypeHint)
+	if err != nil {
+		oauthErrorJSON(c, code, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(code, res)
+}
+
+// revoke is token revocation endpoint (RFC 7009), success response doesn't
+// have body and it's sent even when the token is invalid.
+func (d *usersHandler) revoke(c *gin.Context) {
+	var request revokeRequest
+
+	err := c.ShouldBind(&request)
+	if err != nil {
+		oauthErrorJSON(c, 400, &auth.OAuthError{ErrorCode: auth.OAuthErrInvalidRequest, Description: err.Error()})
+		return
+	}
+
+	code, err := d.service.RevokeToken(clientCredential(c), request.Token, request.TokenTypeHint)
+	if err != nil {
+		oauthErrorJSON(c, code, err)
+		return
+	}
+
+	c.Status(code)
+}
+
+// authorize is authorization endpoint of authorization code flow for the
+// logged in user. GET only check the request and tell whether consent of the
+// user is required, POST send the answer of the user with approve. The
+// response tell the frontend where to redirect the user.
+func (d *usersHandler) authorize(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	var request authorizeRequest
+
+	var err error
+	if c.Request.Method == http.MethodGet {
+		err = c.ShouldBindQuery(&request)
+		request.Approve = nil
+	} else {
+		err = c.ShouldBind(&request)
+		if err == nil && request.Approve == nil {
+			err = errors.New("approve is required")
+		}
+	}
+	if err != nil {
+		oauthErrorJSON(c, 400, &auth.OAuthError{ErrorCode: auth.OAuthErrInvalidRequest, Description: err.Error()})
+		return
+	}
+
+	res, code, err := d.service.Authorize(*authPayload, toAuthorizeRequest(request))
+	if err != nil {
+		oauthErrorJSON(c, code, err)
+		return
+	}
+
+	respBody := toAuthorizeResponse(res)
+
+	response := responses.SuccessWithDataResponse(respBody, 200, "authorize success")
+	c.IndentedJSON(200, response)
+}
+
+// token is oauth token endpoint, the request is form encoded and the response
+// is not wrapped in response envelope.
+func (d *usersHandler) token(c *gin.Context) {
+	var request tokenRequest
+
+	err := c.ShouldBind(&request)
+	if err != nil {
+		oauthErrorJSON(c, 400, &auth.OAuthError{ErrorCode: auth.OAuthErrInvalidRequest, Description: err.Error()})
+		return
+	}
+
+	input := toTokenRequest(request, c.Request.UserAgent(), c.ClientIP())
+	input.DPoP = toDPoPRequest(c)
+
+	res, code, err := d.service.Token(clientCredential(c), input)
+	if err != nil {
+		oauthErrorJSON(c, code, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(code, res)
+}
@@ -0,0 +1,42 @@
+package delivery
+
+import (
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	responses "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openIDConfiguration publish the discovery document of OpenID Connect, the
+// body is not wrapped in response envelope so it can be read by any OIDC
+// library.
+func (d *usersHandler) openIDConfiguration(c *gin.Context) {
+	res, code, err := d.service.GetOpenIDConfiguration()
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, res)
+}
+
+// userInfo is OpenID Connect userinfo endpoint, the claims are sent without
+// response envelope.
+func (d *usersHandler) userInfo(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+
+	if !isExists {
+		oauthErrorJSON(c, 401, &auth.OAuthError{ErrorCode: auth.OAuthErrInvalidToken, Description: "token is wrong"})
+		return
+	}
+
+	res, code, err := d.service.UserInfo(*authPayload)
+	if err != nil {
+		oauthErrorJSON(c, code, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(code, res)
+}
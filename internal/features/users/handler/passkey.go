@@ -0,0 +1,175 @@
+package delivery
+
+import (
+	"errors"
+
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	responses "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	conv "github.com/dwiw96/ran-user-management/pkg/utils/converter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startPasskeyRegistration return options of navigator.credentials.create()
+func (d *usersHandler) startPasskeyRegistration(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	options, code, err := d.service.StartPasskeyRegistration(*authPayload)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(options, code, "passkey registration started")
+	c.IndentedJSON(code, response)
+}
+
+func (d *usersHandler) finishPasskeyRegistration(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	var request registerPasskeyRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	input, err := toPasskeyRegistrationRequest(request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	credential, code, err := d.service.FinishPasskeyRegistration(*authPayload, input)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(toPasskeyResponse(*credential), 201, "passkey registered")
+	c.IndentedJSON(201, response)
+}
+
+func (d *usersHandler) listPasskeys(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	credentials, code, err := d.service.ListPasskeys(*authPayload)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(toPasskeysResponse(credentials), code, "list passkeys success")
+	c.IndentedJSON(code, response)
+}
+
+func (d *usersHandler) deletePasskey(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	id, err := conv.ConvertStrToInt32(c.Param("id"))
+	if err != nil {
+		responses.ErrorJSON(c, 400, []string{"passkey id is not valid"}, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.DeletePasskey(*authPayload, id)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("passkey deleted")
+	c.IndentedJSON(code, response)
+}
+
+// startPasskeyLogin return options of navigator.credentials.get(), the body is
+// optional
+func (d *usersHandler) startPasskeyLogin(c *gin.Context) {
+	var request passkeyLoginStartRequest
+	if c.Request.ContentLength != 0 {
+		err := c.BindJSON(&request)
+		if err != nil {
+			responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+			return
+		}
+	}
+
+	err := d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	options, code, err := d.service.StartPasskeyLogin(toPasskeyLoginStartRequest(request))
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(options, code, "passkey login started")
+	c.IndentedJSON(code, response)
+}
+
+func (d *usersHandler) finishPasskeyLogin(c *gin.Context) {
+	var request passkeyLoginRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	input, err := toPasskeyLoginRequest(request, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+	input.DPoP = toDPoPRequest(c)
+
+	user, accessToken, refreshToken, code, err := d.service.FinishPasskeyLogin(input)
+	if err != nil {
+		var mfaErr *auth.MFARequiredError
+		if errors.As(err, &mfaErr) {
+			response := responses.SuccessWithDataResponse(toMFARequiredResponse(mfaErr), 200, "mfa required")
+			c.IndentedJSON(200, response)
+			return
+		}
+		setRetryAfter(c, err)
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(toLoginResponse(user, accessToken, refreshToken), 200, "Login success")
+	c.IndentedJSON(200, response)
+}
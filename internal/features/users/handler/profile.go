@@ -0,0 +1,109 @@
+package delivery
+
+import (
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	responses "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	conv "github.com/dwiw96/ran-user-management/pkg/utils/converter"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (d *usersHandler) getProfile(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	profile, code, err := d.service.GetProfile(*authPayload)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(toMeResponse(profile), code, "get profile success")
+	c.IndentedJSON(code, response)
+}
+
+// getUser return public data of the user, so other users and services can
+// read it without the email of the user
+func (d *usersHandler) getUser(c *gin.Context) {
+	userID, err := conv.ConvertStrToInt32(c.Param("id"))
+	if err != nil {
+		responses.ErrorJSON(c, 400, []string{"user id is not valid"}, c.Request.RemoteAddr)
+		return
+	}
+
+	user, code, err := d.service.GetUser(userID)
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(toPublicUserResponse(user), code, "get user success")
+	c.IndentedJSON(code, response)
+}
+
+func (d *usersHandler) updateProfile(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	var request updateProfileRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	user, code, err := d.service.UpdateProfile(*authPayload, toUpdateProfileRequest(request))
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessWithDataResponse(toProfileResponse(user), code, "profile updated")
+	c.IndentedJSON(code, response)
+}
+
+// changePassword keep the current session login, other sessions are logged out
+func (d *usersHandler) changePassword(c *gin.Context) {
+	authPayload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		responses.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+		return
+	}
+
+	var request changePasswordRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		responses.ErrorJSON(c, 422, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	err = d.validate.Struct(request)
+	if err != nil {
+		errTranslated := translateError(d.trans, err)
+		responses.ErrorJSON(c, 422, errTranslated, c.Request.RemoteAddr)
+		return
+	}
+
+	code, err := d.service.ChangePassword(*authPayload, toChangePasswordRequest(request))
+	if err != nil {
+		responses.ErrorJSON(c, code, []string{err.Error()}, c.Request.RemoteAddr)
+		return
+	}
+
+	response := responses.SuccessResponse("password changed, other sessions logged out")
+	c.IndentedJSON(code, response)
+}
@@ -1,7 +1,13 @@
 package delivery
 
 import (
+	"errors"
+
 	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	mid "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+
+	"github.com/gin-gonic/gin"
 )
 
 type signupRequest struct {
@@ -19,11 +25,289 @@ func toSignUpRequest(input signupRequest) auth.SignupRequest {
 }
 
 type signinRequest struct {
-	Email    string `json:"email" validate:"required,email,max=255"`
-	Password string `json:"password" validate:"required,min=7"`
+	Email      string `json:"email" validate:"required,email,max=255"`
+	Password   string `json:"password" validate:"required,min=7"`
+	DeviceName string `json:"device_name" validate:"max=255"`
+	Scope      string `json:"scope" validate:"max=255"`
+}
+
+func toLoginRequest(input signinRequest, userAgent, ipAddress string) auth.LoginRequest {
+	return auth.LoginRequest{
+		Email:      input.Email,
+		Password:   input.Password,
+		DeviceName: input.DeviceName,
+		Scope:      input.Scope,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+	}
+}
+
+// toDPoPRequest return DPoP proof of the request, the proof is empty when the
+// client doesn't use DPoP
+func toDPoPRequest(c *gin.Context) auth.DPoPRequest {
+	return auth.DPoPRequest{
+		Proof:  c.GetHeader(mid.DPoPHeader),
+		Method: c.Request.Method,
+		URL:    mid.DPoPRequestURL(c.Request),
+	}
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type resendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
+
+// username is not changed when it's empty
+type updateProfileRequest struct {
+	Username string `json:"username" validate:"omitempty,min=2,max=255"`
+}
+
+func toUpdateProfileRequest(input updateProfileRequest) auth.UpdateProfileRequest {
+	return auth.UpdateProfileRequest{
+		Username: input.Username,
+	}
+}
+
+// new password is checked with password policy by the service
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,max=72"`
+}
+
+func toChangePasswordRequest(input changePasswordRequest) auth.ChangePasswordRequest {
+	return auth.ChangePasswordRequest{
+		CurrentPassword: input.CurrentPassword,
+		NewPassword:     input.NewPassword,
+	}
+}
+
+// code is TOTP code or recovery code
+type mfaCodeRequest struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+type verifyMFARequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required,max=32"`
+}
+
+func toMFARequest(input verifyMFARequest, userAgent, ipAddress string) auth.MFARequest {
+	return auth.MFARequest{
+		MFAToken:  input.MFAToken,
+		Code:      input.Code,
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+	}
+}
+
+type magicLoginStartRequest struct {
+	Email      string `json:"email" validate:"required,email,max=255"`
+	DeviceName string `json:"device_name" validate:"max=255"`
+	Scope      string `json:"scope" validate:"max=255"`
+}
+
+func toMagicLoginStartRequest(input magicLoginStartRequest) auth.MagicLoginStartRequest {
+	return auth.MagicLoginStartRequest{
+		Email:      input.Email,
+		DeviceName: input.DeviceName,
+		Scope:      input.Scope,
+	}
+}
+
+// token is sent when the link is opened, email and code are sent when the
+// code is typed
+type magicLoginRequest struct {
+	Token string `json:"token" validate:"required_without=Code,max=255"`
+	Email string `json:"email" validate:"required_with=Code,omitempty,email,max=255"`
+	Code  string `json:"code" validate:"required_without=Token,max=16"`
+}
+
+func toMagicLoginRequest(input magicLoginRequest, userAgent, ipAddress string) auth.MagicLoginRequest {
+	return auth.MagicLoginRequest{
+		Token:     input.Token,
+		Email:     input.Email,
+		Code:      input.Code,
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+	}
+}
+
+// passkeyCredentialRequest is PublicKeyCredential in WebAuthn JSON format
+// that is returned by its toJSON(), binary is base64url. Response of
+// registration has attestationObject and transports, and response of login
+// has authenticatorData, signature and userHandle.
+type passkeyCredentialRequest struct {
+	ID       string `json:"id" validate:"required"`
+	Type     string `json:"type" validate:"eq=public-key"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON" validate:"required"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports" validate:"max=10,dive,max=32"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+	} `json:"response"`
+}
+
+// decodePasskeyFields decode base64url fields of the credential, empty field
+// is nil.
+func decodePasskeyFields(fields ...string) ([][]byte, error) {
+	res := make([][]byte, len(fields))
+	for i, v := range fields {
+		if v == "" {
+			continue
+		}
+		b, err := password.DecodeWebAuthnBase64(v)
+		if err != nil {
+			return nil, errors.New("passkey credential is not valid base64url")
+		}
+		res[i] = b
+	}
+
+	return res, nil
+}
+
+type registerPasskeyRequest struct {
+	Name       string                   `json:"name" validate:"max=255"`
+	Credential passkeyCredentialRequest `json:"credential"`
+}
+
+func toPasskeyRegistrationRequest(input registerPasskeyRequest) (auth.PasskeyRegistrationRequest, error) {
+	cred := input.Credential
+	fields, err := decodePasskeyFields(cred.ID, cred.Response.ClientDataJSON, cred.Response.AttestationObject)
+	if err != nil {
+		return auth.PasskeyRegistrationRequest{}, err
+	}
+
+	return auth.PasskeyRegistrationRequest{
+		Name:              input.Name,
+		CredentialID:      fields[0],
+		ClientDataJSON:    fields[1],
+		AttestationObject: fields[2],
+		Transports:        cred.Response.Transports,
+	}, nil
+}
+
+type passkeyLoginStartRequest struct {
+	DeviceName string `json:"device_name" validate:"max=255"`
+	Scope      string `json:"scope" validate:"max=255"`
+}
+
+func toPasskeyLoginStartRequest(input passkeyLoginStartRequest) auth.PasskeyLoginStartRequest {
+	return auth.PasskeyLoginStartRequest{
+		DeviceName: input.DeviceName,
+		Scope:      input.Scope,
+	}
+}
+
+type passkeyLoginRequest struct {
+	Credential passkeyCredentialRequest `json:"credential"`
+}
+
+func toPasskeyLoginRequest(input passkeyLoginRequest, userAgent, ipAddress string) (auth.PasskeyLoginRequest, error) {
+	cred := input.Credential
+	fields, err := decodePasskeyFields(cred.ID, cred.Response.ClientDataJSON, cred.Response.AuthenticatorData, cred.Response.Signature, cred.Response.UserHandle)
+	if err != nil {
+		return auth.PasskeyLoginRequest{}, err
+	}
+
+	return auth.PasskeyLoginRequest{
+		CredentialID:      fields[0],
+		ClientDataJSON:    fields[1],
+		AuthenticatorData: fields[2],
+		Signature:         fields[3],
+		UserHandle:        fields[4],
+		UserAgent:         userAgent,
+		IPAddress:         ipAddress,
+	}, nil
 }
 
 type refreshTokenRequest struct {
 	RefreshToken string `json:"refresh_token"`
 	AccessToken  string `json:"access_token"`
 }
+
+// alg is optional, the algorithm of the current active key is used when it's empty
+type rotateSigningKeyRequest struct {
+	Alg string `json:"alg" validate:"omitempty,oneof=RS256 PS256 ES256 EdDSA"`
+}
+
+type introspectRequest struct {
+	Token         string `form:"token"`
+	TokenTypeHint string `form:"token_type_hint"`
+}
+
+type revokeRequest struct {
+	Token         string `form:"token"`
+	TokenTypeHint string `form:"token_type_hint"`
+}
+
+// approve is only sent when the user answer the consent
+type authorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	Approve             *bool  `form:"approve" json:"approve"`
+}
+
+func toAuthorizeRequest(input authorizeRequest) auth.AuthorizeRequest {
+	return auth.AuthorizeRequest{
+		ResponseType:        input.ResponseType,
+		ClientID:            input.ClientID,
+		RedirectURI:         input.RedirectURI,
+		Scope:               input.Scope,
+		State:               input.State,
+		CodeChallenge:       input.CodeChallenge,
+		CodeChallengeMethod: input.CodeChallengeMethod,
+		Nonce:               input.Nonce,
+		Approve:             input.Approve,
+	}
+}
+
+type tokenRequest struct {
+	GrantType          string `form:"grant_type"`
+	Code               string `form:"code"`
+	RedirectURI        string `form:"redirect_uri"`
+	CodeVerifier       string `form:"code_verifier"`
+	Scope              string `form:"scope"`
+	RefreshToken       string `form:"refresh_token"`
+	SubjectToken       string `form:"subject_token"`
+	SubjectTokenType   string `form:"subject_token_type"`
+	RequestedTokenType string `form:"requested_token_type"`
+	Audience           string `form:"audience"`
+}
+
+func toTokenRequest(input tokenRequest, userAgent, ipAddress string) auth.TokenRequest {
+	return auth.TokenRequest{
+		GrantType:    input.GrantType,
+		Code:         input.Code,
+		RedirectURI:  input.RedirectURI,
+		CodeVerifier: input.CodeVerifier,
+		Scope:        input.Scope,
+		UserAgent:    userAgent,
+		IPAddress:    ipAddress,
+
+		RefreshToken:       input.RefreshToken,
+		SubjectToken:       input.SubjectToken,
+		SubjectTokenType:   input.SubjectTokenType,
+		RequestedTokenType: input.RequestedTokenType,
+		Audience:           input.Audience,
+	}
+}
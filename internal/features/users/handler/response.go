@@ -1,6 +1,10 @@
 package delivery
 
-import auth "github.com/dwiw96/ran-user-management/internal/features/users"
+import (
+	"time"
+
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+)
 
 type signupResponse struct {
 	Username string `json:"username"`
@@ -31,7 +35,200 @@ func toLoginResponse(input *auth.User, accessToken, refreshToken string) loginRe
 	}
 }
 
+// mfaRequiredResponse is returned by login when the user enable MFA, the
+// login is continued by sending the mfa token and the code
+type mfaRequiredResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func toMFARequiredResponse(input *auth.MFARequiredError) mfaRequiredResponse {
+	return mfaRequiredResponse{
+		MFARequired: true,
+		MFAToken:    input.MFAToken,
+		ExpiresIn:   int64(input.ExpiresIn.Seconds()),
+	}
+}
+
+type totpEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type profileResponse struct {
+	ID       int32  `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+func toProfileResponse(input *auth.User) profileResponse {
+	return profileResponse{
+		ID:       input.ID,
+		Username: input.Username,
+		Email:    input.Email,
+	}
+}
+
+// meResponse is the profile that is returned to the user itself
+type meResponse struct {
+	ID              int32      `json:"id"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	EmailVerified   bool       `json:"email_verified"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Roles           []string   `json:"roles"`
+	MFAEnabled      bool       `json:"mfa_enabled"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+func toMeResponse(input *auth.UserProfile) meResponse {
+	res := meResponse{
+		ID:            input.User.ID,
+		Username:      input.User.Username,
+		Email:         input.User.Email,
+		EmailVerified: input.User.EmailVerifiedAt.Valid,
+		Roles:         input.Roles,
+		MFAEnabled:    input.MFAEnabled,
+		CreatedAt:     input.User.CreatedAt.Time,
+	}
+	if input.User.EmailVerifiedAt.Valid {
+		res.EmailVerifiedAt = &input.User.EmailVerifiedAt.Time
+	}
+
+	return res
+}
+
+// publicUserResponse is the user that is returned to other user or service,
+// it doesn't contain private data such as email
+type publicUserResponse struct {
+	ID       int32  `json:"id"`
+	Username string `json:"username"`
+}
+
+func toPublicUserResponse(input *auth.User) publicUserResponse {
+	return publicUserResponse{
+		ID:       input.ID,
+		Username: input.Username,
+	}
+}
+
 type refreshTokenResponse struct {
 	RefreshToken string `json:"refresh_token"`
 	AccessToken  string `json:"access_token"`
 }
+
+type sessionResponse struct {
+	ID         int32     `json:"id"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+func toSessionsResponse(input []auth.RefreshTokenWhitelist, currentSessionID int32) []sessionResponse {
+	res := make([]sessionResponse, 0, len(input))
+	for _, v := range input {
+		res = append(res, sessionResponse{
+			ID:         v.ID,
+			DeviceName: v.DeviceName,
+			UserAgent:  v.UserAgent,
+			IPAddress:  v.IPAddress,
+			CreatedAt:  v.CreatedAt.Time,
+			LastUsedAt: v.LastUsedAt.Time,
+			ExpiresAt:  v.ExpiresAt.Time,
+			Current:    v.ID == currentSessionID,
+		})
+	}
+
+	return res
+}
+
+// public key of the passkey is not returned
+type passkeyResponse struct {
+	ID             int32      `json:"id"`
+	Name           string     `json:"name"`
+	Transports     []string   `json:"transports"`
+	BackupEligible bool       `json:"backup_eligible"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+}
+
+func toPasskeyResponse(input auth.WebAuthnCredential) passkeyResponse {
+	res := passkeyResponse{
+		ID:             input.ID,
+		Name:           input.Name,
+		Transports:     input.Transports,
+		BackupEligible: input.BackupEligible,
+		CreatedAt:      input.CreatedAt.Time,
+	}
+	if input.LastUsedAt.Valid {
+		res.LastUsedAt = &input.LastUsedAt.Time
+	}
+
+	return res
+}
+
+func toPasskeysResponse(input []auth.WebAuthnCredential) []passkeyResponse {
+	res := make([]passkeyResponse, 0, len(input))
+	for _, v := range input {
+		res = append(res, toPasskeyResponse(v))
+	}
+
+	return res
+}
+
+// private key is never returned
+type signingKeyResponse struct {
+	Kid       string     `json:"kid"`
+	Alg       string     `json:"alg"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at"`
+}
+
+func toSigningKeyResponse(input auth.SigningKey) signingKeyResponse {
+	res := signingKeyResponse{
+		Kid:       input.Kid,
+		Alg:       input.Alg,
+		Status:    input.Status,
+		CreatedAt: input.CreatedAt.Time,
+	}
+	if input.RetiredAt.Valid {
+		res.RetiredAt = &input.RetiredAt.Time
+	}
+
+	return res
+}
+
+func toSigningKeysResponse(input []auth.SigningKey) []signingKeyResponse {
+	res := make([]signingKeyResponse, 0, len(input))
+	for _, v := range input {
+		res = append(res, toSigningKeyResponse(v))
+	}
+
+	return res
+}
+
+type authorizeResponse struct {
+	ConsentRequired bool   `json:"consent_required"`
+	ClientName      string `json:"client_name"`
+	Scope           string `json:"scope"`
+	RedirectTo      string `json:"redirect_to,omitempty"`
+}
+
+func toAuthorizeResponse(input *auth.AuthorizeResponse) authorizeResponse {
+	return authorizeResponse{
+		ConsentRequired: input.ConsentRequired,
+		ClientName:      input.ClientName,
+		Scope:           input.Scope,
+		RedirectTo:      input.RedirectTo,
+	}
+}
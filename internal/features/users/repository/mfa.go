@@ -0,0 +1,204 @@
+package repository
+
+import (
+	"context"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+)
+
+const upsertTOTP = `-- name: UpsertTOTP :exec
+INSERT INTO user_totp(
+    user_id,
+    secret,
+    encrypted_dek,
+    kek_id
+) VALUES (
+    $1, $2, $3, $4
+) ON CONFLICT (user_id) DO UPDATE SET
+    secret = EXCLUDED.secret,
+    encrypted_dek = EXCLUDED.encrypted_dek,
+    kek_id = EXCLUDED.kek_id,
+    last_used_step = 0,
+    created_at = NOW()
+WHERE
+    user_totp.confirmed_at IS NULL
+`
+
+// UpsertTOTP save the secret sealed with the key-encryption key, it replace
+// the unconfirmed secret. ErrNoRowsAffected is returned when the secret of
+// the user is already confirmed.
+func (q *usersRepository) UpsertTOTP(ctx context.Context, arg pUsers.UpsertTOTPParams) error {
+	sealed, wrappedDEK, err := q.kek.SealSecret(password.TOTPSecretID(arg.UserID), arg.Secret)
+	if err != nil {
+		return err
+	}
+
+	res, err := q.db.Exec(ctx, upsertTOTP, arg.UserID, sealed, wrappedDEK, q.kek.ID)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
+
+const getTOTP = `-- name: GetTOTP :one
+SELECT
+    user_id, secret, encrypted_dek, kek_id, last_used_step, confirmed_at, created_at
+FROM
+    user_totp
+WHERE
+    user_id = $1
+`
+
+// GetTOTP return the TOTP of the user with decrypted secret.
+func (q *usersRepository) GetTOTP(ctx context.Context, userID int32) (*pUsers.UserTOTP, error) {
+	row := q.db.QueryRow(ctx, getTOTP, userID)
+	var i pUsers.UserTOTP
+	var sealed, wrappedDEK []byte
+	var kekID string
+	err := row.Scan(
+		&i.UserID,
+		&sealed,
+		&wrappedDEK,
+		&kekID,
+		&i.LastUsedStep,
+		&i.ConfirmedAt,
+		&i.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	i.Secret, err = q.kek.OpenSecret(password.TOTPSecretID(i.UserID), kekID, sealed, wrappedDEK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+const confirmTOTP = `-- name: ConfirmTOTP :exec
+UPDATE
+    user_totp
+SET
+    confirmed_at = NOW(),
+    last_used_step = $2
+WHERE
+    user_id = $1
+AND confirmed_at IS NULL
+AND last_used_step < $2
+`
+
+const deleteRecoveryCodes = `-- name: DeleteRecoveryCodes :exec
+DELETE FROM
+    mfa_recovery_codes
+WHERE
+    user_id = $1
+`
+
+const insertRecoveryCodes = `-- name: InsertRecoveryCodes :exec
+INSERT INTO mfa_recovery_codes(
+    user_id,
+    code_hash
+) SELECT
+    $1, UNNEST($2::BYTEA[])
+`
+
+// ConfirmTOTPTx enable MFA of the user and replace the recovery codes in one
+// transaction. ErrNoRowsAffected is returned when there is no unconfirmed
+// secret or the code is already used.
+func (r *usersRepository) ConfirmTOTPTx(ctx context.Context, arg pUsers.ConfirmTOTPParams) error {
+	return r.ExecDbTx(ctx, func(ar *usersRepository) error {
+		res, err := ar.db.Exec(ctx, confirmTOTP, arg.UserID, arg.LastUsedStep)
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return pUsers.ErrNoRowsAffected
+		}
+
+		_, err = ar.db.Exec(ctx, deleteRecoveryCodes, arg.UserID)
+		if err != nil {
+			return err
+		}
+
+		_, err = ar.db.Exec(ctx, insertRecoveryCodes, arg.UserID, arg.RecoveryCodeHashes)
+		return err
+	})
+}
+
+const updateTOTPLastUsedStep = `-- name: UpdateTOTPLastUsedStep :exec
+UPDATE
+    user_totp
+SET
+    last_used_step = $2
+WHERE
+    user_id = $1
+AND confirmed_at IS NOT NULL
+AND last_used_step < $2
+`
+
+// UpdateTOTPLastUsedStep save the time step of the code that is accepted,
+// ErrNoRowsAffected is returned when the same or newer code is already used,
+// so two requests can't use the same code at the same time.
+func (q *usersRepository) UpdateTOTPLastUsedStep(ctx context.Context, arg pUsers.UpdateTOTPLastUsedStepParams) error {
+	res, err := q.db.Exec(ctx, updateTOTPLastUsedStep, arg.UserID, arg.LastUsedStep)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
+
+const useRecoveryCode = `-- name: UseRecoveryCode :exec
+UPDATE
+    mfa_recovery_codes
+SET
+    used_at = NOW()
+WHERE
+    user_id = $1
+AND code_hash = $2
+AND used_at IS NULL
+`
+
+// UseRecoveryCode mark the recovery code as used, ErrNoRowsAffected is
+// returned when the code is not found or already used.
+func (q *usersRepository) UseRecoveryCode(ctx context.Context, arg pUsers.UseRecoveryCodeParams) error {
+	res, err := q.db.Exec(ctx, useRecoveryCode, arg.UserID, arg.CodeHash)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
+
+const deleteTOTP = `-- name: DeleteTOTP :exec
+DELETE FROM
+    user_totp
+WHERE
+    user_id = $1
+`
+
+// DeleteTOTP disable MFA of the user, the recovery codes are deleted with it.
+// ErrNoRowsAffected is returned when the user doesn't have TOTP.
+func (q *usersRepository) DeleteTOTP(ctx context.Context, userID int32) error {
+	res, err := q.db.Exec(ctx, deleteTOTP, userID)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
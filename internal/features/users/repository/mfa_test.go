@@ -0,0 +1,237 @@
+package repository
+
+import (
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createTOTPTest save new TOTP secret of the user, the secret is confirmed
+// with recovery codes when confirmed is true
+func createTOTPTest(t *testing.T, userID int32, confirmed bool) (secret []byte, recoveryCodes []string) {
+	secret, err := password.GenerateTOTPSecret()
+	require.NoError(t, err)
+
+	err = repoTest.UpsertTOTP(ctx, pUsers.UpsertTOTPParams{UserID: userID, Secret: secret})
+	require.NoError(t, err)
+
+	if confirmed {
+		recoveryCodes, err = password.GenerateRecoveryCodes(password.RecoveryCodeCount)
+		require.NoError(t, err)
+		var hashes [][]byte
+		for _, v := range recoveryCodes {
+			hashes = append(hashes, password.HashRecoveryCode(v))
+		}
+
+		err = repoTest.ConfirmTOTPTx(ctx, pUsers.ConfirmTOTPParams{UserID: userID, LastUsedStep: 100, RecoveryCodeHashes: hashes})
+		require.NoError(t, err)
+	}
+
+	return secret, recoveryCodes
+}
+
+func TestUpsertTOTP(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	secret, _ := createTOTPTest(t, user.ID, false)
+
+	// secret is not saved in plaintext
+	var sealed []byte
+	err = poolTest.QueryRow(ctx, "SELECT secret FROM user_totp WHERE user_id = $1", user.ID).Scan(&sealed)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), string(secret))
+
+	res, err := repoTest.GetTOTP(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, secret, res.Secret)
+	assert.False(t, res.ConfirmedAt.Valid)
+
+	t.Run("success_replace_unconfirmed", func(t *testing.T) {
+		newSecret, _ := createTOTPTest(t, user.ID, false)
+
+		res, err := repoTest.GetTOTP(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, newSecret, res.Secret)
+	})
+
+	t.Run("failed_confirmed", func(t *testing.T) {
+		confirmedUser := createRandomUser(t)
+		confirmedSecret, _ := createTOTPTest(t, confirmedUser.ID, true)
+
+		err := repoTest.UpsertTOTP(ctx, pUsers.UpsertTOTPParams{UserID: confirmedUser.ID, Secret: secret})
+		require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+
+		res, err := repoTest.GetTOTP(ctx, confirmedUser.ID)
+		require.NoError(t, err)
+		assert.Equal(t, confirmedSecret, res.Secret)
+	})
+
+	t.Run("failed_not_found", func(t *testing.T) {
+		res, err := repoTest.GetTOTP(ctx, user.ID+100)
+		require.ErrorIs(t, err, pgx.ErrNoRows)
+		assert.Nil(t, res)
+	})
+}
+
+func TestConfirmTOTPTx(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	createTOTPTest(t, user.ID, false)
+	hashes := [][]byte{password.HashRecoveryCode("code-1"), password.HashRecoveryCode("code-2")}
+
+	err = repoTest.ConfirmTOTPTx(ctx, pUsers.ConfirmTOTPParams{UserID: user.ID, LastUsedStep: 10, RecoveryCodeHashes: hashes})
+	require.NoError(t, err)
+
+	res, err := repoTest.GetTOTP(ctx, user.ID)
+	require.NoError(t, err)
+	assert.True(t, res.ConfirmedAt.Valid)
+	assert.Equal(t, int64(10), res.LastUsedStep)
+
+	var count int
+	err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1", user.ID).Scan(&count)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// confirmed secret can't be confirmed again
+	err = repoTest.ConfirmTOTPTx(ctx, pUsers.ConfirmTOTPParams{UserID: user.ID, LastUsedStep: 20, RecoveryCodeHashes: hashes})
+	require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+
+	// user without secret
+	otherUser := createRandomUser(t)
+	err = repoTest.ConfirmTOTPTx(ctx, pUsers.ConfirmTOTPParams{UserID: otherUser.ID, LastUsedStep: 10, RecoveryCodeHashes: hashes})
+	require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+}
+
+func TestUpdateTOTPLastUsedStep(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	createTOTPTest(t, user.ID, true)
+	unconfirmedUser := createRandomUser(t)
+	createTOTPTest(t, unconfirmedUser.ID, false)
+
+	testCases := []struct {
+		desc string
+		arg  pUsers.UpdateTOTPLastUsedStepParams
+		err  bool
+	}{
+		{
+			desc: "success",
+			arg:  pUsers.UpdateTOTPLastUsedStepParams{UserID: user.ID, LastUsedStep: 101},
+		}, {
+			desc: "failed_used_step",
+			arg:  pUsers.UpdateTOTPLastUsedStepParams{UserID: user.ID, LastUsedStep: 101},
+			err:  true,
+		}, {
+			desc: "failed_older_step",
+			arg:  pUsers.UpdateTOTPLastUsedStepParams{UserID: user.ID, LastUsedStep: 99},
+			err:  true,
+		}, {
+			desc: "failed_unconfirmed",
+			arg:  pUsers.UpdateTOTPLastUsedStepParams{UserID: unconfirmedUser.ID, LastUsedStep: 101},
+			err:  true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := repoTest.UpdateTOTPLastUsedStep(ctx, tC.arg)
+			if tC.err {
+				require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+				return
+			}
+			require.NoError(t, err)
+
+			res, err := repoTest.GetTOTP(ctx, tC.arg.UserID)
+			require.NoError(t, err)
+			assert.Equal(t, tC.arg.LastUsedStep, res.LastUsedStep)
+		})
+	}
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	_, recoveryCodes := createTOTPTest(t, user.ID, true)
+	otherUser := createRandomUser(t)
+	createTOTPTest(t, otherUser.ID, true)
+
+	testCases := []struct {
+		desc string
+		arg  pUsers.UseRecoveryCodeParams
+		err  bool
+	}{
+		{
+			desc: "success",
+			arg:  pUsers.UseRecoveryCodeParams{UserID: user.ID, CodeHash: password.HashRecoveryCode(recoveryCodes[0])},
+		}, {
+			desc: "failed_used",
+			arg:  pUsers.UseRecoveryCodeParams{UserID: user.ID, CodeHash: password.HashRecoveryCode(recoveryCodes[0])},
+			err:  true,
+		}, {
+			desc: "failed_other_user",
+			arg:  pUsers.UseRecoveryCodeParams{UserID: otherUser.ID, CodeHash: password.HashRecoveryCode(recoveryCodes[1])},
+			err:  true,
+		}, {
+			desc: "failed_wrong_code",
+			arg:  pUsers.UseRecoveryCodeParams{UserID: user.ID, CodeHash: password.HashRecoveryCode("wrong-code")},
+			err:  true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := repoTest.UseRecoveryCode(ctx, tC.arg)
+			if tC.err {
+				require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDeleteTOTP(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	createTOTPTest(t, user.ID, true)
+
+	err = repoTest.DeleteTOTP(ctx, user.ID)
+	require.NoError(t, err)
+
+	_, err = repoTest.GetTOTP(ctx, user.ID)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	// recovery codes are deleted with the secret
+	var count int
+	err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1", user.ID).Scan(&count)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	err = repoTest.DeleteTOTP(ctx, user.ID)
+	require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+
+	// MFA of deleted user is deleted
+	deletedUser := createRandomUser(t)
+	createTOTPTest(t, deletedUser.ID, true)
+	err = repoTest.DeleteUserTx(ctx, pUsers.SoftDeleteUserParams{ID: deletedUser.ID, Email: deletedUser.Email})
+	require.NoError(t, err)
+
+	_, err = repoTest.GetTOTP(ctx, deletedUser.ID)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+}
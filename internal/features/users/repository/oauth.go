@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"context"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+)
+
+const createOAuthClient = `-- name: CreateOAuthClient :one
+INSERT INTO oauth_clients(
+    client_id,
+    client_secret_hash,
+    name,
+    redirect_uris,
+    is_public,
+    grant_types,
+    allowed_scopes,
+    allowed_audiences
+) VALUES (
+    $1, $2, $3, $4, $5, COALESCE($6::TEXT[], '{authorization_code}'), COALESCE($7::TEXT[], '{}'), COALESCE($8::TEXT[], '{}')
+) RETURNING id, client_id, client_secret_hash, name, created_at, revoked_at, redirect_uris, is_public, grant_types, allowed_scopes, allowed_audiences
+`
+
+func (q *usersRepository) CreateOAuthClient(ctx context.Context, arg pUsers.CreateOAuthClientParams) (*pUsers.OAuthClient, error) {
+	redirectURIs := arg.RedirectURIs
+	if redirectURIs == nil {
+		redirectURIs = []string{}
+	}
+	row := q.db.QueryRow(ctx, createOAuthClient, arg.ClientID, arg.ClientSecretHash, arg.Name, redirectURIs, arg.IsPublic, arg.GrantTypes, arg.AllowedScopes, arg.AllowedAudiences)
+	var i pUsers.OAuthClient
+	err := row.Scan(
+		&i.ID,
+		&i.ClientID,
+		&i.ClientSecretHash,
+		&i.Name,
+		&i.CreatedAt,
+		&i.RevokedAt,
+		&i.RedirectURIs,
+		&i.IsPublic,
+		&i.GrantTypes,
+		&i.AllowedScopes,
+		&i.AllowedAudiences,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+const getOAuthClient = `-- name: GetOAuthClient :one
+SELECT
+	id, client_id, client_secret_hash, name, created_at, revoked_at, redirect_uris, is_public, grant_types, allowed_scopes, allowed_audiences
+FROM
+	oauth_clients
+WHERE client_id = $1 AND revoked_at IS NULL
+`
+
+// GetOAuthClient return the client that is not revoked.
+func (q *usersRepository) GetOAuthClient(ctx context.Context, clientID string) (*pUsers.OAuthClient, error) {
+	row := q.db.QueryRow(ctx, getOAuthClient, clientID)
+	var i pUsers.OAuthClient
+	err := row.Scan(
+		&i.ID,
+		&i.ClientID,
+		&i.ClientSecretHash,
+		&i.Name,
+		&i.CreatedAt,
+		&i.RevokedAt,
+		&i.RedirectURIs,
+		&i.IsPublic,
+		&i.GrantTypes,
+		&i.AllowedScopes,
+		&i.AllowedAudiences,
+	)
+	return &i, err
+}
+
+const listOAuthClients = `-- name: ListOAuthClients :many
+SELECT
+	id, client_id, client_secret_hash, name, created_at, revoked_at, redirect_uris, is_public, grant_types, allowed_scopes, allowed_audiences
+FROM
+	oauth_clients
+ORDER BY created_at DESC
+`
+
+func (q *usersRepository) ListOAuthClients(ctx context.Context) ([]pUsers.OAuthClient, error) {
+	rows, err := q.db.Query(ctx, listOAuthClients)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []pUsers.OAuthClient
+	for rows.Next() {
+		var i pUsers.OAuthClient
+		if err := rows.Scan(
+			&i.ID,
+			&i.ClientID,
+			&i.ClientSecretHash,
+			&i.Name,
+			&i.CreatedAt,
+			&i.RevokedAt,
+			&i.RedirectURIs,
+			&i.IsPublic,
+			&i.GrantTypes,
+			&i.AllowedScopes,
+			&i.AllowedAudiences,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+const revokeOAuthClient = `-- name: RevokeOAuthClient :exec
+UPDATE
+	oauth_clients
+SET
+	revoked_at = NOW()
+WHERE client_id = $1 AND revoked_at IS NULL
+`
+
+func (q *usersRepository) RevokeOAuthClient(ctx context.Context, clientID string) error {
+	res, err := q.db.Exec(ctx, revokeOAuthClient, clientID)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
+
+const getOAuthConsent = `-- name: GetOAuthConsent :one
+SELECT
+	id, user_id, client_id, scope, created_at, updated_at
+FROM
+	oauth_consents
+WHERE user_id = $1 AND client_id = $2
+`
+
+func (q *usersRepository) GetOAuthConsent(ctx context.Context, arg pUsers.GetOAuthConsentParams) (*pUsers.OAuthConsent, error) {
+	row := q.db.QueryRow(ctx, getOAuthConsent, arg.UserID, arg.ClientID)
+	var i pUsers.OAuthConsent
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.ClientID,
+		&i.Scope,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return &i, err
+}
+
+const upsertOAuthConsent = `-- name: UpsertOAuthConsent :one
+INSERT INTO oauth_consents(
+    user_id,
+    client_id,
+    scope
+) VALUES (
+    $1, $2, $3
+) ON CONFLICT (user_id, client_id) DO UPDATE SET
+    scope = EXCLUDED.scope,
+    updated_at = NOW()
+RETURNING id, user_id, client_id, scope, created_at, updated_at
+`
+
+// UpsertOAuthConsent save the consent of the user to the client, previous
+// consent of the user to the client is replaced.
+func (q *usersRepository) UpsertOAuthConsent(ctx context.Context, arg pUsers.UpsertOAuthConsentParams) (*pUsers.OAuthConsent, error) {
+	row := q.db.QueryRow(ctx, upsertOAuthConsent, arg.UserID, arg.ClientID, arg.Scope)
+	var i pUsers.OAuthConsent
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.ClientID,
+		&i.Scope,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
@@ -0,0 +1,247 @@
+package repository
+
+import (
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createOAuthClientTest(t *testing.T) *pUsers.OAuthClient {
+	clientID, clientSecret, err := password.GenerateClientCredential()
+	require.NoError(t, err)
+
+	arg := pUsers.CreateOAuthClientParams{
+		ClientID:         clientID,
+		ClientSecretHash: password.HashClientSecret(clientSecret),
+		Name:             generator.CreateRandomString(7),
+		RedirectURIs:     []string{"https://example.com/callback", "http://localhost:8080/callback"},
+	}
+	res, err := repoTest.CreateOAuthClient(ctx, arg)
+	require.NoError(t, err)
+	assert.NotZero(t, res.ID)
+	assert.Equal(t, arg.ClientID, res.ClientID)
+	assert.Equal(t, arg.ClientSecretHash, res.ClientSecretHash)
+	assert.Equal(t, arg.Name, res.Name)
+	assert.False(t, res.CreatedAt.Time.IsZero())
+	assert.False(t, res.RevokedAt.Valid)
+	assert.Equal(t, arg.RedirectURIs, res.RedirectURIs)
+	assert.False(t, res.IsPublic)
+	assert.Equal(t, []string{pUsers.GrantTypeAuthorizationCode}, res.GrantTypes)
+	assert.Empty(t, res.AllowedScopes)
+	assert.Empty(t, res.AllowedAudiences)
+
+	return res
+}
+
+func TestCreateOAuthClient(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t)
+
+	testCases := []struct {
+		desc string
+		arg  pUsers.CreateOAuthClientParams
+	}{
+		{
+			desc: "failed_duplicate_client_id",
+			arg: pUsers.CreateOAuthClientParams{
+				ClientID:         client.ClientID,
+				ClientSecretHash: password.HashClientSecret(generator.CreateRandomString(10)),
+				Name:             generator.CreateRandomString(7),
+			},
+		}, {
+			desc: "failed_empty_name",
+			arg: pUsers.CreateOAuthClientParams{
+				ClientID:         generator.CreateRandomString(10),
+				ClientSecretHash: password.HashClientSecret(generator.CreateRandomString(10)),
+			},
+		}, {
+			desc: "failed_confidential_without_secret",
+			arg: pUsers.CreateOAuthClientParams{
+				ClientID: generator.CreateRandomString(10),
+				Name:     generator.CreateRandomString(7),
+			},
+		}, {
+			desc: "failed_public_with_secret",
+			arg: pUsers.CreateOAuthClientParams{
+				ClientID:         generator.CreateRandomString(10),
+				ClientSecretHash: password.HashClientSecret(generator.CreateRandomString(10)),
+				Name:             generator.CreateRandomString(7),
+				IsPublic:         true,
+			},
+		}, {
+			desc: "failed_public_client_credentials",
+			arg: pUsers.CreateOAuthClientParams{
+				ClientID:   generator.CreateRandomString(10),
+				Name:       generator.CreateRandomString(7),
+				IsPublic:   true,
+				GrantTypes: []string{pUsers.GrantTypeClientCredentials},
+			},
+		}, {
+			desc: "failed_public_token_exchange",
+			arg: pUsers.CreateOAuthClientParams{
+				ClientID:   generator.CreateRandomString(10),
+				Name:       generator.CreateRandomString(7),
+				IsPublic:   true,
+				GrantTypes: []string{pUsers.GrantTypeTokenExchange},
+			},
+		}, {
+			desc: "failed_unknown_grant_type",
+			arg: pUsers.CreateOAuthClientParams{
+				ClientID:         generator.CreateRandomString(10),
+				ClientSecretHash: password.HashClientSecret(generator.CreateRandomString(10)),
+				Name:             generator.CreateRandomString(7),
+				GrantTypes:       []string{"password"},
+			},
+		}, {
+			desc: "failed_secret_not_hashed",
+			arg: pUsers.CreateOAuthClientParams{
+				ClientID:         generator.CreateRandomString(10),
+				ClientSecretHash: []byte(generator.CreateRandomString(10)),
+				Name:             generator.CreateRandomString(7),
+			},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, err := repoTest.CreateOAuthClient(ctx, tC.arg)
+			require.Error(t, err)
+			assert.Nil(t, res)
+		})
+	}
+
+	t.Run("success_public", func(t *testing.T) {
+		arg := pUsers.CreateOAuthClientParams{
+			ClientID: generator.CreateRandomString(10),
+			Name:     generator.CreateRandomString(7),
+			IsPublic: true,
+		}
+		res, err := repoTest.CreateOAuthClient(ctx, arg)
+		require.NoError(t, err)
+		assert.True(t, res.IsPublic)
+		assert.Nil(t, res.ClientSecretHash)
+		assert.Empty(t, res.RedirectURIs)
+	})
+
+	t.Run("success_service_account", func(t *testing.T) {
+		arg := pUsers.CreateOAuthClientParams{
+			ClientID:         generator.CreateRandomString(10),
+			ClientSecretHash: password.HashClientSecret(generator.CreateRandomString(10)),
+			Name:             generator.CreateRandomString(7),
+			GrantTypes:       []string{pUsers.GrantTypeClientCredentials},
+			AllowedScopes:    []string{"users:read", "users:write"},
+		}
+		res, err := repoTest.CreateOAuthClient(ctx, arg)
+		require.NoError(t, err)
+		assert.Equal(t, arg.GrantTypes, res.GrantTypes)
+		assert.Equal(t, arg.AllowedScopes, res.AllowedScopes)
+	})
+
+	t.Run("success_token_exchange", func(t *testing.T) {
+		arg := pUsers.CreateOAuthClientParams{
+			ClientID:         generator.CreateRandomString(10),
+			ClientSecretHash: password.HashClientSecret(generator.CreateRandomString(10)),
+			Name:             generator.CreateRandomString(7),
+			GrantTypes:       []string{pUsers.GrantTypeTokenExchange},
+			AllowedAudiences: []string{"https://orders.example.com"},
+		}
+		res, err := repoTest.CreateOAuthClient(ctx, arg)
+		require.NoError(t, err)
+		assert.Equal(t, arg.GrantTypes, res.GrantTypes)
+		assert.Equal(t, arg.AllowedAudiences, res.AllowedAudiences)
+	})
+}
+
+func TestGetOAuthClient(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t)
+
+	res, err := repoTest.GetOAuthClient(ctx, client.ClientID)
+	require.NoError(t, err)
+	assert.Equal(t, client, res)
+
+	_, err = repoTest.GetOAuthClient(ctx, generator.CreateRandomString(10))
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	err = repoTest.RevokeOAuthClient(ctx, client.ClientID)
+	require.NoError(t, err)
+
+	// revoked client can't be used anymore
+	_, err = repoTest.GetOAuthClient(ctx, client.ClientID)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	err = repoTest.RevokeOAuthClient(ctx, client.ClientID)
+	require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+
+	clients, err := repoTest.ListOAuthClients(ctx)
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	assert.True(t, clients[0].RevokedAt.Valid)
+}
+
+func TestGetRefreshTokenByHash(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	refreshTokenHash := newRefreshTokenHashTest(t)
+	session := inserRefreshTokenTest(t, user.ID, refreshTokenHash)
+
+	res, err := repoTest.GetRefreshTokenByHash(ctx, refreshTokenHash)
+	require.NoError(t, err)
+	assert.Equal(t, session.ID, res.ID)
+	assert.Equal(t, user.ID, res.UserID)
+
+	_, err = repoTest.GetRefreshTokenByHash(ctx, newRefreshTokenHashTest(t))
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+}
+
+func TestUpsertOAuthConsent(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	client := createOAuthClientTest(t)
+	getArg := pUsers.GetOAuthConsentParams{
+		UserID:   user.ID,
+		ClientID: client.ClientID,
+	}
+
+	_, err = repoTest.GetOAuthConsent(ctx, getArg)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	arg := pUsers.UpsertOAuthConsentParams{
+		UserID:   user.ID,
+		ClientID: client.ClientID,
+		Scope:    "profile",
+	}
+	res, err := repoTest.UpsertOAuthConsent(ctx, arg)
+	require.NoError(t, err)
+	assert.Equal(t, arg.Scope, res.Scope)
+
+	// consent of the same user and client is replaced
+	arg.Scope = "profile email"
+	res2, err := repoTest.UpsertOAuthConsent(ctx, arg)
+	require.NoError(t, err)
+	assert.Equal(t, res.ID, res2.ID)
+	assert.Equal(t, arg.Scope, res2.Scope)
+
+	consent, err := repoTest.GetOAuthConsent(ctx, getArg)
+	require.NoError(t, err)
+	assert.Equal(t, res2, consent)
+
+	arg.ClientID = generator.CreateRandomString(10)
+	_, err = repoTest.UpsertOAuthConsent(ctx, arg)
+	require.Error(t, err)
+}
@@ -2,15 +2,15 @@ package repository
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
 	"errors"
 	"fmt"
+	"time"
 
 	db "github.com/dwiw96/ran-user-management/internal/db"
 	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 
-	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -18,15 +18,24 @@ import (
 type usersRepository struct {
 	db   db.DBTX
 	txDb *pgxpool.Pool
+	// kek decrypt and encrypt jwt private key in sec_m
+	kek *password.KeyEncryptionKey
 }
 
-func NewUsersRepository(db db.DBTX, txDb *pgxpool.Pool) pUsers.IRepository {
+func NewUsersRepository(db db.DBTX, txDb *pgxpool.Pool, kek *password.KeyEncryptionKey) pUsers.IRepository {
 	return &usersRepository{
 		db:   db,
 		txDb: txDb,
+		kek:  kek,
 	}
 }
 
+// durationToInterval convert duration into postgres interval, so lifetime can
+// be passed to the query instead of hard-coded in the query.
+func durationToInterval(d time.Duration) pgtype.Interval {
+	return pgtype.Interval{Microseconds: d.Microseconds(), Valid: true}
+}
+
 type transactionTx struct {
 	db *pgxpool.Pool
 }
@@ -43,7 +52,7 @@ func (r *usersRepository) ExecDbTx(ctx context.Context, fn func(*usersRepository
 		return fmt.Errorf("failed to start db transaction, err: %v", err)
 	}
 
-	q := &usersRepository{db: tx}
+	q := &usersRepository{db: tx, kek: r.kek}
 	err = fn(q)
 	defer func() {
 		if err != nil {
@@ -63,7 +72,7 @@ INSERT INTO users(
     hashed_password
 ) VALUES (
     $1, $2, $3
-) RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at
+) RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until
 `
 
 func (q *usersRepository) CreateUser(ctx context.Context, arg pUsers.CreateUserParams) (*pUsers.User, error) {
@@ -77,13 +86,16 @@ func (q *usersRepository) CreateUser(ctx context.Context, arg pUsers.CreateUserP
 		&i.CreatedAt,
 		&i.IsDeleted,
 		&i.DeletedAt,
+		&i.Role,
+		&i.EmailVerifiedAt,
+		&i.LockedUntil,
 	)
 	return &i, err
 }
 
 const getUserByEmail = `-- name: GetUserByEmail :one
 SELECT 
-	id, username, email, hashed_password, created_at, is_deleted, deleted_at 
+	id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until 
 FROM 
 	users 
 WHERE email = $1
@@ -100,6 +112,35 @@ func (q *usersRepository) GetUserByEmail(ctx context.Context, email string) (*pU
 		&i.CreatedAt,
 		&i.IsDeleted,
 		&i.DeletedAt,
+		&i.Role,
+		&i.EmailVerifiedAt,
+		&i.LockedUntil,
+	)
+	return &i, err
+}
+
+const getUserByID = `-- name: GetUserByID :one
+SELECT 
+	id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until 
+FROM 
+	users 
+WHERE id = $1
+`
+
+func (q *usersRepository) GetUserByID(ctx context.Context, id int32) (*pUsers.User, error) {
+	row := q.db.QueryRow(ctx, getUserByID, id)
+	var i pUsers.User
+	err := row.Scan(
+		&i.ID,
+		&i.Username,
+		&i.Email,
+		&i.HashedPassword,
+		&i.CreatedAt,
+		&i.IsDeleted,
+		&i.DeletedAt,
+		&i.Role,
+		&i.EmailVerifiedAt,
+		&i.LockedUntil,
 	)
 	return &i, err
 }
@@ -108,18 +149,20 @@ const updateUser = `-- name: UpdateUser :one
 UPDATE
     users
 SET
-    username = coalesce($1, username),
-    hashed_password = coalesce($2, hashed_password)
+    username = coalesce(NULLIF($1::VARCHAR, ''), username),
+    hashed_password = coalesce(NULLIF($2::VARCHAR, ''), hashed_password)
 WHERE
     id = $3
 AND (
-    $1::VARCHAR IS NOT NULL AND $1 IS DISTINCT FROM username OR
-    $2::VARCHAR IS NOT NULL AND $2 IS DISTINCT FROM hashed_password
+    $1::VARCHAR <> '' AND $1 IS DISTINCT FROM username OR
+    $2::VARCHAR <> '' AND $2 IS DISTINCT FROM hashed_password
 ) AND 
     is_deleted = FALSE
-RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at
+RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until
 `
 
+// UpdateUser update the field that is not empty, pgx.ErrNoRows is returned
+// when nothing is changed or the user is deleted.
 func (q *usersRepository) UpdateUser(ctx context.Context, arg pUsers.UpdateUserParams) (*pUsers.User, error) {
 	row := q.db.QueryRow(ctx, updateUser, arg.Username, arg.HashedPassword, arg.ID)
 	var i pUsers.User
@@ -131,10 +174,124 @@ func (q *usersRepository) UpdateUser(ctx context.Context, arg pUsers.UpdateUserP
 		&i.CreatedAt,
 		&i.IsDeleted,
 		&i.DeletedAt,
+		&i.Role,
+		&i.EmailVerifiedAt,
+		&i.LockedUntil,
+	)
+	return &i, err
+}
+
+const verifyUserEmail = `-- name: VerifyUserEmail :one
+UPDATE
+    users
+SET
+    email_verified_at = NOW()
+WHERE
+    id = $1
+AND email = $2
+AND is_deleted = FALSE
+AND email_verified_at IS NULL
+RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until
+`
+
+// VerifyUserEmail mark the email of the user as verified, pgx.ErrNoRows is
+// returned when the email is changed or already verified.
+func (q *usersRepository) VerifyUserEmail(ctx context.Context, arg pUsers.VerifyUserEmailParams) (*pUsers.User, error) {
+	row := q.db.QueryRow(ctx, verifyUserEmail, arg.ID, arg.Email)
+	var i pUsers.User
+	err := row.Scan(
+		&i.ID,
+		&i.Username,
+		&i.Email,
+		&i.HashedPassword,
+		&i.CreatedAt,
+		&i.IsDeleted,
+		&i.DeletedAt,
+		&i.Role,
+		&i.EmailVerifiedAt,
+		&i.LockedUntil,
+	)
+	return &i, err
+}
+
+const updateUserPassword = `-- name: UpdateUserPassword :one
+UPDATE
+    users
+SET
+    hashed_password = $2
+WHERE
+    id = $1
+AND is_deleted = FALSE
+RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until
+`
+
+// UpdateUserPassword replace the password of the user, pgx.ErrNoRows is
+// returned when the user is not found or deleted.
+func (q *usersRepository) UpdateUserPassword(ctx context.Context, arg pUsers.UpdateUserPasswordParams) (*pUsers.User, error) {
+	row := q.db.QueryRow(ctx, updateUserPassword, arg.ID, arg.HashedPassword)
+	var i pUsers.User
+	err := row.Scan(
+		&i.ID,
+		&i.Username,
+		&i.Email,
+		&i.HashedPassword,
+		&i.CreatedAt,
+		&i.IsDeleted,
+		&i.DeletedAt,
+		&i.Role,
+		&i.EmailVerifiedAt,
+		&i.LockedUntil,
 	)
 	return &i, err
 }
 
+const lockUser = `-- name: LockUser :exec
+UPDATE
+    users
+SET
+    locked_until = $2
+WHERE
+    id = $1
+AND is_deleted = FALSE
+`
+
+// LockUser refuse login of the user until arg.LockedUntil.
+func (q *usersRepository) LockUser(ctx context.Context, arg pUsers.LockUserParams) error {
+	res, err := q.db.Exec(ctx, lockUser, arg.ID, arg.LockedUntil)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
+
+const unlockUser = `-- name: UnlockUser :exec
+UPDATE
+    users
+SET
+    locked_until = NULL
+WHERE
+    id = $1
+AND is_deleted = FALSE
+`
+
+// UnlockUser allow the locked user to login again before the lock is expired,
+// ErrNoRowsAffected is returned when the user is not found.
+func (q *usersRepository) UnlockUser(ctx context.Context, id int32) error {
+	res, err := q.db.Exec(ctx, unlockUser, id)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
+
 const softDeleteUser = `-- name: SoftDeleteUser :exec
 UPDATE
     users
@@ -157,74 +314,358 @@ func (q *usersRepository) SoftDeleteUser(ctx context.Context, arg pUsers.SoftDel
 	return err
 }
 
-func (r *usersRepository) LoadKey(ctx context.Context) (key *rsa.PrivateKey, err error) {
-	query := "select private_key from sec_m"
-	var keyBytes []byte
-	rows, err := r.db.Query(ctx, query)
+const loadKey = `-- name: LoadKey :one
+SELECT
+	kid, alg, private_key, encrypted_dek, kek_id, status, created_at, retired_at
+FROM
+	sec_m
+WHERE
+	status = 'active'
+`
+
+// LoadKey return the active key that is used to sign new token
+func (r *usersRepository) LoadKey(ctx context.Context) (key *pUsers.SigningKey, err error) {
+	row := r.db.QueryRow(ctx, loadKey)
+	key, err = r.scanSigningKey(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errors.New("no private key found in database")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// scanSigningKey scan one row of sec_m and decrypt the private key
+func (r *usersRepository) scanSigningKey(row pgx.Row) (*pUsers.SigningKey, error) {
+	var i pUsers.SigningKey
+	var keyBytes, wrappedDEK []byte
+	var kekID pgtype.Text
+	err := row.Scan(
+		&i.Kid,
+		&i.Alg,
+		&keyBytes,
+		&wrappedDEK,
+		&kekID,
+		&i.Status,
+		&i.CreatedAt,
+		&i.RetiredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !kekID.Valid {
+		return nil, fmt.Errorf("private key is not encrypted, kid: %s", i.Kid)
+	}
+
+	i.PrivateKey, err = r.kek.OpenPrivateKey(i.Kid, kekID.String, keyBytes, wrappedDEK)
 	if err != nil {
-		errMsg := fmt.Errorf("failed to load private key, err: %v", err)
-		return nil, errMsg
+		return nil, err
 	}
+
+	return &i, nil
+}
+
+func (r *usersRepository) scanSigningKeys(rows pgx.Rows) ([]pUsers.SigningKey, error) {
 	defer rows.Close()
 
-	if rows.Next() {
-		err = rows.Scan(&keyBytes)
+	var items []pUsers.SigningKey
+	for rows.Next() {
+		i, err := r.scanSigningKey(rows)
 		if err != nil {
-			errMsg := fmt.Errorf("failed to scan private key, err: %v", err)
-			return nil, errMsg
+			return nil, err
 		}
+		items = append(items, *i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+const listSigningKeys = `-- name: ListSigningKeys :many
+SELECT
+	kid, alg, private_key, encrypted_dek, kek_id, status, created_at, retired_at
+FROM
+	sec_m
+ORDER BY
+	created_at DESC
+`
+
+func (r *usersRepository) ListSigningKeys(ctx context.Context) ([]pUsers.SigningKey, error) {
+	rows, err := r.db.Query(ctx, listSigningKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing keys, err: %v", err)
+	}
+
+	return r.scanSigningKeys(rows)
+}
+
+const listVerificationKeys = `-- name: ListVerificationKeys :many
+SELECT
+	kid, alg, private_key, encrypted_dek, kek_id, status, created_at, retired_at
+FROM
+	sec_m
+WHERE
+	status IN ('active', 'verifying')
+ORDER BY
+	created_at DESC
+`
+
+// ListVerificationKeys return keys that token signed with is still accepted,
+// the active key and the keys that is rotated out but not retired yet.
+func (r *usersRepository) ListVerificationKeys(ctx context.Context) ([]pUsers.SigningKey, error) {
+	rows, err := r.db.Query(ctx, listVerificationKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load verification keys, err: %v", err)
+	}
+
+	return r.scanSigningKeys(rows)
+}
+
+const demoteActiveSigningKey = `-- name: DemoteActiveSigningKey :exec
+UPDATE
+	sec_m
+SET
+	status = 'verifying'
+WHERE
+	status = 'active'
+`
+
+const insertSigningKey = `-- name: InsertSigningKey :one
+INSERT INTO sec_m(
+	kid,
+	alg,
+	private_key,
+	encrypted_dek,
+	kek_id,
+	status
+) VALUES (
+	$1, $2, $3, $4, $5, 'active'
+) RETURNING kid, alg, private_key, encrypted_dek, kek_id, status, created_at, retired_at
+`
+
+// RotateSigningKey save new key as the active key, the previous active key is
+// kept as verifying key so token signed with it is still valid until it expired.
+func (r *usersRepository) RotateSigningKey(ctx context.Context, arg pUsers.InsertSigningKeyParams) (key *pUsers.SigningKey, err error) {
+	keyBytes, wrappedDEK, err := r.kek.SealPrivateKey(arg.Kid, arg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt private key, err: %v", err)
+	}
 
-		privateKey, err := x509.ParsePKCS1PrivateKey(keyBytes)
+	err = r.ExecDbTx(ctx, func(q *usersRepository) error {
+		_, err := q.db.Exec(ctx, demoteActiveSigningKey)
 		if err != nil {
-			errMsg := fmt.Errorf("failed to parse private key, err: %v", err)
-			return nil, errMsg
+			return err
 		}
 
-		return privateKey, nil
+		row := q.db.QueryRow(ctx, insertSigningKey, arg.Kid, arg.Alg, keyBytes, wrappedDEK, r.kek.ID)
+		key, err = q.scanSigningKey(row)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("no private key found in database")
+	return key, nil
 }
 
-const insertRefreshToken = `-- name: InsertRefreshToken :exec
-INSERT INTO 
-    refresh_token_whitelist(user_id, refresh_token, expires_at) 
-VALUES(
-    $1, $2, NOW() + INTERVAL '5 minute'
-)
+const retireSigningKey = `-- name: RetireSigningKey :exec
+UPDATE
+	sec_m
+SET
+	status = 'retired',
+	retired_at = NOW()
+WHERE
+	kid = $1
+AND status = 'verifying'
 `
 
-func (q *usersRepository) InsertRefreshToken(ctx context.Context, arg pUsers.InsertRefreshTokenParams) error {
-	res, err := q.db.Exec(ctx, insertRefreshToken, arg.UserID, arg.RefreshToken)
+// RetireSigningKey stop verifying token signed with the key, active key can't
+// be retired, it must be rotated first.
+func (r *usersRepository) RetireSigningKey(ctx context.Context, kid string) error {
+	res, err := r.db.Exec(ctx, retireSigningKey, kid)
+	if err != nil {
+		return err
+	}
 
 	if res.RowsAffected() == 0 {
 		return pUsers.ErrNoRowsAffected
 	}
 
-	return err
+	return nil
+}
+
+const insertRefreshToken = `-- name: InsertRefreshToken :one
+INSERT INTO 
+    refresh_token_whitelist(user_id, refresh_token_hash, expires_at, device_name, user_agent, ip_address, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr) 
+VALUES(
+    $1, $2, NOW() + LEAST($7::INTERVAL, $8::INTERVAL), $3, $4, $5, COALESCE($6::UUID, gen_random_uuid()), $9, NOW() + $8::INTERVAL, $10, $11, $12, COALESCE($13::TEXT[], '{}')
+) RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr
+`
+
+// InsertRefreshToken create new session, new family is generated when
+// arg.FamilyID is not valid.
+func (q *usersRepository) InsertRefreshToken(ctx context.Context, arg pUsers.InsertRefreshTokenParams) (*pUsers.RefreshTokenWhitelist, error) {
+	row := q.db.QueryRow(ctx, insertRefreshToken, arg.UserID, arg.RefreshTokenHash, arg.DeviceName, arg.UserAgent, arg.IPAddress, arg.FamilyID,
+		durationToInterval(arg.RefreshTokenTTL), durationToInterval(arg.AbsoluteLifetime), arg.LifetimeKey, arg.ClientID, arg.Scope, arg.AuthTime, arg.AMR)
+	var i pUsers.RefreshTokenWhitelist
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.RefreshTokenHash,
+		&i.ExpiresAt,
+		&i.CreatedAt,
+		&i.DeviceName,
+		&i.UserAgent,
+		&i.IPAddress,
+		&i.LastUsedAt,
+		&i.AccessTokenID,
+		&i.AccessTokenExpiresAt,
+		&i.FamilyID,
+		&i.LifetimeKey,
+		&i.AbsoluteExpiresAt,
+		&i.ClientID,
+		&i.Scope,
+		&i.AuthTime,
+		&i.AMR,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
 }
 
 const getRefreshToken = `-- name: GetRefreshToken :one
-SELECT id, user_id, refresh_token, expires_at, created_at FROM refresh_token_whitelist WHERE user_id = $1 AND refresh_token = $2
+SELECT 
+	id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr 
+FROM 
+	refresh_token_whitelist 
+WHERE user_id = $1 AND refresh_token_hash = $2
 `
 
 func (q *usersRepository) GetRefreshToken(ctx context.Context, arg pUsers.GetRefreshTokenParams) (*pUsers.RefreshTokenWhitelist, error) {
-	row := q.db.QueryRow(ctx, getRefreshToken, arg.UserID, arg.RefreshToken)
+	row := q.db.QueryRow(ctx, getRefreshToken, arg.UserID, arg.RefreshTokenHash)
+	var i pUsers.RefreshTokenWhitelist
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.RefreshTokenHash,
+		&i.ExpiresAt,
+		&i.CreatedAt,
+		&i.DeviceName,
+		&i.UserAgent,
+		&i.IPAddress,
+		&i.LastUsedAt,
+		&i.AccessTokenID,
+		&i.AccessTokenExpiresAt,
+		&i.FamilyID,
+		&i.LifetimeKey,
+		&i.AbsoluteExpiresAt,
+		&i.ClientID,
+		&i.Scope,
+		&i.AuthTime,
+		&i.AMR,
+	)
+	return &i, err
+}
+
+const getRefreshTokenByHash = `-- name: GetRefreshTokenByHash :one
+SELECT 
+	id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr 
+FROM 
+	refresh_token_whitelist 
+WHERE refresh_token_hash = $1
+`
+
+// GetRefreshTokenByHash lookup the session only by refresh token digest, it's
+// used by oauth endpoint that only receive the refresh token.
+func (q *usersRepository) GetRefreshTokenByHash(ctx context.Context, refreshTokenHash []byte) (*pUsers.RefreshTokenWhitelist, error) {
+	row := q.db.QueryRow(ctx, getRefreshTokenByHash, refreshTokenHash)
 	var i pUsers.RefreshTokenWhitelist
 	err := row.Scan(
 		&i.ID,
 		&i.UserID,
-		&i.RefreshToken,
+		&i.RefreshTokenHash,
 		&i.ExpiresAt,
 		&i.CreatedAt,
+		&i.DeviceName,
+		&i.UserAgent,
+		&i.IPAddress,
+		&i.LastUsedAt,
+		&i.AccessTokenID,
+		&i.AccessTokenExpiresAt,
+		&i.FamilyID,
+		&i.LifetimeKey,
+		&i.AbsoluteExpiresAt,
+		&i.ClientID,
+		&i.Scope,
+		&i.AuthTime,
+		&i.AMR,
 	)
 	return &i, err
 }
 
+const listRefreshTokenByUserID = `-- name: ListRefreshTokenByUserID :many
+SELECT 
+	id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr 
+FROM 
+	refresh_token_whitelist 
+WHERE user_id = $1 AND expires_at > NOW()
+ORDER BY last_used_at DESC
+`
+
+// ListRefreshTokenByUserID return all active sessions of the user.
+func (q *usersRepository) ListRefreshTokenByUserID(ctx context.Context, userID int32) ([]pUsers.RefreshTokenWhitelist, error) {
+	rows, err := q.db.Query(ctx, listRefreshTokenByUserID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []pUsers.RefreshTokenWhitelist
+	for rows.Next() {
+		var i pUsers.RefreshTokenWhitelist
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.RefreshTokenHash,
+			&i.ExpiresAt,
+			&i.CreatedAt,
+			&i.DeviceName,
+			&i.UserAgent,
+			&i.IPAddress,
+			&i.LastUsedAt,
+			&i.AccessTokenID,
+			&i.AccessTokenExpiresAt,
+			&i.FamilyID,
+			&i.LifetimeKey,
+			&i.AbsoluteExpiresAt,
+			&i.ClientID,
+			&i.Scope,
+			&i.AuthTime,
+			&i.AMR,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
 const deleteRefreshToken = `-- name: DeleteRefreshToken :exec
 DELETE FROM refresh_token_whitelist WHERE user_id = $1
 `
 
+// DeleteRefreshToken delete all sessions of the user.
 func (q *usersRepository) DeleteRefreshToken(ctx context.Context, userID int32) error {
 	res, err := q.db.Exec(ctx, deleteRefreshToken, userID)
 
@@ -235,26 +676,312 @@ func (q *usersRepository) DeleteRefreshToken(ctx context.Context, userID int32)
 	return err
 }
 
-func (r *usersRepository) UpdateRefreshToken(ctx context.Context, userID int32, refreshToken uuid.UUID) (err error) {
-	r.ExecDbTx(ctx, func(tr *usersRepository) error {
-		err = tr.DeleteRefreshToken(ctx, userID)
-		if err != nil {
-			return err
+const deleteRefreshTokenByID = `-- name: DeleteRefreshTokenByID :one
+DELETE FROM refresh_token_whitelist WHERE id = $1 AND user_id = $2
+RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr
+`
+
+// DeleteRefreshTokenByID delete only one session of the user and return the
+// deleted session.
+func (q *usersRepository) DeleteRefreshTokenByID(ctx context.Context, arg pUsers.DeleteRefreshTokenByIDParams) (*pUsers.RefreshTokenWhitelist, error) {
+	row := q.db.QueryRow(ctx, deleteRefreshTokenByID, arg.ID, arg.UserID)
+	var i pUsers.RefreshTokenWhitelist
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.RefreshTokenHash,
+		&i.ExpiresAt,
+		&i.CreatedAt,
+		&i.DeviceName,
+		&i.UserAgent,
+		&i.IPAddress,
+		&i.LastUsedAt,
+		&i.AccessTokenID,
+		&i.AccessTokenExpiresAt,
+		&i.FamilyID,
+		&i.LifetimeKey,
+		&i.AbsoluteExpiresAt,
+		&i.ClientID,
+		&i.Scope,
+		&i.AuthTime,
+		&i.AMR,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, pUsers.ErrNoRowsAffected
+		}
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+const deleteOtherRefreshToken = `-- name: DeleteOtherRefreshToken :many
+DELETE FROM refresh_token_whitelist WHERE user_id = $2 AND id <> $1
+RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr
+`
+
+// DeleteOtherRefreshToken delete all sessions of the user except the session
+// with arg.ID and return the deleted sessions.
+func (q *usersRepository) DeleteOtherRefreshToken(ctx context.Context, arg pUsers.DeleteRefreshTokenByIDParams) ([]pUsers.RefreshTokenWhitelist, error) {
+	rows, err := q.db.Query(ctx, deleteOtherRefreshToken, arg.ID, arg.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []pUsers.RefreshTokenWhitelist
+	for rows.Next() {
+		var i pUsers.RefreshTokenWhitelist
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.RefreshTokenHash,
+			&i.ExpiresAt,
+			&i.CreatedAt,
+			&i.DeviceName,
+			&i.UserAgent,
+			&i.IPAddress,
+			&i.LastUsedAt,
+			&i.AccessTokenID,
+			&i.AccessTokenExpiresAt,
+			&i.FamilyID,
+			&i.LifetimeKey,
+			&i.AbsoluteExpiresAt,
+			&i.ClientID,
+			&i.Scope,
+			&i.AuthTime,
+			&i.AMR,
+		); err != nil {
+			return nil, err
 		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		arg := pUsers.InsertRefreshTokenParams{
-			UserID:       userID,
-			RefreshToken: pgtype.UUID{Bytes: refreshToken, Valid: true},
+	return items, nil
+}
+
+const deleteAllRefreshToken = `-- name: DeleteAllRefreshToken :many
+DELETE FROM refresh_token_whitelist WHERE user_id = $1
+RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr
+`
+
+// DeleteAllRefreshToken delete all sessions of the user and return the
+// deleted sessions, so their access token can be blocked.
+func (q *usersRepository) DeleteAllRefreshToken(ctx context.Context, userID int32) ([]pUsers.RefreshTokenWhitelist, error) {
+	rows, err := q.db.Query(ctx, deleteAllRefreshToken, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []pUsers.RefreshTokenWhitelist
+	for rows.Next() {
+		var i pUsers.RefreshTokenWhitelist
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.RefreshTokenHash,
+			&i.ExpiresAt,
+			&i.CreatedAt,
+			&i.DeviceName,
+			&i.UserAgent,
+			&i.IPAddress,
+			&i.LastUsedAt,
+			&i.AccessTokenID,
+			&i.AccessTokenExpiresAt,
+			&i.FamilyID,
+			&i.LifetimeKey,
+			&i.AbsoluteExpiresAt,
+			&i.ClientID,
+			&i.Scope,
+			&i.AuthTime,
+			&i.AMR,
+		); err != nil {
+			return nil, err
 		}
-		err = tr.InsertRefreshToken(ctx, arg)
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+const updateRefreshToken = `-- name: UpdateRefreshToken :exec
+UPDATE
+    refresh_token_whitelist
+SET
+    refresh_token_hash = $4,
+    expires_at = LEAST(NOW() + $7::INTERVAL, absolute_expires_at),
+    last_used_at = NOW(),
+    access_token_id = $5,
+    access_token_expires_at = $6
+WHERE
+    id = $1
+AND user_id = $2
+AND refresh_token_hash = $3
+`
+
+const insertRefreshTokenHistory = `-- name: InsertRefreshTokenHistory :exec
+INSERT INTO
+    refresh_token_history(user_id, family_id, refresh_token_hash)
+VALUES(
+    $1, $2, $3
+)
+`
+
+// UpdateRefreshToken rotate the refresh token of one session, the old refresh
+// token must be match so only the token being presented is rotated. The old
+// refresh token is saved into history so its reuse can be detected.
+func (r *usersRepository) UpdateRefreshToken(ctx context.Context, arg pUsers.UpdateRefreshTokenParams) error {
+	return r.ExecDbTx(ctx, func(tr *usersRepository) error {
+		res, err := tr.db.Exec(ctx, updateRefreshToken, arg.ID, arg.UserID, arg.RefreshTokenHash, arg.NewRefreshTokenHash, arg.AccessTokenID, arg.AccessTokenExpiresAt, durationToInterval(arg.RefreshTokenTTL))
 		if err != nil {
 			return err
 		}
+		if res.RowsAffected() == 0 {
+			return pUsers.ErrNoRowsAffected
+		}
 
-		return nil
+		_, err = tr.db.Exec(ctx, insertRefreshTokenHistory, arg.UserID, arg.FamilyID, arg.RefreshTokenHash)
+		return err
 	})
+}
 
-	return nil
+const getRotatedRefreshToken = `-- name: GetRotatedRefreshToken :one
+SELECT 
+	id, user_id, family_id, refresh_token_hash, rotated_at 
+FROM 
+	refresh_token_history 
+WHERE user_id = $1 AND refresh_token_hash = $2
+`
+
+func (q *usersRepository) GetRotatedRefreshToken(ctx context.Context, arg pUsers.GetRefreshTokenParams) (*pUsers.RefreshTokenHistory, error) {
+	row := q.db.QueryRow(ctx, getRotatedRefreshToken, arg.UserID, arg.RefreshTokenHash)
+	var i pUsers.RefreshTokenHistory
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.FamilyID,
+		&i.RefreshTokenHash,
+		&i.RotatedAt,
+	)
+	return &i, err
+}
+
+const getRotatedRefreshTokenByHash = `-- name: GetRotatedRefreshTokenByHash :one
+SELECT 
+	id, user_id, family_id, refresh_token_hash, rotated_at 
+FROM 
+	refresh_token_history 
+WHERE refresh_token_hash = $1
+`
+
+// GetRotatedRefreshTokenByHash lookup rotated refresh token only by its
+// digest, it's used when the refresh token is sent without access token.
+func (q *usersRepository) GetRotatedRefreshTokenByHash(ctx context.Context, refreshTokenHash []byte) (*pUsers.RefreshTokenHistory, error) {
+	row := q.db.QueryRow(ctx, getRotatedRefreshTokenByHash, refreshTokenHash)
+	var i pUsers.RefreshTokenHistory
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.FamilyID,
+		&i.RefreshTokenHash,
+		&i.RotatedAt,
+	)
+	return &i, err
+}
+
+const revokeRefreshTokenFamily = `-- name: RevokeRefreshTokenFamily :many
+DELETE FROM refresh_token_whitelist WHERE user_id = $1 AND family_id = $2
+RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr
+`
+
+// RevokeRefreshTokenFamily delete every refresh token of the family and return
+// the deleted sessions.
+func (q *usersRepository) RevokeRefreshTokenFamily(ctx context.Context, arg pUsers.RevokeRefreshTokenFamilyParams) ([]pUsers.RefreshTokenWhitelist, error) {
+	rows, err := q.db.Query(ctx, revokeRefreshTokenFamily, arg.UserID, arg.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []pUsers.RefreshTokenWhitelist
+	for rows.Next() {
+		var i pUsers.RefreshTokenWhitelist
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.RefreshTokenHash,
+			&i.ExpiresAt,
+			&i.CreatedAt,
+			&i.DeviceName,
+			&i.UserAgent,
+			&i.IPAddress,
+			&i.LastUsedAt,
+			&i.AccessTokenID,
+			&i.AccessTokenExpiresAt,
+			&i.FamilyID,
+			&i.LifetimeKey,
+			&i.AbsoluteExpiresAt,
+			&i.ClientID,
+			&i.Scope,
+			&i.AuthTime,
+			&i.AMR,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+const insertSecurityEvent = `-- name: InsertSecurityEvent :exec
+INSERT INTO
+    security_events(user_id, event_type, description)
+VALUES(
+    $1, $2, $3
+)
+`
+
+func (q *usersRepository) InsertSecurityEvent(ctx context.Context, arg pUsers.InsertSecurityEventParams) error {
+	res, err := q.db.Exec(ctx, insertSecurityEvent, arg.UserID, arg.EventType, arg.Description)
+
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return err
+}
+
+const updateSessionAccessToken = `-- name: UpdateSessionAccessToken :exec
+UPDATE
+    refresh_token_whitelist
+SET
+    access_token_id = $3,
+    access_token_expires_at = $4
+WHERE
+    id = $1
+AND user_id = $2
+`
+
+func (q *usersRepository) UpdateSessionAccessToken(ctx context.Context, arg pUsers.UpdateSessionAccessTokenParams) error {
+	res, err := q.db.Exec(ctx, updateSessionAccessToken, arg.ID, arg.UserID, arg.AccessTokenID, arg.AccessTokenExpiresAt)
+
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return err
 }
 
 const updateUserIsDeleted = `-- name: UpdateUserIsDeleted :one
@@ -264,12 +991,14 @@ SET
     is_deleted = FALSE,
 	username = $1,
 	hashed_password = $2,
-	created_at = NOW()
+	created_at = NOW(),
+	email_verified_at = NULL,
+	locked_until = NULL
 WHERE
     email = $3
 AND
 	is_deleted = TRUE
-RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at
+RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until
 `
 
 func (q *usersRepository) UpdateUserIsDeleted(ctx context.Context, arg pUsers.CreateUserParams) (*pUsers.User, error) {
@@ -283,6 +1012,9 @@ func (q *usersRepository) UpdateUserIsDeleted(ctx context.Context, arg pUsers.Cr
 		&i.CreatedAt,
 		&i.IsDeleted,
 		&i.DeletedAt,
+		&i.Role,
+		&i.EmailVerifiedAt,
+		&i.LockedUntil,
 	)
 	return &i, err
 }
@@ -294,6 +1026,18 @@ func (r *usersRepository) DeleteUserTx(ctx context.Context, arg pUsers.SoftDelet
 			return err
 		}
 
+		// the email can be signed up again, so MFA and passkeys of the
+		// deleted user are not kept
+		err = ar.DeleteTOTP(ctx, arg.ID)
+		if err != nil && err != pUsers.ErrNoRowsAffected {
+			return err
+		}
+
+		err = ar.DeleteUserWebAuthnCredentials(ctx, arg.ID)
+		if err != nil {
+			return err
+		}
+
 		err = ar.SoftDeleteUser(ctx, arg)
 		if err != nil {
 			return err
@@ -303,3 +1047,51 @@ func (r *usersRepository) DeleteUserTx(ctx context.Context, arg pUsers.SoftDelet
 	})
 	return err
 }
+
+// ResetPasswordTx replace the password of the user and delete all sessions of
+// the user in one transaction, the deleted sessions are returned so their
+// access token can be blocked.
+func (r *usersRepository) ResetPasswordTx(ctx context.Context, arg pUsers.UpdateUserPasswordParams) (sessions []pUsers.RefreshTokenWhitelist, err error) {
+	err = r.ExecDbTx(ctx, func(ar *usersRepository) error {
+		_, err := ar.UpdateUserPassword(ctx, arg)
+		if err != nil {
+			return err
+		}
+
+		sessions, err = ar.DeleteAllRefreshToken(ctx, arg.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// ChangePasswordTx replace the password of the user and delete all sessions
+// of the user except the current session in one transaction, the deleted
+// sessions are returned so their access token can be blocked.
+func (r *usersRepository) ChangePasswordTx(ctx context.Context, arg pUsers.ChangePasswordParams) (sessions []pUsers.RefreshTokenWhitelist, err error) {
+	err = r.ExecDbTx(ctx, func(ar *usersRepository) error {
+		passwordArg := pUsers.UpdateUserPasswordParams{
+			ID:             arg.ID,
+			HashedPassword: arg.HashedPassword,
+		}
+		_, err := ar.UpdateUserPassword(ctx, passwordArg)
+		if err != nil {
+			return err
+		}
+
+		sessionArg := pUsers.DeleteRefreshTokenByIDParams{
+			ID:     arg.SessionID,
+			UserID: arg.ID,
+		}
+		sessions, err = ar.DeleteOtherRefreshToken(ctx, sessionArg)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
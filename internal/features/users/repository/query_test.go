@@ -13,6 +13,7 @@ import (
 	testUtils "github.com/dwiw96/ran-user-management/testutils"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
@@ -31,9 +32,9 @@ func TestMain(m *testing.M) {
 
 	schemaCleanup := testUtils.SetupDB("test_repo_users")
 
-	password.JwtInit(poolTest, ctx)
+	password.JwtInit(poolTest, ctx, password.DefaultSigningAlg, testUtils.GetKeyEncryptionKey())
 
-	repoTest = NewUsersRepository(poolTest, poolTest)
+	repoTest = NewUsersRepository(poolTest, poolTest, testUtils.GetKeyEncryptionKey())
 
 	exitTest := m.Run()
 
@@ -65,6 +66,8 @@ func createRandomUser(t *testing.T) (res *pUsers.User) {
 	assert.False(t, res.CreatedAt.Time.IsZero())
 	assert.False(t, res.IsDeleted.Bool)
 	assert.False(t, res.DeletedAt.Valid)
+	assert.False(t, res.EmailVerifiedAt.Valid)
+	assert.False(t, res.LockedUntil.Valid)
 
 	return res
 }
@@ -213,33 +216,52 @@ func TestUpdateUser(t *testing.T) {
 				Username:       usernameSuccess,
 				Email:          user.Email,
 				HashedPassword: hashedPasswordSuccess,
+				Role:           user.Role,
 				CreatedAt:      user.CreatedAt,
 				IsDeleted:      user.IsDeleted,
 				DeletedAt:      user.DeletedAt,
 			},
 			err: false,
 		}, {
-			desc: "failed_empty_username",
+			// empty field is not changed
+			desc: "success_empty_username",
 			arg: pUsers.UpdateUserParams{
 				ID:             user.ID,
 				HashedPassword: hashedPasswordEmptyUsername,
 			},
 			ans: pUsers.User{
-				ID:             0,
-				Username:       "",
+				ID:             user.ID,
+				Username:       usernameSuccess,
+				Email:          user.Email,
 				HashedPassword: hashedPasswordEmptyUsername,
+				Role:           user.Role,
+				CreatedAt:      user.CreatedAt,
+				IsDeleted:      user.IsDeleted,
+				DeletedAt:      user.DeletedAt,
 			},
-			err: true,
+			err: false,
 		}, {
-			desc: "failed_empty_hashed_password",
+			desc: "success_empty_hashed_password",
 			arg: pUsers.UpdateUserParams{
 				ID:       user.ID,
 				Username: usernameEmptyHashedPassword,
 			},
 			ans: pUsers.User{
-				ID:             0,
+				ID:             user.ID,
 				Username:       usernameEmptyHashedPassword,
-				HashedPassword: "",
+				Email:          user.Email,
+				HashedPassword: hashedPasswordEmptyUsername,
+				Role:           user.Role,
+				CreatedAt:      user.CreatedAt,
+				IsDeleted:      user.IsDeleted,
+				DeletedAt:      user.DeletedAt,
+			},
+			err: false,
+		}, {
+			desc: "failed_nothing_changed",
+			arg: pUsers.UpdateUserParams{
+				ID:       user.ID,
+				Username: usernameEmptyHashedPassword,
 			},
 			err: true,
 		}, {
@@ -341,6 +363,189 @@ func TestSoftDeleteUser(t *testing.T) {
 	}
 }
 
+func TestVerifyUserEmail(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	deletedUser := createRandomUser(t)
+	err = repoTest.SoftDeleteUser(ctx, pUsers.SoftDeleteUserParams{ID: deletedUser.ID, Email: deletedUser.Email})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc string
+		arg  pUsers.VerifyUserEmailParams
+		err  bool
+	}{
+		{
+			desc: "success",
+			arg:  pUsers.VerifyUserEmailParams{ID: user.ID, Email: user.Email},
+		}, {
+			desc: "failed_already_verified",
+			arg:  pUsers.VerifyUserEmailParams{ID: user.ID, Email: user.Email},
+			err:  true,
+		}, {
+			desc: "failed_other_email",
+			arg:  pUsers.VerifyUserEmailParams{ID: user.ID, Email: "a" + user.Email},
+			err:  true,
+		}, {
+			desc: "failed_deleted_user",
+			arg:  pUsers.VerifyUserEmailParams{ID: deletedUser.ID, Email: deletedUser.Email},
+			err:  true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, err := repoTest.VerifyUserEmail(ctx, tC.arg)
+			if tC.err {
+				require.ErrorIs(t, err, pgx.ErrNoRows)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, res.ID)
+			assert.True(t, res.EmailVerifiedAt.Valid)
+
+			res, err = repoTest.GetUserByID(ctx, user.ID)
+			require.NoError(t, err)
+			assert.True(t, res.EmailVerifiedAt.Valid)
+		})
+	}
+}
+
+func TestUpdateUserPassword(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	deletedUser := createRandomUser(t)
+	err = repoTest.SoftDeleteUser(ctx, pUsers.SoftDeleteUserParams{ID: deletedUser.ID, Email: deletedUser.Email})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc string
+		arg  pUsers.UpdateUserPasswordParams
+		err  bool
+	}{
+		{
+			desc: "success",
+			arg:  pUsers.UpdateUserPasswordParams{ID: user.ID, HashedPassword: generator.CreateRandomString(20)},
+		}, {
+			desc: "failed_deleted_user",
+			arg:  pUsers.UpdateUserPasswordParams{ID: deletedUser.ID, HashedPassword: generator.CreateRandomString(20)},
+			err:  true,
+		}, {
+			desc: "failed_unknown_user",
+			arg:  pUsers.UpdateUserPasswordParams{ID: deletedUser.ID + 100, HashedPassword: generator.CreateRandomString(20)},
+			err:  true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, err := repoTest.UpdateUserPassword(ctx, tC.arg)
+			if tC.err {
+				require.ErrorIs(t, err, pgx.ErrNoRows)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tC.arg.HashedPassword, res.HashedPassword)
+			// other column is not changed
+			assert.Equal(t, user.Username, res.Username)
+			assert.Equal(t, user.Email, res.Email)
+		})
+	}
+}
+
+func TestLockUser(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	deletedUser := createRandomUser(t)
+	err = repoTest.SoftDeleteUser(ctx, pUsers.SoftDeleteUserParams{ID: deletedUser.ID, Email: deletedUser.Email})
+	require.NoError(t, err)
+
+	lockedUntil := pgtype.Timestamp{Time: time.Now().UTC().Add(15 * time.Minute), Valid: true}
+
+	testCases := []struct {
+		desc string
+		id   int32
+		err  bool
+	}{
+		{
+			desc: "success",
+			id:   user.ID,
+		}, {
+			desc: "failed_deleted_user",
+			id:   deletedUser.ID,
+			err:  true,
+		}, {
+			desc: "failed_unknown_user",
+			id:   deletedUser.ID + 100,
+			err:  true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := repoTest.LockUser(ctx, pUsers.LockUserParams{ID: tC.id, LockedUntil: lockedUntil})
+			if tC.err {
+				require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+				return
+			}
+			require.NoError(t, err)
+
+			res, err := repoTest.GetUserByID(ctx, tC.id)
+			require.NoError(t, err)
+			require.True(t, res.LockedUntil.Valid)
+			assert.WithinDuration(t, lockedUntil.Time, res.LockedUntil.Time, time.Second)
+		})
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	err = repoTest.LockUser(ctx, pUsers.LockUserParams{ID: user.ID, LockedUntil: pgtype.Timestamp{Time: time.Now().UTC().Add(time.Hour), Valid: true}})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc string
+		id   int32
+		err  bool
+	}{
+		{
+			desc: "success",
+			id:   user.ID,
+		}, {
+			desc: "success_not_locked_user",
+			id:   user.ID,
+		}, {
+			desc: "failed_unknown_user",
+			id:   user.ID + 100,
+			err:  true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := repoTest.UnlockUser(ctx, tC.id)
+			if tC.err {
+				require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+				return
+			}
+			require.NoError(t, err)
+
+			res, err := repoTest.GetUserByID(ctx, tC.id)
+			require.NoError(t, err)
+			assert.False(t, res.LockedUntil.Valid)
+		})
+	}
+}
+
 func TestLoadKey(t *testing.T) {
 	err := testUtils.DeleteSchemaTestData(poolTest)
 	require.NoError(t, err)
@@ -350,21 +555,115 @@ func TestLoadKey(t *testing.T) {
 	require.NotNil(t, res)
 }
 
-func inserRefreshTokenTest(t *testing.T, userID int32, refreshToken uuid.UUID) {
+func TestRotateSigningKey(t *testing.T) {
+	oldKey, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	privateKey, kid, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+
+	arg := pUsers.InsertSigningKeyParams{
+		Kid:        kid,
+		Alg:        password.SigningAlgES256,
+		PrivateKey: privateKey,
+	}
+	res, err := repoTest.RotateSigningKey(ctx, arg)
+	require.NoError(t, err)
+	assert.Equal(t, kid, res.Kid)
+	assert.Equal(t, password.SigningAlgES256, res.Alg)
+	assert.Equal(t, pUsers.SigningKeyStatusActive, res.Status)
+	assert.Equal(t, privateKey.Public(), res.PrivateKey.Public())
+
+	// private key is saved encrypted
+	var storedKey []byte
+	var kekID string
+	err = poolTest.QueryRow(ctx, "SELECT private_key, kek_id FROM sec_m WHERE kid = $1", kid).Scan(&storedKey, &kekID)
+	require.NoError(t, err)
+	assert.Equal(t, testUtils.GetKeyEncryptionKey().ID, kekID)
+	_, err = password.ParsePrivateKey(storedKey)
+	require.Error(t, err)
+
+	activeKey, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, kid, activeKey.Kid)
+
+	verificationKeys, err := repoTest.ListVerificationKeys(ctx)
+	require.NoError(t, err)
+	statuses := make(map[string]string)
+	for _, v := range verificationKeys {
+		statuses[v.Kid] = v.Status
+	}
+	assert.Equal(t, pUsers.SigningKeyStatusActive, statuses[kid])
+	assert.Equal(t, pUsers.SigningKeyStatusVerifying, statuses[oldKey.Kid])
+
+	t.Run("error_retire_active_key", func(t *testing.T) {
+		err = repoTest.RetireSigningKey(ctx, kid)
+		require.Error(t, err)
+		assert.Equal(t, pUsers.ErrNoRowsAffected, err)
+	})
+
+	t.Run("success_retire_verifying_key", func(t *testing.T) {
+		err = repoTest.RetireSigningKey(ctx, oldKey.Kid)
+		require.NoError(t, err)
+
+		verificationKeys, err := repoTest.ListVerificationKeys(ctx)
+		require.NoError(t, err)
+		for _, v := range verificationKeys {
+			assert.NotEqual(t, oldKey.Kid, v.Kid)
+		}
+
+		keys, err := repoTest.ListSigningKeys(ctx)
+		require.NoError(t, err)
+		for _, v := range keys {
+			if v.Kid == oldKey.Kid {
+				assert.Equal(t, pUsers.SigningKeyStatusRetired, v.Status)
+				assert.True(t, v.RetiredAt.Valid)
+			}
+		}
+	})
+
+	t.Run("error_duplicate_kid", func(t *testing.T) {
+		_, err = repoTest.RotateSigningKey(ctx, arg)
+		require.Error(t, err)
+
+		// failed rotation doesn't demote the active key
+		activeKey, err := repoTest.LoadKey(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, kid, activeKey.Kid)
+	})
+}
+
+func newRefreshTokenHashTest(t *testing.T) []byte {
+	refreshToken, err := password.GenerateRefreshToken()
+	require.NoError(t, err)
+
+	return password.HashRefreshToken(refreshToken)
+}
+
+func inserRefreshTokenTest(t *testing.T, userID int32, refreshTokenHash []byte) *pUsers.RefreshTokenWhitelist {
 	arg := pUsers.InsertRefreshTokenParams{
-		UserID:       userID,
-		RefreshToken: pgtype.UUID{Bytes: refreshToken, Valid: true},
+		UserID:           userID,
+		RefreshTokenHash: refreshTokenHash,
+		RefreshTokenTTL:  time.Hour,
+		AbsoluteLifetime: 24 * time.Hour,
+		DeviceName:       generator.CreateRandomString(7),
+		UserAgent:        generator.CreateRandomString(20),
+		IPAddress:        "127.0.0.1",
 	}
 
-	err := repoTest.InsertRefreshToken(ctx, arg)
+	res, err := repoTest.InsertRefreshToken(ctx, arg)
 	require.NoError(t, err)
+	require.NotNil(t, res)
+
+	return res
 }
 
 func TestInsertRefreshToken(t *testing.T) {
 	err := testUtils.DeleteSchemaTestData(poolTest)
 	require.NoError(t, err)
 
-	refreshToken := uuid.New()
+	refreshToken := newRefreshTokenHashTest(t)
+	user := createRandomUser(t)
 
 	testCases := []struct {
 		name string
@@ -374,36 +673,71 @@ func TestInsertRefreshToken(t *testing.T) {
 		{
 			name: "succes_1",
 			arg: pUsers.InsertRefreshTokenParams{
-				UserID:       createRandomUser(t).ID,
-				RefreshToken: pgtype.UUID{Bytes: refreshToken, Valid: true},
+				UserID:           createRandomUser(t).ID,
+				RefreshTokenHash: refreshToken,
+				RefreshTokenTTL:  time.Hour,
+				AbsoluteLifetime: 24 * time.Hour,
 			},
 			err: false,
 		}, {
 			name: "succes_2",
 			arg: pUsers.InsertRefreshTokenParams{
-				UserID:       createRandomUser(t).ID,
-				RefreshToken: pgtype.UUID{Bytes: uuid.New(), Valid: true},
+				UserID:           createRandomUser(t).ID,
+				RefreshTokenHash: newRefreshTokenHashTest(t),
+				RefreshTokenTTL:  time.Hour,
+				AbsoluteLifetime: 24 * time.Hour,
 			},
 			err: false,
 		}, {
 			name: "succes_3",
 			arg: pUsers.InsertRefreshTokenParams{
-				UserID:       createRandomUser(t).ID,
-				RefreshToken: pgtype.UUID{Bytes: uuid.New(), Valid: true},
+				UserID:           createRandomUser(t).ID,
+				RefreshTokenHash: newRefreshTokenHashTest(t),
+				RefreshTokenTTL:  time.Hour,
+				AbsoluteLifetime: 24 * time.Hour,
+			},
+			err: false,
+		}, {
+			name: "succes_same_user_first_device",
+			arg: pUsers.InsertRefreshTokenParams{
+				UserID:           user.ID,
+				RefreshTokenHash: newRefreshTokenHashTest(t),
+				RefreshTokenTTL:  time.Hour,
+				AbsoluteLifetime: 24 * time.Hour,
+				DeviceName:       "laptop",
+				UserAgent:        "Mozilla/5.0",
+				IPAddress:        "10.0.0.1",
+			},
+			err: false,
+		}, {
+			name: "succes_same_user_second_device",
+			arg: pUsers.InsertRefreshTokenParams{
+				UserID:           user.ID,
+				RefreshTokenHash: newRefreshTokenHashTest(t),
+				RefreshTokenTTL:  time.Hour,
+				AbsoluteLifetime: 24 * time.Hour,
+				DeviceName:       "phone",
+				UserAgent:        "okhttp/4.12.0",
+				IPAddress:        "10.0.0.2",
+				ClientID:         "mobile-app",
 			},
 			err: false,
 		}, {
 			name: "error_wrong_id",
 			arg: pUsers.InsertRefreshTokenParams{
-				UserID:       createRandomUser(t).ID + 5,
-				RefreshToken: pgtype.UUID{Bytes: uuid.New(), Valid: true},
+				UserID:           createRandomUser(t).ID + 5,
+				RefreshTokenHash: newRefreshTokenHashTest(t),
+				RefreshTokenTTL:  time.Hour,
+				AbsoluteLifetime: 24 * time.Hour,
 			},
 			err: true,
 		}, {
-			name: "error_duplicate_uuid",
+			name: "error_duplicate_refresh_token",
 			arg: pUsers.InsertRefreshTokenParams{
-				UserID:       createRandomUser(t).ID,
-				RefreshToken: pgtype.UUID{Bytes: refreshToken, Valid: true},
+				UserID:           createRandomUser(t).ID,
+				RefreshTokenHash: refreshToken,
+				RefreshTokenTTL:  time.Hour,
+				AbsoluteLifetime: 24 * time.Hour,
 			},
 			err: true,
 		},
@@ -411,9 +745,18 @@ func TestInsertRefreshToken(t *testing.T) {
 
 	for _, tC := range testCases {
 		t.Run(tC.name, func(t *testing.T) {
-			err := repoTest.InsertRefreshToken(ctx, tC.arg)
+			res, err := repoTest.InsertRefreshToken(ctx, tC.arg)
 			if !tC.err {
 				require.NoError(t, err)
+				assert.NotZero(t, res.ID)
+				assert.Equal(t, tC.arg.UserID, res.UserID)
+				assert.Equal(t, tC.arg.RefreshTokenHash, res.RefreshTokenHash)
+				assert.Equal(t, tC.arg.DeviceName, res.DeviceName)
+				assert.Equal(t, tC.arg.UserAgent, res.UserAgent)
+				assert.Equal(t, tC.arg.IPAddress, res.IPAddress)
+				assert.Equal(t, tC.arg.ClientID, res.ClientID)
+				assert.True(t, res.LastUsedAt.Valid)
+				assert.True(t, res.FamilyID.Valid)
 			} else {
 				require.Error(t, err)
 			}
@@ -426,12 +769,12 @@ func TestReadRefreshToken(t *testing.T) {
 	require.NoError(t, err)
 
 	var users []*pUsers.User
-	var refreshTokens []uuid.UUID
+	var refreshTokens [][]byte
 
 	for i := 0; i < 3; i++ {
 		user := createRandomUser(t)
 		users = append(users, user)
-		refreshToken := uuid.New()
+		refreshToken := newRefreshTokenHashTest(t)
 		refreshTokens = append(refreshTokens, refreshToken)
 
 		inserRefreshTokenTest(t, user.ID, refreshToken)
@@ -446,40 +789,40 @@ func TestReadRefreshToken(t *testing.T) {
 		{
 			name: "succes_1",
 			arg: pUsers.GetRefreshTokenParams{
-				UserID:       users[0].ID,
-				RefreshToken: pgtype.UUID{Bytes: refreshTokens[0], Valid: true},
+				UserID:           users[0].ID,
+				RefreshTokenHash: refreshTokens[0],
 			},
 			now: time.Now().UTC(),
 			err: false,
 		}, {
 			name: "succes_2",
 			arg: pUsers.GetRefreshTokenParams{
-				UserID:       users[1].ID,
-				RefreshToken: pgtype.UUID{Bytes: refreshTokens[1], Valid: true},
+				UserID:           users[1].ID,
+				RefreshTokenHash: refreshTokens[1],
 			},
 			now: time.Now().UTC(),
 			err: false,
 		}, {
 			name: "succes_3",
 			arg: pUsers.GetRefreshTokenParams{
-				UserID:       users[2].ID,
-				RefreshToken: pgtype.UUID{Bytes: refreshTokens[2], Valid: true},
+				UserID:           users[2].ID,
+				RefreshTokenHash: refreshTokens[2],
 			},
 			now: time.Now().UTC(),
 			err: false,
 		}, {
 			name: "error_wrong_id",
 			arg: pUsers.GetRefreshTokenParams{
-				UserID:       users[0].ID + 5,
-				RefreshToken: pgtype.UUID{Bytes: refreshTokens[0], Valid: true},
+				UserID:           users[0].ID + 5,
+				RefreshTokenHash: refreshTokens[0],
 			},
 			now: time.Now().UTC(),
 			err: true,
 		}, {
-			name: "error_wrong_uuid",
+			name: "error_wrong_refresh_token",
 			arg: pUsers.GetRefreshTokenParams{
-				UserID:       users[1].ID,
-				RefreshToken: pgtype.UUID{Bytes: refreshTokens[2], Valid: true},
+				UserID:           users[1].ID,
+				RefreshTokenHash: refreshTokens[2],
 			},
 			now: time.Now().UTC(),
 			err: true,
@@ -493,7 +836,7 @@ func TestReadRefreshToken(t *testing.T) {
 				require.NoError(t, err)
 				assert.NotZero(t, res.ID)
 				assert.Equal(t, tC.arg.UserID, res.UserID)
-				assert.Equal(t, tC.arg.RefreshToken, res.RefreshToken)
+				assert.Equal(t, tC.arg.RefreshTokenHash, res.RefreshTokenHash)
 				assert.NotZero(t, res.CreatedAt.Time)
 				assert.True(t, res.CreatedAt.Valid)
 				assert.True(t, res.ExpiresAt.Time.After(tC.now))
@@ -514,7 +857,7 @@ func TestDeleteRefreshToken(t *testing.T) {
 		user := createRandomUser(t)
 		users = append(users, user)
 
-		inserRefreshTokenTest(t, user.ID, uuid.New())
+		inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
 	}
 
 	testCases := []struct {
@@ -553,6 +896,336 @@ func TestDeleteRefreshToken(t *testing.T) {
 	}
 }
 
+func TestDeleteRefreshTokenByID(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	var sessions []*pUsers.RefreshTokenWhitelist
+	for i := 0; i < 3; i++ {
+		sessions = append(sessions, inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t)))
+	}
+
+	testCases := []struct {
+		name string
+		arg  pUsers.DeleteRefreshTokenByIDParams
+		err  bool
+	}{
+		{
+			name: "succes",
+			arg: pUsers.DeleteRefreshTokenByIDParams{
+				ID:     sessions[0].ID,
+				UserID: user.ID,
+			},
+			err: false,
+		}, {
+			name: "error_already_deleted",
+			arg: pUsers.DeleteRefreshTokenByIDParams{
+				ID:     sessions[0].ID,
+				UserID: user.ID,
+			},
+			err: true,
+		}, {
+			name: "error_wrong_user_id",
+			arg: pUsers.DeleteRefreshTokenByIDParams{
+				ID:     sessions[1].ID,
+				UserID: user.ID + 5,
+			},
+			err: true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			res, err := repoTest.DeleteRefreshTokenByID(ctx, tC.arg)
+			if !tC.err {
+				require.NoError(t, err)
+				assert.Equal(t, tC.arg.ID, res.ID)
+				assert.Equal(t, tC.arg.UserID, res.UserID)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+
+	// other sessions of the user are still exists
+	for _, session := range sessions[1:] {
+		arg := pUsers.GetRefreshTokenParams{
+			UserID:           user.ID,
+			RefreshTokenHash: session.RefreshTokenHash,
+		}
+		_, err = repoTest.GetRefreshToken(ctx, arg)
+		require.NoError(t, err)
+	}
+}
+
+func TestDeleteOtherRefreshToken(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	var sessions []*pUsers.RefreshTokenWhitelist
+	for i := 0; i < 3; i++ {
+		sessions = append(sessions, inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t)))
+	}
+	otherUser := createRandomUser(t)
+	otherSession := inserRefreshTokenTest(t, otherUser.ID, newRefreshTokenHashTest(t))
+
+	arg := pUsers.DeleteRefreshTokenByIDParams{
+		ID:     sessions[0].ID,
+		UserID: user.ID,
+	}
+	res, err := repoTest.DeleteOtherRefreshToken(ctx, arg)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	for _, v := range res {
+		assert.NotEqual(t, sessions[0].ID, v.ID)
+		assert.Equal(t, user.ID, v.UserID)
+	}
+
+	resList, err := repoTest.ListRefreshTokenByUserID(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, resList, 1)
+	assert.Equal(t, sessions[0].ID, resList[0].ID)
+
+	resList, err = repoTest.ListRefreshTokenByUserID(ctx, otherUser.ID)
+	require.NoError(t, err)
+	require.Len(t, resList, 1)
+	assert.Equal(t, otherSession.ID, resList[0].ID)
+}
+
+func TestDeleteAllRefreshToken(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	for i := 0; i < 3; i++ {
+		inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
+	}
+	otherUser := createRandomUser(t)
+	otherSession := inserRefreshTokenTest(t, otherUser.ID, newRefreshTokenHashTest(t))
+
+	res, err := repoTest.DeleteAllRefreshToken(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	for _, v := range res {
+		assert.Equal(t, user.ID, v.UserID)
+	}
+
+	resList, err := repoTest.ListRefreshTokenByUserID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, resList)
+
+	resList, err = repoTest.ListRefreshTokenByUserID(ctx, otherUser.ID)
+	require.NoError(t, err)
+	require.Len(t, resList, 1)
+	assert.Equal(t, otherSession.ID, resList[0].ID)
+
+	// user without session
+	res, err = repoTest.DeleteAllRefreshToken(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func TestRevokeRefreshTokenFamily(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	session1 := inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
+	session2 := inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
+	assert.NotEqual(t, session1.FamilyID, session2.FamilyID)
+
+	arg := pUsers.RevokeRefreshTokenFamilyParams{
+		UserID:   user.ID,
+		FamilyID: session1.FamilyID,
+	}
+	res, err := repoTest.RevokeRefreshTokenFamily(ctx, arg)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, session1.ID, res[0].ID)
+
+	res, err = repoTest.RevokeRefreshTokenFamily(ctx, arg)
+	require.NoError(t, err)
+	assert.Empty(t, res)
+
+	resList, err := repoTest.ListRefreshTokenByUserID(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, resList, 1)
+	assert.Equal(t, session2.ID, resList[0].ID)
+}
+
+func TestInsertSecurityEvent(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+
+	testCases := []struct {
+		desc string
+		arg  pUsers.InsertSecurityEventParams
+		err  bool
+	}{
+		{
+			desc: "success",
+			arg: pUsers.InsertSecurityEventParams{
+				UserID:      pgtype.Int4{Int32: user.ID, Valid: true},
+				EventType:   pUsers.SecurityEventRefreshTokenReuse,
+				Description: generator.CreateRandomString(20),
+			},
+			err: false,
+		}, {
+			desc: "success_without_user",
+			arg: pUsers.InsertSecurityEventParams{
+				EventType: pUsers.SecurityEventRefreshTokenReuse,
+			},
+			err: false,
+		}, {
+			desc: "failed_empty_event_type",
+			arg: pUsers.InsertSecurityEventParams{
+				UserID: pgtype.Int4{Int32: user.ID, Valid: true},
+			},
+			err: true,
+		}, {
+			desc: "failed_wrong_user_id",
+			arg: pUsers.InsertSecurityEventParams{
+				UserID:    pgtype.Int4{Int32: user.ID + 5, Valid: true},
+				EventType: pUsers.SecurityEventRefreshTokenReuse,
+			},
+			err: true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := repoTest.InsertSecurityEvent(ctx, tC.arg)
+			if !tC.err {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestUpdateSessionAccessToken(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	session := inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
+	assert.False(t, session.AccessTokenID.Valid)
+
+	arg := pUsers.UpdateSessionAccessTokenParams{
+		ID:                   session.ID,
+		UserID:               user.ID,
+		AccessTokenID:        pgtype.UUID{Bytes: uuid.New(), Valid: true},
+		AccessTokenExpiresAt: pgtype.Timestamp{Time: time.Now().UTC().Add(time.Hour).Truncate(time.Second), Valid: true},
+	}
+	err = repoTest.UpdateSessionAccessToken(ctx, arg)
+	require.NoError(t, err)
+
+	res, err := repoTest.GetRefreshToken(ctx, pUsers.GetRefreshTokenParams{UserID: user.ID, RefreshTokenHash: session.RefreshTokenHash})
+	require.NoError(t, err)
+	assert.Equal(t, arg.AccessTokenID, res.AccessTokenID)
+	assert.Equal(t, arg.AccessTokenExpiresAt.Time.Unix(), res.AccessTokenExpiresAt.Time.Unix())
+
+	arg.UserID = user.ID + 5
+	err = repoTest.UpdateSessionAccessToken(ctx, arg)
+	require.Error(t, err)
+}
+
+func TestUpdateRefreshToken(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	session1 := inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
+	session2 := inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
+
+	newRefreshToken := newRefreshTokenHashTest(t)
+	testCases := []struct {
+		name string
+		arg  pUsers.UpdateRefreshTokenParams
+		err  bool
+	}{
+		{
+			name: "succes",
+			arg: pUsers.UpdateRefreshTokenParams{
+				ID:                  session1.ID,
+				UserID:              user.ID,
+				FamilyID:            session1.FamilyID,
+				RefreshTokenHash:    session1.RefreshTokenHash,
+				NewRefreshTokenHash: newRefreshToken,
+				RefreshTokenTTL:     time.Hour,
+			},
+			err: false,
+		}, {
+			name: "error_old_refresh_token",
+			arg: pUsers.UpdateRefreshTokenParams{
+				ID:                  session1.ID,
+				UserID:              user.ID,
+				FamilyID:            session1.FamilyID,
+				RefreshTokenHash:    session1.RefreshTokenHash,
+				NewRefreshTokenHash: newRefreshTokenHashTest(t),
+				RefreshTokenTTL:     time.Hour,
+			},
+			err: true,
+		}, {
+			name: "error_token_of_other_session",
+			arg: pUsers.UpdateRefreshTokenParams{
+				ID:                  session1.ID,
+				UserID:              user.ID,
+				FamilyID:            session1.FamilyID,
+				RefreshTokenHash:    session2.RefreshTokenHash,
+				NewRefreshTokenHash: newRefreshTokenHashTest(t),
+				RefreshTokenTTL:     time.Hour,
+			},
+			err: true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			err = repoTest.UpdateRefreshToken(ctx, tC.arg)
+			if !tC.err {
+				require.NoError(t, err)
+
+				arg := pUsers.GetRefreshTokenParams{
+					UserID:           user.ID,
+					RefreshTokenHash: tC.arg.NewRefreshTokenHash,
+				}
+				res, err := repoTest.GetRefreshToken(ctx, arg)
+				require.NoError(t, err)
+				assert.Equal(t, tC.arg.ID, res.ID)
+				assert.Equal(t, tC.arg.FamilyID, res.FamilyID)
+
+				// old refresh token is moved into history
+				arg.RefreshTokenHash = tC.arg.RefreshTokenHash
+				resHistory, err := repoTest.GetRotatedRefreshToken(ctx, arg)
+				require.NoError(t, err)
+				assert.Equal(t, tC.arg.FamilyID, resHistory.FamilyID)
+				assert.Equal(t, tC.arg.RefreshTokenHash, resHistory.RefreshTokenHash)
+
+				resHistory, err = repoTest.GetRotatedRefreshTokenByHash(ctx, tC.arg.RefreshTokenHash)
+				require.NoError(t, err)
+				assert.Equal(t, user.ID, resHistory.UserID)
+				assert.Equal(t, tC.arg.FamilyID, resHistory.FamilyID)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+
+	// the other session is not rotated
+	arg := pUsers.GetRefreshTokenParams{
+		UserID:           user.ID,
+		RefreshTokenHash: session2.RefreshTokenHash,
+	}
+	_, err = repoTest.GetRefreshToken(ctx, arg)
+	require.NoError(t, err)
+}
+
 func TestUpdateUserIsDeleted(t *testing.T) {
 	err := testUtils.DeleteSchemaTestData(poolTest)
 	require.NoError(t, err)
@@ -564,6 +1237,9 @@ func TestUpdateUserIsDeleted(t *testing.T) {
 	}
 
 	for i := 0; i < 3; i++ {
+		_, err = repoTest.VerifyUserEmail(ctx, pUsers.VerifyUserEmailParams{ID: users[i].ID, Email: users[i].Email})
+		require.NoError(t, err)
+
 		arg := pUsers.SoftDeleteUserParams{
 			ID:    users[i].ID,
 			Email: users[i].Email,
@@ -627,6 +1303,8 @@ func TestUpdateUserIsDeleted(t *testing.T) {
 				assert.NotEqual(t, tC.user.CreatedAt, res.CreatedAt)
 				assert.False(t, res.IsDeleted.Bool)
 				assert.False(t, res.DeletedAt.Time.IsZero())
+				// the new owner of the email must verify it again
+				assert.False(t, res.EmailVerifiedAt.Valid)
 
 			} else {
 				require.Error(t, err)
@@ -644,7 +1322,7 @@ func TestDeleteUserTx(t *testing.T) {
 		user := createRandomUser(t)
 		users = append(users, user)
 
-		inserRefreshTokenTest(t, user.ID, uuid.New())
+		inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
 	}
 
 	users = append(users, createRandomUser(t))
@@ -710,3 +1388,75 @@ func TestDeleteUserTx(t *testing.T) {
 		})
 	}
 }
+
+func TestResetPasswordTx(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	for i := 0; i < 2; i++ {
+		inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t))
+	}
+
+	arg := pUsers.UpdateUserPasswordParams{
+		ID:             user.ID,
+		HashedPassword: generator.CreateRandomString(20),
+	}
+	sessions, err := repoTest.ResetPasswordTx(ctx, arg)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 2)
+
+	res, err := repoTest.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, arg.HashedPassword, res.HashedPassword)
+	resList, err := repoTest.ListRefreshTokenByUserID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, resList)
+
+	// sessions are not deleted when the password can't be updated
+	deletedUser := createRandomUser(t)
+	inserRefreshTokenTest(t, deletedUser.ID, newRefreshTokenHashTest(t))
+	_, err = repoTest.ResetPasswordTx(ctx, pUsers.UpdateUserPasswordParams{ID: deletedUser.ID + 100, HashedPassword: arg.HashedPassword})
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+	resList, err = repoTest.ListRefreshTokenByUserID(ctx, deletedUser.ID)
+	require.NoError(t, err)
+	assert.Len(t, resList, 1)
+}
+
+func TestChangePasswordTx(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	var sessions []*pUsers.RefreshTokenWhitelist
+	for i := 0; i < 3; i++ {
+		sessions = append(sessions, inserRefreshTokenTest(t, user.ID, newRefreshTokenHashTest(t)))
+	}
+
+	arg := pUsers.ChangePasswordParams{
+		ID:             user.ID,
+		HashedPassword: generator.CreateRandomString(20),
+		SessionID:      sessions[0].ID,
+	}
+	res, err := repoTest.ChangePasswordTx(ctx, arg)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	for _, v := range res {
+		assert.NotEqual(t, sessions[0].ID, v.ID)
+	}
+
+	resUser, err := repoTest.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, arg.HashedPassword, resUser.HashedPassword)
+
+	// current session is kept
+	resList, err := repoTest.ListRefreshTokenByUserID(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, resList, 1)
+	assert.Equal(t, sessions[0].ID, resList[0].ID)
+
+	// unknown user
+	arg.ID = user.ID + 100
+	_, err = repoTest.ChangePasswordTx(ctx, arg)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+}
@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"context"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+)
+
+const insertWebAuthnCredential = `-- name: InsertWebAuthnCredential :one
+INSERT INTO webauthn_credentials(
+    user_id,
+    credential_id,
+    public_key,
+    sign_count,
+    transports,
+    name,
+    aaguid,
+    backup_eligible
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8
+) RETURNING id, user_id, credential_id, public_key, sign_count, transports, name, aaguid, backup_eligible, last_used_at, created_at
+`
+
+// InsertWebAuthnCredential save new passkey of the user, unique violation is
+// returned when the credential ID is already registered.
+func (q *usersRepository) InsertWebAuthnCredential(ctx context.Context, arg pUsers.InsertWebAuthnCredentialParams) (*pUsers.WebAuthnCredential, error) {
+	transports := arg.Transports
+	if transports == nil {
+		transports = []string{}
+	}
+
+	row := q.db.QueryRow(ctx, insertWebAuthnCredential,
+		arg.UserID,
+		arg.CredentialID,
+		arg.PublicKey,
+		arg.SignCount,
+		transports,
+		arg.Name,
+		arg.AAGUID,
+		arg.BackupEligible,
+	)
+	var i pUsers.WebAuthnCredential
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.CredentialID,
+		&i.PublicKey,
+		&i.SignCount,
+		&i.Transports,
+		&i.Name,
+		&i.AAGUID,
+		&i.BackupEligible,
+		&i.LastUsedAt,
+		&i.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+const getWebAuthnCredential = `-- name: GetWebAuthnCredential :one
+SELECT
+    id, user_id, credential_id, public_key, sign_count, transports, name, aaguid, backup_eligible, last_used_at, created_at
+FROM
+    webauthn_credentials
+WHERE
+    credential_id = $1
+`
+
+func (q *usersRepository) GetWebAuthnCredential(ctx context.Context, credentialID []byte) (*pUsers.WebAuthnCredential, error) {
+	row := q.db.QueryRow(ctx, getWebAuthnCredential, credentialID)
+	var i pUsers.WebAuthnCredential
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.CredentialID,
+		&i.PublicKey,
+		&i.SignCount,
+		&i.Transports,
+		&i.Name,
+		&i.AAGUID,
+		&i.BackupEligible,
+		&i.LastUsedAt,
+		&i.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+const listWebAuthnCredentials = `-- name: ListWebAuthnCredentials :many
+SELECT
+    id, user_id, credential_id, public_key, sign_count, transports, name, aaguid, backup_eligible, last_used_at, created_at
+FROM
+    webauthn_credentials
+WHERE
+    user_id = $1
+ORDER BY id
+`
+
+// ListWebAuthnCredentials return all passkeys of the user.
+func (q *usersRepository) ListWebAuthnCredentials(ctx context.Context, userID int32) ([]pUsers.WebAuthnCredential, error) {
+	rows, err := q.db.Query(ctx, listWebAuthnCredentials, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []pUsers.WebAuthnCredential
+	for rows.Next() {
+		var i pUsers.WebAuthnCredential
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.CredentialID,
+			&i.PublicKey,
+			&i.SignCount,
+			&i.Transports,
+			&i.Name,
+			&i.AAGUID,
+			&i.BackupEligible,
+			&i.LastUsedAt,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+const updateWebAuthnCredentialUsage = `-- name: UpdateWebAuthnCredentialUsage :exec
+UPDATE
+    webauthn_credentials
+SET
+    sign_count = $2,
+    last_used_at = NOW()
+WHERE
+    id = $1
+AND (sign_count < $2 OR $2 = 0)
+`
+
+// UpdateWebAuthnCredentialUsage save the sign count of the assertion,
+// ErrNoRowsAffected is returned when the same or bigger sign count is already
+// saved, so two requests can't use the same assertion at the same time.
+func (q *usersRepository) UpdateWebAuthnCredentialUsage(ctx context.Context, arg pUsers.UpdateWebAuthnCredentialUsageParams) error {
+	res, err := q.db.Exec(ctx, updateWebAuthnCredentialUsage, arg.ID, arg.SignCount)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
+
+const deleteWebAuthnCredential = `-- name: DeleteWebAuthnCredential :exec
+DELETE FROM
+    webauthn_credentials
+WHERE
+    id = $1
+AND user_id = $2
+`
+
+// DeleteWebAuthnCredential delete the passkey of the user, ErrNoRowsAffected
+// is returned when the passkey is not found or it's owned by other user.
+func (q *usersRepository) DeleteWebAuthnCredential(ctx context.Context, arg pUsers.DeleteWebAuthnCredentialParams) error {
+	res, err := q.db.Exec(ctx, deleteWebAuthnCredential, arg.ID, arg.UserID)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pUsers.ErrNoRowsAffected
+	}
+
+	return nil
+}
+
+const deleteUserWebAuthnCredentials = `-- name: DeleteUserWebAuthnCredentials :exec
+DELETE FROM
+    webauthn_credentials
+WHERE
+    user_id = $1
+`
+
+// DeleteUserWebAuthnCredentials delete all passkeys of the user.
+func (q *usersRepository) DeleteUserWebAuthnCredentials(ctx context.Context, userID int32) error {
+	_, err := q.db.Exec(ctx, deleteUserWebAuthnCredentials, userID)
+	return err
+}
@@ -0,0 +1,185 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createWebAuthnCredentialTest(t *testing.T, userID int32) *pUsers.WebAuthnCredential {
+	arg := pUsers.InsertWebAuthnCredentialParams{
+		UserID:         userID,
+		CredentialID:   []byte(generator.CreateRandomString(16)),
+		PublicKey:      []byte(generator.CreateRandomString(77)),
+		SignCount:      1,
+		Transports:     []string{"internal", "hybrid"},
+		Name:           generator.CreateRandomString(5),
+		AAGUID:         make([]byte, 16),
+		BackupEligible: true,
+	}
+
+	res, err := repoTest.InsertWebAuthnCredential(ctx, arg)
+	require.NoError(t, err)
+	assert.NotZero(t, res.ID)
+	assert.Equal(t, arg.UserID, res.UserID)
+	assert.Equal(t, arg.CredentialID, res.CredentialID)
+	assert.Equal(t, arg.PublicKey, res.PublicKey)
+	assert.Equal(t, arg.SignCount, res.SignCount)
+	assert.Equal(t, arg.Transports, res.Transports)
+	assert.Equal(t, arg.Name, res.Name)
+	assert.Equal(t, arg.AAGUID, res.AAGUID)
+	assert.True(t, res.BackupEligible)
+	assert.False(t, res.LastUsedAt.Valid)
+	assert.True(t, res.CreatedAt.Valid)
+
+	return res
+}
+
+func TestInsertWebAuthnCredential(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	cred := createWebAuthnCredentialTest(t, user.ID)
+
+	t.Run("success_without_transports", func(t *testing.T) {
+		res, err := repoTest.InsertWebAuthnCredential(ctx, pUsers.InsertWebAuthnCredentialParams{
+			UserID:       user.ID,
+			CredentialID: []byte(generator.CreateRandomString(16)),
+			PublicKey:    []byte(generator.CreateRandomString(77)),
+			Name:         "key",
+		})
+		require.NoError(t, err)
+		assert.Empty(t, res.Transports)
+		assert.Nil(t, res.AAGUID)
+	})
+
+	t.Run("failed_duplicated_credential_id", func(t *testing.T) {
+		other := createRandomUser(t)
+		_, err := repoTest.InsertWebAuthnCredential(ctx, pUsers.InsertWebAuthnCredentialParams{
+			UserID:       other.ID,
+			CredentialID: cred.CredentialID,
+			PublicKey:    cred.PublicKey,
+			Name:         "key",
+		})
+		require.Error(t, err)
+		var pgErr *pgconn.PgError
+		require.True(t, errors.As(err, &pgErr))
+		assert.Equal(t, "23505", pgErr.Code)
+	})
+}
+
+func TestGetWebAuthnCredential(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	cred := createWebAuthnCredentialTest(t, user.ID)
+
+	res, err := repoTest.GetWebAuthnCredential(ctx, cred.CredentialID)
+	require.NoError(t, err)
+	assert.Equal(t, cred, res)
+
+	_, err = repoTest.GetWebAuthnCredential(ctx, []byte("unknown"))
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+}
+
+func TestListWebAuthnCredentials(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	var creds []pUsers.WebAuthnCredential
+	for i := 0; i < 3; i++ {
+		creds = append(creds, *createWebAuthnCredentialTest(t, user.ID))
+	}
+	other := createRandomUser(t)
+	createWebAuthnCredentialTest(t, other.ID)
+
+	res, err := repoTest.ListWebAuthnCredentials(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, creds, res)
+}
+
+func TestUpdateWebAuthnCredentialUsage(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	cred := createWebAuthnCredentialTest(t, user.ID)
+
+	testCases := []struct {
+		desc      string
+		signCount int64
+		err       error
+	}{
+		{
+			desc:      "success",
+			signCount: 5,
+		}, {
+			desc:      "failed_same_sign_count",
+			signCount: 5,
+			err:       pUsers.ErrNoRowsAffected,
+		}, {
+			desc:      "failed_smaller_sign_count",
+			signCount: 2,
+			err:       pUsers.ErrNoRowsAffected,
+		}, {
+			desc:      "success_zero_sign_count",
+			signCount: 0,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := repoTest.UpdateWebAuthnCredentialUsage(ctx, pUsers.UpdateWebAuthnCredentialUsageParams{ID: cred.ID, SignCount: tC.signCount})
+			if tC.err != nil {
+				require.ErrorIs(t, err, tC.err)
+				return
+			}
+			require.NoError(t, err)
+
+			res, err := repoTest.GetWebAuthnCredential(ctx, cred.CredentialID)
+			require.NoError(t, err)
+			assert.Equal(t, tC.signCount, res.SignCount)
+			assert.True(t, res.LastUsedAt.Valid)
+		})
+	}
+}
+
+func TestDeleteWebAuthnCredential(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user := createRandomUser(t)
+	cred := createWebAuthnCredentialTest(t, user.ID)
+	other := createRandomUser(t)
+
+	// passkey of other user can't be deleted
+	err = repoTest.DeleteWebAuthnCredential(ctx, pUsers.DeleteWebAuthnCredentialParams{ID: cred.ID, UserID: other.ID})
+	require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+
+	err = repoTest.DeleteWebAuthnCredential(ctx, pUsers.DeleteWebAuthnCredentialParams{ID: cred.ID, UserID: user.ID})
+	require.NoError(t, err)
+	_, err = repoTest.GetWebAuthnCredential(ctx, cred.CredentialID)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	err = repoTest.DeleteWebAuthnCredential(ctx, pUsers.DeleteWebAuthnCredentialParams{ID: cred.ID, UserID: user.ID})
+	require.ErrorIs(t, err, pUsers.ErrNoRowsAffected)
+
+	// passkeys of deleted user are deleted
+	createWebAuthnCredentialTest(t, other.ID)
+	err = repoTest.DeleteUserTx(ctx, pUsers.SoftDeleteUserParams{ID: other.ID, Email: other.Email})
+	require.NoError(t, err)
+	res, err := repoTest.ListWebAuthnCredentials(ctx, other.ID)
+	require.NoError(t, err)
+	assert.Empty(t, res)
+}
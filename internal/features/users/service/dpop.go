@@ -0,0 +1,79 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+// readDPoPProof verify DPoP proof that is sent to get token (RFC 9449 section
+// 5), and save its jti so the proof can't be replayed. The tokens are bound to
+// JKT of the result.
+func (s *usersService) readDPoPProof(input pUsers.DPoPRequest) (proof *pUsers.DPoPProofPayload, code int, err error) {
+	proof, err = middleware.ReadDPoPProof(input.Proof, input.Method, input.URL, "")
+	if err != nil {
+		return nil, errs.CodeFailedUser, fmt.Errorf("%s: %v", pUsers.OAuthErrInvalidDPoPProof, err)
+	}
+
+	isNew, err := s.cache.CachingDPoPProof(proof.ID, middleware.DPoPProofLifetime)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if !isNew {
+		return nil, errs.CodeFailedUser, fmt.Errorf("%s: dpop proof has been used", pUsers.OAuthErrInvalidDPoPProof)
+	}
+
+	return proof, errs.CodeSuccess, nil
+}
+
+// checkSubjectTokenDPoP check the proof that is sent to exchange subject token,
+// subject token that is bound to DPoP key can only be exchanged with proof of
+// the same key, so stolen token can't be turned into bearer token.
+func (s *usersService) checkSubjectTokenDPoP(subject *pUsers.JwtPayload, input pUsers.DPoPRequest) (code int, err error) {
+	if subject.Cnf == nil {
+		return errs.CodeSuccess, nil
+	}
+	if input.Proof == "" {
+		return errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidDPoPProof, "dpop proof is required, the subject token is bound to dpop key")
+	}
+
+	proof, code, err := s.readDPoPProof(input)
+	if err != nil {
+		if code == errs.CodeFailedServer {
+			return code, err
+		}
+		return code, newOAuthError(pUsers.OAuthErrInvalidDPoPProof, strings.TrimPrefix(err.Error(), pUsers.OAuthErrInvalidDPoPProof+": "))
+	}
+	if proof.JKT != subject.Cnf.JKT {
+		return errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidDPoPProof, "dpop proof is not signed with the key that the subject token is bound to")
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// checkSessionDPoP check the proof of the refresh request, session that is
+// bound to DPoP key can only be refreshed with proof of the same key. Proof
+// that is sent to refresh session that is not bound is ignored, the session
+// is only bound at login.
+func (s *usersService) checkSessionDPoP(payload *pUsers.JwtPayload, input pUsers.DPoPRequest) (code int, err error) {
+	if payload.Cnf == nil {
+		return errs.CodeSuccess, nil
+	}
+	if input.Proof == "" {
+		return errs.CodeFailedUnauthorized, fmt.Errorf("%s: dpop proof is required, the session is bound to dpop key", pUsers.OAuthErrInvalidDPoPProof)
+	}
+
+	proof, code, err := s.readDPoPProof(input)
+	if err != nil {
+		return code, err
+	}
+	if proof.JKT != payload.Cnf.JKT {
+		return errs.CodeFailedUnauthorized, errors.New("dpop proof is not signed with the key that the session is bound to")
+	}
+
+	return errs.CodeSuccess, nil
+}
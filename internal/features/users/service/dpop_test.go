@@ -0,0 +1,185 @@
+package service
+
+import (
+	"crypto"
+	"net/http"
+	"strings"
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	loginURLTest        = "https://auth.example.com/api/v1/auth/login"
+	refreshTokenURLTest = "https://auth.example.com/api/v1/auth/refresh_token"
+	tokenURLTest        = "https://auth.example.com/oauth/token"
+)
+
+func dpopRequestTest(t *testing.T, privateKey crypto.Signer, url string) pUsers.DPoPRequest {
+	proof, err := middleware.CreateDPoPProof(privateKey, password.SigningAlgES256, http.MethodPost, url, "")
+	require.NoError(t, err)
+
+	return pUsers.DPoPRequest{
+		Proof:  proof,
+		Method: http.MethodPost,
+		URL:    url,
+	}
+}
+
+func TestLogInDPoP(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	_, signUpReq := createUser(t)
+	dpopKey, jkt, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		arg := pUsers.LoginRequest{
+			Email:    signUpReq.Email,
+			Password: signUpReq.Password,
+			DPoP:     dpopRequestTest(t, dpopKey, loginURLTest),
+		}
+		_, accessToken, _, code, err := serviceTest.LogIn(arg)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.True(t, strings.HasPrefix(accessToken, "DPoP "))
+
+		payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		require.NotNil(t, payload.Cnf)
+		assert.Equal(t, jkt, payload.Cnf.JKT)
+
+		introspectionClient := createOAuthClientTest(t, false)
+		introspection, _, err := serviceTest.IntrospectToken(introspectionClient, strings.TrimPrefix(accessToken, "DPoP "), "")
+		require.NoError(t, err)
+		assert.True(t, introspection.Active)
+		assert.Equal(t, pUsers.AuthSchemeDPoP, introspection.TokenType)
+		assert.Equal(t, payload.Cnf, introspection.Cnf)
+	})
+
+	t.Run("success_without_dpop", func(t *testing.T) {
+		_, accessToken, _, _, err := serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(accessToken, "Bearer "))
+
+		payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Nil(t, payload.Cnf)
+	})
+
+	t.Run("failed_replayed_proof", func(t *testing.T) {
+		arg := pUsers.LoginRequest{
+			Email:    signUpReq.Email,
+			Password: signUpReq.Password,
+			DPoP:     dpopRequestTest(t, dpopKey, loginURLTest),
+		}
+		_, _, _, _, err := serviceTest.LogIn(arg)
+		require.NoError(t, err)
+
+		_, _, _, code, err := serviceTest.LogIn(arg)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+
+	t.Run("failed_proof_of_other_url", func(t *testing.T) {
+		arg := pUsers.LoginRequest{
+			Email:    signUpReq.Email,
+			Password: signUpReq.Password,
+			DPoP:     dpopRequestTest(t, dpopKey, refreshTokenURLTest),
+		}
+		arg.DPoP.URL = loginURLTest
+
+		_, _, _, code, err := serviceTest.LogIn(arg)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+}
+
+func TestRefreshTokenDPoP(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	_, signUpReq := createUser(t)
+	dpopKey, jkt, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+	otherKey, _, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	login := func(t *testing.T) (accessToken, refreshToken string) {
+		arg := pUsers.LoginRequest{
+			Email:    signUpReq.Email,
+			Password: signUpReq.Password,
+			DPoP:     dpopRequestTest(t, dpopKey, loginURLTest),
+		}
+		_, accessToken, refreshToken, _, err := serviceTest.LogIn(arg)
+		require.NoError(t, err)
+
+		return accessToken, refreshToken
+	}
+
+	t.Run("success", func(t *testing.T) {
+		accessToken, refreshToken := login(t)
+
+		_, newAccessToken, code, err := serviceTest.RefreshToken(refreshToken, strings.Split(accessToken, " ")[1], dpopRequestTest(t, dpopKey, refreshTokenURLTest))
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		// the refreshed token is bound to the same key
+		payload, err := middleware.ReadToken(newAccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		require.NotNil(t, payload.Cnf)
+		assert.Equal(t, jkt, payload.Cnf.JKT)
+	})
+
+	testCases := []struct {
+		desc string
+		dpop func(t *testing.T) pUsers.DPoPRequest
+		code int
+	}{
+		{
+			desc: "failed_without_proof",
+			dpop: func(t *testing.T) pUsers.DPoPRequest { return pUsers.DPoPRequest{} },
+			code: errs.CodeFailedUnauthorized,
+		}, {
+			desc: "failed_proof_of_other_key",
+			dpop: func(t *testing.T) pUsers.DPoPRequest { return dpopRequestTest(t, otherKey, refreshTokenURLTest) },
+			code: errs.CodeFailedUnauthorized,
+		}, {
+			desc: "failed_proof_of_other_url",
+			dpop: func(t *testing.T) pUsers.DPoPRequest {
+				arg := dpopRequestTest(t, dpopKey, loginURLTest)
+				arg.URL = refreshTokenURLTest
+				return arg
+			},
+			code: errs.CodeFailedUser,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			accessToken, refreshToken := login(t)
+
+			_, _, code, err := serviceTest.RefreshToken(refreshToken, strings.Split(accessToken, " ")[1], tC.dpop(t))
+			require.Error(t, err)
+			assert.Equal(t, tC.code, code)
+
+			// the stolen tokens can't be used to block the session
+			payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+			require.NoError(t, err)
+			err = cacheTest.CheckBlockedToken(*payload)
+			require.NoError(t, err)
+		})
+	}
+}
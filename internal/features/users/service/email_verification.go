@@ -0,0 +1,124 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	mailer "github.com/dwiw96/ran-user-management/pkg/mailer"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+var errInvalidVerificationToken = errors.New("verification token is invalid, expired or has been used")
+
+// sendVerificationEmail send link with new verification token to the email
+// of the user, token that is sent before can't be used anymore.
+func (s *usersService) sendVerificationEmail(user *pUsers.User) error {
+	key, err := s.repo.LoadKey(s.ctx)
+	if err != nil {
+		return fmt.Errorf("load key error: %w", err)
+	}
+
+	payload := &pUsers.EmailVerificationPayload{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:  s.issuer,
+			Subject: strconv.Itoa(int(user.ID)),
+		},
+		Email: user.Email,
+	}
+	token, payload, err := middleware.CreateEmailVerificationToken(payload, s.emailVerification.TokenTTL, key)
+	if err != nil {
+		return errors.New("failed generate verification token")
+	}
+
+	err = s.cache.CachingEmailVerification(user.ID, payload.ID, s.emailVerification.TokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(s.emailVerification.URL)
+	if err != nil {
+		return fmt.Errorf("email verification url is invalid, msg: %v", err)
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	msg := mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease verify your email by opening the link below, the link expires in %s.\n\n%s\n\nIf you didn't sign up, you can ignore this email.\n",
+			user.Username, s.emailVerification.TokenTTL, link.String()),
+	}
+
+	return s.mailer.Send(s.ctx, msg)
+}
+
+// VerifyEmail mark the email of the user of the token as verified, the token
+// can only be used once and only the latest token that is sent can be used.
+func (s *usersService) VerifyEmail(token string) (code int, err error) {
+	verificationKeys, err := s.repo.ListVerificationKeys(s.ctx)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	payload, err := middleware.ReadEmailVerificationToken(token, middleware.NewKeySet(verificationKeys...))
+	if err != nil {
+		return errs.CodeFailedUser, errInvalidVerificationToken
+	}
+	userID, err := strconv.Atoi(payload.Subject)
+	if err != nil {
+		return errs.CodeFailedUser, errInvalidVerificationToken
+	}
+
+	isDeleted, err := s.cache.DeleteEmailVerification(int32(userID), payload.ID)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+	if !isDeleted {
+		return errs.CodeFailedUser, errInvalidVerificationToken
+	}
+
+	arg := pUsers.VerifyUserEmailParams{
+		ID:    int32(userID),
+		Email: payload.Email,
+	}
+	_, err = s.repo.VerifyUserEmail(s.ctx, arg)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errs.CodeFailedUser, errInvalidVerificationToken
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to verify email, msg: %v", err)
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// ResendVerification send new verification email to the user of the email,
+// the result is the same whether the email is registered, verified or not,
+// so it can't be used to find registered email.
+func (s *usersService) ResendVerification(email string) (code int, err error) {
+	user, err := s.repo.GetUserByEmail(s.ctx, email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errs.CodeSuccess, nil
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to load user, msg: %v", err)
+	}
+	if user.IsDeleted.Bool || user.EmailVerifiedAt.Valid {
+		return errs.CodeSuccess, nil
+	}
+
+	err = s.sendVerificationEmail(user)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	return errs.CodeSuccess, nil
+}
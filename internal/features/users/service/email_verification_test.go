@@ -0,0 +1,158 @@
+package service
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var verificationLinkRegex = regexp.MustCompile(`https?://\S+`)
+
+// lastVerificationTokenTest return the token of the latest verification email
+// that is sent to the email
+func lastVerificationTokenTest(t *testing.T, email string) string {
+	messages := mailerTest.Messages(email)
+	require.NotEmpty(t, messages)
+	msg := messages[len(messages)-1]
+	assert.Equal(t, "Verify your email", msg.Subject)
+
+	link, err := url.Parse(verificationLinkRegex.FindString(msg.Body))
+	require.NoError(t, err)
+	assert.Equal(t, emailVerificationTest.URL, link.Scheme+"://"+link.Host+link.Path)
+	token := link.Query().Get("token")
+	require.NotEmpty(t, token)
+
+	return token
+}
+
+func TestSignUpSendVerificationEmail(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user, signUpReq := createUser(t)
+	assert.False(t, user.EmailVerifiedAt.Valid)
+
+	messages := mailerTest.Messages(signUpReq.Email)
+	require.Len(t, messages, 1)
+	assert.Contains(t, messages[0].Body, signUpReq.Username)
+	lastVerificationTokenTest(t, signUpReq.Email)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		token := lastVerificationTokenTest(t, signUpReq.Email)
+
+		code, err := serviceTest.VerifyEmail(token)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		res, err := repoTest.GetUserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.True(t, res.EmailVerifiedAt.Valid)
+
+		// token can only be used once
+		code, err = serviceTest.VerifyEmail(token)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+
+	t.Run("failed_old_token", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		oldToken := lastVerificationTokenTest(t, signUpReq.Email)
+
+		code, err := serviceTest.ResendVerification(signUpReq.Email)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		newToken := lastVerificationTokenTest(t, signUpReq.Email)
+		assert.NotEqual(t, oldToken, newToken)
+
+		code, err = serviceTest.VerifyEmail(oldToken)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+
+		code, err = serviceTest.VerifyEmail(newToken)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+	})
+
+	t.Run("failed_invalid_token", func(t *testing.T) {
+		code, err := serviceTest.VerifyEmail(generator.CreateRandomString(50))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+
+	t.Run("failed_access_token", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		_, accessToken, _, _, err := serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+		require.NoError(t, err)
+
+		code, err := serviceTest.VerifyEmail(strings.TrimPrefix(accessToken, "Bearer "))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+}
+
+func TestResendVerification(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success_unknown_email", func(t *testing.T) {
+		email := generator.CreateRandomEmail(generator.CreateRandomString(5))
+
+		code, err := serviceTest.ResendVerification(email)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Empty(t, mailerTest.Messages(email))
+	})
+
+	t.Run("success_verified_email", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		_, err := serviceTest.VerifyEmail(lastVerificationTokenTest(t, signUpReq.Email))
+		require.NoError(t, err)
+
+		code, err := serviceTest.ResendVerification(signUpReq.Email)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Len(t, mailerTest.Messages(signUpReq.Email), 1)
+	})
+}
+
+func TestLogInRequireEmailVerification(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	emailVerification := emailVerificationTest
+	emailVerification.Required = true
+	service := NewUsersService(repoTest, cacheTest, mailerTest, cfg.TokenLifetimeConfig{Default: cfg.DefaultTokenLifetime}, emailVerification, passwordResetTest, magicLinkTest, loginProtectionTest, webAuthnTest, issuerTest, audienceTest, ctx)
+
+	_, signUpReq := createUser(t)
+	arg := pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password}
+
+	_, _, _, code, err := service.LogIn(arg)
+	require.Error(t, err)
+	assert.Equal(t, errs.CodeFailedForbidden, code)
+	assert.Equal(t, errEmailNotVerified, err)
+
+	code, err = service.VerifyEmail(lastVerificationTokenTest(t, signUpReq.Email))
+	require.NoError(t, err)
+	assert.Equal(t, errs.CodeSuccess, code)
+
+	_, accessToken, _, code, err := service.LogIn(arg)
+	require.NoError(t, err)
+	assert.Equal(t, errs.CodeSuccess, code)
+	assert.NotEmpty(t, accessToken)
+}
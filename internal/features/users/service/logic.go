@@ -2,9 +2,9 @@ package service
 
 import (
 	"context"
-	"crypto/rsa"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -13,28 +13,75 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
 
+	cfg "github.com/dwiw96/ran-user-management/config"
 	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	mailer "github.com/dwiw96/ran-user-management/pkg/mailer"
 	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
 	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
 )
 
 type usersService struct {
-	repo  pUsers.IRepository
-	cache pUsers.ICache
-	ctx   context.Context
+	repo     pUsers.IRepository
+	cache    pUsers.ICache
+	mailer   mailer.Mailer
+	lifetime cfg.TokenLifetimeConfig
+	// email verification config
+	emailVerification cfg.EmailVerificationConfig
+	passwordReset     cfg.PasswordResetConfig
+	// passwordless login by email
+	magicLink cfg.MagicLinkConfig
+	// limit of failed login
+	loginProtection cfg.LoginProtectionConfig
+	// passkey config
+	webAuthn cfg.WebAuthnConfig
+	// base url of the service as OpenID Connect issuer
+	issuer string
+	// audience of access token for this service
+	audience string
+	ctx      context.Context
 }
 
-func NewUsersService(repo pUsers.IRepository, cache pUsers.ICache, ctx context.Context) pUsers.IService {
+func NewUsersService(repo pUsers.IRepository, cache pUsers.ICache, mailer mailer.Mailer, lifetime cfg.TokenLifetimeConfig, emailVerification cfg.EmailVerificationConfig, passwordReset cfg.PasswordResetConfig, magicLink cfg.MagicLinkConfig, loginProtection cfg.LoginProtectionConfig, webAuthn cfg.WebAuthnConfig, issuer, audience string, ctx context.Context) pUsers.IService {
 	return &usersService{
-		repo:  repo,
-		cache: cache,
-		ctx:   ctx,
+		repo:              repo,
+		cache:             cache,
+		mailer:            mailer,
+		lifetime:          lifetime,
+		emailVerification: emailVerification,
+		passwordReset:     passwordReset,
+		magicLink:         magicLink,
+		loginProtection:   loginProtection,
+		webAuthn:          webAuthn,
+		issuer:            issuer,
+		audience:          audience,
+		ctx:               ctx,
 	}
 }
 
+// roleScopes is the scopes that the user of the role can be granted
+var roleScopes = map[string][]string{
+	pUsers.RoleUser:  {pUsers.ScopeUsersRead, pUsers.ScopeUsersWrite},
+	pUsers.RoleAdmin: {pUsers.ScopeUsersRead, pUsers.ScopeUsersWrite, pUsers.ScopeAdmin},
+}
+
+// checkUserScope check the role of the user can be granted all the requested
+// scopes, OpenID Connect scopes can always be requested.
+func checkUserScope(role, scope string) error {
+	allowed := append([]string{pUsers.ScopeOpenID, pUsers.ScopeProfile, pUsers.ScopeEmail}, roleScopes[role]...)
+	if !scopeContains(strings.Join(allowed, " "), scope) {
+		return fmt.Errorf("scope is not allowed for the user, allowed scopes: %s", strings.Join(allowed, " "))
+	}
+
+	return nil
+}
+
 var (
-	errRefreshTokenExp = errors.New("refresh token is expires")
+	errRefreshTokenExp   = errors.New("refresh token is expires")
+	errSessionIdle       = errors.New("session is idle for too long, please login again")
+	errRefreshTokenReuse = errors.New("refresh token has been used before, all sessions of the token are revoked")
+	errNotAdmin          = errors.New("only admin can access this resource")
+	errEmailNotVerified  = errors.New("email is not verified, please verify the email first")
 )
 
 func handleError(arg error) (code int, err error) {
@@ -99,55 +146,235 @@ func (s *usersService) SignUp(input pUsers.SignupRequest) (user *pUsers.User, co
 		return nil, code, err
 	}
 
+	// the user is created even when the email can't be sent, the user can
+	// request the email again
+	err = s.sendVerificationEmail(user)
+	if err != nil {
+		log.Println("failed to send verification email, err:", err)
+	}
+
 	return user, errs.CodeSuccessCreate, nil
 }
 
 func (s *usersService) LogIn(input pUsers.LoginRequest) (user *pUsers.User, accessToken, refreshToken string, code int, err error) {
+	attempt := pUsers.LoginAttempt{
+		Email:     input.Email,
+		IPAddress: input.IPAddress,
+	}
+	code, err = s.checkLoginThrottle(attempt)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
 	user, err = s.repo.GetUserByEmail(s.ctx, input.Email)
 	if err != nil {
+		// guessing unregistered email is counted too
+		if errors.Is(err, pgx.ErrNoRows) {
+			code, errFailure := s.recordLoginFailure(attempt, nil)
+			if errFailure != nil {
+				return nil, "", "", code, errFailure
+			}
+		}
 		code, err = handleError(err)
 		return nil, "", "", code, err
 	}
 
+	code, err = checkUserLocked(user)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
 	err = password.VerifyHashPassword(input.Password, user.HashedPassword)
 	if err != nil {
+		code, err = s.recordLoginFailure(attempt, user)
+		if err != nil {
+			return nil, "", "", code, err
+		}
 		errMsg := errors.New("password is wrong")
 		return nil, "", "", errs.CodeFailedUnauthorized, errMsg
 	}
 
-	key, err := s.repo.LoadKey(s.ctx)
+	scope, err := loginScope(user.Role, input.Scope)
 	if err != nil {
-		return nil, "", "", errs.CodeFailedServer, fmt.Errorf("load key error: %w", err)
+		return nil, "", "", errs.CodeFailedUser, err
 	}
 
-	accessToken, err = middleware.CreateToken(*user, 60, key)
+	// failures are kept until the second factor is verified, so the password
+	// can't be used to reset the failures of wrong code
+	mfaEnabled, err := s.mfaEnabled(user.ID)
 	if err != nil {
-		errMsg := errors.New("failed generate access token")
-		return nil, "", "", errs.CodeFailedServer, errMsg
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+	if mfaEnabled {
+		code, err = s.createMFAChallenge(user, pUsers.MFAChallenge{
+			DeviceName: input.DeviceName,
+			Scope:      scope,
+			AMR:        []string{pUsers.AMRPassword},
+		})
+		return nil, "", "", code, err
+	}
+
+	err = s.cache.DeleteLoginFailures(attempt)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+
+	accessToken, refreshToken, code, err = s.issueLoginTokens(user, sessionInfo{
+		DeviceName: input.DeviceName,
+		UserAgent:  input.UserAgent,
+		IPAddress:  input.IPAddress,
+		Claims: pUsers.SessionClaims{
+			Scope: scope,
+			AMR:   []string{pUsers.AMRPassword},
+		},
+	}, input.DPoP)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	return user, accessToken, refreshToken, errs.CodeSuccess, nil
+}
+
+// loginScope return the scope of first party login, the login is granted all
+// scopes of the role when it doesn't request any scope.
+func loginScope(role, requested string) (scope string, err error) {
+	scope = mergeScope("", requested)
+	if scope == "" {
+		scope = strings.Join(roleScopes[role], " ")
+	}
+	err = checkUserScope(role, scope)
+	if err != nil {
+		return "", err
+	}
+
+	return scope, nil
+}
+
+// issueLoginTokens issue the tokens of the user that is authenticated by
+// login. Tokens of the session are bound to the key of DPoP proof, the client
+// that doesn't send the proof get bearer token.
+func (s *usersService) issueLoginTokens(user *pUsers.User, input sessionInfo, dpop pUsers.DPoPRequest) (accessToken, refreshToken string, code int, err error) {
+	if dpop.Proof != "" {
+		proof, code, err := s.readDPoPProof(dpop)
+		if err != nil {
+			return "", "", code, err
+		}
+		input.Claims.Cnf = &pUsers.Confirmation{JKT: proof.JKT}
+	}
+
+	accessToken, refreshToken, _, code, err = s.issueTokens(user, input)
+	if err != nil {
+		return "", "", code, err
+	}
+
+	return accessToken, refreshToken, errs.CodeSuccess, nil
+}
+
+// sessionInfo is the device that the session is created for, Claims is put in
+// every access token of the session
+type sessionInfo struct {
+	DeviceName string
+	UserAgent  string
+	IPAddress  string
+	Claims     pUsers.SessionClaims
+}
+
+// issueTokens create new session for the authenticated user, and return the
+// access token and refresh token of the session. Every grant that issue token
+// for user go through here, so all of them issue the same tokens as LogIn.
+func (s *usersService) issueTokens(user *pUsers.User, input sessionInfo) (accessToken, refreshToken string, payload *pUsers.JwtPayload, code int, err error) {
+	// user that doesn't verify the email can't get token when it's required
+	if s.emailVerification.Required && !user.EmailVerifiedAt.Valid {
+		return "", "", nil, errs.CodeFailedForbidden, errEmailNotVerified
+	}
+
+	key, err := s.repo.LoadKey(s.ctx)
+	if err != nil {
+		return "", "", nil, errs.CodeFailedServer, fmt.Errorf("load key error: %w", err)
 	}
-	refreshTokenUUID, err := uuid.NewRandom()
+
+	refreshToken, err = password.GenerateRefreshToken()
 	if err != nil {
 		errMsg := errors.New("failed generate refresh token")
-		return nil, "", "", errs.CodeFailedServer, errMsg
+		return "", "", nil, errs.CodeFailedServer, errMsg
+	}
+	familyID, err := uuid.NewRandom()
+	if err != nil {
+		errMsg := errors.New("failed generate refresh token family")
+		return "", "", nil, errs.CodeFailedServer, errMsg
 	}
 
-	insertRefreshTokenArg := pUsers.InsertRefreshTokenParams{
-		UserID:       user.ID,
-		RefreshToken: pgtype.UUID{Bytes: refreshTokenUUID, Valid: true},
+	// lifetime can be overridden per client or per role, override of the role
+	// cap override of the client. Only client that is authenticated by oauth
+	// grant has its lifetime.
+	var lifetimeKeys []string
+	if input.Claims.ClientID != "" {
+		lifetimeKeys = append(lifetimeKeys, cfg.ClientLifetimeKey(input.Claims.ClientID))
+	}
+	lifetimeKeys = append(lifetimeKeys, cfg.RoleLifetimeKey(user.Role))
+	lifetimeKey, lifetime := s.lifetime.Get(lifetimeKeys...)
+
+	// auth_time is the login time unless the session is created from earlier login
+	if input.Claims.AuthTime == 0 {
+		input.Claims.AuthTime = time.Now().UTC().Unix()
 	}
-	err = s.repo.InsertRefreshToken(s.ctx, insertRefreshTokenArg)
+	if input.Claims.Audience == nil {
+		input.Claims.Audience = []string{s.audience}
+	}
+
+	// every login create new session, so the user can login from many devices
+	insertRefreshTokenArg := pUsers.InsertRefreshTokenParams{
+		UserID:           user.ID,
+		RefreshTokenHash: password.HashRefreshToken(refreshToken),
+		DeviceName:       input.DeviceName,
+		UserAgent:        input.UserAgent,
+		IPAddress:        input.IPAddress,
+		FamilyID:         pgtype.UUID{Bytes: familyID, Valid: true},
+		LifetimeKey:      lifetimeKey,
+		RefreshTokenTTL:  lifetime.RefreshTokenTTL,
+		AbsoluteLifetime: lifetime.AbsoluteLifetime,
+		ClientID:         input.Claims.ClientID,
+		Scope:            input.Claims.Scope,
+		AuthTime:         pgtype.Timestamp{Time: time.Unix(input.Claims.AuthTime, 0).UTC(), Valid: true},
+		AMR:              input.Claims.AMR,
+	}
+	session, err := s.repo.InsertRefreshToken(s.ctx, insertRefreshTokenArg)
 	if err != nil {
 		code, err = handleError(err)
-		return nil, "", "", code, err
+		return "", "", nil, code, err
+	}
+
+	accessToken, payload, err = middleware.CreateToken(*user, session.ID, input.Claims, lifetime.AccessTokenTTL, key)
+	if err != nil {
+		errMsg := errors.New("failed generate access token")
+		return "", "", nil, errs.CodeFailedServer, errMsg
 	}
 
-	refreshToken = refreshTokenUUID.String()
+	// keep the access token id in the session, so the token can be blocklisted
+	// when the session is revoked from other device
+	accessTokenID, accessTokenExpiresAt := accessTokenOfPayload(payload)
+	updateSessionArg := pUsers.UpdateSessionAccessTokenParams{
+		ID:                   session.ID,
+		UserID:               user.ID,
+		AccessTokenID:        accessTokenID,
+		AccessTokenExpiresAt: accessTokenExpiresAt,
+	}
+	err = s.repo.UpdateSessionAccessToken(s.ctx, updateSessionArg)
+	if err != nil {
+		code, err = handleError(err)
+		return "", "", nil, code, err
+	}
 
-	return user, accessToken, refreshToken, errs.CodeSuccess, nil
+	return accessToken, refreshToken, payload, errs.CodeSuccess, nil
 }
 
+// LogOut revoke only the session of the access token, other devices stay login.
 func (s *usersService) LogOut(payload pUsers.JwtPayload) error {
-	err := s.repo.DeleteRefreshToken(s.ctx, payload.UserID)
+	arg := pUsers.DeleteRefreshTokenByIDParams{
+		ID:     payload.SessionID,
+		UserID: payload.UserID,
+	}
+	_, err := s.repo.DeleteRefreshTokenByID(s.ctx, arg)
 	if err != nil {
 		return err
 	}
@@ -166,38 +393,55 @@ func (s *usersService) DeleteUser(arg pUsers.SoftDeleteUserParams) (code int, er
 	return errs.CodeSuccess, nil
 }
 
-func (s *usersService) RefreshToken(refreshToken, accessToken string) (newRefreshToken, newAccessToken string, code int, err error) {
+func (s *usersService) RefreshToken(refreshToken, accessToken string, dpop pUsers.DPoPRequest) (newRefreshToken, newAccessToken string, code int, err error) {
 	key, err := s.repo.LoadKey(s.ctx)
 	if err != nil {
 		return "", "", errs.CodeFailedServer, err
 	}
 
+	// access token may be signed with key that is rotated out but not retired yet
+	verificationKeys, err := s.repo.ListVerificationKeys(s.ctx)
+	if err != nil {
+		return "", "", errs.CodeFailedServer, err
+	}
+
 	authHeader := "Bearer " + accessToken
-	payload, err := middleware.ReadToken(authHeader, key)
+	payload, err := middleware.ReadToken(authHeader, middleware.NewKeySet(verificationKeys...))
 	if err != nil {
 		return "", "", errs.CodeFailedServer, err
 	}
 
-	err = s.cache.CachingBlockedToken(*payload)
+	// stolen tokens of the session that is bound to DPoP key can't be refreshed
+	// without the key
+	code, err = s.checkSessionDPoP(payload, dpop)
 	if err != nil {
-		return "", "", errs.CodeFailedServer, fmt.Errorf("failed to caching access token, msg: %v", err)
+		return "", "", code, err
 	}
 
-	refreshTokenUUID, err := uuid.Parse(refreshToken)
+	err = s.cache.CachingBlockedToken(*payload)
 	if err != nil {
-		return "", "", errs.CodeFailedServer, fmt.Errorf("failed to convert refresh token from string to uuid, msg: %v", err)
+		return "", "", errs.CodeFailedServer, fmt.Errorf("failed to caching access token, msg: %v", err)
 	}
 
-	// Read and validate refresh token from database
+	// Read and validate refresh token from database, refresh token is looked up by its digest
 	getRefreshTokenArg := pUsers.GetRefreshTokenParams{
-		UserID:       payload.UserID,
-		RefreshToken: pgtype.UUID{Bytes: refreshTokenUUID, Valid: true},
+		UserID:           payload.UserID,
+		RefreshTokenHash: password.HashRefreshToken(refreshToken),
 	}
 	resGetRefreshToken, errReadRefreshToken := s.repo.GetRefreshToken(s.ctx, getRefreshTokenArg)
+	if errors.Is(errReadRefreshToken, pgx.ErrNoRows) {
+		code, err = s.detectRefreshTokenReuse(getRefreshTokenArg)
+		if err != nil {
+			return "", "", code, err
+		}
+	}
 	err = s.validateRefreshToken(resGetRefreshToken, errReadRefreshToken)
 	if err != nil {
 		return "", "", errs.CodeFailedUnauthorized, err
 	}
+	if resGetRefreshToken.ID != payload.SessionID {
+		return "", "", errs.CodeFailedUnauthorized, errors.New("refresh token doesn't belong to the access token session")
+	}
 
 	// When the refresh token is expired:
 	// delete refresh token from database
@@ -210,15 +454,39 @@ func (s *usersService) RefreshToken(refreshToken, accessToken string) (newRefres
 		return "", "", errs.CodeFailedUnauthorized, errRefreshTokenExp
 	}
 
-	var newRefreshTokenUUID uuid.UUID
-	newAccessToken, newRefreshTokenUUID, err = s.createNewToken(key, payload)
+	// When the session is not used longer than idle timeout:
+	// end the session
+	_, lifetime := s.lifetime.Get(resGetRefreshToken.LifetimeKey)
+	if lifetime.IdleTimeout > 0 && time.Now().UTC().After(resGetRefreshToken.LastUsedAt.Time.Add(lifetime.IdleTimeout)) {
+		deleteArg := pUsers.DeleteRefreshTokenByIDParams{
+			ID:     resGetRefreshToken.ID,
+			UserID: resGetRefreshToken.UserID,
+		}
+		_, err = s.repo.DeleteRefreshTokenByID(s.ctx, deleteArg)
+		if err != nil {
+			return "", "", errs.CodeFailedServer, fmt.Errorf("failed to process idle session, msg: %v", err)
+		}
+
+		return "", "", errs.CodeFailedUnauthorized, errSessionIdle
+	}
+
+	// new token carry the current profile of the user instead of the profile
+	// in the old token
+	user, err := s.tokenUser(payload)
 	if err != nil {
 		return "", "", errs.CodeFailedServer, err
 	}
-	fmt.Println("new refesh token uuid:", newRefreshTokenUUID)
+	if user == nil {
+		return "", "", errs.CodeFailedUnauthorized, errUserNotFound
+	}
 
-	newRefreshToken = newRefreshTokenUUID.String()
-	fmt.Println("new refesh token:", newRefreshToken)
+	newAccessToken, newRefreshToken, _, err = s.createNewToken(key, user, payload.SessionClaims(), resGetRefreshToken, lifetime)
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return "", "", errs.CodeFailedUnauthorized, errors.New("refresh token has been used")
+		}
+		return "", "", errs.CodeFailedServer, err
+	}
 
 	return newRefreshToken, newAccessToken, errs.CodeSuccess, nil
 }
@@ -233,7 +501,7 @@ func (s *usersService) validateRefreshToken(arg *pUsers.RefreshTokenWhitelist, e
 	if errIn != nil {
 		return fmt.Errorf("invalid refresh token, msg: %v", errIn)
 	}
-	if !arg.RefreshToken.Valid {
+	if len(arg.RefreshTokenHash) == 0 {
 		return fmt.Errorf("invalid refresh token")
 	}
 
@@ -242,7 +510,11 @@ func (s *usersService) validateRefreshToken(arg *pUsers.RefreshTokenWhitelist, e
 
 func (s *usersService) deleteRefreshToken(arg *pUsers.RefreshTokenWhitelist) (err error) {
 	if time.Now().UTC().After(arg.ExpiresAt.Time) {
-		err = s.repo.DeleteRefreshToken(s.ctx, arg.UserID)
+		deleteArg := pUsers.DeleteRefreshTokenByIDParams{
+			ID:     arg.ID,
+			UserID: arg.UserID,
+		}
+		_, err = s.repo.DeleteRefreshTokenByID(s.ctx, deleteArg)
 		if err != nil {
 			return fmt.Errorf("failed to process expired refresh token, msg: %v", err)
 		}
@@ -252,26 +524,272 @@ func (s *usersService) deleteRefreshToken(arg *pUsers.RefreshTokenWhitelist) (er
 	return nil
 }
 
-// createNewToken return new access token, new refresh token and error
-func (s *usersService) createNewToken(key *rsa.PrivateKey, payload *pUsers.JwtPayload) (newAccessToken string, newRefreshTokenUUID uuid.UUID, err error) {
-	user := pUsers.User{
-		ID:       payload.UserID,
-		Username: payload.Name,
-		Email:    payload.Email,
+// createNewToken return new access token, new refresh token, payload of the
+// new access token and error.
+// Only the refresh token of the session is rotated, other sessions are untouched.
+func (s *usersService) createNewToken(key *pUsers.SigningKey, user *pUsers.User, claims pUsers.SessionClaims, session *pUsers.RefreshTokenWhitelist, lifetime cfg.TokenLifetime) (newAccessToken, newRefreshToken string, newPayload *pUsers.JwtPayload, err error) {
+	// token that is issued before audience is added is refreshed for this service
+	if claims.Audience == nil {
+		claims.Audience = []string{s.audience}
 	}
 
-	newAccessToken, err = middleware.CreateToken(user, 60, key)
+	newAccessToken, newPayload, err = middleware.CreateToken(*user, session.ID, claims, lifetime.AccessTokenTTL, key)
 	if err != nil {
 		return
 	}
-	newRefreshTokenUUID, err = uuid.NewRandom()
+
+	newRefreshToken, err = password.GenerateRefreshToken()
 	if err != nil {
 		return
 	}
-	err = s.repo.UpdateRefreshToken(s.ctx, payload.UserID, newRefreshTokenUUID)
+	accessTokenID, accessTokenExpiresAt := accessTokenOfPayload(newPayload)
+	arg := pUsers.UpdateRefreshTokenParams{
+		ID:                   session.ID,
+		UserID:               session.UserID,
+		FamilyID:             session.FamilyID,
+		RefreshTokenHash:     session.RefreshTokenHash,
+		NewRefreshTokenHash:  password.HashRefreshToken(newRefreshToken),
+		AccessTokenID:        accessTokenID,
+		AccessTokenExpiresAt: accessTokenExpiresAt,
+		RefreshTokenTTL:      lifetime.RefreshTokenTTL,
+	}
+	err = s.repo.UpdateRefreshToken(s.ctx, arg)
 	if err != nil {
 		return
 	}
 
 	return
 }
+
+// detectRefreshTokenReuse check if the refresh token that not found in whitelist
+// is a refresh token that already rotated. Reuse of rotated refresh token means
+// the token is stolen, so every refresh token in the family is revoked, the
+// access tokens are blocklisted and security event is recorded.
+func (s *usersService) detectRefreshTokenReuse(arg pUsers.GetRefreshTokenParams) (code int, err error) {
+	rotated, err := s.repo.GetRotatedRefreshToken(s.ctx, arg)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errs.CodeSuccess, nil
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to check refresh token history, msg: %v", err)
+	}
+
+	return s.revokeReusedRefreshToken(rotated)
+}
+
+// revokeReusedRefreshToken revoke the family of the rotated refresh token that
+// is reused and record the security event.
+func (s *usersService) revokeReusedRefreshToken(rotated *pUsers.RefreshTokenHistory) (code int, err error) {
+	revokeArg := pUsers.RevokeRefreshTokenFamilyParams{
+		UserID:   rotated.UserID,
+		FamilyID: rotated.FamilyID,
+	}
+	sessions, err := s.repo.RevokeRefreshTokenFamily(s.ctx, revokeArg)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to revoke refresh token family, msg: %v", err)
+	}
+
+	for _, session := range sessions {
+		err = s.blockSessionAccessToken(session)
+		if err != nil {
+			return errs.CodeFailedServer, err
+		}
+	}
+
+	eventArg := pUsers.InsertSecurityEventParams{
+		UserID:      pgtype.Int4{Int32: rotated.UserID, Valid: true},
+		EventType:   pUsers.SecurityEventRefreshTokenReuse,
+		Description: fmt.Sprintf("rotated refresh token of family %s is reused, %d session revoked", uuid.UUID(rotated.FamilyID.Bytes), len(sessions)),
+	}
+	err = s.repo.InsertSecurityEvent(s.ctx, eventArg)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to record security event, msg: %v", err)
+	}
+
+	return errs.CodeFailedUnauthorized, errRefreshTokenReuse
+}
+
+// accessTokenOfPayload return access token id and expiration to be saved in the session.
+func accessTokenOfPayload(payload *pUsers.JwtPayload) (pgtype.UUID, pgtype.Timestamp) {
+	id := pgtype.UUID{Bytes: payload.ID, Valid: true}
+	exp := pgtype.Timestamp{Time: time.Unix(payload.Exp, 0).UTC(), Valid: true}
+
+	return id, exp
+}
+
+// blockSessionAccessToken add the live access token of revoked session into
+// blocklist, so the device is logged out right away instead of waiting the
+// access token to expire.
+func (s *usersService) blockSessionAccessToken(session pUsers.RefreshTokenWhitelist) error {
+	if !session.AccessTokenID.Valid || !session.AccessTokenExpiresAt.Valid {
+		return nil
+	}
+
+	payload := pUsers.JwtPayload{
+		ID:     session.AccessTokenID.Bytes,
+		UserID: session.UserID,
+		Exp:    session.AccessTokenExpiresAt.Time.Unix(),
+	}
+	err := s.cache.CachingBlockedToken(payload)
+	if err != nil {
+		return fmt.Errorf("failed to block access token of session %d, msg: %v", session.ID, err)
+	}
+
+	return nil
+}
+
+func (s *usersService) ListSessions(payload pUsers.JwtPayload) (sessions []pUsers.RefreshTokenWhitelist, code int, err error) {
+	sessions, err = s.repo.ListRefreshTokenByUserID(s.ctx, payload.UserID)
+	if err != nil {
+		code, err = handleError(err)
+		return nil, code, err
+	}
+
+	return sessions, errs.CodeSuccess, nil
+}
+
+// RevokeSession delete one session of the user and blocklist its access token.
+func (s *usersService) RevokeSession(payload pUsers.JwtPayload, sessionID int32) (code int, err error) {
+	arg := pUsers.DeleteRefreshTokenByIDParams{
+		ID:     sessionID,
+		UserID: payload.UserID,
+	}
+	session, err := s.repo.DeleteRefreshTokenByID(s.ctx, arg)
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return errs.CodeFailedNotFound, errors.New("session not found")
+		}
+		code, err = handleError(err)
+		return code, err
+	}
+
+	err = s.blockSessionAccessToken(*session)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// LogOutOtherSessions delete all sessions of the user except the current one.
+func (s *usersService) LogOutOtherSessions(payload pUsers.JwtPayload) (code int, err error) {
+	arg := pUsers.DeleteRefreshTokenByIDParams{
+		ID:     payload.SessionID,
+		UserID: payload.UserID,
+	}
+	sessions, err := s.repo.DeleteOtherRefreshToken(s.ctx, arg)
+	if err != nil {
+		code, err = handleError(err)
+		return code, err
+	}
+
+	for _, session := range sessions {
+		err = s.blockSessionAccessToken(session)
+		if err != nil {
+			return errs.CodeFailedServer, err
+		}
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// GetJWKS return public keys of the keys that token is still verified with, so
+// other services can verify the token without the private key.
+func (s *usersService) GetJWKS() (jwks *pUsers.JWKSet, code int, err error) {
+	keys, err := s.repo.ListVerificationKeys(s.ctx)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	jwks = &pUsers.JWKSet{Keys: []pUsers.JWK{}}
+	for _, key := range keys {
+		jwk, err := password.PublicJWK(key.Kid, key.Alg, key.PrivateKey.Public())
+		if err != nil {
+			return nil, errs.CodeFailedServer, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks, errs.CodeSuccess, nil
+}
+
+// checkAdmin return forbidden error when the user of the token is not admin
+func (s *usersService) checkAdmin(payload pUsers.JwtPayload) (code int, err error) {
+	user, err := s.repo.GetUserByID(s.ctx, payload.UserID)
+	if err != nil {
+		code, err = handleError(err)
+		return code, err
+	}
+
+	if user.Role != pUsers.RoleAdmin {
+		return errs.CodeFailedForbidden, errNotAdmin
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+func (s *usersService) ListSigningKeys(payload pUsers.JwtPayload) (keys []pUsers.SigningKey, code int, err error) {
+	code, err = s.checkAdmin(payload)
+	if err != nil {
+		return nil, code, err
+	}
+
+	keys, err = s.repo.ListSigningKeys(s.ctx)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	return keys, errs.CodeSuccess, nil
+}
+
+// RotateSigningKey generate new active key, token signed with the previous key
+// is still valid until the previous key is retired. The new key use the same
+// algorithm as the previous key when alg is empty.
+func (s *usersService) RotateSigningKey(payload pUsers.JwtPayload, alg string) (key *pUsers.SigningKey, code int, err error) {
+	code, err = s.checkAdmin(payload)
+	if err != nil {
+		return nil, code, err
+	}
+
+	if alg == "" {
+		activeKey, err := s.repo.LoadKey(s.ctx)
+		if err != nil {
+			return nil, errs.CodeFailedServer, err
+		}
+		alg = activeKey.Alg
+	}
+
+	privateKey, kid, err := password.GenerateSigningKey(alg)
+	if err != nil {
+		return nil, errs.CodeFailedUser, err
+	}
+
+	arg := pUsers.InsertSigningKeyParams{
+		Kid:        kid,
+		Alg:        alg,
+		PrivateKey: privateKey,
+	}
+	key, err = s.repo.RotateSigningKey(s.ctx, arg)
+	if err != nil {
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to rotate signing key, msg: %v", err)
+	}
+
+	return key, errs.CodeSuccess, nil
+}
+
+func (s *usersService) RetireSigningKey(payload pUsers.JwtPayload, kid string) (code int, err error) {
+	code, err = s.checkAdmin(payload)
+	if err != nil {
+		return code, err
+	}
+
+	err = s.repo.RetireSigningKey(s.ctx, kid)
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return errs.CodeFailedNotFound, errors.New("verifying key not found, active key must be rotated before retired")
+		}
+		return errs.CodeFailedServer, err
+	}
+
+	return errs.CodeSuccess, nil
+}
@@ -6,19 +6,21 @@ import (
 
 	"strings"
 	"testing"
+	"time"
 
+	cfg "github.com/dwiw96/ran-user-management/config"
 	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
 	cache "github.com/dwiw96/ran-user-management/internal/features/users/cache"
 	repo "github.com/dwiw96/ran-user-management/internal/features/users/repository"
 
+	mailer "github.com/dwiw96/ran-user-management/pkg/mailer"
 	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
 	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
 	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
 	testUtils "github.com/dwiw96/ran-user-management/testutils"
 
-	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -26,24 +28,58 @@ import (
 
 var (
 	serviceTest pUsers.IService
+	cacheTest   pUsers.ICache
 	poolTest    *pgxpool.Pool
 	ctx         context.Context
 	repoTest    pUsers.IRepository
+	mailerTest  *mailer.MemoryMailer
 )
 
+const (
+	issuerTest   = "http://localhost:8080"
+	audienceTest = "ran-user-management"
+)
+
+var emailVerificationTest = cfg.EmailVerificationConfig{
+	TokenTTL: cfg.DefaultEmailVerificationTTL,
+	URL:      issuerTest + "/verify_email",
+}
+
+var passwordResetTest = cfg.PasswordResetConfig{
+	TokenTTL: cfg.DefaultPasswordResetTTL,
+	URL:      issuerTest + "/reset_password",
+}
+
+var magicLinkTest = cfg.MagicLinkConfig{
+	TokenTTL:    cfg.DefaultMagicLink.TokenTTL,
+	MaxAttempts: cfg.DefaultMagicLink.MaxAttempts,
+	URL:         issuerTest + "/magic_login",
+}
+
+var loginProtectionTest = cfg.DefaultLoginProtection
+
+var webAuthnTest = cfg.WebAuthnConfig{
+	RPID:             "localhost",
+	RPName:           "ran-user-management",
+	Origins:          []string{issuerTest},
+	Timeout:          cfg.DefaultWebAuthnTimeout,
+	UserVerification: cfg.UserVerificationPreferred,
+}
+
 func TestMain(m *testing.M) {
 	poolTest = testUtils.GetPool()
 	ctx = testUtils.GetContext()
 
 	schemaCleanup := testUtils.SetupDB("test_service_auth")
 
-	password.JwtInit(poolTest, ctx)
+	password.JwtInit(poolTest, ctx, password.DefaultSigningAlg, testUtils.GetKeyEncryptionKey())
 
 	client := testUtils.GetRedisClient()
 
-	repoTest = repo.NewUsersRepository(poolTest, poolTest)
-	cacheTest := cache.NewUsersCache(client, ctx)
-	serviceTest = NewUsersService(repoTest, cacheTest, ctx)
+	repoTest = repo.NewUsersRepository(poolTest, poolTest, testUtils.GetKeyEncryptionKey())
+	cacheTest = cache.NewUsersCache(client, ctx)
+	mailerTest = mailer.NewMemoryMailer()
+	serviceTest = NewUsersService(repoTest, cacheTest, mailerTest, cfg.TokenLifetimeConfig{Default: cfg.DefaultTokenLifetime}, emailVerificationTest, passwordResetTest, magicLinkTest, loginProtectionTest, webAuthnTest, issuerTest, audienceTest, ctx)
 
 	exitTest := m.Run()
 
@@ -292,6 +328,54 @@ func TestLogIn(t *testing.T) {
 			}
 		})
 	}
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	scopeTestCases := []struct {
+		name  string
+		scope string
+		res   string
+		code  int
+	}{
+		{
+			name:  "success_all_scopes_of_role",
+			scope: "",
+			res:   "users:read users:write",
+			code:  errs.CodeSuccess,
+		}, {
+			name:  "success_requested_scope",
+			scope: "users:read openid",
+			res:   "users:read openid",
+			code:  errs.CodeSuccess,
+		}, {
+			name:  "failed_scope_not_allowed_for_role",
+			scope: "users:read admin",
+			code:  errs.CodeFailedUser,
+		},
+	}
+
+	for _, tC := range scopeTestCases {
+		t.Run(tC.name, func(t *testing.T) {
+			arg := pUsers.LoginRequest{
+				Email:    signUpReq.Email,
+				Password: signUpReq.Password,
+				Scope:    tC.scope,
+			}
+			_, accessToken, _, code, err := serviceTest.LogIn(arg)
+			assert.Equal(t, tC.code, code)
+			if tC.code != errs.CodeSuccess {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+			require.NoError(t, err)
+			assert.Equal(t, tC.res, payload.Scope)
+			assert.Equal(t, jwt.ClaimStrings{audienceTest}, payload.Audience)
+		})
+	}
 }
 
 func TestLogOut(t *testing.T) {
@@ -315,7 +399,7 @@ func TestLogOut(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, key)
 
-	payload, err := middleware.ReadToken(accessToken, key)
+	payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
 	require.NoError(t, err)
 
 	t.Run("success", func(t *testing.T) {
@@ -329,15 +413,358 @@ func TestLogOut(t *testing.T) {
 	})
 }
 
-func insertRefreshTokenTest(t *testing.T, userID int32) uuid.UUID {
-	refreshToken, err := uuid.NewRandom()
+func TestLogInMultipleDevices(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	_, signUpReq := createUser(t)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	var payloads []*pUsers.JwtPayload
+	var refreshTokens []string
+	for _, device := range []string{"laptop", "phone"} {
+		argLogin := pUsers.LoginRequest{
+			Email:      signUpReq.Email,
+			Password:   signUpReq.Password,
+			DeviceName: device,
+		}
+		_, accessToken, refreshToken, code, err := serviceTest.LogIn(argLogin)
+		require.NoError(t, err)
+		require.Equal(t, errs.CodeSuccess, code)
+
+		payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.NotZero(t, payload.SessionID)
+
+		payloads = append(payloads, payload)
+		refreshTokens = append(refreshTokens, refreshToken)
+	}
+	assert.NotEqual(t, payloads[0].SessionID, payloads[1].SessionID)
+
+	// logout from the laptop only revoke the laptop session
+	err = serviceTest.LogOut(*payloads[0])
+	require.NoError(t, err)
+
+	for i, refreshToken := range refreshTokens {
+		arg := pUsers.GetRefreshTokenParams{
+			UserID:           payloads[i].UserID,
+			RefreshTokenHash: password.HashRefreshToken(refreshToken),
+		}
+		_, err = repoTest.GetRefreshToken(ctx, arg)
+		if i == 0 {
+			require.Error(t, err)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
+
+func loginDevicesTest(t *testing.T, signUpReq pUsers.SignupRequest, devices []string) (payloads []*pUsers.JwtPayload) {
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	for _, device := range devices {
+		argLogin := pUsers.LoginRequest{
+			Email:      signUpReq.Email,
+			Password:   signUpReq.Password,
+			DeviceName: device,
+		}
+		_, accessToken, _, code, err := serviceTest.LogIn(argLogin)
+		require.NoError(t, err)
+		require.Equal(t, errs.CodeSuccess, code)
+
+		payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+
+		payloads = append(payloads, payload)
+	}
+
+	return
+}
+
+func TestListSessions(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	_, signUpReq := createUser(t)
+	payloads := loginDevicesTest(t, signUpReq, []string{"laptop", "phone", "tablet"})
+
+	sessions, code, err := serviceTest.ListSessions(*payloads[0])
+	require.NoError(t, err)
+	assert.Equal(t, errs.CodeSuccess, code)
+	require.Len(t, sessions, 3)
+
+	var devices []string
+	for _, v := range sessions {
+		devices = append(devices, v.DeviceName)
+		assert.True(t, v.AccessTokenID.Valid)
+	}
+	assert.ElementsMatch(t, []string{"laptop", "phone", "tablet"}, devices)
+}
+
+func TestRevokeSession(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	_, signUpReq := createUser(t)
+	payloads := loginDevicesTest(t, signUpReq, []string{"laptop", "phone"})
+
+	t.Run("success", func(t *testing.T) {
+		code, err := serviceTest.RevokeSession(*payloads[0], payloads[1].SessionID)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		// access token of the revoked session is blocked right away
+		err = cacheTest.CheckBlockedToken(*payloads[1])
+		require.Error(t, err)
+		err = cacheTest.CheckBlockedToken(*payloads[0])
+		require.NoError(t, err)
+	})
+
+	t.Run("failed_not_found", func(t *testing.T) {
+		code, err := serviceTest.RevokeSession(*payloads[0], payloads[1].SessionID)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedNotFound, code)
+	})
+}
+
+func TestLogOutOtherSessions(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	_, signUpReq := createUser(t)
+	payloads := loginDevicesTest(t, signUpReq, []string{"laptop", "phone", "tablet"})
+
+	code, err := serviceTest.LogOutOtherSessions(*payloads[0])
+	require.NoError(t, err)
+	assert.Equal(t, errs.CodeSuccess, code)
+
+	sessions, _, err := serviceTest.ListSessions(*payloads[0])
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, payloads[0].SessionID, sessions[0].ID)
+
+	err = cacheTest.CheckBlockedToken(*payloads[0])
+	require.NoError(t, err)
+	for _, payload := range payloads[1:] {
+		err = cacheTest.CheckBlockedToken(*payload)
+		require.Error(t, err)
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	_, signUpReq := createUser(t)
+
+	argLogin := pUsers.LoginRequest{
+		Email:    signUpReq.Email,
+		Password: signUpReq.Password,
+	}
+	_, accessToken, refreshToken, _, err := serviceTest.LogIn(argLogin)
+	require.NoError(t, err)
+
+	// legit client rotate the refresh token
+	newRefreshToken, newAccessToken, code, err := serviceTest.RefreshToken(refreshToken, strings.Split(accessToken, " ")[1], pUsers.DPoPRequest{})
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+	newPayload, err := middleware.ReadToken(newAccessToken, middleware.NewKeySet(*key))
+	require.NoError(t, err)
+	// authentication of the login is kept in the refreshed token
+	assert.NotZero(t, newPayload.AuthTime)
+	assert.Equal(t, []string{pUsers.AMRPassword}, newPayload.AMR)
+
+	// attacker replay the old refresh token
+	_, _, code, err = serviceTest.RefreshToken(refreshToken, strings.Split(newAccessToken, " ")[1], pUsers.DPoPRequest{})
+	require.Error(t, err)
+	assert.Equal(t, errs.CodeFailedUnauthorized, code)
+	assert.Equal(t, errRefreshTokenReuse, err)
+
+	// the whole family is revoked, include the newest refresh token
+	_, _, code, err = serviceTest.RefreshToken(newRefreshToken, strings.Split(newAccessToken, " ")[1], pUsers.DPoPRequest{})
+	require.Error(t, err)
+	assert.Equal(t, errs.CodeFailedUnauthorized, code)
+
+	err = cacheTest.CheckBlockedToken(*newPayload)
+	require.Error(t, err)
+
+	var count int
+	err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM security_events WHERE user_id = $1 AND event_type = $2", newPayload.UserID, pUsers.SecurityEventRefreshTokenReuse).Scan(&count)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestLifetimeOverride(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t, false)
+	user, signUpReq := createUser(t)
+
+	lifetime := cfg.TokenLifetimeConfig{
+		Default: cfg.DefaultTokenLifetime,
+		Overrides: map[string]cfg.TokenLifetime{
+			cfg.ClientLifetimeKey(client.ClientID): {
+				AccessTokenTTL:   15 * time.Minute,
+				RefreshTokenTTL:  720 * time.Hour,
+				AbsoluteLifetime: 2160 * time.Hour,
+				IdleTimeout:      time.Nanosecond,
+			},
+			cfg.RoleLifetimeKey(user.Role): {
+				AccessTokenTTL:   30 * time.Minute,
+				RefreshTokenTTL:  2 * time.Hour,
+				AbsoluteLifetime: 24 * time.Hour,
+				IdleTimeout:      time.Hour,
+			},
+		},
+	}
+	service := NewUsersService(repoTest, cacheTest, mailerTest, lifetime, emailVerificationTest, passwordResetTest, magicLinkTest, loginProtectionTest, webAuthnTest, issuerTest, audienceTest, ctx)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	t.Run("first_party_login_use_role", func(t *testing.T) {
+		_, accessToken, refreshToken, code, err := service.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+		require.NoError(t, err)
+		require.Equal(t, errs.CodeSuccess, code)
+
+		payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(30*time.Minute), time.Unix(payload.Exp, 0), time.Minute)
+
+		session, err := repoTest.GetRefreshTokenByHash(ctx, password.HashRefreshToken(refreshToken))
+		require.NoError(t, err)
+		assert.Equal(t, cfg.RoleLifetimeKey(user.Role), session.LifetimeKey)
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), session.ExpiresAt.Time, time.Minute)
+	})
+
+	t.Run("oauth_client_capped_by_role", func(t *testing.T) {
+		verifier, err := password.GenerateAuthorizationCode()
+		require.NoError(t, err)
+		authorizationCode := authorizeTest(t, pUsers.JwtPayload{UserID: user.ID, Name: user.Username, Email: user.Email}, pUsers.AuthorizeRequest{
+			ResponseType:        pUsers.ResponseTypeCode,
+			ClientID:            client.ClientID,
+			RedirectURI:         redirectURITest,
+			Scope:               "profile",
+			CodeChallenge:       password.CodeChallengeS256(verifier),
+			CodeChallengeMethod: password.CodeChallengeMethodS256,
+		})
+		res, code, err := service.Token(client, pUsers.TokenRequest{
+			GrantType:    pUsers.GrantTypeAuthorizationCode,
+			Code:         authorizationCode,
+			RedirectURI:  redirectURITest,
+			CodeVerifier: verifier,
+		})
+		require.NoError(t, err)
+		require.Equal(t, errs.CodeSuccess, code)
+
+		payload, err := middleware.ReadToken("Bearer "+res.AccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(15*time.Minute), time.Unix(payload.Exp, 0), time.Minute)
+
+		session, err := repoTest.GetRefreshTokenByHash(ctx, password.HashRefreshToken(res.RefreshToken))
+		require.NoError(t, err)
+		assert.Equal(t, cfg.ClientLifetimeKey(client.ClientID)+","+cfg.RoleLifetimeKey(user.Role), session.LifetimeKey)
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), session.ExpiresAt.Time, time.Minute)
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), session.AbsoluteExpiresAt.Time, time.Minute)
+
+		// idle timeout of the client is already passed
+		_, _, code, err = service.RefreshToken(res.RefreshToken, res.AccessToken, pUsers.DPoPRequest{})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errSessionIdle, err)
+	})
+}
+
+func TestRotateSigningKey(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user, signUpReq := createUser(t)
+
+	argLogin := pUsers.LoginRequest{
+		Email:    signUpReq.Email,
+		Password: signUpReq.Password,
+	}
+	_, accessToken, refreshToken, _, err := serviceTest.LogIn(argLogin)
+	require.NoError(t, err)
+
+	oldKey, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+	payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*oldKey))
+	require.NoError(t, err)
+
+	t.Run("error_not_admin", func(t *testing.T) {
+		res, code, err := serviceTest.RotateSigningKey(*payload, "")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedForbidden, code)
+		assert.Nil(t, res)
+	})
+
+	_, err = poolTest.Exec(ctx, "UPDATE users SET role = $1 WHERE id = $2", pUsers.RoleAdmin, user.ID)
+	require.NoError(t, err)
+
+	t.Run("error_unsupported_alg", func(t *testing.T) {
+		res, code, err := serviceTest.RotateSigningKey(*payload, "HS256")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+		assert.Nil(t, res)
+	})
+
+	newKey, code, err := serviceTest.RotateSigningKey(*payload, password.SigningAlgEdDSA)
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+	assert.NotEqual(t, oldKey.Kid, newKey.Kid)
+	assert.Equal(t, password.SigningAlgEdDSA, newKey.Alg)
+
+	jwks, code, err := serviceTest.GetJWKS()
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+	var kids []string
+	for _, v := range jwks.Keys {
+		kids = append(kids, v.Kid)
+	}
+	assert.Contains(t, kids, oldKey.Kid)
+	assert.Contains(t, kids, newKey.Kid)
+
+	// token signed with the old key is still accepted and the new token is
+	// signed with the new key
+	_, newAccessToken, code, err := serviceTest.RefreshToken(refreshToken, strings.Split(accessToken, " ")[1], pUsers.DPoPRequest{})
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+	assert.Equal(t, newKey.Kid, middleware.TokenKid(newAccessToken))
+
+	code, err = serviceTest.RetireSigningKey(*payload, oldKey.Kid)
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+
+	code, err = serviceTest.RetireSigningKey(*payload, newKey.Kid)
+	require.Error(t, err)
+	assert.Equal(t, errs.CodeFailedNotFound, code)
+
+	jwks, _, err = serviceTest.GetJWKS()
+	require.NoError(t, err)
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, newKey.Kid, jwks.Keys[0].Kid)
+}
+
+func insertRefreshTokenTest(t *testing.T, userID int32) string {
+	refreshToken, err := password.GenerateRefreshToken()
 	require.NoError(t, err)
 
 	arg := pUsers.InsertRefreshTokenParams{
-		UserID:       userID,
-		RefreshToken: pgtype.UUID{Bytes: refreshToken, Valid: true},
+		UserID:           userID,
+		RefreshTokenHash: password.HashRefreshToken(refreshToken),
+		RefreshTokenTTL:  time.Hour,
+		AbsoluteLifetime: 24 * time.Hour,
 	}
-	err = repoTest.InsertRefreshToken(ctx, arg)
+	_, err = repoTest.InsertRefreshToken(ctx, arg)
 	require.NoError(t, err)
 
 	return refreshToken
@@ -472,7 +899,7 @@ func TestRefreshToken(t *testing.T) {
 
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			newRefreshToken, newAccessToken, code, err := serviceTest.RefreshToken(tC.refreshToken, tC.accessToken)
+			newRefreshToken, newAccessToken, code, err := serviceTest.RefreshToken(tC.refreshToken, tC.accessToken, pUsers.DPoPRequest{})
 			if !tC.err {
 				require.NoError(t, err)
 				require.Equal(t, 200, code)
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+// checkLoginThrottle refuse login from the IP that fail too many login for any
+// email, and delay login of the email from the IP after it fail DelayAfter
+// times. The delay is doubled every failure.
+func (s *usersService) checkLoginThrottle(arg pUsers.LoginAttempt) (code int, err error) {
+	failures, err := s.cache.GetLoginFailures(arg, s.loginProtection.Window)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	now := time.Now().UTC()
+	if s.loginProtection.IPLimit > 0 && failures.IP.Count >= s.loginProtection.IPLimit {
+		return errs.CodeFailedTooMany, &pUsers.LoginThrottledError{
+			RetryAfter: failures.IP.Oldest.Add(s.loginProtection.Window).Sub(now),
+		}
+	}
+
+	delay := s.loginProtection.Delay(failures.EmailIP.Count)
+	if retryAfter := failures.EmailIP.Latest.Add(delay).Sub(now); delay > 0 && retryAfter > 0 {
+		return errs.CodeFailedTooMany, &pUsers.LoginThrottledError{RetryAfter: retryAfter}
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// checkUserLocked refuse login of the user that is locked, even when the
+// password is right.
+func checkUserLocked(user *pUsers.User) (code int, err error) {
+	if !user.LockedUntil.Valid {
+		return errs.CodeSuccess, nil
+	}
+
+	retryAfter := user.LockedUntil.Time.Sub(time.Now().UTC())
+	if retryAfter <= 0 {
+		return errs.CodeSuccess, nil
+	}
+
+	return errs.CodeFailedLocked, &pUsers.LoginThrottledError{Locked: true, RetryAfter: retryAfter}
+}
+
+// recordLoginFailure count the failed login, and lock the user when the email
+// fail LockoutAfter times from any IP. user is nil when the email is not
+// registered, the failure is still counted so the IP can be limited.
+func (s *usersService) recordLoginFailure(arg pUsers.LoginAttempt, user *pUsers.User) (code int, err error) {
+	failures, err := s.cache.AddLoginFailure(arg, s.loginProtection.Window)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+	if user == nil || s.loginProtection.LockoutAfter <= 0 || failures.Email.Count < s.loginProtection.LockoutAfter {
+		return errs.CodeSuccess, nil
+	}
+
+	lockArg := pUsers.LockUserParams{
+		ID:          user.ID,
+		LockedUntil: pgtype.Timestamp{Time: time.Now().UTC().Add(s.loginProtection.LockoutDuration), Valid: true},
+	}
+	err = s.repo.LockUser(s.ctx, lockArg)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to lock user, msg: %v", err)
+	}
+
+	// failures are counted again after the lock is expired
+	err = s.cache.DeleteLoginFailures(arg)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	eventArg := pUsers.InsertSecurityEventParams{
+		UserID:      pgtype.Int4{Int32: user.ID, Valid: true},
+		EventType:   pUsers.SecurityEventAccountLocked,
+		Description: fmt.Sprintf("%d failed login in %s, last from %s, locked for %s", failures.Email.Count, s.loginProtection.Window, arg.IPAddress, s.loginProtection.LockoutDuration),
+	}
+	err = s.repo.InsertSecurityEvent(s.ctx, eventArg)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to record security event, msg: %v", err)
+	}
+
+	return errs.CodeFailedLocked, &pUsers.LoginThrottledError{Locked: true, RetryAfter: s.loginProtection.LockoutDuration}
+}
+
+// UnlockUser allow the locked user to login again before the lock is expired,
+// failed login of the email is forgotten. Only admin can unlock user.
+func (s *usersService) UnlockUser(payload pUsers.JwtPayload, userID int32) (code int, err error) {
+	code, err = s.checkAdmin(payload)
+	if err != nil {
+		return code, err
+	}
+
+	user, err := s.activeUser(userID)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return errs.CodeFailedNotFound, errs.ErrNoData
+	}
+
+	err = s.repo.UnlockUser(s.ctx, user.ID)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to unlock user, msg: %v", err)
+	}
+
+	err = s.cache.DeleteLoginFailures(pUsers.LoginAttempt{Email: user.Email})
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	eventArg := pUsers.InsertSecurityEventParams{
+		UserID:      pgtype.Int4{Int32: user.ID, Valid: true},
+		EventType:   pUsers.SecurityEventAccountUnlocked,
+		Description: fmt.Sprintf("unlocked by admin %d", payload.UserID),
+	}
+	err = s.repo.InsertSecurityEvent(s.ctx, eventArg)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to record security event, msg: %v", err)
+	}
+
+	return errs.CodeSuccess, nil
+}
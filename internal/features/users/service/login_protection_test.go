@@ -0,0 +1,169 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// randomIPTest return random IP address, so failures of other test is not
+// counted
+func randomIPTest() string {
+	return fmt.Sprintf("10.%d.%d.%d", generator.RandomInt32(0, 255), generator.RandomInt32(0, 255), generator.RandomInt32(1, 254))
+}
+
+func requireThrottledTest(t *testing.T, err error, locked bool) {
+	var throttledErr *pUsers.LoginThrottledError
+	require.True(t, errors.As(err, &throttledErr))
+	assert.Equal(t, locked, throttledErr.Locked)
+	assert.Positive(t, throttledErr.RetryAfter)
+}
+
+func TestLogInProtection(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	loginProtection := cfg.LoginProtectionConfig{
+		Window:          time.Minute,
+		DelayAfter:      2,
+		BaseDelay:       time.Hour,
+		MaxDelay:        time.Hour,
+		LockoutAfter:    4,
+		LockoutDuration: 15 * time.Minute,
+		IPLimit:         6,
+	}
+	service := NewUsersService(repoTest, cacheTest, mailerTest, cfg.TokenLifetimeConfig{Default: cfg.DefaultTokenLifetime}, emailVerificationTest, passwordResetTest, magicLinkTest, loginProtection, webAuthnTest, issuerTest, audienceTest, ctx)
+
+	t.Run("delay", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		ip := randomIPTest()
+		arg := pUsers.LoginRequest{Email: signUpReq.Email, Password: "wrong password", IPAddress: ip}
+
+		for i := 0; i < 2; i++ {
+			_, _, _, code, err := service.LogIn(arg)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		}
+
+		// right password must wait too
+		arg.Password = signUpReq.Password
+		_, _, _, code, err := service.LogIn(arg)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedTooMany, code)
+		requireThrottledTest(t, err, false)
+
+		// other IP is not delayed, and success login forget the failures
+		arg.IPAddress = randomIPTest()
+		_, accessToken, _, code, err := service.LogIn(arg)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.NotEmpty(t, accessToken)
+
+		failures, err := cacheTest.GetLoginFailures(pUsers.LoginAttempt{Email: signUpReq.Email, IPAddress: ip}, loginProtection.Window)
+		require.NoError(t, err)
+		assert.Zero(t, failures.Email.Count)
+	})
+
+	t.Run("lockout", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		arg := pUsers.LoginRequest{Email: signUpReq.Email, Password: "wrong password"}
+
+		for i := 0; i < 3; i++ {
+			arg.IPAddress = randomIPTest()
+			_, _, _, code, err := service.LogIn(arg)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		}
+
+		arg.IPAddress = randomIPTest()
+		_, _, _, code, err := service.LogIn(arg)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedLocked, code)
+		requireThrottledTest(t, err, true)
+
+		res, err := repoTest.GetUserByID(ctx, user.ID)
+		require.NoError(t, err)
+		require.True(t, res.LockedUntil.Valid)
+		assert.WithinDuration(t, time.Now().UTC().Add(loginProtection.LockoutDuration), res.LockedUntil.Time, 5*time.Second)
+
+		// right password is refused while the user is locked
+		arg.Password = signUpReq.Password
+		arg.IPAddress = randomIPTest()
+		_, _, _, code, err = service.LogIn(arg)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedLocked, code)
+		requireThrottledTest(t, err, true)
+
+		var count int
+		err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM security_events WHERE user_id = $1 AND event_type = $2", user.ID, pUsers.SecurityEventAccountLocked).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("unlock", func(t *testing.T) {
+		admin, _ := createUser(t)
+		_, err := poolTest.Exec(ctx, "UPDATE users SET role = $1 WHERE id = $2", pUsers.RoleAdmin, admin.ID)
+		require.NoError(t, err)
+		adminPayload := pUsers.JwtPayload{UserID: admin.ID, Email: admin.Email}
+
+		user, signUpReq := createUser(t)
+		userPayload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+		arg := pUsers.LoginRequest{Email: signUpReq.Email, Password: "wrong password"}
+		for i := 0; i < 4; i++ {
+			arg.IPAddress = randomIPTest()
+			service.LogIn(arg)
+		}
+
+		code, err := service.UnlockUser(userPayload, user.ID)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedForbidden, code)
+
+		code, err = service.UnlockUser(adminPayload, user.ID+100)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedNotFound, code)
+
+		code, err = service.UnlockUser(adminPayload, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		arg.Password = signUpReq.Password
+		arg.IPAddress = randomIPTest()
+		_, accessToken, _, code, err := service.LogIn(arg)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.NotEmpty(t, accessToken)
+	})
+
+	t.Run("ip_limit", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		ip := randomIPTest()
+
+		// guessing unregistered email from the IP
+		for i := int64(0); i < loginProtection.IPLimit; i++ {
+			arg := pUsers.LoginRequest{
+				Email:     generator.CreateRandomEmail(generator.CreateRandomString(5)),
+				Password:  "wrong password",
+				IPAddress: ip,
+			}
+			_, _, _, code, err := service.LogIn(arg)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		}
+
+		arg := pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password, IPAddress: ip}
+		_, _, _, code, err := service.LogIn(arg)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedTooMany, code)
+		requireThrottledTest(t, err, false)
+	})
+}
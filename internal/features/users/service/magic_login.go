@@ -0,0 +1,237 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/jackc/pgx/v5"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	mailer "github.com/dwiw96/ran-user-management/pkg/mailer"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+var (
+	errInvalidMagicLogin = errors.New("login link or code is invalid, expired or has been used")
+	errWrongLoginCode    = errors.New("login code is wrong")
+)
+
+// sendMagicLoginEmail send link with new token and the login code to the
+// email of the user. Only the digest of the token and the code are saved, and
+// link and code that are sent before can't be used anymore.
+func (s *usersService) sendMagicLoginEmail(user *pUsers.User, input pUsers.MagicLoginStartRequest) error {
+	token, err := password.GenerateRefreshToken()
+	if err != nil {
+		return err
+	}
+	loginCode, err := password.GenerateLoginCode()
+	if err != nil {
+		return err
+	}
+
+	tokenHash := password.HashRefreshToken(token)
+	arg := pUsers.MagicLogin{
+		UserID:     user.ID,
+		Email:      user.Email,
+		CodeHash:   password.HashLoginCode(tokenHash, loginCode),
+		DeviceName: input.DeviceName,
+		Scope:      input.Scope,
+	}
+	err = s.cache.CachingMagicLogin(tokenHash, arg, s.magicLink.TokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(s.magicLink.URL)
+	if err != nil {
+		return fmt.Errorf("magic link url is invalid, msg: %v", err)
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	msg := mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen the link below to log in, or enter the code %s in the login page. The link and the code expire in %s and can only be used once.\n\n%s\n\nIf you didn't request it, you can ignore this email.\n",
+			user.Username, loginCode, s.magicLink.TokenTTL, link.String()),
+	}
+
+	return s.mailer.Send(s.ctx, msg)
+}
+
+// StartMagicLogin send magic link and login code to the email. The result is
+// the same whether the email is registered or not and whether the email is
+// sent or not, so it can't be used to find registered email.
+func (s *usersService) StartMagicLogin(input pUsers.MagicLoginStartRequest) (code int, err error) {
+	user, err := s.repo.GetUserByEmail(s.ctx, input.Email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errs.CodeSuccess, nil
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to load user, msg: %v", err)
+	}
+	if user.IsDeleted.Bool {
+		return errs.CodeSuccess, nil
+	}
+
+	err = s.sendMagicLoginEmail(user, input)
+	if err != nil {
+		log.Printf("failed to send magic link email to user %d, msg: %v", user.ID, err)
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// getMagicLogin return the magic login of the link token, or the latest
+// magic login of the email when the code is used instead of the link.
+func (s *usersService) getMagicLogin(input pUsers.MagicLoginRequest) (tokenHash []byte, magic *pUsers.MagicLogin, code int, err error) {
+	if input.Token != "" {
+		tokenHash = password.HashRefreshToken(input.Token)
+	} else {
+		if input.Email == "" || input.Code == "" {
+			return nil, nil, errs.CodeFailedUser, errs.ErrInvalidInput
+		}
+
+		user, err := s.repo.GetUserByEmail(s.ctx, input.Email)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, nil, errs.CodeFailedUnauthorized, errInvalidMagicLogin
+			}
+			return nil, nil, errs.CodeFailedServer, fmt.Errorf("failed to load user, msg: %v", err)
+		}
+
+		tokenHash, err = s.cache.GetUserMagicLogin(user.ID)
+		if err != nil {
+			return nil, nil, errs.CodeFailedServer, err
+		}
+		if tokenHash == nil {
+			return nil, nil, errs.CodeFailedUnauthorized, errInvalidMagicLogin
+		}
+	}
+
+	magic, err = s.cache.GetMagicLogin(tokenHash)
+	if err != nil {
+		return nil, nil, errs.CodeFailedServer, err
+	}
+	if magic == nil {
+		return nil, nil, errs.CodeFailedUnauthorized, errInvalidMagicLogin
+	}
+
+	return tokenHash, magic, errs.CodeSuccess, nil
+}
+
+// VerifyMagicLogin issue the tokens like LogIn when the link token or the
+// code is right, the link and the code can only be used once. Wrong code is
+// counted as failed login, and the code can't be used anymore after too many
+// wrong code. The email of the user is verified by the login, and the user
+// that enable MFA get mfa token instead of tokens like LogIn.
+func (s *usersService) VerifyMagicLogin(input pUsers.MagicLoginRequest) (user *pUsers.User, accessToken, refreshToken string, code int, err error) {
+	tokenHash, magic, code, err := s.getMagicLogin(input)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	attempt := pUsers.LoginAttempt{
+		Email:     magic.Email,
+		IPAddress: input.IPAddress,
+	}
+	code, err = s.checkLoginThrottle(attempt)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	user, err = s.activeUser(magic.UserID)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+	if user == nil || user.Email != magic.Email {
+		return nil, "", "", errs.CodeFailedUnauthorized, errInvalidMagicLogin
+	}
+
+	code, err = checkUserLocked(user)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	if input.Token == "" && !password.VerifyLoginCode(tokenHash, input.Code, magic.CodeHash) {
+		failures, errFailure := s.cache.AddMagicLoginFailure(tokenHash, s.magicLink.TokenTTL)
+		if errFailure != nil {
+			return nil, "", "", errs.CodeFailedServer, errFailure
+		}
+		if failures >= s.magicLink.MaxAttempts {
+			_, errFailure = s.cache.DeleteMagicLogin(tokenHash, user.ID)
+			if errFailure != nil {
+				return nil, "", "", errs.CodeFailedServer, errFailure
+			}
+		}
+
+		code, errFailure = s.recordLoginFailure(attempt, user)
+		if errFailure != nil {
+			return nil, "", "", code, errFailure
+		}
+		return nil, "", "", errs.CodeFailedUnauthorized, errWrongLoginCode
+	}
+
+	scope, err := loginScope(user.Role, magic.Scope)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedUser, err
+	}
+
+	isDeleted, err := s.cache.DeleteMagicLogin(tokenHash, user.ID)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+	if !isDeleted {
+		return nil, "", "", errs.CodeFailedUnauthorized, errInvalidMagicLogin
+	}
+
+	// the user that open the link or type the code own the email
+	if !user.EmailVerifiedAt.Valid {
+		user, err = s.repo.VerifyUserEmail(s.ctx, pUsers.VerifyUserEmailParams{ID: user.ID, Email: user.Email})
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, "", "", errs.CodeFailedUnauthorized, errInvalidMagicLogin
+			}
+			return nil, "", "", errs.CodeFailedServer, fmt.Errorf("failed to verify email, msg: %v", err)
+		}
+	}
+
+	// the email is one factor, the user that enable MFA must verify the TOTP
+	// code too
+	mfaEnabled, err := s.mfaEnabled(user.ID)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+	if mfaEnabled {
+		code, err = s.createMFAChallenge(user, pUsers.MFAChallenge{
+			DeviceName: magic.DeviceName,
+			Scope:      scope,
+			AMR:        []string{pUsers.AMROTP},
+		})
+		return nil, "", "", code, err
+	}
+
+	err = s.cache.DeleteLoginFailures(attempt)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+
+	accessToken, refreshToken, code, err = s.issueLoginTokens(user, sessionInfo{
+		DeviceName: magic.DeviceName,
+		UserAgent:  input.UserAgent,
+		IPAddress:  input.IPAddress,
+		Claims: pUsers.SessionClaims{
+			Scope: scope,
+			AMR:   []string{pUsers.AMROTP},
+		},
+	}, input.DPoP)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	return user, accessToken, refreshToken, errs.CodeSuccess, nil
+}
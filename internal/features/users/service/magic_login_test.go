@@ -0,0 +1,291 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var loginCodeRegex = regexp.MustCompile(`code ([0-9]{6})`)
+
+// lastMagicLoginTest return the token and the code of the latest magic link
+// email that is sent to the email
+func lastMagicLoginTest(t *testing.T, email string) (token, loginCode string) {
+	messages := mailerTest.Messages(email)
+	require.NotEmpty(t, messages)
+	msg := messages[len(messages)-1]
+	assert.Equal(t, "Your login link", msg.Subject)
+
+	link, err := url.Parse(verificationLinkRegex.FindString(msg.Body))
+	require.NoError(t, err)
+	assert.Equal(t, magicLinkTest.URL, link.Scheme+"://"+link.Host+link.Path)
+	token = link.Query().Get("token")
+	require.NotEmpty(t, token)
+
+	match := loginCodeRegex.FindStringSubmatch(msg.Body)
+	require.Len(t, match, 2)
+
+	return token, match[1]
+}
+
+// wrongLoginCodeTest return code that is not the right code
+func wrongLoginCodeTest(loginCode string) string {
+	if loginCode == "000000" {
+		return "000001"
+	}
+	return "000000"
+}
+
+func TestStartMagicLogin(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+
+		code, err := serviceTest.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: signUpReq.Email, DeviceName: "laptop"})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		token, loginCode := lastMagicLoginTest(t, signUpReq.Email)
+
+		// token is saved by its digest and the code is not saved in plain
+		res, err := cacheTest.GetMagicLogin([]byte(token))
+		require.NoError(t, err)
+		assert.Nil(t, res)
+		res, err = cacheTest.GetMagicLogin(password.HashRefreshToken(token))
+		require.NoError(t, err)
+		require.NotNil(t, res)
+		assert.Equal(t, user.ID, res.UserID)
+		assert.Equal(t, "laptop", res.DeviceName)
+		assert.NotContains(t, string(res.CodeHash), loginCode)
+		assert.True(t, password.VerifyLoginCode(password.HashRefreshToken(token), loginCode, res.CodeHash))
+	})
+
+	t.Run("success_unknown_email", func(t *testing.T) {
+		email := generator.CreateRandomEmail(generator.CreateRandomString(5))
+
+		code, err := serviceTest.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: email})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Empty(t, mailerTest.Messages(email))
+	})
+}
+
+func TestVerifyMagicLogin(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	t.Run("success_link", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		_, err := serviceTest.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: signUpReq.Email, Scope: pUsers.ScopeUsersRead})
+		require.NoError(t, err)
+		token, _ := lastMagicLoginTest(t, signUpReq.Email)
+
+		res, accessToken, refreshToken, code, err := serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Token: token})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, user.ID, res.ID)
+		assert.NotEmpty(t, refreshToken)
+		assert.True(t, res.EmailVerifiedAt.Valid)
+
+		payload, err := middleware.ReadToken(strings.TrimPrefix(accessToken, "Bearer "), middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, payload.UserID)
+		assert.Equal(t, pUsers.ScopeUsersRead, payload.Scope)
+		assert.Equal(t, []string{pUsers.AMROTP}, payload.AMR)
+
+		// link can only be used once
+		_, _, _, code, err = serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Token: token})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMagicLogin, err)
+	})
+
+	t.Run("success_code", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		_, err := serviceTest.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: signUpReq.Email})
+		require.NoError(t, err)
+		token, loginCode := lastMagicLoginTest(t, signUpReq.Email)
+
+		res, accessToken, _, code, err := serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Email: signUpReq.Email, Code: loginCode})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, user.ID, res.ID)
+		assert.NotEmpty(t, accessToken)
+
+		// the link of the same email can't be used after the code
+		_, _, _, code, err = serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Token: token})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMagicLogin, err)
+
+		_, _, _, code, err = serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Email: signUpReq.Email, Code: loginCode})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMagicLogin, err)
+	})
+
+	t.Run("success_require_email_verification", func(t *testing.T) {
+		emailVerification := emailVerificationTest
+		emailVerification.Required = true
+		service := NewUsersService(repoTest, cacheTest, mailerTest, cfg.TokenLifetimeConfig{Default: cfg.DefaultTokenLifetime}, emailVerification, passwordResetTest, magicLinkTest, loginProtectionTest, webAuthnTest, issuerTest, audienceTest, ctx)
+
+		_, signUpReq := createUser(t)
+		_, err := service.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: signUpReq.Email})
+		require.NoError(t, err)
+		token, _ := lastMagicLoginTest(t, signUpReq.Email)
+
+		// the link prove the email
+		_, accessToken, _, code, err := service.VerifyMagicLogin(pUsers.MagicLoginRequest{Token: token})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.NotEmpty(t, accessToken)
+	})
+
+	t.Run("success_mfa_enabled", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		secret, _ := enableTOTPTest(t, user)
+		_, err := serviceTest.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: signUpReq.Email})
+		require.NoError(t, err)
+		token, _ := lastMagicLoginTest(t, signUpReq.Email)
+
+		// the link is not enough for the user that enable MFA
+		_, accessToken, _, code, err := serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Token: token})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Empty(t, accessToken)
+
+		var mfaErr *pUsers.MFARequiredError
+		require.True(t, errors.As(err, &mfaErr))
+		require.NotEmpty(t, mfaErr.MFAToken)
+
+		// the link is used by the challenge
+		_, _, _, code, err = serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Token: token})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMagicLogin, err)
+
+		res, accessToken, _, code, err := serviceTest.VerifyMFA(pUsers.MFARequest{MFAToken: mfaErr.MFAToken, Code: totpCodeTest(secret, true)})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, user.ID, res.ID)
+
+		payload, err := middleware.ReadToken(strings.TrimPrefix(accessToken, "Bearer "), middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, []string{pUsers.AMROTP, pUsers.AMRMultiFactor}, payload.AMR)
+	})
+
+	t.Run("failed_replaced", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		_, err := serviceTest.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: signUpReq.Email})
+		require.NoError(t, err)
+		token, loginCode := lastMagicLoginTest(t, signUpReq.Email)
+
+		_, err = serviceTest.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: signUpReq.Email})
+		require.NoError(t, err)
+		newToken, newLoginCode := lastMagicLoginTest(t, signUpReq.Email)
+
+		_, _, _, code, err := serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Token: token})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMagicLogin, err)
+
+		if loginCode != newLoginCode {
+			_, _, _, code, err = serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Email: signUpReq.Email, Code: loginCode})
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUnauthorized, code)
+			assert.Equal(t, errWrongLoginCode, err)
+		}
+
+		_, _, _, code, err = serviceTest.VerifyMagicLogin(pUsers.MagicLoginRequest{Token: newToken})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+	})
+
+	t.Run("failed_too_many_wrong_code", func(t *testing.T) {
+		loginProtection := loginProtectionTest
+		loginProtection.DelayAfter = 100
+		loginProtection.LockoutAfter = 100
+		service := NewUsersService(repoTest, cacheTest, mailerTest, cfg.TokenLifetimeConfig{Default: cfg.DefaultTokenLifetime}, emailVerificationTest, passwordResetTest, magicLinkTest, loginProtection, webAuthnTest, issuerTest, audienceTest, ctx)
+
+		_, signUpReq := createUser(t)
+		_, err := service.StartMagicLogin(pUsers.MagicLoginStartRequest{Email: signUpReq.Email})
+		require.NoError(t, err)
+		_, loginCode := lastMagicLoginTest(t, signUpReq.Email)
+
+		for i := int64(0); i < magicLinkTest.MaxAttempts; i++ {
+			_, _, _, code, err := service.VerifyMagicLogin(pUsers.MagicLoginRequest{Email: signUpReq.Email, Code: wrongLoginCodeTest(loginCode)})
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUnauthorized, code)
+			assert.Equal(t, errWrongLoginCode, err)
+		}
+
+		failures, err := cacheTest.GetLoginFailures(pUsers.LoginAttempt{Email: signUpReq.Email}, loginProtection.Window)
+		require.NoError(t, err)
+		assert.Equal(t, magicLinkTest.MaxAttempts, failures.Email.Count)
+
+		// the right code can't be used after too many wrong code
+		_, _, _, code, err := service.VerifyMagicLogin(pUsers.MagicLoginRequest{Email: signUpReq.Email, Code: loginCode})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMagicLogin, err)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+
+		testCases := []struct {
+			desc  string
+			input pUsers.MagicLoginRequest
+			code  int
+			err   error
+		}{
+			{
+				desc:  "failed_unknown_token",
+				input: pUsers.MagicLoginRequest{Token: "token"},
+				code:  errs.CodeFailedUnauthorized,
+				err:   errInvalidMagicLogin,
+			}, {
+				desc:  "failed_not_started",
+				input: pUsers.MagicLoginRequest{Email: signUpReq.Email, Code: "123456"},
+				code:  errs.CodeFailedUnauthorized,
+				err:   errInvalidMagicLogin,
+			}, {
+				desc:  "failed_unknown_email",
+				input: pUsers.MagicLoginRequest{Email: generator.CreateRandomEmail(generator.CreateRandomString(5)), Code: "123456"},
+				code:  errs.CodeFailedUnauthorized,
+				err:   errInvalidMagicLogin,
+			}, {
+				desc:  "failed_empty_code",
+				input: pUsers.MagicLoginRequest{Email: signUpReq.Email},
+				code:  errs.CodeFailedUser,
+				err:   errs.ErrInvalidInput,
+			},
+		}
+
+		for _, tC := range testCases {
+			t.Run(tC.desc, func(t *testing.T) {
+				_, _, _, code, err := serviceTest.VerifyMagicLogin(tC.input)
+				require.Error(t, err)
+				assert.Equal(t, tC.code, code)
+				assert.Equal(t, tC.err, err)
+			})
+		}
+	})
+}
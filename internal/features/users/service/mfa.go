@@ -0,0 +1,348 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+const (
+	// mfaChallengeTTL is lifetime of mfa token that is returned by LogIn
+	mfaChallengeTTL = 5 * time.Minute
+	// mfaChallengeMaxFailures is number of wrong code before the mfa token is
+	// deleted and the user must login again
+	mfaChallengeMaxFailures = 5
+)
+
+var (
+	errMFAAlreadyEnabled = errors.New("mfa is already enabled")
+	errMFANotEnabled     = errors.New("mfa is not enabled")
+	errMFANotEnrolled    = errors.New("mfa enrollment is not started, please enroll first")
+	errWrongMFACode      = errors.New("mfa code is wrong")
+	errInvalidMFAToken   = errors.New("mfa token is invalid, expired or has been used")
+)
+
+// mfaEnabled return true when the user confirm the TOTP secret.
+func (s *usersService) mfaEnabled(userID int32) (bool, error) {
+	totp, err := s.repo.GetTOTP(s.ctx, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to load totp, msg: %v", err)
+	}
+
+	return totp.ConfirmedAt.Valid, nil
+}
+
+// totpIssuer return the name of the service that is shown in authenticator
+// app, it's the host of the issuer.
+func (s *usersService) totpIssuer() string {
+	issuer, err := url.Parse(s.issuer)
+	if err != nil || issuer.Host == "" {
+		return s.issuer
+	}
+
+	return issuer.Host
+}
+
+// EnrollTOTP generate new TOTP secret of the user, MFA is not enabled until
+// the secret is confirmed with ConfirmTOTP. Enroll again replace the secret
+// that is not confirmed.
+func (s *usersService) EnrollTOTP(payload pUsers.JwtPayload) (enrollment *pUsers.TOTPEnrollment, code int, err error) {
+	user, err := s.tokenUser(&payload)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUnauthorized, errUserNotFound
+	}
+
+	secret, err := password.GenerateTOTPSecret()
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	err = s.repo.UpsertTOTP(s.ctx, pUsers.UpsertTOTPParams{UserID: user.ID, Secret: secret})
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return nil, errs.CodeFailedDuplicated, errMFAAlreadyEnabled
+		}
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to save totp, msg: %v", err)
+	}
+
+	enrollment = &pUsers.TOTPEnrollment{
+		Secret: password.EncodeTOTPSecret(secret),
+		URI:    password.TOTPURI(s.totpIssuer(), user.Email, secret),
+	}
+
+	return enrollment, errs.CodeSuccess, nil
+}
+
+// ConfirmTOTP enable MFA when the code of the enrolled secret is right, the
+// recovery codes are returned only once.
+func (s *usersService) ConfirmTOTP(payload pUsers.JwtPayload, totpCode string) (recoveryCodes []string, code int, err error) {
+	user, err := s.tokenUser(&payload)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUnauthorized, errUserNotFound
+	}
+
+	totp, err := s.repo.GetTOTP(s.ctx, user.ID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errs.CodeFailedUser, errMFANotEnrolled
+		}
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to load totp, msg: %v", err)
+	}
+	if totp.ConfirmedAt.Valid {
+		return nil, errs.CodeFailedDuplicated, errMFAAlreadyEnabled
+	}
+
+	step, ok := password.VerifyTOTP(totp.Secret, totpCode, time.Now(), totp.LastUsedStep)
+	if !ok {
+		return nil, errs.CodeFailedUser, errWrongMFACode
+	}
+
+	recoveryCodes, err = password.GenerateRecoveryCodes(password.RecoveryCodeCount)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	hashes := make([][]byte, len(recoveryCodes))
+	for i, v := range recoveryCodes {
+		hashes[i] = password.HashRecoveryCode(v)
+	}
+
+	arg := pUsers.ConfirmTOTPParams{
+		UserID:             user.ID,
+		LastUsedStep:       step,
+		RecoveryCodeHashes: hashes,
+	}
+	err = s.repo.ConfirmTOTPTx(s.ctx, arg)
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return nil, errs.CodeFailedDuplicated, errMFAAlreadyEnabled
+		}
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to confirm totp, msg: %v", err)
+	}
+
+	code, err = s.insertSecurityEvent(user.ID, pUsers.SecurityEventMFAEnabled, "totp is enabled")
+	if err != nil {
+		return nil, code, err
+	}
+
+	return recoveryCodes, errs.CodeSuccess, nil
+}
+
+// DisableTOTP disable MFA and delete the recovery codes, the user must send
+// TOTP code or recovery code.
+func (s *usersService) DisableTOTP(payload pUsers.JwtPayload, mfaCode string) (code int, err error) {
+	user, err := s.tokenUser(&payload)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return errs.CodeFailedUnauthorized, errUserNotFound
+	}
+
+	code, err = s.verifyMFACode(user, mfaCode)
+	if err != nil {
+		return code, err
+	}
+
+	err = s.repo.DeleteTOTP(s.ctx, user.ID)
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return errs.CodeFailedUser, errMFANotEnabled
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to delete totp, msg: %v", err)
+	}
+
+	return s.insertSecurityEvent(user.ID, pUsers.SecurityEventMFADisabled, "totp is disabled")
+}
+
+// verifyMFACode check TOTP code or recovery code of the user that enable MFA,
+// every code can only be used once. errWrongMFACode is returned when the code
+// is wrong.
+func (s *usersService) verifyMFACode(user *pUsers.User, mfaCode string) (code int, err error) {
+	totp, err := s.repo.GetTOTP(s.ctx, user.ID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errs.CodeFailedUser, errMFANotEnabled
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to load totp, msg: %v", err)
+	}
+	if !totp.ConfirmedAt.Valid {
+		return errs.CodeFailedUser, errMFANotEnabled
+	}
+
+	step, ok := password.VerifyTOTP(totp.Secret, mfaCode, time.Now(), totp.LastUsedStep)
+	if ok {
+		// other request may use the same code at the same time
+		err = s.repo.UpdateTOTPLastUsedStep(s.ctx, pUsers.UpdateTOTPLastUsedStepParams{UserID: user.ID, LastUsedStep: step})
+		if err != nil {
+			if errors.Is(err, pUsers.ErrNoRowsAffected) {
+				return errs.CodeFailedUser, errWrongMFACode
+			}
+			return errs.CodeFailedServer, fmt.Errorf("failed to update totp, msg: %v", err)
+		}
+		return errs.CodeSuccess, nil
+	}
+
+	err = s.repo.UseRecoveryCode(s.ctx, pUsers.UseRecoveryCodeParams{UserID: user.ID, CodeHash: password.HashRecoveryCode(mfaCode)})
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return errs.CodeFailedUser, errWrongMFACode
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to use recovery code, msg: %v", err)
+	}
+
+	return s.insertSecurityEvent(user.ID, pUsers.SecurityEventRecoveryCodeUsed, "recovery code is used")
+}
+
+func (s *usersService) insertSecurityEvent(userID int32, eventType, description string) (code int, err error) {
+	arg := pUsers.InsertSecurityEventParams{
+		UserID:      pgtype.Int4{Int32: userID, Valid: true},
+		EventType:   eventType,
+		Description: description,
+	}
+	err = s.repo.InsertSecurityEvent(s.ctx, arg)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to record security event, msg: %v", err)
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// mfaAMR return amr of login that is verified by the first factor and TOTP
+// code, the login that already use one-time password is multi-factor.
+func mfaAMR(first []string) []string {
+	if len(first) == 0 {
+		first = []string{pUsers.AMRPassword}
+	}
+
+	amr := append([]string(nil), first...)
+	if slices.Contains(amr, pUsers.AMROTP) {
+		return append(amr, pUsers.AMRMultiFactor)
+	}
+	return append(amr, pUsers.AMROTP)
+}
+
+// createMFAChallenge save the login that the first factor is verified, and
+// return MFARequiredError with the mfa token that continue the login in
+// VerifyMFA. arg is the session of the login, the user is set from user.
+func (s *usersService) createMFAChallenge(user *pUsers.User, arg pUsers.MFAChallenge) (code int, err error) {
+	token, err := password.GenerateRefreshToken()
+	if err != nil {
+		return errs.CodeFailedServer, errors.New("failed generate mfa token")
+	}
+
+	arg.UserID = user.ID
+	arg.Email = user.Email
+	err = s.cache.CachingMFAChallenge(password.HashRefreshToken(token), arg, mfaChallengeTTL)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	return errs.CodeFailedUnauthorized, &pUsers.MFARequiredError{MFAToken: token, ExpiresIn: mfaChallengeTTL}
+}
+
+// VerifyMFA is the second step of login of the user that enable MFA, tokens
+// are issued when the code of the mfa token is right. Wrong code is counted
+// as failed login, and the mfa token is deleted after too many wrong code.
+func (s *usersService) VerifyMFA(input pUsers.MFARequest) (user *pUsers.User, accessToken, refreshToken string, code int, err error) {
+	tokenHash := password.HashRefreshToken(input.MFAToken)
+	challenge, err := s.cache.GetMFAChallenge(tokenHash)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+	if challenge == nil {
+		return nil, "", "", errs.CodeFailedUnauthorized, errInvalidMFAToken
+	}
+
+	attempt := pUsers.LoginAttempt{
+		Email:     challenge.Email,
+		IPAddress: input.IPAddress,
+	}
+	code, err = s.checkLoginThrottle(attempt)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	user, err = s.activeUser(challenge.UserID)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+	if user == nil || user.Email != challenge.Email {
+		return nil, "", "", errs.CodeFailedUnauthorized, errInvalidMFAToken
+	}
+
+	code, err = checkUserLocked(user)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	code, err = s.verifyMFACode(user, input.Code)
+	if err != nil {
+		if !errors.Is(err, errWrongMFACode) {
+			return nil, "", "", code, err
+		}
+
+		failures, errFailure := s.cache.AddMFAChallengeFailure(tokenHash, mfaChallengeTTL)
+		if errFailure != nil {
+			return nil, "", "", errs.CodeFailedServer, errFailure
+		}
+		if failures >= mfaChallengeMaxFailures {
+			_, errFailure = s.cache.DeleteMFAChallenge(tokenHash)
+			if errFailure != nil {
+				return nil, "", "", errs.CodeFailedServer, errFailure
+			}
+		}
+
+		code, errFailure = s.recordLoginFailure(attempt, user)
+		if errFailure != nil {
+			return nil, "", "", code, errFailure
+		}
+		return nil, "", "", errs.CodeFailedUnauthorized, err
+	}
+
+	// the mfa token can only be used once
+	isDeleted, err := s.cache.DeleteMFAChallenge(tokenHash)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+	if !isDeleted {
+		return nil, "", "", errs.CodeFailedUnauthorized, errInvalidMFAToken
+	}
+
+	err = s.cache.DeleteLoginFailures(attempt)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+
+	accessToken, refreshToken, code, err = s.issueLoginTokens(user, sessionInfo{
+		DeviceName: challenge.DeviceName,
+		UserAgent:  input.UserAgent,
+		IPAddress:  input.IPAddress,
+		Claims: pUsers.SessionClaims{
+			Scope: challenge.Scope,
+			AMR:   mfaAMR(challenge.AMR),
+		},
+	}, input.DPoP)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	return user, accessToken, refreshToken, errs.CodeSuccess, nil
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// totpCodeTest return TOTP code of the secret, the code of the next step is
+// returned when next is true because the code of one step can only be used once
+func totpCodeTest(secret []byte, next bool) string {
+	step := password.TOTPStep(time.Now())
+	if next {
+		step++
+	}
+	return password.HOTP(secret, step, password.TOTPDigits)
+}
+
+// enableTOTPTest enroll and confirm TOTP of the user, the code of the current
+// step is used to confirm it
+func enableTOTPTest(t *testing.T, user *pUsers.User) (secret []byte, recoveryCodes []string) {
+	payload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+
+	enrollment, code, err := serviceTest.EnrollTOTP(payload)
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+
+	secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+
+	recoveryCodes, code, err = serviceTest.ConfirmTOTP(payload, totpCodeTest(secret, false))
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+	require.Len(t, recoveryCodes, password.RecoveryCodeCount)
+
+	return secret, recoveryCodes
+}
+
+// loginMFATokenTest login the user that enable MFA and return the mfa token
+func loginMFATokenTest(t *testing.T, service pUsers.IService, signUpReq pUsers.SignupRequest) string {
+	_, accessToken, _, code, err := service.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+	require.Error(t, err)
+	assert.Equal(t, errs.CodeFailedUnauthorized, code)
+	assert.Empty(t, accessToken)
+
+	var mfaErr *pUsers.MFARequiredError
+	require.True(t, errors.As(err, &mfaErr))
+	require.NotEmpty(t, mfaErr.MFAToken)
+	assert.Equal(t, mfaChallengeTTL, mfaErr.ExpiresIn)
+
+	return mfaErr.MFAToken
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		user, _ := createUser(t)
+		payload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+
+		first, code, err := serviceTest.EnrollTOTP(payload)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.NotEmpty(t, first.Secret)
+		assert.True(t, strings.HasPrefix(first.URI, "otpauth://totp/"))
+		assert.Contains(t, first.URI, "issuer=localhost%3A8080")
+
+		// enroll again replace the secret that is not confirmed
+		second, code, err := serviceTest.EnrollTOTP(payload)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.NotEqual(t, first.Secret, second.Secret)
+
+		// MFA is not enabled before it's confirmed
+		profile, _, err := serviceTest.GetProfile(payload)
+		require.NoError(t, err)
+		assert.False(t, profile.MFAEnabled)
+	})
+
+	t.Run("failed_enabled", func(t *testing.T) {
+		user, _ := createUser(t)
+		enableTOTPTest(t, user)
+
+		_, code, err := serviceTest.EnrollTOTP(pUsers.JwtPayload{UserID: user.ID, Email: user.Email})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedDuplicated, code)
+		assert.Equal(t, errMFAAlreadyEnabled, err)
+	})
+}
+
+func TestConfirmTOTP(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		user, _ := createUser(t)
+		enableTOTPTest(t, user)
+
+		profile, _, err := serviceTest.GetProfile(pUsers.JwtPayload{UserID: user.ID, Email: user.Email})
+		require.NoError(t, err)
+		assert.True(t, profile.MFAEnabled)
+
+		var count int
+		err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM security_events WHERE user_id = $1 AND event_type = $2", user.ID, pUsers.SecurityEventMFAEnabled).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("failed_wrong_code", func(t *testing.T) {
+		user, _ := createUser(t)
+		payload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+		_, _, err := serviceTest.EnrollTOTP(payload)
+		require.NoError(t, err)
+
+		_, code, err := serviceTest.ConfirmTOTP(payload, "000000x")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+		assert.Equal(t, errWrongMFACode, err)
+	})
+
+	t.Run("failed_not_enrolled", func(t *testing.T) {
+		user, _ := createUser(t)
+
+		_, code, err := serviceTest.ConfirmTOTP(pUsers.JwtPayload{UserID: user.ID, Email: user.Email}, "123456")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+		assert.Equal(t, errMFANotEnrolled, err)
+	})
+}
+
+func TestDisableTOTP(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success_totp_code", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		secret, _ := enableTOTPTest(t, user)
+		payload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+
+		// the code that confirm the secret can't be used again
+		code, err := serviceTest.DisableTOTP(payload, totpCodeTest(secret, false))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+		assert.Equal(t, errWrongMFACode, err)
+
+		code, err = serviceTest.DisableTOTP(payload, totpCodeTest(secret, true))
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		// login doesn't need MFA anymore
+		_, accessToken, _, _, err := serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+		require.NoError(t, err)
+		assert.NotEmpty(t, accessToken)
+
+		code, err = serviceTest.DisableTOTP(payload, totpCodeTest(secret, true))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+		assert.Equal(t, errMFANotEnabled, err)
+	})
+
+	t.Run("success_recovery_code", func(t *testing.T) {
+		user, _ := createUser(t)
+		_, recoveryCodes := enableTOTPTest(t, user)
+
+		code, err := serviceTest.DisableTOTP(pUsers.JwtPayload{UserID: user.ID, Email: user.Email}, strings.ToUpper(recoveryCodes[0]))
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		var count int
+		err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM security_events WHERE user_id = $1 AND event_type = $2", user.ID, pUsers.SecurityEventMFADisabled).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestVerifyMFA(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	t.Run("success_totp_code", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		secret, _ := enableTOTPTest(t, user)
+		mfaToken := loginMFATokenTest(t, serviceTest, signUpReq)
+
+		res, accessToken, refreshToken, code, err := serviceTest.VerifyMFA(pUsers.MFARequest{MFAToken: mfaToken, Code: totpCodeTest(secret, true)})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, user.ID, res.ID)
+		assert.NotEmpty(t, refreshToken)
+
+		payload, err := middleware.ReadToken(strings.TrimPrefix(accessToken, "Bearer "), middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, []string{pUsers.AMRPassword, pUsers.AMROTP}, payload.AMR)
+
+		// mfa token can only be used once
+		_, _, _, code, err = serviceTest.VerifyMFA(pUsers.MFARequest{MFAToken: mfaToken, Code: totpCodeTest(secret, true)})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMFAToken, err)
+	})
+
+	t.Run("success_recovery_code", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		_, recoveryCodes := enableTOTPTest(t, user)
+
+		_, accessToken, _, code, err := serviceTest.VerifyMFA(pUsers.MFARequest{MFAToken: loginMFATokenTest(t, serviceTest, signUpReq), Code: recoveryCodes[0]})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.NotEmpty(t, accessToken)
+
+		// recovery code can only be used once
+		_, _, _, code, err = serviceTest.VerifyMFA(pUsers.MFARequest{MFAToken: loginMFATokenTest(t, serviceTest, signUpReq), Code: recoveryCodes[0]})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errWrongMFACode, err)
+
+		var count int
+		err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM security_events WHERE user_id = $1 AND event_type = $2", user.ID, pUsers.SecurityEventRecoveryCodeUsed).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("failed_too_many_wrong_code", func(t *testing.T) {
+		loginProtection := loginProtectionTest
+		loginProtection.DelayAfter = 100
+		loginProtection.LockoutAfter = 100
+		service := NewUsersService(repoTest, cacheTest, mailerTest, cfg.TokenLifetimeConfig{Default: cfg.DefaultTokenLifetime}, emailVerificationTest, passwordResetTest, magicLinkTest, loginProtection, webAuthnTest, issuerTest, audienceTest, ctx)
+
+		user, signUpReq := createUser(t)
+		secret, _ := enableTOTPTest(t, user)
+		mfaToken := loginMFATokenTest(t, service, signUpReq)
+
+		for i := 0; i < mfaChallengeMaxFailures; i++ {
+			_, _, _, code, err := service.VerifyMFA(pUsers.MFARequest{MFAToken: mfaToken, Code: "wrong code"})
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUnauthorized, code)
+			assert.Equal(t, errWrongMFACode, err)
+		}
+
+		failures, err := cacheTest.GetLoginFailures(pUsers.LoginAttempt{Email: signUpReq.Email}, loginProtection.Window)
+		require.NoError(t, err)
+		assert.Equal(t, int64(mfaChallengeMaxFailures), failures.Email.Count)
+
+		// the right code can't be used after too many wrong code
+		_, _, _, code, err := service.VerifyMFA(pUsers.MFARequest{MFAToken: mfaToken, Code: totpCodeTest(secret, true)})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMFAToken, err)
+	})
+
+	t.Run("failed_invalid_token", func(t *testing.T) {
+		_, _, _, code, err := serviceTest.VerifyMFA(pUsers.MFARequest{MFAToken: "invalid token", Code: "123456"})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidMFAToken, err)
+	})
+}
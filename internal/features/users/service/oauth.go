@@ -0,0 +1,790 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+var (
+	errInvalidClient = &pUsers.OAuthError{ErrorCode: pUsers.OAuthErrInvalidClient, Description: "client authentication failed"}
+	errTokenRequired = &pUsers.OAuthError{ErrorCode: pUsers.OAuthErrInvalidRequest, Description: "token is required"}
+)
+
+// token_type of introspected token
+const (
+	tokenTypeBearer       = "Bearer"
+	tokenTypeRefreshToken = "refresh_token"
+)
+
+// authorizationCodeTTL is how long authorization code can be exchanged for
+// token, it's short because the code is sent in redirect uri.
+const authorizationCodeTTL = time.Minute
+
+// authenticateClient check the client credential of oauth client that call
+// oauth endpoint, the client must be registered and not revoked. Public client
+// can't keep secret, so it's only identified by the client id.
+func (s *usersService) authenticateClient(client pUsers.ClientCredential) (res *pUsers.OAuthClient, code int, err error) {
+	if client.ClientID == "" {
+		return nil, errs.CodeFailedUnauthorized, errInvalidClient
+	}
+
+	res, err = s.repo.GetOAuthClient(s.ctx, client.ClientID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errs.CodeFailedUnauthorized, errInvalidClient
+		}
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to load client, msg: %v", err)
+	}
+
+	if res.IsPublic {
+		if client.ClientSecret != "" {
+			return nil, errs.CodeFailedUnauthorized, errInvalidClient
+		}
+		return res, errs.CodeSuccess, nil
+	}
+
+	err = password.VerifyClientSecret(client.ClientSecret, res.ClientSecretHash)
+	if err != nil {
+		return nil, errs.CodeFailedUnauthorized, errInvalidClient
+	}
+
+	return res, errs.CodeSuccess, nil
+}
+
+// IntrospectToken return the state of access token or refresh token (RFC 7662),
+// so other services don't have to verify the token by themselves. The token is
+// checked the same way as AuthMiddleware and RefreshToken check it, token that
+// is expired, blocklisted, revoked or belong to deleted user is not active.
+// tokenTypeHint only decide which token type is looked up first.
+func (s *usersService) IntrospectToken(client pUsers.ClientCredential, token, tokenTypeHint string) (res *pUsers.IntrospectionResponse, code int, err error) {
+	oauthClient, code, err := s.authenticateClient(client)
+	if err != nil {
+		return nil, code, err
+	}
+	// only service that has client secret can introspect token
+	if oauthClient.IsPublic {
+		return nil, errs.CodeFailedUnauthorized, errInvalidClient
+	}
+
+	if token == "" {
+		return nil, errs.CodeFailedUser, errTokenRequired
+	}
+
+	lookups := []func(token string) (*pUsers.IntrospectionResponse, error){
+		s.introspectAccessToken,
+		s.introspectRefreshToken,
+	}
+	if tokenTypeHint == pUsers.TokenTypeHintRefreshToken {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
+	for _, lookup := range lookups {
+		res, err = lookup(token)
+		if err != nil {
+			return nil, errs.CodeFailedServer, err
+		}
+		if res != nil {
+			return res, errs.CodeSuccess, nil
+		}
+	}
+
+	return &pUsers.IntrospectionResponse{Active: false}, errs.CodeSuccess, nil
+}
+
+// activeUser return the user when the user is exists and not deleted, nil
+// user is returned when it's not.
+func (s *usersService) activeUser(userID int32) (*pUsers.User, error) {
+	user, err := s.repo.GetUserByID(s.ctx, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load user, msg: %v", err)
+	}
+	if user.IsDeleted.Bool {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+// readActiveAccessToken return payload of the access token, nil payload is
+// returned when the token is invalid, expired or blocklisted. Error is only
+// returned when the token can't be checked.
+func (s *usersService) readActiveAccessToken(token string) (*pUsers.JwtPayload, error) {
+	verificationKeys, err := s.repo.ListVerificationKeys(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := middleware.ReadToken("Bearer "+token, middleware.NewKeySet(verificationKeys...))
+	if err != nil {
+		return nil, nil
+	}
+
+	// exp is not validated by ReadToken
+	if time.Now().UTC().Unix() >= payload.Exp {
+		return nil, nil
+	}
+
+	err = s.cache.CheckBlockedToken(*payload)
+	if err != nil {
+		return nil, nil
+	}
+
+	return payload, nil
+}
+
+// tokenUser return the user of the access token, nil user is returned when
+// the user is deleted or doesn't match the token. It's the same check as
+// PayloadVerification, the username is not checked because it can be changed
+// while the token is live.
+func (s *usersService) tokenUser(payload *pUsers.JwtPayload) (*pUsers.User, error) {
+	user, err := s.activeUser(payload.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Email != payload.Email {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+// introspectAccessToken return nil response when the token is not active
+// access token, error is only returned when the token can't be checked.
+func (s *usersService) introspectAccessToken(token string) (*pUsers.IntrospectionResponse, error) {
+	payload, err := s.readActiveAccessToken(token)
+	if err != nil || payload == nil {
+		return nil, err
+	}
+
+	if payload.IsServiceAccount() {
+		return s.introspectServiceAccountToken(payload)
+	}
+
+	user, err := s.tokenUser(payload)
+	if err != nil || user == nil {
+		return nil, err
+	}
+
+	tokenType := tokenTypeBearer
+	if payload.Cnf != nil {
+		tokenType = pUsers.AuthSchemeDPoP
+	}
+
+	res := &pUsers.IntrospectionResponse{
+		Active:    true,
+		Username:  user.Username,
+		TokenType: tokenType,
+		Exp:       payload.Exp,
+		Iat:       payload.Iat,
+		Sub:       strconv.Itoa(int(user.ID)),
+		Aud:       payload.Audience,
+		Iss:       payload.Iss,
+		Jti:       payload.ID.String(),
+		SessionID: payload.SessionID,
+		ClientID:  payload.ClientID,
+		Scope:     payload.Scope,
+		Act:       payload.Act,
+		Cnf:       payload.Cnf,
+	}
+
+	return res, nil
+}
+
+// introspectServiceAccountToken return nil response when the client of the
+// token is revoked, same check as ServiceAccountVerification.
+func (s *usersService) introspectServiceAccountToken(payload *pUsers.JwtPayload) (*pUsers.IntrospectionResponse, error) {
+	_, err := s.repo.GetOAuthClient(s.ctx, payload.ClientID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load client, msg: %v", err)
+	}
+
+	res := &pUsers.IntrospectionResponse{
+		Active:    true,
+		Scope:     payload.Scope,
+		ClientID:  payload.ClientID,
+		TokenType: tokenTypeBearer,
+		Exp:       payload.Exp,
+		Iat:       payload.Iat,
+		Sub:       payload.Subject,
+		Aud:       payload.Audience,
+		Iss:       payload.Iss,
+		Jti:       payload.ID.String(),
+	}
+
+	return res, nil
+}
+
+// introspectRefreshToken return nil response when the token is not active
+// refresh token, error is only returned when the token can't be checked.
+func (s *usersService) introspectRefreshToken(token string) (*pUsers.IntrospectionResponse, error) {
+	session, err := s.repo.GetRefreshTokenByHash(s.ctx, password.HashRefreshToken(token))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load refresh token, msg: %v", err)
+	}
+
+	now := time.Now().UTC()
+	if now.After(session.ExpiresAt.Time) {
+		return nil, nil
+	}
+	_, lifetime := s.lifetime.Get(session.LifetimeKey)
+	if lifetime.IdleTimeout > 0 && now.After(session.LastUsedAt.Time.Add(lifetime.IdleTimeout)) {
+		return nil, nil
+	}
+
+	user, err := s.activeUser(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, nil
+	}
+
+	res := &pUsers.IntrospectionResponse{
+		Active:    true,
+		Username:  user.Username,
+		TokenType: tokenTypeRefreshToken,
+		Exp:       session.ExpiresAt.Time.Unix(),
+		Sub:       strconv.Itoa(int(user.ID)),
+		SessionID: session.ID,
+	}
+
+	return res, nil
+}
+
+// RevokeToken revoke access token or refresh token (RFC 7009). Refresh token
+// end its session and the access token of the session is blocklisted, access
+// token is blocklisted until it's expired. Invalid or unknown token is not an
+// error, because the client can't do anything with it. Token that is issued
+// to other client is not revoked and it's not an error too (RFC 7009 section
+// 2.1). tokenTypeHint only decide which token type is looked up first.
+func (s *usersService) RevokeToken(client pUsers.ClientCredential, token, tokenTypeHint string) (code int, err error) {
+	_, code, err = s.authenticateClient(client)
+	if err != nil {
+		return code, err
+	}
+
+	if token == "" {
+		return errs.CodeFailedUser, errTokenRequired
+	}
+
+	revokes := []func(clientID, token string) (bool, error){
+		s.revokeAccessToken,
+		s.revokeRefreshToken,
+	}
+	if tokenTypeHint == pUsers.TokenTypeHintRefreshToken {
+		revokes[0], revokes[1] = revokes[1], revokes[0]
+	}
+
+	for _, revoke := range revokes {
+		isFound, err := revoke(client.ClientID, token)
+		if err != nil {
+			return errs.CodeFailedServer, err
+		}
+		if isFound {
+			break
+		}
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// revokeAccessToken return false when the token is not access token, the
+// token is only revoked when it's issued to the client.
+func (s *usersService) revokeAccessToken(clientID, token string) (bool, error) {
+	verificationKeys, err := s.repo.ListVerificationKeys(s.ctx)
+	if err != nil {
+		return false, err
+	}
+
+	payload, err := middleware.ReadToken("Bearer "+token, middleware.NewKeySet(verificationKeys...))
+	if err != nil {
+		return false, nil
+	}
+	if payload.ClientID != clientID {
+		return true, nil
+	}
+
+	err = s.cache.CachingBlockedToken(*payload)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// revokeRefreshToken return false when the token is not refresh token, the
+// session is only revoked when it's issued to the client.
+func (s *usersService) revokeRefreshToken(clientID, token string) (bool, error) {
+	session, err := s.repo.GetRefreshTokenByHash(s.ctx, password.HashRefreshToken(token))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to load refresh token, msg: %v", err)
+	}
+	if session.ClientID != clientID {
+		return true, nil
+	}
+
+	arg := pUsers.DeleteRefreshTokenByIDParams{
+		ID:     session.ID,
+		UserID: session.UserID,
+	}
+	_, err = s.repo.DeleteRefreshTokenByID(s.ctx, arg)
+	if err != nil {
+		// the session is revoked by other request
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to revoke refresh token, msg: %v", err)
+	}
+
+	err = s.blockSessionAccessToken(*session)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func newOAuthError(errorCode, description string) *pUsers.OAuthError {
+	return &pUsers.OAuthError{ErrorCode: errorCode, Description: description}
+}
+
+// scopeContains return true when every scope in requested is in granted.
+func scopeContains(granted, requested string) bool {
+	grantedScopes := strings.Fields(granted)
+	for _, v := range strings.Fields(requested) {
+		if !slices.Contains(grantedScopes, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mergeScope return the scopes in a and b without duplicate.
+func mergeScope(a, b string) string {
+	res := strings.Fields(a)
+	for _, v := range strings.Fields(b) {
+		if !slices.Contains(res, v) {
+			res = append(res, v)
+		}
+	}
+
+	return strings.Join(res, " ")
+}
+
+// redirectURIWithParams add the params into the query of the redirect uri,
+// query that is already in the redirect uri is kept.
+func redirectURIWithParams(redirectURI string, params url.Values) (string, error) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", fmt.Errorf("redirect uri is not valid, msg: %v", err)
+	}
+
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Authorize handle authorization request of authorization code flow with PKCE
+// for the logged in user. The user is asked for consent the first time the
+// client request a scope, then authorization code is sent to the redirect uri
+// of the client. Error before the redirect uri is verified is never sent to the
+// redirect uri.
+func (s *usersService) Authorize(payload pUsers.JwtPayload, input pUsers.AuthorizeRequest) (res *pUsers.AuthorizeResponse, code int, err error) {
+	if input.ClientID == "" {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, "client_id is required")
+	}
+	client, err := s.repo.GetOAuthClient(s.ctx, input.ClientID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, "client_id is not valid")
+		}
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to load client, msg: %v", err)
+	}
+
+	// redirect uri must exactly match one of the registered redirect uri
+	if !slices.Contains(client.RedirectURIs, input.RedirectURI) {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, "redirect_uri is not registered for the client")
+	}
+
+	if input.ResponseType != pUsers.ResponseTypeCode {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrUnsupportedResponseType, "response_type must be code")
+	}
+	if !slices.Contains(client.GrantTypes, pUsers.GrantTypeAuthorizationCode) {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrUnauthorizedClient, "client is not allowed to use authorization code")
+	}
+
+	// PKCE is required for every client
+	err = password.ValidateCodeChallenge(input.CodeChallenge, input.CodeChallengeMethod)
+	if err != nil {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, err.Error())
+	}
+
+	user, err := s.activeUser(payload.UserID)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUnauthorized, errors.New("user is not found")
+	}
+	scope := mergeScope("", input.Scope)
+	err = checkUserScope(user.Role, scope)
+	if err != nil {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidScope, err.Error())
+	}
+	params := url.Values{}
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+
+	switch {
+	case input.Approve == nil:
+		consent, err := s.repo.GetOAuthConsent(s.ctx, pUsers.GetOAuthConsentParams{UserID: payload.UserID, ClientID: client.ClientID})
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, errs.CodeFailedServer, fmt.Errorf("failed to load consent, msg: %v", err)
+		}
+		if err != nil || !scopeContains(consent.Scope, scope) {
+			res = &pUsers.AuthorizeResponse{
+				ConsentRequired: true,
+				ClientName:      client.Name,
+				Scope:           scope,
+			}
+			return res, errs.CodeSuccess, nil
+		}
+	case !*input.Approve:
+		params.Set("error", pUsers.OAuthErrAccessDenied)
+		params.Set("error_description", "the user denied the request")
+
+		res = &pUsers.AuthorizeResponse{ClientName: client.Name, Scope: scope}
+		res.RedirectTo, err = redirectURIWithParams(input.RedirectURI, params)
+		if err != nil {
+			return nil, errs.CodeFailedServer, err
+		}
+		return res, errs.CodeSuccess, nil
+	default:
+		consent, err := s.repo.GetOAuthConsent(s.ctx, pUsers.GetOAuthConsentParams{UserID: payload.UserID, ClientID: client.ClientID})
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, errs.CodeFailedServer, fmt.Errorf("failed to load consent, msg: %v", err)
+		}
+		consentScope := scope
+		if err == nil {
+			consentScope = mergeScope(consent.Scope, scope)
+		}
+
+		consentArg := pUsers.UpsertOAuthConsentParams{
+			UserID:   payload.UserID,
+			ClientID: client.ClientID,
+			Scope:    consentScope,
+		}
+		_, err = s.repo.UpsertOAuthConsent(s.ctx, consentArg)
+		if err != nil {
+			code, err = handleError(err)
+			return nil, code, err
+		}
+	}
+
+	authorizationCode, err := password.GenerateAuthorizationCode()
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	// the user isn't authenticated again, ID token tell when and how the user
+	// logged in to the session of the access token
+	authTime := payload.AuthTime
+	if authTime == 0 {
+		authTime = payload.Iat
+	}
+	codeArg := pUsers.AuthorizationCode{
+		ClientID:            client.ClientID,
+		RedirectURI:         input.RedirectURI,
+		UserID:              payload.UserID,
+		Scope:               scope,
+		CodeChallenge:       input.CodeChallenge,
+		CodeChallengeMethod: input.CodeChallengeMethod,
+		Nonce:               input.Nonce,
+		AuthTime:            authTime,
+		AMR:                 payload.AMR,
+	}
+	err = s.cache.CachingAuthorizationCode(password.HashRefreshToken(authorizationCode), codeArg, authorizationCodeTTL)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	params.Set("code", authorizationCode)
+	res = &pUsers.AuthorizeResponse{ClientName: client.Name, Scope: scope}
+	res.RedirectTo, err = redirectURIWithParams(input.RedirectURI, params)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	return res, errs.CodeSuccess, nil
+}
+
+// Token is oauth token endpoint, it exchange the grant of the client for
+// token.
+func (s *usersService) Token(client pUsers.ClientCredential, input pUsers.TokenRequest) (res *pUsers.TokenResponse, code int, err error) {
+	oauthClient, code, err := s.authenticateClient(client)
+	if err != nil {
+		return nil, code, err
+	}
+
+	grants := map[string]func(client *pUsers.OAuthClient, input pUsers.TokenRequest) (*pUsers.TokenResponse, int, error){
+		pUsers.GrantTypeAuthorizationCode: s.authorizationCodeGrant,
+		pUsers.GrantTypeClientCredentials: s.clientCredentialsGrant,
+		pUsers.GrantTypeTokenExchange:     s.tokenExchangeGrant,
+		pUsers.GrantTypeRefreshToken:      s.refreshTokenGrant,
+	}
+
+	if input.GrantType == "" {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, "grant_type is required")
+	}
+	grant, ok := grants[input.GrantType]
+	if !ok {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrUnsupportedGrantType, fmt.Sprintf("grant_type %s is not supported", input.GrantType))
+	}
+	allowedGrant := input.GrantType
+	if allowedGrant == pUsers.GrantTypeRefreshToken {
+		allowedGrant = pUsers.GrantTypeAuthorizationCode
+	}
+	if !slices.Contains(oauthClient.GrantTypes, allowedGrant) {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrUnauthorizedClient, fmt.Sprintf("client is not allowed to use grant_type %s", input.GrantType))
+	}
+
+	return grant(oauthClient, input)
+}
+
+// authorizationCodeGrant exchange authorization code for the same access token
+// and refresh token that LogIn issue. The code is deleted when it's read, so it
+// can't be exchanged twice even when the request is failed.
+func (s *usersService) authorizationCodeGrant(client *pUsers.OAuthClient, input pUsers.TokenRequest) (res *pUsers.TokenResponse, code int, err error) {
+	if input.Code == "" || input.CodeVerifier == "" {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, "code and code_verifier are required")
+	}
+
+	authorizationCode, err := s.cache.GetAuthorizationCode(password.HashRefreshToken(input.Code))
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	errInvalidCode := newOAuthError(pUsers.OAuthErrInvalidGrant, "authorization code is invalid, expired or used")
+	if authorizationCode == nil || authorizationCode.ClientID != client.ClientID {
+		return nil, errs.CodeFailedUser, errInvalidCode
+	}
+	if authorizationCode.RedirectURI != input.RedirectURI {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidGrant, "redirect_uri doesn't match the authorization request")
+	}
+
+	err = password.VerifyCodeVerifier(input.CodeVerifier, authorizationCode.CodeChallenge, authorizationCode.CodeChallengeMethod)
+	if err != nil {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidGrant, err.Error())
+	}
+
+	user, err := s.activeUser(authorizationCode.UserID)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUser, errInvalidCode
+	}
+
+	accessToken, refreshToken, payload, code, err := s.issueTokens(user, sessionInfo{
+		DeviceName: client.Name,
+		UserAgent:  input.UserAgent,
+		IPAddress:  input.IPAddress,
+		Claims: pUsers.SessionClaims{
+			ClientID: client.ClientID,
+			Scope:    authorizationCode.Scope,
+			AuthTime: authorizationCode.AuthTime,
+			AMR:      authorizationCode.AMR,
+		},
+	})
+	if err != nil {
+		return nil, code, err
+	}
+
+	res = &pUsers.TokenResponse{
+		AccessToken:  strings.TrimPrefix(accessToken, "Bearer "),
+		TokenType:    tokenTypeBearer,
+		ExpiresIn:    payload.Exp - time.Now().UTC().Unix(),
+		RefreshToken: refreshToken,
+		Scope:        authorizationCode.Scope,
+	}
+
+	if scopeContains(authorizationCode.Scope, pUsers.ScopeOpenID) {
+		res.IDToken, err = s.createIDToken(user, authorizationCode, time.Duration(res.ExpiresIn)*time.Second)
+		if err != nil {
+			return nil, errs.CodeFailedServer, err
+		}
+	}
+
+	return res, errs.CodeSuccess, nil
+}
+
+// refreshTokenGrant rotate refresh token of the session that is issued to the
+// client by authorization code grant, the client don't have to send the old
+// access token. The new access token keep the claims of the session, and the
+// scope can only be narrowed. Reuse of rotated refresh token revoke the family
+// like RefreshToken.
+func (s *usersService) refreshTokenGrant(client *pUsers.OAuthClient, input pUsers.TokenRequest) (res *pUsers.TokenResponse, code int, err error) {
+	if input.RefreshToken == "" {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, "refresh_token is required")
+	}
+
+	errInvalidRefreshToken := newOAuthError(pUsers.OAuthErrInvalidGrant, "refresh token is invalid, expired or revoked")
+	refreshTokenHash := password.HashRefreshToken(input.RefreshToken)
+	session, err := s.repo.GetRefreshTokenByHash(s.ctx, refreshTokenHash)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, errs.CodeFailedServer, fmt.Errorf("failed to load refresh token, msg: %v", err)
+		}
+
+		rotated, err := s.repo.GetRotatedRefreshTokenByHash(s.ctx, refreshTokenHash)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, errs.CodeFailedUser, errInvalidRefreshToken
+			}
+			return nil, errs.CodeFailedServer, fmt.Errorf("failed to check refresh token history, msg: %v", err)
+		}
+		code, err = s.revokeReusedRefreshToken(rotated)
+		if code == errs.CodeFailedServer {
+			return nil, code, err
+		}
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidGrant, errRefreshTokenReuse.Error())
+	}
+
+	// refresh token can only be used by the client that it's issued to, first
+	// party session has no client and can't be refreshed here
+	if session.ClientID == "" || session.ClientID != client.ClientID {
+		return nil, errs.CodeFailedUser, errInvalidRefreshToken
+	}
+
+	scope := session.Scope
+	if input.Scope != "" {
+		if !scopeContains(session.Scope, input.Scope) {
+			return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidScope, "requested scope is more than the scope of the refresh token")
+		}
+		scope = mergeScope("", input.Scope)
+	}
+
+	now := time.Now().UTC()
+	_, lifetime := s.lifetime.Get(session.LifetimeKey)
+	if now.After(session.ExpiresAt.Time) || (lifetime.IdleTimeout > 0 && now.After(session.LastUsedAt.Time.Add(lifetime.IdleTimeout))) {
+		deleteArg := pUsers.DeleteRefreshTokenByIDParams{
+			ID:     session.ID,
+			UserID: session.UserID,
+		}
+		_, err = s.repo.DeleteRefreshTokenByID(s.ctx, deleteArg)
+		if err != nil {
+			return nil, errs.CodeFailedServer, fmt.Errorf("failed to end expired session, msg: %v", err)
+		}
+		return nil, errs.CodeFailedUser, errInvalidRefreshToken
+	}
+
+	user, err := s.activeUser(session.UserID)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUser, errInvalidRefreshToken
+	}
+
+	key, err := s.repo.LoadKey(s.ctx)
+	if err != nil {
+		return nil, errs.CodeFailedServer, fmt.Errorf("load key error: %w", err)
+	}
+
+	// access token of the session is replaced, so the old one is blocklisted
+	err = s.blockSessionAccessToken(*session)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	claims := pUsers.SessionClaims{
+		ClientID: client.ClientID,
+		Scope:    scope,
+		AMR:      session.AMR,
+	}
+	if session.AuthTime.Valid {
+		claims.AuthTime = session.AuthTime.Time.Unix()
+	}
+	accessToken, refreshToken, payload, err := s.createNewToken(key, user, claims, session, lifetime)
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return nil, errs.CodeFailedUser, errInvalidRefreshToken
+		}
+		return nil, errs.CodeFailedServer, err
+	}
+
+	res = &pUsers.TokenResponse{
+		AccessToken:  strings.TrimPrefix(accessToken, "Bearer "),
+		TokenType:    tokenTypeBearer,
+		ExpiresIn:    payload.Exp - now.Unix(),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	}
+
+	return res, errs.CodeSuccess, nil
+}
+
+// clientCredentialsGrant issue access token for the client as service account.
+// The token only has the requested scopes, all allowed scopes of the client is
+// granted when scope is not requested. Refresh token is not issued, the client
+// can request new token with its credential.
+func (s *usersService) clientCredentialsGrant(client *pUsers.OAuthClient, input pUsers.TokenRequest) (res *pUsers.TokenResponse, code int, err error) {
+	scope := mergeScope("", input.Scope)
+	allowedScope := strings.Join(client.AllowedScopes, " ")
+	if scope == "" {
+		scope = allowedScope
+	}
+	if !scopeContains(allowedScope, scope) {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidScope, "requested scope is not allowed for the client")
+	}
+
+	key, err := s.repo.LoadKey(s.ctx)
+	if err != nil {
+		return nil, errs.CodeFailedServer, fmt.Errorf("load key error: %w", err)
+	}
+
+	_, lifetime := s.lifetime.Get(cfg.ClientLifetimeKey(client.ClientID))
+	accessToken, payload, err := middleware.CreateClientToken(*client, scope, []string{s.audience}, lifetime.AccessTokenTTL, key)
+	if err != nil {
+		return nil, errs.CodeFailedServer, errors.New("failed generate access token")
+	}
+
+	res = &pUsers.TokenResponse{
+		AccessToken: strings.TrimPrefix(accessToken, "Bearer "),
+		TokenType:   tokenTypeBearer,
+		ExpiresIn:   payload.Exp - time.Now().UTC().Unix(),
+		Scope:       scope,
+	}
+
+	return res, errs.CodeSuccess, nil
+}
@@ -0,0 +1,834 @@
+package service
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const redirectURITest = "https://example.com/callback"
+
+func createOAuthClientTest(t *testing.T, isPublic bool) pUsers.ClientCredential {
+	clientID, clientSecret, err := password.GenerateClientCredential()
+	require.NoError(t, err)
+
+	arg := pUsers.CreateOAuthClientParams{
+		ClientID:     clientID,
+		Name:         generator.CreateRandomString(7),
+		RedirectURIs: []string{redirectURITest},
+		IsPublic:     isPublic,
+	}
+	if isPublic {
+		clientSecret = ""
+	} else {
+		arg.ClientSecretHash = password.HashClientSecret(clientSecret)
+	}
+	_, err = repoTest.CreateOAuthClient(ctx, arg)
+	require.NoError(t, err)
+
+	return pUsers.ClientCredential{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}
+}
+
+func TestIntrospectToken(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t, false)
+	user, signUpReq := createUser(t)
+
+	argLogin := pUsers.LoginRequest{
+		Email:    signUpReq.Email,
+		Password: signUpReq.Password,
+	}
+	_, accessToken, refreshToken, _, err := serviceTest.LogIn(argLogin)
+	require.NoError(t, err)
+	accessToken = strings.Split(accessToken, " ")[1]
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+	payload, err := middleware.ReadToken("Bearer "+accessToken, middleware.NewKeySet(*key))
+	require.NoError(t, err)
+
+	t.Run("success_access_token", func(t *testing.T) {
+		res, code, err := serviceTest.IntrospectToken(client, accessToken, "")
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.True(t, res.Active)
+		assert.Equal(t, strconv.Itoa(int(user.ID)), res.Sub)
+		assert.Equal(t, user.Username, res.Username)
+		assert.Equal(t, payload.ID.String(), res.Jti)
+		assert.Equal(t, payload.Exp, res.Exp)
+		assert.Equal(t, payload.SessionID, res.SessionID)
+		assert.Equal(t, tokenTypeBearer, res.TokenType)
+	})
+
+	t.Run("success_refresh_token", func(t *testing.T) {
+		for _, hint := range []string{"", pUsers.TokenTypeHintAccessToken, pUsers.TokenTypeHintRefreshToken} {
+			res, code, err := serviceTest.IntrospectToken(client, refreshToken, hint)
+			require.NoError(t, err)
+			assert.Equal(t, errs.CodeSuccess, code)
+			assert.True(t, res.Active)
+			assert.Equal(t, strconv.Itoa(int(user.ID)), res.Sub)
+			assert.Equal(t, payload.SessionID, res.SessionID)
+			assert.Equal(t, tokenTypeRefreshToken, res.TokenType)
+		}
+	})
+
+	t.Run("inactive_unknown_token", func(t *testing.T) {
+		res, code, err := serviceTest.IntrospectToken(client, generator.CreateRandomString(30), "")
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, &pUsers.IntrospectionResponse{Active: false}, res)
+	})
+
+	t.Run("failed_wrong_client_secret", func(t *testing.T) {
+		wrongClient := pUsers.ClientCredential{
+			ClientID:     client.ClientID,
+			ClientSecret: client.ClientSecret + "a",
+		}
+		res, code, err := serviceTest.IntrospectToken(wrongClient, accessToken, "")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Nil(t, res)
+	})
+
+	t.Run("failed_unknown_client", func(t *testing.T) {
+		res, code, err := serviceTest.IntrospectToken(pUsers.ClientCredential{}, accessToken, "")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Nil(t, res)
+	})
+
+	t.Run("failed_revoked_client", func(t *testing.T) {
+		revokedClient := createOAuthClientTest(t, false)
+		err := repoTest.RevokeOAuthClient(ctx, revokedClient.ClientID)
+		require.NoError(t, err)
+
+		_, code, err := serviceTest.IntrospectToken(revokedClient, accessToken, "")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+	})
+
+	t.Run("failed_public_client", func(t *testing.T) {
+		publicClient := createOAuthClientTest(t, true)
+
+		_, code, err := serviceTest.IntrospectToken(publicClient, accessToken, "")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+	})
+
+	t.Run("failed_empty_token", func(t *testing.T) {
+		_, code, err := serviceTest.IntrospectToken(client, "", "")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+
+	t.Run("inactive_after_logout", func(t *testing.T) {
+		err := serviceTest.LogOut(*payload)
+		require.NoError(t, err)
+
+		for _, token := range []string{accessToken, refreshToken} {
+			res, code, err := serviceTest.IntrospectToken(client, token, "")
+			require.NoError(t, err)
+			assert.Equal(t, errs.CodeSuccess, code)
+			assert.False(t, res.Active)
+		}
+	})
+}
+
+func TestRevokeToken(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t, false)
+	otherClient := createOAuthClientTest(t, true)
+	user, signUpReq := createUser(t)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	// login return the tokens that are issued to the client by authorization
+	// code flow
+	login := func(t *testing.T) (accessToken, refreshToken string, payload *pUsers.JwtPayload) {
+		verifier, err := password.GenerateAuthorizationCode()
+		require.NoError(t, err)
+		authorizationCode := authorizeTest(t, pUsers.JwtPayload{UserID: user.ID, Name: user.Username, Email: user.Email}, pUsers.AuthorizeRequest{
+			ResponseType:        pUsers.ResponseTypeCode,
+			ClientID:            client.ClientID,
+			RedirectURI:         redirectURITest,
+			Scope:               "profile",
+			CodeChallenge:       password.CodeChallengeS256(verifier),
+			CodeChallengeMethod: password.CodeChallengeMethodS256,
+		})
+
+		res, _, err := serviceTest.Token(client, pUsers.TokenRequest{
+			GrantType:    pUsers.GrantTypeAuthorizationCode,
+			Code:         authorizationCode,
+			RedirectURI:  redirectURITest,
+			CodeVerifier: verifier,
+		})
+		require.NoError(t, err)
+
+		payload, err = middleware.ReadToken("Bearer "+res.AccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		require.Equal(t, client.ClientID, payload.ClientID)
+
+		return res.AccessToken, res.RefreshToken, payload
+	}
+
+	t.Run("success_access_token", func(t *testing.T) {
+		accessToken, refreshToken, payload := login(t)
+
+		code, err := serviceTest.RevokeToken(client, accessToken, pUsers.TokenTypeHintAccessToken)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		err = cacheTest.CheckBlockedToken(*payload)
+		require.Error(t, err)
+
+		// session of the access token is not revoked
+		res, _, err := serviceTest.IntrospectToken(client, refreshToken, pUsers.TokenTypeHintRefreshToken)
+		require.NoError(t, err)
+		assert.True(t, res.Active)
+	})
+
+	t.Run("success_refresh_token", func(t *testing.T) {
+		accessToken, refreshToken, payload := login(t)
+
+		// wrong hint, the token is still found
+		code, err := serviceTest.RevokeToken(client, refreshToken, pUsers.TokenTypeHintAccessToken)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		for _, token := range []string{accessToken, refreshToken} {
+			res, _, err := serviceTest.IntrospectToken(client, token, "")
+			require.NoError(t, err)
+			assert.False(t, res.Active)
+		}
+		err = cacheTest.CheckBlockedToken(*payload)
+		require.Error(t, err)
+
+		sessions, _, err := serviceTest.ListSessions(*payload)
+		require.NoError(t, err)
+		for _, v := range sessions {
+			assert.NotEqual(t, payload.SessionID, v.ID)
+		}
+
+		// revoke revoked token is not an error
+		code, err = serviceTest.RevokeToken(client, refreshToken, pUsers.TokenTypeHintRefreshToken)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+	})
+
+	t.Run("success_unknown_token", func(t *testing.T) {
+		code, err := serviceTest.RevokeToken(client, generator.CreateRandomString(30), "")
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+	})
+
+	t.Run("success_token_of_other_client", func(t *testing.T) {
+		accessToken, refreshToken, payload := login(t)
+
+		// token of other client is not revoked, but it's not an error
+		for _, token := range []string{accessToken, refreshToken} {
+			code, err := serviceTest.RevokeToken(otherClient, token, "")
+			require.NoError(t, err)
+			assert.Equal(t, errs.CodeSuccess, code)
+
+			res, _, err := serviceTest.IntrospectToken(client, token, "")
+			require.NoError(t, err)
+			assert.True(t, res.Active)
+		}
+		err = cacheTest.CheckBlockedToken(*payload)
+		require.NoError(t, err)
+	})
+
+	t.Run("success_first_party_token", func(t *testing.T) {
+		_, accessToken, refreshToken, _, err := serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+		require.NoError(t, err)
+		accessToken = strings.TrimPrefix(accessToken, "Bearer ")
+
+		// token of first party login is not issued to any client
+		for _, token := range []string{accessToken, refreshToken} {
+			code, err := serviceTest.RevokeToken(client, token, "")
+			require.NoError(t, err)
+			assert.Equal(t, errs.CodeSuccess, code)
+
+			res, _, err := serviceTest.IntrospectToken(client, token, "")
+			require.NoError(t, err)
+			assert.True(t, res.Active)
+		}
+	})
+
+	t.Run("failed_wrong_client", func(t *testing.T) {
+		_, refreshToken, _ := login(t)
+
+		wrongClient := pUsers.ClientCredential{
+			ClientID:     client.ClientID,
+			ClientSecret: generator.CreateRandomString(30),
+		}
+		code, err := serviceTest.RevokeToken(wrongClient, refreshToken, "")
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+
+		res, _, err := serviceTest.IntrospectToken(client, refreshToken, "")
+		require.NoError(t, err)
+		assert.True(t, res.Active)
+	})
+}
+
+// authorizeTest approve the authorization request and return the authorization code
+func authorizeTest(t *testing.T, payload pUsers.JwtPayload, arg pUsers.AuthorizeRequest) string {
+	approve := true
+	arg.Approve = &approve
+	res, code, err := serviceTest.Authorize(payload, arg)
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+	require.False(t, res.ConsentRequired)
+
+	redirectTo, err := url.Parse(res.RedirectTo)
+	require.NoError(t, err)
+	assert.Equal(t, arg.State, redirectTo.Query().Get("state"))
+	require.NotEmpty(t, redirectTo.Query().Get("code"))
+
+	return redirectTo.Query().Get("code")
+}
+
+func TestAuthorize(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t, true)
+	user, _ := createUser(t)
+	payload := pUsers.JwtPayload{UserID: user.ID, Name: user.Username, Email: user.Email}
+
+	verifier, err := password.GenerateAuthorizationCode()
+	require.NoError(t, err)
+	arg := pUsers.AuthorizeRequest{
+		ResponseType:        pUsers.ResponseTypeCode,
+		ClientID:            client.ClientID,
+		RedirectURI:         redirectURITest,
+		Scope:               "profile email",
+		State:               generator.CreateRandomString(10),
+		CodeChallenge:       password.CodeChallengeS256(verifier),
+		CodeChallengeMethod: password.CodeChallengeMethodS256,
+	}
+
+	t.Run("consent_required", func(t *testing.T) {
+		res, code, err := serviceTest.Authorize(payload, arg)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.True(t, res.ConsentRequired)
+		assert.Equal(t, "profile email", res.Scope)
+		assert.Empty(t, res.RedirectTo)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		deny := false
+		denyArg := arg
+		denyArg.Approve = &deny
+		res, code, err := serviceTest.Authorize(payload, denyArg)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		redirectTo, err := url.Parse(res.RedirectTo)
+		require.NoError(t, err)
+		assert.Equal(t, pUsers.OAuthErrAccessDenied, redirectTo.Query().Get("error"))
+		assert.Equal(t, arg.State, redirectTo.Query().Get("state"))
+		assert.Empty(t, redirectTo.Query().Get("code"))
+	})
+
+	t.Run("approved", func(t *testing.T) {
+		authorizeTest(t, payload, arg)
+
+		consent, err := repoTest.GetOAuthConsent(ctx, pUsers.GetOAuthConsentParams{UserID: user.ID, ClientID: client.ClientID})
+		require.NoError(t, err)
+		assert.Equal(t, "profile email", consent.Scope)
+
+		// consent is remembered, code is sent right away
+		res, _, err := serviceTest.Authorize(payload, arg)
+		require.NoError(t, err)
+		assert.False(t, res.ConsentRequired)
+		assert.Contains(t, res.RedirectTo, "code=")
+
+		// new scope need new consent
+		newScopeArg := arg
+		newScopeArg.Scope = "email users:read"
+		res, _, err = serviceTest.Authorize(payload, newScopeArg)
+		require.NoError(t, err)
+		assert.True(t, res.ConsentRequired)
+	})
+
+	invalidTestCases := []struct {
+		desc      string
+		modify    func(arg *pUsers.AuthorizeRequest)
+		errorCode string
+	}{
+		{
+			desc:      "failed_unknown_client",
+			modify:    func(arg *pUsers.AuthorizeRequest) { arg.ClientID = generator.CreateRandomString(10) },
+			errorCode: pUsers.OAuthErrInvalidRequest,
+		}, {
+			desc:      "failed_unregistered_redirect_uri",
+			modify:    func(arg *pUsers.AuthorizeRequest) { arg.RedirectURI = redirectURITest + "/other" },
+			errorCode: pUsers.OAuthErrInvalidRequest,
+		}, {
+			desc:      "failed_response_type_token",
+			modify:    func(arg *pUsers.AuthorizeRequest) { arg.ResponseType = "token" },
+			errorCode: pUsers.OAuthErrUnsupportedResponseType,
+		}, {
+			desc:      "failed_without_pkce",
+			modify:    func(arg *pUsers.AuthorizeRequest) { arg.CodeChallenge = "" },
+			errorCode: pUsers.OAuthErrInvalidRequest,
+		}, {
+			desc: "failed_plain_pkce",
+			modify: func(arg *pUsers.AuthorizeRequest) {
+				arg.CodeChallenge = verifier
+				arg.CodeChallengeMethod = "plain"
+			},
+			errorCode: pUsers.OAuthErrInvalidRequest,
+		}, {
+			desc:      "failed_scope_not_allowed_for_role",
+			modify:    func(arg *pUsers.AuthorizeRequest) { arg.Scope = "profile admin" },
+			errorCode: pUsers.OAuthErrInvalidScope,
+		},
+	}
+
+	for _, tC := range invalidTestCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			invalidArg := arg
+			tC.modify(&invalidArg)
+
+			res, code, err := serviceTest.Authorize(payload, invalidArg)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUser, code)
+			assert.Nil(t, res)
+
+			var oauthErr *pUsers.OAuthError
+			require.ErrorAs(t, err, &oauthErr)
+			assert.Equal(t, tC.errorCode, oauthErr.ErrorCode)
+		})
+	}
+}
+
+func TestTokenAuthorizationCode(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	publicClient := createOAuthClientTest(t, true)
+	confidentialClient := createOAuthClientTest(t, false)
+	user, _ := createUser(t)
+	payload := pUsers.JwtPayload{UserID: user.ID, Name: user.Username, Email: user.Email}
+
+	newAuthorizeArg := func(t *testing.T, clientID string) (arg pUsers.AuthorizeRequest, verifier string) {
+		verifier, err := password.GenerateAuthorizationCode()
+		require.NoError(t, err)
+
+		arg = pUsers.AuthorizeRequest{
+			ResponseType:        pUsers.ResponseTypeCode,
+			ClientID:            clientID,
+			RedirectURI:         redirectURITest,
+			Scope:               "profile",
+			CodeChallenge:       password.CodeChallengeS256(verifier),
+			CodeChallengeMethod: password.CodeChallengeMethodS256,
+		}
+		return arg, verifier
+	}
+
+	for _, client := range []pUsers.ClientCredential{publicClient, confidentialClient} {
+		t.Run("success", func(t *testing.T) {
+			arg, verifier := newAuthorizeArg(t, client.ClientID)
+			authorizationCode := authorizeTest(t, payload, arg)
+
+			tokenArg := pUsers.TokenRequest{
+				GrantType:    pUsers.GrantTypeAuthorizationCode,
+				Code:         authorizationCode,
+				RedirectURI:  redirectURITest,
+				CodeVerifier: verifier,
+			}
+			res, code, err := serviceTest.Token(client, tokenArg)
+			require.NoError(t, err)
+			assert.Equal(t, errs.CodeSuccess, code)
+			assert.Equal(t, tokenTypeBearer, res.TokenType)
+			assert.Equal(t, "profile", res.Scope)
+			assert.NotEmpty(t, res.RefreshToken)
+			assert.Greater(t, res.ExpiresIn, int64(0))
+
+			// the token is the same token that LogIn issue
+			key, err := repoTest.LoadKey(ctx)
+			require.NoError(t, err)
+			tokenPayload, err := middleware.ReadToken("Bearer "+res.AccessToken, middleware.NewKeySet(*key))
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, tokenPayload.UserID)
+			assert.Equal(t, user.Email, tokenPayload.Email)
+
+			sessions, _, err := serviceTest.ListSessions(*tokenPayload)
+			require.NoError(t, err)
+			var isFound bool
+			for _, v := range sessions {
+				if v.ID == tokenPayload.SessionID {
+					isFound = true
+				}
+			}
+			assert.True(t, isFound)
+
+			// authorization code is one-time
+			_, code, err = serviceTest.Token(client, tokenArg)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUser, code)
+		})
+	}
+
+	failedTestCases := []struct {
+		desc      string
+		client    pUsers.ClientCredential
+		modify    func(arg *pUsers.TokenRequest)
+		code      int
+		errorCode string
+	}{
+		{
+			desc:      "failed_wrong_verifier",
+			client:    publicClient,
+			modify:    func(arg *pUsers.TokenRequest) { arg.CodeVerifier = arg.CodeVerifier[1:] + "a" },
+			code:      errs.CodeFailedUser,
+			errorCode: pUsers.OAuthErrInvalidGrant,
+		}, {
+			desc:      "failed_wrong_redirect_uri",
+			client:    publicClient,
+			modify:    func(arg *pUsers.TokenRequest) { arg.RedirectURI = redirectURITest + "/other" },
+			code:      errs.CodeFailedUser,
+			errorCode: pUsers.OAuthErrInvalidGrant,
+		}, {
+			desc:      "failed_code_of_other_client",
+			client:    confidentialClient,
+			modify:    func(arg *pUsers.TokenRequest) {},
+			code:      errs.CodeFailedUser,
+			errorCode: pUsers.OAuthErrInvalidGrant,
+		}, {
+			desc:      "failed_unknown_code",
+			client:    publicClient,
+			modify:    func(arg *pUsers.TokenRequest) { arg.Code = generator.CreateRandomString(30) },
+			code:      errs.CodeFailedUser,
+			errorCode: pUsers.OAuthErrInvalidGrant,
+		}, {
+			desc:      "failed_unsupported_grant_type",
+			client:    publicClient,
+			modify:    func(arg *pUsers.TokenRequest) { arg.GrantType = "password" },
+			code:      errs.CodeFailedUser,
+			errorCode: pUsers.OAuthErrUnsupportedGrantType,
+		}, {
+			desc: "failed_public_client_with_secret",
+			client: pUsers.ClientCredential{
+				ClientID:     publicClient.ClientID,
+				ClientSecret: generator.CreateRandomString(30),
+			},
+			modify:    func(arg *pUsers.TokenRequest) {},
+			code:      errs.CodeFailedUnauthorized,
+			errorCode: pUsers.OAuthErrInvalidClient,
+		}, {
+			desc: "failed_confidential_client_without_secret",
+			client: pUsers.ClientCredential{
+				ClientID: confidentialClient.ClientID,
+			},
+			modify:    func(arg *pUsers.TokenRequest) {},
+			code:      errs.CodeFailedUnauthorized,
+			errorCode: pUsers.OAuthErrInvalidClient,
+		},
+	}
+
+	for _, tC := range failedTestCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			arg, verifier := newAuthorizeArg(t, publicClient.ClientID)
+			authorizationCode := authorizeTest(t, payload, arg)
+
+			tokenArg := pUsers.TokenRequest{
+				GrantType:    pUsers.GrantTypeAuthorizationCode,
+				Code:         authorizationCode,
+				RedirectURI:  redirectURITest,
+				CodeVerifier: verifier,
+			}
+			tC.modify(&tokenArg)
+
+			res, code, err := serviceTest.Token(tC.client, tokenArg)
+			require.Error(t, err)
+			assert.Equal(t, tC.code, code)
+			assert.Nil(t, res)
+
+			var oauthErr *pUsers.OAuthError
+			require.ErrorAs(t, err, &oauthErr)
+			assert.Equal(t, tC.errorCode, oauthErr.ErrorCode)
+		})
+	}
+}
+
+func TestTokenRefreshToken(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t, true)
+	otherClient := createOAuthClientTest(t, false)
+	user, _ := createUser(t)
+	payload := pUsers.JwtPayload{UserID: user.ID, Name: user.Username, Email: user.Email, AuthTime: time.Now().UTC().Add(-time.Hour).Unix()}
+
+	verifier, err := password.GenerateAuthorizationCode()
+	require.NoError(t, err)
+	authorizationCode := authorizeTest(t, payload, pUsers.AuthorizeRequest{
+		ResponseType:        pUsers.ResponseTypeCode,
+		ClientID:            client.ClientID,
+		RedirectURI:         redirectURITest,
+		Scope:               "profile",
+		CodeChallenge:       password.CodeChallengeS256(verifier),
+		CodeChallengeMethod: password.CodeChallengeMethodS256,
+	})
+	tokens, _, err := serviceTest.Token(client, pUsers.TokenRequest{
+		GrantType:    pUsers.GrantTypeAuthorizationCode,
+		Code:         authorizationCode,
+		RedirectURI:  redirectURITest,
+		CodeVerifier: verifier,
+	})
+	require.NoError(t, err)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+	tokenPayload, err := middleware.ReadToken("Bearer "+tokens.AccessToken, middleware.NewKeySet(*key))
+	require.NoError(t, err)
+
+	failedTestCases := []struct {
+		desc      string
+		client    pUsers.ClientCredential
+		arg       pUsers.TokenRequest
+		errorCode string
+	}{
+		{
+			desc:      "failed_without_refresh_token",
+			client:    client,
+			arg:       pUsers.TokenRequest{GrantType: pUsers.GrantTypeRefreshToken},
+			errorCode: pUsers.OAuthErrInvalidRequest,
+		}, {
+			desc:      "failed_unknown_refresh_token",
+			client:    client,
+			arg:       pUsers.TokenRequest{GrantType: pUsers.GrantTypeRefreshToken, RefreshToken: generator.CreateRandomString(30)},
+			errorCode: pUsers.OAuthErrInvalidGrant,
+		}, {
+			desc:      "failed_refresh_token_of_other_client",
+			client:    otherClient,
+			arg:       pUsers.TokenRequest{GrantType: pUsers.GrantTypeRefreshToken, RefreshToken: tokens.RefreshToken},
+			errorCode: pUsers.OAuthErrInvalidGrant,
+		}, {
+			desc:      "failed_wider_scope",
+			client:    client,
+			arg:       pUsers.TokenRequest{GrantType: pUsers.GrantTypeRefreshToken, RefreshToken: tokens.RefreshToken, Scope: "profile email"},
+			errorCode: pUsers.OAuthErrInvalidScope,
+		},
+	}
+
+	for _, tC := range failedTestCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, code, err := serviceTest.Token(tC.client, tC.arg)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUser, code)
+			assert.Nil(t, res)
+
+			var oauthErr *pUsers.OAuthError
+			require.ErrorAs(t, err, &oauthErr)
+			assert.Equal(t, tC.errorCode, oauthErr.ErrorCode)
+		})
+	}
+
+	var newTokens *pUsers.TokenResponse
+	t.Run("success", func(t *testing.T) {
+		var code int
+		newTokens, code, err = serviceTest.Token(client, pUsers.TokenRequest{
+			GrantType:    pUsers.GrantTypeRefreshToken,
+			RefreshToken: tokens.RefreshToken,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, tokenTypeBearer, newTokens.TokenType)
+		assert.Equal(t, "profile", newTokens.Scope)
+		assert.NotEmpty(t, newTokens.RefreshToken)
+		assert.NotEqual(t, tokens.RefreshToken, newTokens.RefreshToken)
+
+		// the new access token keep the claims of the session
+		newPayload, err := middleware.ReadToken("Bearer "+newTokens.AccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, tokenPayload.SessionID, newPayload.SessionID)
+		assert.Equal(t, client.ClientID, newPayload.ClientID)
+		assert.Equal(t, tokenPayload.Scope, newPayload.Scope)
+		assert.Equal(t, tokenPayload.AuthTime, newPayload.AuthTime)
+		assert.Equal(t, tokenPayload.AMR, newPayload.AMR)
+
+		// the old access token of the session is blocklisted
+		err = cacheTest.CheckBlockedToken(*tokenPayload)
+		require.Error(t, err)
+	})
+
+	t.Run("failed_reused_refresh_token", func(t *testing.T) {
+		_, _, err := serviceTest.Token(client, pUsers.TokenRequest{
+			GrantType:    pUsers.GrantTypeRefreshToken,
+			RefreshToken: tokens.RefreshToken,
+		})
+		var oauthErr *pUsers.OAuthError
+		require.ErrorAs(t, err, &oauthErr)
+		assert.Equal(t, pUsers.OAuthErrInvalidGrant, oauthErr.ErrorCode)
+
+		// the family is revoked, so the rotated refresh token can't be used too
+		_, err = repoTest.GetRefreshTokenByHash(ctx, password.HashRefreshToken(newTokens.RefreshToken))
+		require.ErrorIs(t, err, pgx.ErrNoRows)
+	})
+}
+
+func createServiceAccountTest(t *testing.T, allowedScopes ...string) pUsers.ClientCredential {
+	clientID, clientSecret, err := password.GenerateClientCredential()
+	require.NoError(t, err)
+
+	arg := pUsers.CreateOAuthClientParams{
+		ClientID:         clientID,
+		ClientSecretHash: password.HashClientSecret(clientSecret),
+		Name:             generator.CreateRandomString(7),
+		GrantTypes:       []string{pUsers.GrantTypeClientCredentials},
+		AllowedScopes:    allowedScopes,
+	}
+	_, err = repoTest.CreateOAuthClient(ctx, arg)
+	require.NoError(t, err)
+
+	return pUsers.ClientCredential{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}
+}
+
+func TestTokenClientCredentials(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	serviceAccount := createServiceAccountTest(t, "users:read", "users:write")
+	introspectionClient := createOAuthClientTest(t, false)
+
+	testCases := []struct {
+		desc  string
+		scope string
+		res   string
+	}{
+		{
+			desc:  "success_all_allowed_scopes",
+			scope: "",
+			res:   "users:read users:write",
+		}, {
+			desc:  "success_requested_scope",
+			scope: "users:read",
+			res:   "users:read",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			arg := pUsers.TokenRequest{
+				GrantType: pUsers.GrantTypeClientCredentials,
+				Scope:     tC.scope,
+			}
+			res, code, err := serviceTest.Token(serviceAccount, arg)
+			require.NoError(t, err)
+			assert.Equal(t, errs.CodeSuccess, code)
+			assert.Equal(t, tokenTypeBearer, res.TokenType)
+			assert.Equal(t, tC.res, res.Scope)
+			assert.Empty(t, res.RefreshToken)
+			assert.Greater(t, res.ExpiresIn, int64(0))
+
+			key, err := repoTest.LoadKey(ctx)
+			require.NoError(t, err)
+			payload, err := middleware.ReadToken("Bearer "+res.AccessToken, middleware.NewKeySet(*key))
+			require.NoError(t, err)
+			assert.True(t, payload.IsServiceAccount())
+			assert.Equal(t, serviceAccount.ClientID, payload.Subject)
+			assert.Equal(t, tC.res, payload.Scope)
+			assert.Equal(t, jwt.ClaimStrings{audienceTest}, payload.Audience)
+
+			introspection, code, err := serviceTest.IntrospectToken(introspectionClient, res.AccessToken, "")
+			require.NoError(t, err)
+			assert.Equal(t, errs.CodeSuccess, code)
+			assert.True(t, introspection.Active)
+			assert.Equal(t, serviceAccount.ClientID, introspection.Sub)
+			assert.Equal(t, serviceAccount.ClientID, introspection.ClientID)
+			assert.Equal(t, tC.res, introspection.Scope)
+			assert.Equal(t, []string{audienceTest}, introspection.Aud)
+		})
+	}
+
+	failedTestCases := []struct {
+		desc      string
+		client    pUsers.ClientCredential
+		scope     string
+		code      int
+		errorCode string
+	}{
+		{
+			desc:      "failed_scope_not_allowed",
+			client:    serviceAccount,
+			scope:     "users:read users:delete",
+			code:      errs.CodeFailedUser,
+			errorCode: pUsers.OAuthErrInvalidScope,
+		}, {
+			desc:      "failed_client_without_grant_type",
+			client:    introspectionClient,
+			code:      errs.CodeFailedUser,
+			errorCode: pUsers.OAuthErrUnauthorizedClient,
+		}, {
+			desc: "failed_wrong_client_secret",
+			client: pUsers.ClientCredential{
+				ClientID:     serviceAccount.ClientID,
+				ClientSecret: serviceAccount.ClientSecret + "a",
+			},
+			code:      errs.CodeFailedUnauthorized,
+			errorCode: pUsers.OAuthErrInvalidClient,
+		},
+	}
+
+	for _, tC := range failedTestCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			arg := pUsers.TokenRequest{
+				GrantType: pUsers.GrantTypeClientCredentials,
+				Scope:     tC.scope,
+			}
+			res, code, err := serviceTest.Token(tC.client, arg)
+			require.Error(t, err)
+			assert.Equal(t, tC.code, code)
+			assert.Nil(t, res)
+
+			var oauthErr *pUsers.OAuthError
+			require.ErrorAs(t, err, &oauthErr)
+			assert.Equal(t, tC.errorCode, oauthErr.ErrorCode)
+		})
+	}
+
+	t.Run("inactive_after_client_revoked", func(t *testing.T) {
+		client := createServiceAccountTest(t, "users:read")
+		res, _, err := serviceTest.Token(client, pUsers.TokenRequest{GrantType: pUsers.GrantTypeClientCredentials})
+		require.NoError(t, err)
+
+		err = repoTest.RevokeOAuthClient(ctx, client.ClientID)
+		require.NoError(t, err)
+
+		introspection, code, err := serviceTest.IntrospectToken(introspectionClient, res.AccessToken, "")
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.False(t, introspection.Active)
+	})
+}
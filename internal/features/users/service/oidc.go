@@ -0,0 +1,122 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+// path of the endpoints that is published in discovery document, the path
+// must be the same as the route in handler
+const (
+	authorizationEndpointPath = "/api/v1/oauth/authorize"
+	tokenEndpointPath         = "/api/v1/oauth/token"
+	userinfoEndpointPath      = "/api/v1/oauth/userinfo"
+	jwksURIPath               = "/.well-known/jwks.json"
+	revocationEndpointPath    = "/api/v1/oauth/revoke"
+	introspectionEndpointPath = "/api/v1/oauth/introspect"
+)
+
+// GetOpenIDConfiguration return the discovery document of OpenID Connect
+// provider. Signing algorithm of ID token is the algorithm of the keys that
+// token is verified with, so it follow the key rotation.
+func (s *usersService) GetOpenIDConfiguration() (res *pUsers.OpenIDConfiguration, code int, err error) {
+	keys, err := s.repo.ListVerificationKeys(s.ctx)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	algs := []string{}
+	for _, key := range keys {
+		if !slices.Contains(algs, key.Alg) {
+			algs = append(algs, key.Alg)
+		}
+	}
+
+	res = &pUsers.OpenIDConfiguration{
+		Issuer:                            s.issuer,
+		AuthorizationEndpoint:             s.issuer + authorizationEndpointPath,
+		TokenEndpoint:                     s.issuer + tokenEndpointPath,
+		UserinfoEndpoint:                  s.issuer + userinfoEndpointPath,
+		JwksURI:                           s.issuer + jwksURIPath,
+		RevocationEndpoint:                s.issuer + revocationEndpointPath,
+		IntrospectionEndpoint:             s.issuer + introspectionEndpointPath,
+		ScopesSupported:                   []string{pUsers.ScopeOpenID, pUsers.ScopeProfile, pUsers.ScopeEmail},
+		ResponseTypesSupported:            []string{pUsers.ResponseTypeCode},
+		GrantTypesSupported:               []string{pUsers.GrantTypeAuthorizationCode, pUsers.GrantTypeRefreshToken, pUsers.GrantTypeClientCredentials, pUsers.GrantTypeTokenExchange},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algs,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{password.CodeChallengeMethodS256},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr", "name", "preferred_username", "email"},
+		DPoPSigningAlgValuesSupported:     middleware.DPoPSigningAlgs(),
+	}
+
+	return res, errs.CodeSuccess, nil
+}
+
+// createIDToken create ID token for the client that the user authorized with
+// authorization code, the token has the same lifetime as the access token.
+func (s *usersService) createIDToken(user *pUsers.User, authorizationCode *pUsers.AuthorizationCode, ttl time.Duration) (string, error) {
+	key, err := s.repo.LoadKey(s.ctx)
+	if err != nil {
+		return "", fmt.Errorf("load key error: %w", err)
+	}
+
+	payload := &pUsers.IDTokenPayload{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   s.issuer,
+			Subject:  strconv.Itoa(int(user.ID)),
+			Audience: jwt.ClaimStrings{authorizationCode.ClientID},
+		},
+		Nonce:    authorizationCode.Nonce,
+		AuthTime: authorizationCode.AuthTime,
+		AMR:      authorizationCode.AMR,
+	}
+
+	idToken, _, err := middleware.CreateIDToken(payload, ttl, key)
+	if err != nil {
+		return "", errors.New("failed generate id token")
+	}
+
+	return idToken, nil
+}
+
+// UserInfo return claims of the user of the access token, the access token
+// must be granted openid scope and the other claims is only returned when
+// their scope is granted.
+func (s *usersService) UserInfo(payload pUsers.JwtPayload) (res *pUsers.UserInfo, code int, err error) {
+	if payload.IsServiceAccount() || !scopeContains(payload.Scope, pUsers.ScopeOpenID) {
+		return nil, errs.CodeFailedForbidden, newOAuthError(pUsers.OAuthErrInsufficientScope, "access token doesn't have openid scope")
+	}
+
+	user, err := s.activeUser(payload.UserID)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUnauthorized, newOAuthError(pUsers.OAuthErrInvalidToken, "user of the access token is not found")
+	}
+
+	res = &pUsers.UserInfo{
+		Sub: strconv.Itoa(int(user.ID)),
+	}
+	if scopeContains(payload.Scope, pUsers.ScopeProfile) {
+		res.Name = user.Username
+		res.PreferredUsername = user.Username
+	}
+	if scopeContains(payload.Scope, pUsers.ScopeEmail) {
+		res.Email = user.Email
+	}
+
+	return res, errs.CodeSuccess, nil
+}
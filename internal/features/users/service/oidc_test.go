@@ -0,0 +1,187 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOpenIDConfiguration(t *testing.T) {
+	res, code, err := serviceTest.GetOpenIDConfiguration()
+	require.NoError(t, err)
+	assert.Equal(t, errs.CodeSuccess, code)
+	assert.Equal(t, issuerTest, res.Issuer)
+	assert.Equal(t, issuerTest+"/api/v1/oauth/authorize", res.AuthorizationEndpoint)
+	assert.Equal(t, issuerTest+"/api/v1/oauth/token", res.TokenEndpoint)
+	assert.Equal(t, issuerTest+"/api/v1/oauth/userinfo", res.UserinfoEndpoint)
+	assert.Equal(t, issuerTest+"/.well-known/jwks.json", res.JwksURI)
+	assert.Contains(t, res.ScopesSupported, pUsers.ScopeOpenID)
+	assert.Equal(t, []string{pUsers.ResponseTypeCode}, res.ResponseTypesSupported)
+	assert.Equal(t, []string{password.CodeChallengeMethodS256}, res.CodeChallengeMethodsSupported)
+	assert.Contains(t, res.DPoPSigningAlgValuesSupported, password.SigningAlgES256)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, res.IDTokenSigningAlgValuesSupported, key.Alg)
+}
+
+// loginAndAuthorizeTest login the user and exchange authorization code for the
+// token with the scope, so the token has the claims of real login.
+func loginAndAuthorizeTest(t *testing.T, client pUsers.ClientCredential, scope, nonce string) (*pUsers.TokenResponse, *pUsers.JwtPayload) {
+	_, signUpReq := createUser(t)
+	_, accessToken, _, _, err := serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+	require.NoError(t, err)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+	payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+	require.NoError(t, err)
+
+	verifier, err := password.GenerateAuthorizationCode()
+	require.NoError(t, err)
+	arg := pUsers.AuthorizeRequest{
+		ResponseType:        pUsers.ResponseTypeCode,
+		ClientID:            client.ClientID,
+		RedirectURI:         redirectURITest,
+		Scope:               scope,
+		CodeChallenge:       password.CodeChallengeS256(verifier),
+		CodeChallengeMethod: password.CodeChallengeMethodS256,
+		Nonce:               nonce,
+	}
+	authorizationCode := authorizeTest(t, *payload, arg)
+
+	tokenArg := pUsers.TokenRequest{
+		GrantType:    pUsers.GrantTypeAuthorizationCode,
+		Code:         authorizationCode,
+		RedirectURI:  redirectURITest,
+		CodeVerifier: verifier,
+	}
+	res, code, err := serviceTest.Token(client, tokenArg)
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+
+	return res, payload
+}
+
+func TestTokenIDToken(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t, false)
+
+	t.Run("success_openid_scope", func(t *testing.T) {
+		res, loginPayload := loginAndAuthorizeTest(t, client, "openid profile", "n-0S6_WzA2Mj")
+		require.NotEmpty(t, res.IDToken)
+
+		key, err := repoTest.LoadKey(ctx)
+		require.NoError(t, err)
+		idToken, err := middleware.ReadIDToken(res.IDToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, issuerTest, idToken.Issuer)
+		assert.Equal(t, strconv.Itoa(int(loginPayload.UserID)), idToken.Subject)
+		assert.Equal(t, []string{client.ClientID}, []string(idToken.Audience))
+		assert.Equal(t, "n-0S6_WzA2Mj", idToken.Nonce)
+		assert.Equal(t, loginPayload.AuthTime, idToken.AuthTime)
+		assert.Equal(t, []string{pUsers.AMRPassword}, idToken.AMR)
+
+		// access token keep the granted scope and authentication of the login
+		accessToken, err := middleware.ReadToken("Bearer "+res.AccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, client.ClientID, accessToken.ClientID)
+		assert.Equal(t, "openid profile", accessToken.Scope)
+		assert.Equal(t, loginPayload.AuthTime, accessToken.AuthTime)
+		assert.Equal(t, loginPayload.AMR, accessToken.AMR)
+	})
+
+	t.Run("success_without_openid_scope", func(t *testing.T) {
+		res, _ := loginAndAuthorizeTest(t, client, "profile", "")
+		assert.Empty(t, res.IDToken)
+	})
+}
+
+func TestUserInfo(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createOAuthClientTest(t, false)
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc    string
+		scope   string
+		profile bool
+		email   bool
+	}{
+		{
+			desc:  "success_openid",
+			scope: "openid",
+		}, {
+			desc:    "success_profile",
+			scope:   "openid profile",
+			profile: true,
+		}, {
+			desc:    "success_profile_email",
+			scope:   "openid profile email",
+			profile: true,
+			email:   true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			token, _ := loginAndAuthorizeTest(t, client, tC.scope, "")
+			payload, err := middleware.ReadToken("Bearer "+token.AccessToken, middleware.NewKeySet(*key))
+			require.NoError(t, err)
+			user, err := repoTest.GetUserByID(ctx, payload.UserID)
+			require.NoError(t, err)
+
+			res, code, err := serviceTest.UserInfo(*payload)
+			require.NoError(t, err)
+			assert.Equal(t, errs.CodeSuccess, code)
+			assert.Equal(t, strconv.Itoa(int(user.ID)), res.Sub)
+			if tC.profile {
+				assert.Equal(t, user.Username, res.Name)
+				assert.Equal(t, user.Username, res.PreferredUsername)
+			} else {
+				assert.Empty(t, res.Name)
+			}
+			if tC.email {
+				assert.Equal(t, user.Email, res.Email)
+			} else {
+				assert.Empty(t, res.Email)
+			}
+		})
+	}
+
+	t.Run("failed_without_openid_scope", func(t *testing.T) {
+		token, _ := loginAndAuthorizeTest(t, client, "profile", "")
+		payload, err := middleware.ReadToken("Bearer "+token.AccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+
+		res, code, err := serviceTest.UserInfo(*payload)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedForbidden, code)
+		assert.Nil(t, res)
+
+		var oauthErr *pUsers.OAuthError
+		require.ErrorAs(t, err, &oauthErr)
+		assert.Equal(t, pUsers.OAuthErrInsufficientScope, oauthErr.ErrorCode)
+	})
+
+	t.Run("failed_login_token", func(t *testing.T) {
+		_, loginPayload := loginAndAuthorizeTest(t, client, "openid", "")
+
+		_, code, err := serviceTest.UserInfo(*loginPayload)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedForbidden, code)
+	})
+}
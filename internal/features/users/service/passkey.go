@@ -0,0 +1,381 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+// defaultPasskeyName is the name of the passkey that the user doesn't name
+const defaultPasskeyName = "Passkey"
+
+var (
+	errInvalidPasskeyChallenge = errors.New("passkey challenge is invalid, expired or has been used")
+	errPasskeyRegistered       = errors.New("passkey is already registered")
+	errPasskeyNotFound         = errors.New("passkey not found")
+	errPasskeyCloned           = errors.New("passkey may be cloned, please use other passkey or login with password")
+)
+
+// relyingParty return the service as WebAuthn relying party.
+func (s *usersService) relyingParty() password.WebAuthnRelyingParty {
+	return password.WebAuthnRelyingParty{
+		ID:                      s.webAuthn.RPID,
+		Origins:                 s.webAuthn.Origins,
+		RequireUserVerification: s.webAuthn.UserVerification == cfg.UserVerificationRequired,
+	}
+}
+
+// passkeyUserHandle return user.id of the passkey, it's the ID of the user so
+// it doesn't contain personal data.
+func passkeyUserHandle(userID int32) []byte {
+	return []byte(strconv.FormatInt(int64(userID), 10))
+}
+
+func toPasskeyDescriptors(credentials []pUsers.WebAuthnCredential) []pUsers.PasskeyCredentialDescriptor {
+	res := make([]pUsers.PasskeyCredentialDescriptor, 0, len(credentials))
+	for _, v := range credentials {
+		res = append(res, pUsers.PasskeyCredentialDescriptor{
+			Type:       "public-key",
+			ID:         password.EncodeWebAuthnBase64(v.CredentialID),
+			Transports: v.Transports,
+		})
+	}
+
+	return res
+}
+
+// createWebAuthnSession generate new challenge and save the ceremony of it.
+func (s *usersService) createWebAuthnSession(arg pUsers.WebAuthnSession) (challenge []byte, code int, err error) {
+	challenge, err = password.GenerateWebAuthnChallenge()
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	err = s.cache.CachingWebAuthnSession(challenge, arg, s.webAuthn.Timeout)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	return challenge, errs.CodeSuccess, nil
+}
+
+// takeWebAuthnSession return the ceremony of the challenge in client data,
+// the challenge can only be used once.
+func (s *usersService) takeWebAuthnSession(clientDataJSON []byte, ceremony string) (session *pUsers.WebAuthnSession, challenge []byte, code int, err error) {
+	challenge, err = password.WebAuthnClientChallenge(clientDataJSON)
+	if err != nil {
+		return nil, nil, errs.CodeFailedUser, err
+	}
+
+	session, err = s.cache.TakeWebAuthnSession(challenge)
+	if err != nil {
+		return nil, nil, errs.CodeFailedServer, err
+	}
+	if session == nil || session.Ceremony != ceremony {
+		return nil, nil, errs.CodeFailedUnauthorized, errInvalidPasskeyChallenge
+	}
+
+	return session, challenge, errs.CodeSuccess, nil
+}
+
+// StartPasskeyRegistration return options of navigator.credentials.create(),
+// the passkeys of the user are excluded so one authenticator doesn't register
+// twice.
+func (s *usersService) StartPasskeyRegistration(payload pUsers.JwtPayload) (options *pUsers.PasskeyCreationOptions, code int, err error) {
+	user, err := s.tokenUser(&payload)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUnauthorized, errUserNotFound
+	}
+
+	credentials, err := s.repo.ListWebAuthnCredentials(s.ctx, user.ID)
+	if err != nil {
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to list passkeys, msg: %v", err)
+	}
+
+	challenge, code, err := s.createWebAuthnSession(pUsers.WebAuthnSession{
+		Ceremony: password.WebAuthnCeremonyCreate,
+		UserID:   user.ID,
+	})
+	if err != nil {
+		return nil, code, err
+	}
+
+	params := make([]pUsers.PasskeyCredentialParameter, 0, len(password.WebAuthnAlgorithms))
+	for _, v := range password.WebAuthnAlgorithms {
+		params = append(params, pUsers.PasskeyCredentialParameter{Type: "public-key", Alg: v})
+	}
+
+	options = &pUsers.PasskeyCreationOptions{
+		Challenge: password.EncodeWebAuthnBase64(challenge),
+		RP: pUsers.PasskeyRelyingParty{
+			ID:   s.webAuthn.RPID,
+			Name: s.webAuthn.RPName,
+		},
+		User: pUsers.PasskeyUser{
+			ID:          password.EncodeWebAuthnBase64(passkeyUserHandle(user.ID)),
+			Name:        user.Email,
+			DisplayName: user.Username,
+		},
+		PubKeyCredParams:   params,
+		Timeout:            s.webAuthn.Timeout.Milliseconds(),
+		ExcludeCredentials: toPasskeyDescriptors(credentials),
+		AuthenticatorSelection: pUsers.PasskeyAuthenticatorSelection{
+			// passkey login doesn't send the email, so the passkey must be
+			// discoverable
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   s.webAuthn.UserVerification,
+		},
+		Attestation: "none",
+	}
+
+	return options, errs.CodeSuccess, nil
+}
+
+// FinishPasskeyRegistration verify the response of the authenticator and save
+// the passkey.
+func (s *usersService) FinishPasskeyRegistration(payload pUsers.JwtPayload, input pUsers.PasskeyRegistrationRequest) (credential *pUsers.WebAuthnCredential, code int, err error) {
+	user, err := s.tokenUser(&payload)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUnauthorized, errUserNotFound
+	}
+
+	session, challenge, code, err := s.takeWebAuthnSession(input.ClientDataJSON, password.WebAuthnCeremonyCreate)
+	if err != nil {
+		return nil, code, err
+	}
+	if session.UserID != user.ID {
+		return nil, errs.CodeFailedUnauthorized, errInvalidPasskeyChallenge
+	}
+
+	res, err := s.relyingParty().VerifyRegistration(password.WebAuthnRegistration{
+		Challenge:         challenge,
+		ClientDataJSON:    input.ClientDataJSON,
+		AttestationObject: input.AttestationObject,
+	})
+	if err != nil {
+		return nil, errs.CodeFailedUser, fmt.Errorf("passkey is not valid, %v", err)
+	}
+	if input.CredentialID != nil && !bytes.Equal(input.CredentialID, res.ID) {
+		return nil, errs.CodeFailedUser, errors.New("passkey is not valid, credential id is wrong")
+	}
+
+	name := input.Name
+	if name == "" {
+		name = defaultPasskeyName
+	}
+	credential, err = s.repo.InsertWebAuthnCredential(s.ctx, pUsers.InsertWebAuthnCredentialParams{
+		UserID:         user.ID,
+		CredentialID:   res.ID,
+		PublicKey:      res.PublicKey,
+		SignCount:      int64(res.SignCount),
+		Transports:     input.Transports,
+		Name:           name,
+		AAGUID:         res.AAGUID,
+		BackupEligible: res.BackupEligible,
+	})
+	if err != nil {
+		code, err = handleError(err)
+		if code == errs.CodeFailedDuplicated {
+			err = errPasskeyRegistered
+		}
+		return nil, code, err
+	}
+
+	code, err = s.insertSecurityEvent(user.ID, pUsers.SecurityEventPasskeyAdded, fmt.Sprintf("passkey %d is added", credential.ID))
+	if err != nil {
+		return nil, code, err
+	}
+
+	return credential, errs.CodeSuccess, nil
+}
+
+// ListPasskeys return all passkeys of the user.
+func (s *usersService) ListPasskeys(payload pUsers.JwtPayload) (credentials []pUsers.WebAuthnCredential, code int, err error) {
+	credentials, err = s.repo.ListWebAuthnCredentials(s.ctx, payload.UserID)
+	if err != nil {
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to list passkeys, msg: %v", err)
+	}
+
+	return credentials, errs.CodeSuccess, nil
+}
+
+// DeletePasskey delete the passkey of the user, passkey of other user is not
+// found.
+func (s *usersService) DeletePasskey(payload pUsers.JwtPayload, id int32) (code int, err error) {
+	err = s.repo.DeleteWebAuthnCredential(s.ctx, pUsers.DeleteWebAuthnCredentialParams{ID: id, UserID: payload.UserID})
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return errs.CodeFailedNotFound, errPasskeyNotFound
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to delete passkey, msg: %v", err)
+	}
+
+	return s.insertSecurityEvent(payload.UserID, pUsers.SecurityEventPasskeyDeleted, fmt.Sprintf("passkey %d is deleted", id))
+}
+
+// StartPasskeyLogin return options of navigator.credentials.get(), the
+// credentials are not listed because the user is not known until the
+// authenticator choose the discoverable passkey.
+func (s *usersService) StartPasskeyLogin(input pUsers.PasskeyLoginStartRequest) (options *pUsers.PasskeyRequestOptions, code int, err error) {
+	challenge, code, err := s.createWebAuthnSession(pUsers.WebAuthnSession{
+		Ceremony:   password.WebAuthnCeremonyGet,
+		DeviceName: input.DeviceName,
+		Scope:      input.Scope,
+	})
+	if err != nil {
+		return nil, code, err
+	}
+
+	options = &pUsers.PasskeyRequestOptions{
+		Challenge:        password.EncodeWebAuthnBase64(challenge),
+		RPID:             s.webAuthn.RPID,
+		Timeout:          s.webAuthn.Timeout.Milliseconds(),
+		AllowCredentials: []pUsers.PasskeyCredentialDescriptor{},
+		UserVerification: s.webAuthn.UserVerification,
+	}
+
+	return options, errs.CodeSuccess, nil
+}
+
+// passkeyAMR return amr of passkey login, the passkey that can be synced is
+// software key. Passkey with user verification is multi-factor because the
+// authenticator check PIN or biometric.
+func passkeyAMR(credential *pUsers.WebAuthnCredential, userVerified bool) []string {
+	amr := []string{pUsers.AMRHardwareKey}
+	if credential.BackupEligible {
+		amr = []string{pUsers.AMRSoftwareKey}
+	}
+	if userVerified {
+		amr = append(amr, pUsers.AMRMultiFactor)
+	}
+
+	return amr
+}
+
+// FinishPasskeyLogin verify the assertion with the saved passkey and issue the
+// tokens like LogIn. Passkey that verify the user is multi-factor so TOTP is
+// not asked, otherwise the user that enable MFA get mfa token like LogIn.
+func (s *usersService) FinishPasskeyLogin(input pUsers.PasskeyLoginRequest) (user *pUsers.User, accessToken, refreshToken string, code int, err error) {
+	session, challenge, code, err := s.takeWebAuthnSession(input.ClientDataJSON, password.WebAuthnCeremonyGet)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	credential, err := s.repo.GetWebAuthnCredential(s.ctx, input.CredentialID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, "", "", errs.CodeFailedUnauthorized, errPasskeyNotFound
+		}
+		return nil, "", "", errs.CodeFailedServer, fmt.Errorf("failed to get passkey, msg: %v", err)
+	}
+	if input.UserHandle != nil && !bytes.Equal(input.UserHandle, passkeyUserHandle(credential.UserID)) {
+		return nil, "", "", errs.CodeFailedUnauthorized, errPasskeyNotFound
+	}
+
+	user, err = s.activeUser(credential.UserID)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, "", "", errs.CodeFailedUnauthorized, errPasskeyNotFound
+	}
+
+	attempt := pUsers.LoginAttempt{
+		Email:     user.Email,
+		IPAddress: input.IPAddress,
+	}
+	code, err = s.checkLoginThrottle(attempt)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+	code, err = checkUserLocked(user)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	scope, err := loginScope(user.Role, session.Scope)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedUser, err
+	}
+
+	res, err := s.relyingParty().VerifyAssertion(password.WebAuthnAssertion{
+		Challenge:         challenge,
+		ClientDataJSON:    input.ClientDataJSON,
+		AuthenticatorData: input.AuthenticatorData,
+		Signature:         input.Signature,
+		PublicKey:         credential.PublicKey,
+		SignCount:         uint32(credential.SignCount),
+	})
+	if err != nil {
+		if errors.Is(err, password.ErrWebAuthnSignCount) {
+			code, err = s.insertSecurityEvent(user.ID, pUsers.SecurityEventPasskeyCloned, fmt.Sprintf("sign count of passkey %d is not increased", credential.ID))
+			if err != nil {
+				return nil, "", "", code, err
+			}
+			return nil, "", "", errs.CodeFailedUnauthorized, errPasskeyCloned
+		}
+		return nil, "", "", errs.CodeFailedUnauthorized, fmt.Errorf("passkey is not valid, %v", err)
+	}
+
+	// other request may use the same sign count at the same time
+	err = s.repo.UpdateWebAuthnCredentialUsage(s.ctx, pUsers.UpdateWebAuthnCredentialUsageParams{ID: credential.ID, SignCount: int64(res.SignCount)})
+	if err != nil {
+		if errors.Is(err, pUsers.ErrNoRowsAffected) {
+			return nil, "", "", errs.CodeFailedUnauthorized, errPasskeyCloned
+		}
+		return nil, "", "", errs.CodeFailedServer, fmt.Errorf("failed to update passkey, msg: %v", err)
+	}
+
+	// passkey without user verification is one factor, the user that enable
+	// MFA must verify the TOTP code too
+	amr := passkeyAMR(credential, res.UserVerified)
+	if !res.UserVerified {
+		mfaEnabled, err := s.mfaEnabled(user.ID)
+		if err != nil {
+			return nil, "", "", errs.CodeFailedServer, err
+		}
+		if mfaEnabled {
+			code, err = s.createMFAChallenge(user, pUsers.MFAChallenge{
+				DeviceName: session.DeviceName,
+				Scope:      scope,
+				AMR:        amr,
+			})
+			return nil, "", "", code, err
+		}
+	}
+
+	err = s.cache.DeleteLoginFailures(attempt)
+	if err != nil {
+		return nil, "", "", errs.CodeFailedServer, err
+	}
+
+	accessToken, refreshToken, code, err = s.issueLoginTokens(user, sessionInfo{
+		DeviceName: session.DeviceName,
+		UserAgent:  input.UserAgent,
+		IPAddress:  input.IPAddress,
+		Claims: pUsers.SessionClaims{
+			Scope: scope,
+			AMR:   amr,
+		},
+	}, input.DPoP)
+	if err != nil {
+		return nil, "", "", code, err
+	}
+
+	return user, accessToken, refreshToken, errs.CodeSuccess, nil
+}
@@ -0,0 +1,358 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+	"github.com/dwiw96/ran-user-management/testutils/authenticator"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registerPasskeyTest register new passkey of the user in the authenticator
+func registerPasskeyTest(t *testing.T, user *pUsers.User, a *authenticator.Authenticator) *pUsers.WebAuthnCredential {
+	payload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+
+	options, code, err := serviceTest.StartPasskeyRegistration(payload)
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+
+	challenge, err := password.DecodeWebAuthnBase64(options.Challenge)
+	require.NoError(t, err)
+	userHandle, err := password.DecodeWebAuthnBase64(options.User.ID)
+	require.NoError(t, err)
+
+	registration, err := a.Create(challenge, userHandle)
+	require.NoError(t, err)
+
+	credential, code, err := serviceTest.FinishPasskeyRegistration(payload, pUsers.PasskeyRegistrationRequest{
+		Name:              "laptop",
+		CredentialID:      registration.CredentialID,
+		ClientDataJSON:    registration.ClientDataJSON,
+		AttestationObject: registration.AttestationObject,
+		Transports:        []string{"internal"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+
+	return credential
+}
+
+// passkeyAssertionTest start passkey login and sign the challenge with the
+// authenticator
+func passkeyAssertionTest(t *testing.T, a *authenticator.Authenticator, input pUsers.PasskeyLoginStartRequest) pUsers.PasskeyLoginRequest {
+	options, code, err := serviceTest.StartPasskeyLogin(input)
+	require.NoError(t, err)
+	require.Equal(t, errs.CodeSuccess, code)
+	assert.Empty(t, options.AllowCredentials)
+
+	challenge, err := password.DecodeWebAuthnBase64(options.Challenge)
+	require.NoError(t, err)
+
+	assertion, err := a.Get(challenge, nil)
+	require.NoError(t, err)
+
+	return pUsers.PasskeyLoginRequest{
+		CredentialID:      assertion.CredentialID,
+		ClientDataJSON:    assertion.ClientDataJSON,
+		AuthenticatorData: assertion.AuthenticatorData,
+		Signature:         assertion.Signature,
+		UserHandle:        assertion.UserHandle,
+		UserAgent:         "Mozilla/5.0",
+		IPAddress:         "127.0.0.1",
+	}
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		user, _ := createUser(t)
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+
+		credential := registerPasskeyTest(t, user, a)
+		assert.Equal(t, user.ID, credential.UserID)
+		assert.Equal(t, "laptop", credential.Name)
+		assert.Equal(t, []string{"internal"}, credential.Transports)
+		assert.NotEmpty(t, credential.PublicKey)
+
+		// the registered passkey is excluded from the next registration
+		options, _, err := serviceTest.StartPasskeyRegistration(pUsers.JwtPayload{UserID: user.ID, Email: user.Email})
+		require.NoError(t, err)
+		require.Len(t, options.ExcludeCredentials, 1)
+		assert.Equal(t, password.EncodeWebAuthnBase64(credential.CredentialID), options.ExcludeCredentials[0].ID)
+
+		passkeys, code, err := serviceTest.ListPasskeys(pUsers.JwtPayload{UserID: user.ID, Email: user.Email})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		require.Len(t, passkeys, 1)
+		assert.Equal(t, credential.ID, passkeys[0].ID)
+
+		var count int
+		err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM security_events WHERE user_id = $1 AND event_type = $2", user.ID, pUsers.SecurityEventPasskeyAdded).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		user, _ := createUser(t)
+		other, _ := createUser(t)
+		payload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+
+		testCases := []struct {
+			desc    string
+			payload pUsers.JwtPayload
+			modify  func(a *authenticator.Authenticator, challenge []byte) *authenticator.Registration
+			code    int
+		}{
+			{
+				desc:    "failed_other_user",
+				payload: pUsers.JwtPayload{UserID: other.ID, Email: other.Email},
+				code:    errs.CodeFailedUnauthorized,
+			}, {
+				desc:    "failed_wrong_challenge",
+				payload: payload,
+				modify: func(a *authenticator.Authenticator, challenge []byte) *authenticator.Registration {
+					res, err := a.Create(append([]byte{1}, challenge...), passkeyUserHandle(user.ID))
+					require.NoError(t, err)
+					return res
+				},
+				code: errs.CodeFailedUnauthorized,
+			}, {
+				desc:    "failed_wrong_origin",
+				payload: payload,
+				modify: func(a *authenticator.Authenticator, challenge []byte) *authenticator.Registration {
+					a.Origin = "https://evil.example.com"
+					res, err := a.Create(challenge, passkeyUserHandle(user.ID))
+					require.NoError(t, err)
+					return res
+				},
+				code: errs.CodeFailedUser,
+			}, {
+				desc:    "failed_wrong_rp_id",
+				payload: payload,
+				modify: func(a *authenticator.Authenticator, challenge []byte) *authenticator.Registration {
+					a.RPID = "evil.example.com"
+					res, err := a.Create(challenge, passkeyUserHandle(user.ID))
+					require.NoError(t, err)
+					return res
+				},
+				code: errs.CodeFailedUser,
+			},
+		}
+
+		for _, tC := range testCases {
+			t.Run(tC.desc, func(t *testing.T) {
+				options, _, err := serviceTest.StartPasskeyRegistration(payload)
+				require.NoError(t, err)
+				challenge, err := password.DecodeWebAuthnBase64(options.Challenge)
+				require.NoError(t, err)
+
+				a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+				var registration *authenticator.Registration
+				if tC.modify != nil {
+					registration = tC.modify(a, challenge)
+				} else {
+					registration, err = a.Create(challenge, passkeyUserHandle(user.ID))
+					require.NoError(t, err)
+				}
+
+				_, code, err := serviceTest.FinishPasskeyRegistration(tC.payload, pUsers.PasskeyRegistrationRequest{
+					ClientDataJSON:    registration.ClientDataJSON,
+					AttestationObject: registration.AttestationObject,
+				})
+				require.Error(t, err)
+				assert.Equal(t, tC.code, code)
+			})
+		}
+
+		passkeys, _, err := serviceTest.ListPasskeys(payload)
+		require.NoError(t, err)
+		assert.Empty(t, passkeys)
+	})
+
+	t.Run("failed_challenge_reused", func(t *testing.T) {
+		user, _ := createUser(t)
+		payload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+
+		options, _, err := serviceTest.StartPasskeyRegistration(payload)
+		require.NoError(t, err)
+		challenge, err := password.DecodeWebAuthnBase64(options.Challenge)
+		require.NoError(t, err)
+
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+		registration, err := a.Create(challenge, passkeyUserHandle(user.ID))
+		require.NoError(t, err)
+		input := pUsers.PasskeyRegistrationRequest{
+			ClientDataJSON:    registration.ClientDataJSON,
+			AttestationObject: registration.AttestationObject,
+		}
+
+		credential, code, err := serviceTest.FinishPasskeyRegistration(payload, input)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, defaultPasskeyName, credential.Name)
+
+		_, code, err = serviceTest.FinishPasskeyRegistration(payload, input)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidPasskeyChallenge, err)
+	})
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		user, _ := createUser(t)
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+		credential := registerPasskeyTest(t, user, a)
+
+		input := passkeyAssertionTest(t, a, pUsers.PasskeyLoginStartRequest{DeviceName: "laptop"})
+		res, accessToken, refreshToken, code, err := serviceTest.FinishPasskeyLogin(input)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, user.ID, res.ID)
+		assert.NotEmpty(t, refreshToken)
+
+		payload, err := middleware.ReadToken(strings.TrimPrefix(accessToken, "Bearer "), middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, payload.UserID)
+		assert.Equal(t, []string{pUsers.AMRHardwareKey, pUsers.AMRMultiFactor}, payload.AMR)
+
+		passkeys, _, err := serviceTest.ListPasskeys(*payload)
+		require.NoError(t, err)
+		require.Len(t, passkeys, 1)
+		assert.Equal(t, credential.ID, passkeys[0].ID)
+		assert.Equal(t, int64(1), passkeys[0].SignCount)
+		assert.True(t, passkeys[0].LastUsedAt.Valid)
+
+		// challenge can only be used once
+		_, _, _, code, err = serviceTest.FinishPasskeyLogin(input)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errInvalidPasskeyChallenge, err)
+	})
+
+	t.Run("success_user_not_verified", func(t *testing.T) {
+		user, _ := createUser(t)
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+		registerPasskeyTest(t, user, a)
+		a.UserVerified = false
+
+		_, accessToken, _, _, err := serviceTest.FinishPasskeyLogin(passkeyAssertionTest(t, a, pUsers.PasskeyLoginStartRequest{}))
+		require.NoError(t, err)
+
+		payload, err := middleware.ReadToken(strings.TrimPrefix(accessToken, "Bearer "), middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, []string{pUsers.AMRHardwareKey}, payload.AMR)
+	})
+
+	t.Run("success_totp_enabled", func(t *testing.T) {
+		user, _ := createUser(t)
+		enableTOTPTest(t, user)
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+		registerPasskeyTest(t, user, a)
+
+		// passkey login doesn't ask TOTP code
+		_, accessToken, _, code, err := serviceTest.FinishPasskeyLogin(passkeyAssertionTest(t, a, pUsers.PasskeyLoginStartRequest{}))
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.NotEmpty(t, accessToken)
+	})
+
+	t.Run("success_totp_enabled_user_not_verified", func(t *testing.T) {
+		user, _ := createUser(t)
+		secret, _ := enableTOTPTest(t, user)
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+		registerPasskeyTest(t, user, a)
+		a.UserVerified = false
+
+		// passkey without user verification is one factor
+		_, accessToken, _, code, err := serviceTest.FinishPasskeyLogin(passkeyAssertionTest(t, a, pUsers.PasskeyLoginStartRequest{}))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Empty(t, accessToken)
+
+		var mfaErr *pUsers.MFARequiredError
+		require.True(t, errors.As(err, &mfaErr))
+		require.NotEmpty(t, mfaErr.MFAToken)
+
+		_, accessToken, _, code, err = serviceTest.VerifyMFA(pUsers.MFARequest{MFAToken: mfaErr.MFAToken, Code: totpCodeTest(secret, true)})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		payload, err := middleware.ReadToken(strings.TrimPrefix(accessToken, "Bearer "), middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, []string{pUsers.AMRHardwareKey, pUsers.AMROTP}, payload.AMR)
+	})
+
+	t.Run("failed_cloned", func(t *testing.T) {
+		user, _ := createUser(t)
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+		registerPasskeyTest(t, user, a)
+		clone := a.Clone()
+
+		_, _, _, _, err := serviceTest.FinishPasskeyLogin(passkeyAssertionTest(t, a, pUsers.PasskeyLoginStartRequest{}))
+		require.NoError(t, err)
+
+		// the clone use the same sign count
+		_, _, _, code, err := serviceTest.FinishPasskeyLogin(passkeyAssertionTest(t, clone, pUsers.PasskeyLoginStartRequest{}))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errPasskeyCloned, err)
+
+		var count int
+		err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM security_events WHERE user_id = $1 AND event_type = $2", user.ID, pUsers.SecurityEventPasskeyCloned).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("failed_deleted", func(t *testing.T) {
+		user, _ := createUser(t)
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+		credential := registerPasskeyTest(t, user, a)
+		payload := pUsers.JwtPayload{UserID: user.ID, Email: user.Email}
+
+		// passkey of other user is not found
+		other, _ := createUser(t)
+		code, err := serviceTest.DeletePasskey(pUsers.JwtPayload{UserID: other.ID, Email: other.Email}, credential.ID)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedNotFound, code)
+		assert.Equal(t, errPasskeyNotFound, err)
+
+		code, err = serviceTest.DeletePasskey(payload, credential.ID)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		_, _, _, code, err = serviceTest.FinishPasskeyLogin(passkeyAssertionTest(t, a, pUsers.PasskeyLoginStartRequest{}))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		assert.Equal(t, errPasskeyNotFound, err)
+	})
+
+	t.Run("failed_wrong_signature", func(t *testing.T) {
+		user, _ := createUser(t)
+		a := authenticator.New(webAuthnTest.RPID, webAuthnTest.Origins[0])
+		registerPasskeyTest(t, user, a)
+
+		input := passkeyAssertionTest(t, a, pUsers.PasskeyLoginStartRequest{})
+		input.Signature[len(input.Signature)-1] ^= 0xff
+
+		_, _, _, code, err := serviceTest.FinishPasskeyLogin(input)
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+	})
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	mailer "github.com/dwiw96/ran-user-management/pkg/mailer"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+var errInvalidResetToken = errors.New("reset token is invalid, expired or has been used")
+
+// sendPasswordResetEmail send link with new reset token to the email of the
+// user. Only the digest of the token is saved, and token that is sent before
+// can't be used anymore.
+func (s *usersService) sendPasswordResetEmail(user *pUsers.User) error {
+	token, err := password.GenerateRefreshToken()
+	if err != nil {
+		return err
+	}
+
+	arg := pUsers.PasswordReset{
+		UserID: user.ID,
+		Email:  user.Email,
+	}
+	err = s.cache.CachingPasswordReset(password.HashRefreshToken(token), arg, s.passwordReset.TokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(s.passwordReset.URL)
+	if err != nil {
+		return fmt.Errorf("password reset url is invalid, msg: %v", err)
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	msg := mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nWe received a request to reset your password, open the link below to set a new password, the link expires in %s.\n\n%s\n\nIf you didn't request it, you can ignore this email and your password won't be changed.\n",
+			user.Username, s.passwordReset.TokenTTL, link.String()),
+	}
+
+	return s.mailer.Send(s.ctx, msg)
+}
+
+// ForgotPassword send password reset email to the user of the email. The
+// result is the same whether the email is registered or not and whether the
+// email is sent or not, so it can't be used to find registered email.
+func (s *usersService) ForgotPassword(email string) (code int, err error) {
+	user, err := s.repo.GetUserByEmail(s.ctx, email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errs.CodeSuccess, nil
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to load user, msg: %v", err)
+	}
+	if user.IsDeleted.Bool {
+		return errs.CodeSuccess, nil
+	}
+
+	err = s.sendPasswordResetEmail(user)
+	if err != nil {
+		log.Printf("failed to send password reset email to user %d, msg: %v", user.ID, err)
+	}
+
+	return errs.CodeSuccess, nil
+}
+
+// ResetPassword replace the password of the user of the reset token, the token
+// is not used when the new password is rejected. All sessions of the user are revoked and their access token are blocked, so
+// anyone that use the old password is logged out.
+func (s *usersService) ResetPassword(token, newPassword string) (code int, err error) {
+	if newPassword == "" {
+		return errs.CodeFailedUser, errs.ErrInvalidInput
+	}
+
+	tokenHash := password.HashRefreshToken(token)
+	reset, err := s.cache.GetPasswordReset(tokenHash)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+	if reset == nil {
+		return errs.CodeFailedUser, errInvalidResetToken
+	}
+
+	user, err := s.repo.GetUserByID(s.ctx, reset.UserID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errs.CodeFailedUser, errInvalidResetToken
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to load user, msg: %v", err)
+	}
+	if user.IsDeleted.Bool || user.Email != reset.Email {
+		return errs.CodeFailedUser, errInvalidResetToken
+	}
+	err = password.ValidatePasswordPolicy(newPassword, user.Username, user.Email)
+	if err != nil {
+		return errs.CodeFailedUser, err
+	}
+
+	hashedPassword, err := password.HashingPassword(newPassword)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	// token is used only when the password can be set, so the user can try
+	// again with other password
+	isDeleted, err := s.cache.DeletePasswordReset(tokenHash, user.ID)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+	if !isDeleted {
+		return errs.CodeFailedUser, errInvalidResetToken
+	}
+
+	arg := pUsers.UpdateUserPasswordParams{
+		ID:             user.ID,
+		HashedPassword: hashedPassword,
+	}
+	sessions, err := s.repo.ResetPasswordTx(s.ctx, arg)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errs.CodeFailedUser, errInvalidResetToken
+		}
+		return errs.CodeFailedServer, fmt.Errorf("failed to reset password, msg: %v", err)
+	}
+
+	for _, session := range sessions {
+		err = s.blockSessionAccessToken(session)
+		if err != nil {
+			return errs.CodeFailedServer, err
+		}
+	}
+
+	eventArg := pUsers.InsertSecurityEventParams{
+		UserID:      pgtype.Int4{Int32: user.ID, Valid: true},
+		EventType:   pUsers.SecurityEventPasswordReset,
+		Description: fmt.Sprintf("password is reset, %d session revoked", len(sessions)),
+	}
+	err = s.repo.InsertSecurityEvent(s.ctx, eventArg)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to record security event, msg: %v", err)
+	}
+
+	return errs.CodeSuccess, nil
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lastResetTokenTest return the token of the latest password reset email that
+// is sent to the email
+func lastResetTokenTest(t *testing.T, email string) string {
+	messages := mailerTest.Messages(email)
+	require.NotEmpty(t, messages)
+	msg := messages[len(messages)-1]
+	assert.Equal(t, "Reset your password", msg.Subject)
+
+	link, err := url.Parse(verificationLinkRegex.FindString(msg.Body))
+	require.NoError(t, err)
+	assert.Equal(t, passwordResetTest.URL, link.Scheme+"://"+link.Host+link.Path)
+	token := link.Query().Get("token")
+	require.NotEmpty(t, token)
+
+	return token
+}
+
+func TestForgotPassword(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+
+		code, err := serviceTest.ForgotPassword(signUpReq.Email)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		token := lastResetTokenTest(t, signUpReq.Email)
+
+		// token is saved by its digest
+		res, err := cacheTest.GetPasswordReset([]byte(token))
+		require.NoError(t, err)
+		assert.Nil(t, res)
+		res, err = cacheTest.GetPasswordReset(password.HashRefreshToken(token))
+		require.NoError(t, err)
+		require.NotNil(t, res)
+		assert.Equal(t, signUpReq.Email, res.Email)
+	})
+
+	t.Run("success_unknown_email", func(t *testing.T) {
+		email := generator.CreateRandomEmail(generator.CreateRandomString(5))
+
+		code, err := serviceTest.ForgotPassword(email)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Empty(t, mailerTest.Messages(email))
+	})
+
+	t.Run("success_deleted_user", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		code, err := serviceTest.DeleteUser(pUsers.SoftDeleteUserParams{ID: user.ID, Email: user.Email})
+		require.NoError(t, err)
+		require.Equal(t, errs.CodeSuccess, code)
+
+		code, err = serviceTest.ForgotPassword(signUpReq.Email)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		for _, msg := range mailerTest.Messages(signUpReq.Email) {
+			assert.NotEqual(t, "Reset your password", msg.Subject)
+		}
+	})
+}
+
+func TestResetPassword(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		payloads := loginDevicesTest(t, signUpReq, []string{"laptop", "phone"})
+
+		_, err := serviceTest.ForgotPassword(signUpReq.Email)
+		require.NoError(t, err)
+		token := lastResetTokenTest(t, signUpReq.Email)
+
+		newPassword := generator.CreateRandomString(10)
+		code, err := serviceTest.ResetPassword(token, newPassword)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		// all sessions are revoked and their access token are blocked
+		sessions, err := repoTest.ListRefreshTokenByUserID(ctx, payloads[0].UserID)
+		require.NoError(t, err)
+		assert.Empty(t, sessions)
+		for _, payload := range payloads {
+			err = cacheTest.CheckBlockedToken(*payload)
+			require.Error(t, err)
+		}
+
+		_, _, _, code, err = serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		_, _, _, code, err = serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: newPassword})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		// token can only be used once
+		code, err = serviceTest.ResetPassword(token, generator.CreateRandomString(10))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+
+	t.Run("success_after_rejected_password", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+
+		_, err := serviceTest.ForgotPassword(signUpReq.Email)
+		require.NoError(t, err)
+		token := lastResetTokenTest(t, signUpReq.Email)
+
+		for _, badPassword := range []string{"short", "password123", signUpReq.Email} {
+			code, err := serviceTest.ResetPassword(token, badPassword)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUser, code)
+			assert.NotErrorIs(t, err, errInvalidResetToken)
+		}
+
+		newPassword := generator.CreateRandomString(10)
+		code, err := serviceTest.ResetPassword(token, newPassword)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		_, _, _, code, err = serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: newPassword})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		code, err = serviceTest.ResetPassword(token, generator.CreateRandomString(10))
+		require.ErrorIs(t, err, errInvalidResetToken)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+
+	t.Run("failed_old_token", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+
+		_, err := serviceTest.ForgotPassword(signUpReq.Email)
+		require.NoError(t, err)
+		oldToken := lastResetTokenTest(t, signUpReq.Email)
+		_, err = serviceTest.ForgotPassword(signUpReq.Email)
+		require.NoError(t, err)
+		newToken := lastResetTokenTest(t, signUpReq.Email)
+		assert.NotEqual(t, oldToken, newToken)
+
+		code, err := serviceTest.ResetPassword(oldToken, generator.CreateRandomString(10))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+
+		code, err = serviceTest.ResetPassword(newToken, generator.CreateRandomString(10))
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+	})
+
+	t.Run("failed_invalid_token", func(t *testing.T) {
+		code, err := serviceTest.ResetPassword(generator.CreateRandomString(43), generator.CreateRandomString(10))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+
+	t.Run("failed_deleted_user", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		_, err := serviceTest.ForgotPassword(signUpReq.Email)
+		require.NoError(t, err)
+		token := lastResetTokenTest(t, signUpReq.Email)
+
+		_, err = serviceTest.DeleteUser(pUsers.SoftDeleteUserParams{ID: user.ID, Email: user.Email})
+		require.NoError(t, err)
+
+		code, err := serviceTest.ResetPassword(token, generator.CreateRandomString(10))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+var (
+	errUserNotFound         = errors.New("user of the token is not found")
+	errWrongCurrentPassword = errors.New("current password is wrong")
+	errSamePassword         = errors.New("new password must be different from current password")
+)
+
+// GetProfile return the profile of the user of the access token.
+func (s *usersService) GetProfile(payload pUsers.JwtPayload) (profile *pUsers.UserProfile, code int, err error) {
+	user, err := s.tokenUser(&payload)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUnauthorized, errUserNotFound
+	}
+
+	mfaEnabled, err := s.mfaEnabled(user.ID)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+
+	profile = &pUsers.UserProfile{
+		User:       user,
+		Roles:      []string{user.Role},
+		MFAEnabled: mfaEnabled,
+	}
+
+	return profile, errs.CodeSuccess, nil
+}
+
+// GetUser return the user of the id, deleted user is not found.
+func (s *usersService) GetUser(userID int32) (user *pUsers.User, code int, err error) {
+	user, err = s.activeUser(userID)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedNotFound, errs.ErrNoData
+	}
+
+	return user, errs.CodeSuccess, nil
+}
+
+// UpdateProfile update the profile of the user of the access token. The name
+// claim of access token that is issued before is not changed until the token
+// is refreshed, the token is still valid because the user is identified by
+// its id and email.
+func (s *usersService) UpdateProfile(payload pUsers.JwtPayload, input pUsers.UpdateProfileRequest) (user *pUsers.User, code int, err error) {
+	user, err = s.tokenUser(&payload)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUnauthorized, errUserNotFound
+	}
+
+	// nothing is changed
+	if input.Username == "" || input.Username == user.Username {
+		return user, errs.CodeSuccess, nil
+	}
+
+	arg := pUsers.UpdateUserParams{
+		ID:       user.ID,
+		Username: input.Username,
+	}
+	user, err = s.repo.UpdateUser(s.ctx, arg)
+	if err != nil {
+		code, err = handleError(err)
+		return nil, code, err
+	}
+
+	return user, errs.CodeSuccess, nil
+}
+
+// ChangePassword replace the password of the user of the access token after
+// the current password is verified. Other sessions of the user are revoked and
+// their access token are blocked, only the session that change the password
+// stay login.
+func (s *usersService) ChangePassword(payload pUsers.JwtPayload, input pUsers.ChangePasswordRequest) (code int, err error) {
+	user, err := s.tokenUser(&payload)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return errs.CodeFailedUnauthorized, errUserNotFound
+	}
+
+	err = password.VerifyHashPassword(input.CurrentPassword, user.HashedPassword)
+	if err != nil {
+		return errs.CodeFailedUser, errWrongCurrentPassword
+	}
+	if input.NewPassword == input.CurrentPassword {
+		return errs.CodeFailedUser, errSamePassword
+	}
+	err = password.ValidatePasswordPolicy(input.NewPassword, user.Username, user.Email)
+	if err != nil {
+		return errs.CodeFailedUser, err
+	}
+
+	hashedPassword, err := password.HashingPassword(input.NewPassword)
+	if err != nil {
+		return errs.CodeFailedServer, err
+	}
+
+	arg := pUsers.ChangePasswordParams{
+		ID:             user.ID,
+		HashedPassword: hashedPassword,
+		SessionID:      payload.SessionID,
+	}
+	sessions, err := s.repo.ChangePasswordTx(s.ctx, arg)
+	if err != nil {
+		code, err = handleError(err)
+		return code, err
+	}
+
+	for _, session := range sessions {
+		err = s.blockSessionAccessToken(session)
+		if err != nil {
+			return errs.CodeFailedServer, err
+		}
+	}
+
+	eventArg := pUsers.InsertSecurityEventParams{
+		UserID:      pgtype.Int4{Int32: user.ID, Valid: true},
+		EventType:   pUsers.SecurityEventPasswordChange,
+		Description: fmt.Sprintf("password is changed by session %d, %d other session revoked", payload.SessionID, len(sessions)),
+	}
+	err = s.repo.InsertSecurityEvent(s.ctx, eventArg)
+	if err != nil {
+		return errs.CodeFailedServer, fmt.Errorf("failed to record security event, msg: %v", err)
+	}
+
+	return errs.CodeSuccess, nil
+}
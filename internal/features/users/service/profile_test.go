@@ -0,0 +1,237 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetProfile(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user, signUpReq := createUser(t)
+	payloads := loginDevicesTest(t, signUpReq, []string{"laptop"})
+
+	res, code, err := serviceTest.GetProfile(*payloads[0])
+	require.NoError(t, err)
+	assert.Equal(t, errs.CodeSuccess, code)
+	assert.Equal(t, user.ID, res.User.ID)
+	assert.Equal(t, user.Email, res.User.Email)
+	assert.Equal(t, []string{pUsers.RoleUser}, res.Roles)
+	assert.False(t, res.User.EmailVerifiedAt.Valid)
+	assert.False(t, res.MFAEnabled)
+
+	_, err = serviceTest.VerifyEmail(lastVerificationTokenTest(t, signUpReq.Email))
+	require.NoError(t, err)
+	res, _, err = serviceTest.GetProfile(*payloads[0])
+	require.NoError(t, err)
+	assert.True(t, res.User.EmailVerifiedAt.Valid)
+
+	_, err = serviceTest.DeleteUser(pUsers.SoftDeleteUserParams{ID: user.ID, Email: user.Email})
+	require.NoError(t, err)
+	_, code, err = serviceTest.GetProfile(*payloads[0])
+	require.Error(t, err)
+	assert.Equal(t, errs.CodeFailedUnauthorized, code)
+}
+
+func TestGetUser(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	user, _ := createUser(t)
+	deletedUser, _ := createUser(t)
+	_, err = serviceTest.DeleteUser(pUsers.SoftDeleteUserParams{ID: deletedUser.ID, Email: deletedUser.Email})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc   string
+		userID int32
+		code   int
+	}{
+		{
+			desc:   "success",
+			userID: user.ID,
+			code:   errs.CodeSuccess,
+		}, {
+			desc:   "failed_deleted_user",
+			userID: deletedUser.ID,
+			code:   errs.CodeFailedNotFound,
+		}, {
+			desc:   "failed_unknown_user",
+			userID: deletedUser.ID + 100,
+			code:   errs.CodeFailedNotFound,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, code, err := serviceTest.GetUser(tC.userID)
+			assert.Equal(t, tC.code, code)
+			if tC.code != errs.CodeSuccess {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, res.ID)
+			assert.Equal(t, user.Username, res.Username)
+		})
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		_, accessToken, refreshToken, _, err := serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+		require.NoError(t, err)
+		key, err := repoTest.LoadKey(ctx)
+		require.NoError(t, err)
+		payload, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+
+		username := generator.CreateRandomString(8)
+		res, code, err := serviceTest.UpdateProfile(*payload, pUsers.UpdateProfileRequest{Username: username})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, username, res.Username)
+		assert.Equal(t, signUpReq.Email, res.Email)
+
+		// token with the old username can still be used
+		res, code, err = serviceTest.UpdateProfile(*payload, pUsers.UpdateProfileRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, username, res.Username)
+
+		// refreshed token carry the new username
+		_, newAccessToken, code, err := serviceTest.RefreshToken(refreshToken, strings.TrimPrefix(accessToken, "Bearer "), pUsers.DPoPRequest{})
+		require.NoError(t, err)
+		require.Equal(t, errs.CodeSuccess, code)
+		newPayload, err := middleware.ReadToken(newAccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, username, newPayload.Name)
+
+		// nothing is changed
+		res, code, err = serviceTest.UpdateProfile(*newPayload, pUsers.UpdateProfileRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, username, res.Username)
+	})
+
+	t.Run("failed_deleted_user", func(t *testing.T) {
+		user, signUpReq := createUser(t)
+		payloads := loginDevicesTest(t, signUpReq, []string{"laptop"})
+		_, err := serviceTest.DeleteUser(pUsers.SoftDeleteUserParams{ID: user.ID, Email: user.Email})
+		require.NoError(t, err)
+
+		_, code, err := serviceTest.UpdateProfile(*payloads[0], pUsers.UpdateProfileRequest{Username: generator.CreateRandomString(8)})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		_, signUpReq := createUser(t)
+		payloads := loginDevicesTest(t, signUpReq, []string{"laptop", "phone", "tablet"})
+
+		arg := pUsers.ChangePasswordRequest{
+			CurrentPassword: signUpReq.Password,
+			NewPassword:     generator.CreateRandomString(12),
+		}
+		code, err := serviceTest.ChangePassword(*payloads[0], arg)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+
+		// only the current session stay login
+		sessions, _, err := serviceTest.ListSessions(*payloads[0])
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, payloads[0].SessionID, sessions[0].ID)
+		err = cacheTest.CheckBlockedToken(*payloads[0])
+		require.NoError(t, err)
+		for _, payload := range payloads[1:] {
+			err = cacheTest.CheckBlockedToken(*payload)
+			require.Error(t, err)
+		}
+
+		_, _, _, code, err = serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUnauthorized, code)
+		_, _, _, code, err = serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: arg.NewPassword})
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+	})
+
+	_, signUpReq := createUser(t)
+	payloads := loginDevicesTest(t, signUpReq, []string{"laptop", "phone"})
+
+	testCases := []struct {
+		desc string
+		arg  pUsers.ChangePasswordRequest
+		err  error
+	}{
+		{
+			desc: "failed_wrong_current_password",
+			arg: pUsers.ChangePasswordRequest{
+				CurrentPassword: "a" + signUpReq.Password,
+				NewPassword:     generator.CreateRandomString(12),
+			},
+			err: errWrongCurrentPassword,
+		}, {
+			desc: "failed_same_password",
+			arg: pUsers.ChangePasswordRequest{
+				CurrentPassword: signUpReq.Password,
+				NewPassword:     signUpReq.Password,
+			},
+			err: errSamePassword,
+		}, {
+			desc: "failed_too_short",
+			arg: pUsers.ChangePasswordRequest{
+				CurrentPassword: signUpReq.Password,
+				NewPassword:     generator.CreateRandomString(5),
+			},
+		}, {
+			desc: "failed_common_password",
+			arg: pUsers.ChangePasswordRequest{
+				CurrentPassword: signUpReq.Password,
+				NewPassword:     "password123",
+			},
+		}, {
+			desc: "failed_same_as_email",
+			arg: pUsers.ChangePasswordRequest{
+				CurrentPassword: signUpReq.Password,
+				NewPassword:     signUpReq.Email,
+			},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			code, err := serviceTest.ChangePassword(*payloads[0], tC.arg)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUser, code)
+			if tC.err != nil {
+				assert.Equal(t, tC.err, err)
+			}
+
+			// other sessions are not revoked
+			sessions, _, err := serviceTest.ListSessions(*payloads[0])
+			require.NoError(t, err)
+			assert.Len(t, sessions, 2)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+)
+
+// tokenExchangeGrant swap access token of the user (subject token) for new
+// access token that the client use to call other service on behalf of the
+// user (RFC 8693). The new token is only valid for the requested audience,
+// it can't have more scopes than the subject token, it doesn't live longer
+// than the subject token and act claim tell which client act for the user.
+// Subject token that is bound to DPoP key is only exchanged with proof of the
+// key, and the new token is bound to the same key. Every exchange is recorded
+// as security event.
+func (s *usersService) tokenExchangeGrant(client *pUsers.OAuthClient, input pUsers.TokenRequest) (res *pUsers.TokenResponse, code int, err error) {
+	if input.SubjectToken == "" || input.SubjectTokenType == "" {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, "subject_token and subject_token_type are required")
+	}
+	if input.SubjectTokenType != pUsers.TokenTypeAccessToken {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, fmt.Sprintf("subject_token_type must be %s", pUsers.TokenTypeAccessToken))
+	}
+	if input.RequestedTokenType != "" && input.RequestedTokenType != pUsers.TokenTypeAccessToken {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, fmt.Sprintf("requested_token_type must be %s", pUsers.TokenTypeAccessToken))
+	}
+	if input.Audience == "" {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidRequest, "audience is required")
+	}
+	if !slices.Contains(client.AllowedAudiences, input.Audience) {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidTarget, "audience is not allowed for the client")
+	}
+
+	errInvalidSubject := newOAuthError(pUsers.OAuthErrInvalidGrant, "subject_token is invalid, expired or revoked")
+	subject, err := s.readActiveAccessToken(input.SubjectToken)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	// only token of the user can be exchanged, service account use its own credential
+	if subject == nil || subject.IsServiceAccount() {
+		return nil, errs.CodeFailedUser, errInvalidSubject
+	}
+	user, err := s.tokenUser(subject)
+	if err != nil {
+		return nil, errs.CodeFailedServer, err
+	}
+	if user == nil {
+		return nil, errs.CodeFailedUser, errInvalidSubject
+	}
+	code, err = s.checkSubjectTokenDPoP(subject, input.DPoP)
+	if err != nil {
+		return nil, code, err
+	}
+
+	scope := mergeScope("", input.Scope)
+	if scope == "" {
+		scope = subject.Scope
+	}
+	if !scopeContains(subject.Scope, scope) {
+		return nil, errs.CodeFailedUser, newOAuthError(pUsers.OAuthErrInvalidScope, "requested scope is not granted to the subject token")
+	}
+
+	key, err := s.repo.LoadKey(s.ctx)
+	if err != nil {
+		return nil, errs.CodeFailedServer, fmt.Errorf("load key error: %w", err)
+	}
+
+	_, lifetime := s.lifetime.Get(cfg.ClientLifetimeKey(client.ClientID), cfg.RoleLifetimeKey(user.Role))
+	ttl := lifetime.AccessTokenTTL
+	if subjectTTL := time.Until(time.Unix(subject.Exp, 0)); subjectTTL < ttl {
+		ttl = subjectTTL
+	}
+
+	claims := pUsers.SessionClaims{
+		ClientID: client.ClientID,
+		Scope:    scope,
+		Audience: []string{input.Audience},
+		AuthTime: subject.AuthTime,
+		AMR:      subject.AMR,
+		// actor of the subject token is kept, so the whole delegation chain is known
+		Act: &pUsers.Actor{Sub: client.ClientID, Act: subject.Act},
+		Cnf: subject.Cnf,
+	}
+	accessToken, payload, err := middleware.CreateToken(*user, subject.SessionID, claims, ttl, key)
+	if err != nil {
+		return nil, errs.CodeFailedServer, errors.New("failed generate access token")
+	}
+
+	eventArg := pUsers.InsertSecurityEventParams{
+		UserID:      pgtype.Int4{Int32: user.ID, Valid: true},
+		EventType:   pUsers.SecurityEventTokenExchange,
+		Description: fmt.Sprintf("client %s exchanged token %s for token %s, audience: %s, scope: %s", client.ClientID, subject.ID, payload.ID, input.Audience, scope),
+	}
+	err = s.repo.InsertSecurityEvent(s.ctx, eventArg)
+	if err != nil {
+		return nil, errs.CodeFailedServer, fmt.Errorf("failed to record security event, msg: %v", err)
+	}
+
+	tokenType := tokenTypeBearer
+	if payload.Cnf != nil {
+		tokenType = pUsers.AuthSchemeDPoP
+	}
+
+	res = &pUsers.TokenResponse{
+		AccessToken:     strings.TrimPrefix(accessToken, tokenType+" "),
+		IssuedTokenType: pUsers.TokenTypeAccessToken,
+		TokenType:       tokenType,
+		ExpiresIn:       payload.Exp - time.Now().UTC().Unix(),
+		Scope:           scope,
+	}
+
+	return res, errs.CodeSuccess, nil
+}
@@ -0,0 +1,276 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	middleware "github.com/dwiw96/ran-user-management/pkg/middleware"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	errs "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const audienceDownstreamTest = "https://orders.example.com"
+
+func createTokenExchangeClientTest(t *testing.T, allowedAudiences ...string) pUsers.ClientCredential {
+	clientID, clientSecret, err := password.GenerateClientCredential()
+	require.NoError(t, err)
+
+	arg := pUsers.CreateOAuthClientParams{
+		ClientID:         clientID,
+		ClientSecretHash: password.HashClientSecret(clientSecret),
+		Name:             generator.CreateRandomString(7),
+		GrantTypes:       []string{pUsers.GrantTypeTokenExchange},
+		AllowedAudiences: allowedAudiences,
+	}
+	_, err = repoTest.CreateOAuthClient(ctx, arg)
+	require.NoError(t, err)
+
+	return pUsers.ClientCredential{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createTokenExchangeClientTest(t, audienceDownstreamTest, audienceTest)
+	_, signUpReq := createUser(t)
+	_, accessToken, _, _, err := serviceTest.LogIn(pUsers.LoginRequest{Email: signUpReq.Email, Password: signUpReq.Password})
+	require.NoError(t, err)
+	subjectToken := strings.TrimPrefix(accessToken, "Bearer ")
+
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+	subject, err := middleware.ReadToken(accessToken, middleware.NewKeySet(*key))
+	require.NoError(t, err)
+
+	newExchangeArg := func(subjectToken string) pUsers.TokenRequest {
+		return pUsers.TokenRequest{
+			GrantType:        pUsers.GrantTypeTokenExchange,
+			SubjectToken:     subjectToken,
+			SubjectTokenType: pUsers.TokenTypeAccessToken,
+			Audience:         audienceDownstreamTest,
+			Scope:            pUsers.ScopeUsersRead,
+		}
+	}
+
+	var exchangedToken string
+	t.Run("success", func(t *testing.T) {
+		res, code, err := serviceTest.Token(client, newExchangeArg(subjectToken))
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, pUsers.TokenTypeAccessToken, res.IssuedTokenType)
+		assert.Equal(t, tokenTypeBearer, res.TokenType)
+		assert.Equal(t, pUsers.ScopeUsersRead, res.Scope)
+		assert.Empty(t, res.RefreshToken)
+		assert.Greater(t, res.ExpiresIn, int64(0))
+		assert.LessOrEqual(t, res.ExpiresIn, subject.Exp-subject.Iat)
+		exchangedToken = res.AccessToken
+
+		payload, err := middleware.ReadToken("Bearer "+res.AccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, subject.UserID, payload.UserID)
+		assert.Equal(t, subject.Subject, payload.Subject)
+		assert.Equal(t, jwt.ClaimStrings{audienceDownstreamTest}, payload.Audience)
+		assert.Equal(t, pUsers.ScopeUsersRead, payload.Scope)
+		assert.Equal(t, client.ClientID, payload.ClientID)
+		assert.Equal(t, &pUsers.Actor{Sub: client.ClientID}, payload.Act)
+		assert.Equal(t, subject.AuthTime, payload.AuthTime)
+		assert.LessOrEqual(t, payload.Exp, subject.Exp)
+
+		introspectionClient := createOAuthClientTest(t, false)
+		introspection, _, err := serviceTest.IntrospectToken(introspectionClient, res.AccessToken, "")
+		require.NoError(t, err)
+		assert.True(t, introspection.Active)
+		assert.Equal(t, []string{audienceDownstreamTest}, introspection.Aud)
+		assert.Equal(t, payload.Act, introspection.Act)
+
+		// every exchange is audited
+		var count int
+		err = poolTest.QueryRow(ctx, "SELECT COUNT(*) FROM security_events WHERE user_id = $1 AND event_type = $2 AND description LIKE '%' || $3 || '%'", subject.UserID, pUsers.SecurityEventTokenExchange, payload.ID.String()).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("success_nested_actor", func(t *testing.T) {
+		// downstream service exchange the token again, the first actor is kept
+		downstreamClient := createTokenExchangeClientTest(t, audienceDownstreamTest)
+		arg := newExchangeArg(exchangedToken)
+		arg.Scope = ""
+
+		res, code, err := serviceTest.Token(downstreamClient, arg)
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, pUsers.ScopeUsersRead, res.Scope)
+
+		payload, err := middleware.ReadToken("Bearer "+res.AccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		assert.Equal(t, &pUsers.Actor{Sub: downstreamClient.ClientID, Act: &pUsers.Actor{Sub: client.ClientID}}, payload.Act)
+	})
+
+	failedTestCases := []struct {
+		desc      string
+		client    pUsers.ClientCredential
+		modify    func(arg *pUsers.TokenRequest)
+		errorCode string
+	}{
+		{
+			desc:      "failed_audience_not_allowed",
+			client:    client,
+			modify:    func(arg *pUsers.TokenRequest) { arg.Audience = "https://other.example.com" },
+			errorCode: pUsers.OAuthErrInvalidTarget,
+		}, {
+			desc:      "failed_without_audience",
+			client:    client,
+			modify:    func(arg *pUsers.TokenRequest) { arg.Audience = "" },
+			errorCode: pUsers.OAuthErrInvalidRequest,
+		}, {
+			desc:      "failed_scope_wider_than_subject",
+			client:    client,
+			modify:    func(arg *pUsers.TokenRequest) { arg.Scope = "users:read admin" },
+			errorCode: pUsers.OAuthErrInvalidScope,
+		}, {
+			desc:      "failed_invalid_subject_token",
+			client:    client,
+			modify:    func(arg *pUsers.TokenRequest) { arg.SubjectToken = generator.CreateRandomString(30) },
+			errorCode: pUsers.OAuthErrInvalidGrant,
+		}, {
+			desc:   "failed_subject_token_type",
+			client: client,
+			modify: func(arg *pUsers.TokenRequest) {
+				arg.SubjectTokenType = "urn:ietf:params:oauth:token-type:refresh_token"
+			},
+			errorCode: pUsers.OAuthErrInvalidRequest,
+		}, {
+			desc:      "failed_requested_token_type",
+			client:    client,
+			modify:    func(arg *pUsers.TokenRequest) { arg.RequestedTokenType = "urn:ietf:params:oauth:token-type:id_token" },
+			errorCode: pUsers.OAuthErrInvalidRequest,
+		}, {
+			desc:      "failed_client_without_grant_type",
+			client:    createOAuthClientTest(t, false),
+			modify:    func(arg *pUsers.TokenRequest) {},
+			errorCode: pUsers.OAuthErrUnauthorizedClient,
+		},
+	}
+
+	for _, tC := range failedTestCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			arg := newExchangeArg(subjectToken)
+			tC.modify(&arg)
+
+			res, code, err := serviceTest.Token(tC.client, arg)
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUser, code)
+			assert.Nil(t, res)
+
+			var oauthErr *pUsers.OAuthError
+			require.ErrorAs(t, err, &oauthErr)
+			assert.Equal(t, tC.errorCode, oauthErr.ErrorCode)
+		})
+	}
+
+	t.Run("failed_service_account_subject", func(t *testing.T) {
+		serviceAccount := createServiceAccountTest(t, pUsers.ScopeUsersRead)
+		serviceToken, _, err := serviceTest.Token(serviceAccount, pUsers.TokenRequest{GrantType: pUsers.GrantTypeClientCredentials})
+		require.NoError(t, err)
+
+		_, code, err := serviceTest.Token(client, newExchangeArg(serviceToken.AccessToken))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+
+	t.Run("failed_after_logout", func(t *testing.T) {
+		err := serviceTest.LogOut(*subject)
+		require.NoError(t, err)
+
+		_, code, err := serviceTest.Token(client, newExchangeArg(subjectToken))
+		require.Error(t, err)
+		assert.Equal(t, errs.CodeFailedUser, code)
+	})
+}
+
+func TestTokenExchangeDPoP(t *testing.T) {
+	err := testUtils.DeleteSchemaTestData(poolTest)
+	require.NoError(t, err)
+
+	client := createTokenExchangeClientTest(t, audienceDownstreamTest)
+	_, signUpReq := createUser(t)
+	dpopKey, jkt, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+	otherDPoPKey, _, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+	key, err := repoTest.LoadKey(ctx)
+	require.NoError(t, err)
+
+	_, accessToken, _, _, err := serviceTest.LogIn(pUsers.LoginRequest{
+		Email:    signUpReq.Email,
+		Password: signUpReq.Password,
+		DPoP:     dpopRequestTest(t, dpopKey, loginURLTest),
+	})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(accessToken, "DPoP "))
+
+	newExchangeArg := func(dpop pUsers.DPoPRequest) pUsers.TokenRequest {
+		return pUsers.TokenRequest{
+			GrantType:        pUsers.GrantTypeTokenExchange,
+			SubjectToken:     strings.TrimPrefix(accessToken, "DPoP "),
+			SubjectTokenType: pUsers.TokenTypeAccessToken,
+			Audience:         audienceDownstreamTest,
+			DPoP:             dpop,
+		}
+	}
+
+	proofOfOtherURL := dpopRequestTest(t, dpopKey, loginURLTest)
+	proofOfOtherURL.URL = tokenURLTest
+
+	failedTestCases := []struct {
+		desc string
+		dpop pUsers.DPoPRequest
+	}{
+		{
+			desc: "failed_without_proof",
+		}, {
+			desc: "failed_proof_of_other_key",
+			dpop: dpopRequestTest(t, otherDPoPKey, tokenURLTest),
+		}, {
+			desc: "failed_proof_of_other_url",
+			dpop: proofOfOtherURL,
+		},
+	}
+
+	for _, tC := range failedTestCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, code, err := serviceTest.Token(client, newExchangeArg(tC.dpop))
+			require.Error(t, err)
+			assert.Equal(t, errs.CodeFailedUser, code)
+			assert.Nil(t, res)
+
+			var oauthErr *pUsers.OAuthError
+			require.ErrorAs(t, err, &oauthErr)
+			assert.Equal(t, pUsers.OAuthErrInvalidDPoPProof, oauthErr.ErrorCode)
+		})
+	}
+
+	t.Run("success", func(t *testing.T) {
+		res, code, err := serviceTest.Token(client, newExchangeArg(dpopRequestTest(t, dpopKey, tokenURLTest)))
+		require.NoError(t, err)
+		assert.Equal(t, errs.CodeSuccess, code)
+		assert.Equal(t, pUsers.AuthSchemeDPoP, res.TokenType)
+
+		// the new token is bound to the key of the subject token
+		payload, err := middleware.ReadToken("DPoP "+res.AccessToken, middleware.NewKeySet(*key))
+		require.NoError(t, err)
+		require.NotNil(t, payload.Cnf)
+		assert.Equal(t, jkt, payload.Cnf.JKT)
+	})
+}
@@ -0,0 +1,18 @@
+BEGIN;
+DROP INDEX IF EXISTS ix_refresh_token_whitelist_user_id;
+CREATE INDEX ix_refresh_token_whitelist_user_id ON refresh_token_whitelist(id);
+
+ALTER TABLE refresh_token_whitelist
+    DROP COLUMN IF EXISTS device_name,
+    DROP COLUMN IF EXISTS user_agent,
+    DROP COLUMN IF EXISTS ip_address,
+    DROP COLUMN IF EXISTS last_used_at;
+
+-- keep only the newest session of every user so the unique constraint can be restored
+DELETE FROM refresh_token_whitelist a
+    USING refresh_token_whitelist b
+WHERE a.user_id = b.user_id AND a.id < b.id;
+
+ALTER TABLE refresh_token_whitelist
+    ADD CONSTRAINT uq_refresh_token_whitelist_user_id UNIQUE (user_id);
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+ALTER TABLE refresh_token_whitelist
+    DROP CONSTRAINT uq_refresh_token_whitelist_user_id;
+
+ALTER TABLE refresh_token_whitelist
+    ADD COLUMN device_name VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN ip_address VARCHAR(45) NOT NULL DEFAULT '',
+    ADD COLUMN last_used_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+DROP INDEX IF EXISTS ix_refresh_token_whitelist_user_id;
+CREATE INDEX ix_refresh_token_whitelist_user_id ON refresh_token_whitelist(user_id);
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+ALTER TABLE refresh_token_whitelist
+    DROP COLUMN IF EXISTS access_token_id,
+    DROP COLUMN IF EXISTS access_token_expires_at;
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+ALTER TABLE refresh_token_whitelist
+    ADD COLUMN access_token_id UUID NULL,
+    ADD COLUMN access_token_expires_at TIMESTAMP NULL;
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+DROP TABLE IF EXISTS security_events;
+DROP TABLE IF EXISTS refresh_token_history;
+DROP INDEX IF EXISTS ix_refresh_token_whitelist_family_id;
+ALTER TABLE refresh_token_whitelist DROP COLUMN IF EXISTS family_id;
+COMMIT;
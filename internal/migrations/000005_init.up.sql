@@ -0,0 +1,34 @@
+BEGIN;
+ALTER TABLE refresh_token_whitelist
+    ADD COLUMN family_id UUID NOT NULL DEFAULT gen_random_uuid();
+
+CREATE INDEX ix_refresh_token_whitelist_family_id ON refresh_token_whitelist(family_id);
+
+CREATE TABLE refresh_token_history(
+    id INT GENERATED ALWAYS AS IDENTITY
+        CONSTRAINT pk_refresh_token_history_id PRIMARY KEY,
+    user_id INT NOT NULL,
+        CONSTRAINT fk_refresh_token_history_user_id FOREIGN KEY (user_id)
+            REFERENCES users(id),
+    family_id UUID NOT NULL,
+    refresh_token UUID NOT NULL
+        CONSTRAINT uq_refresh_token_history_refresh_token UNIQUE,
+    rotated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX ix_refresh_token_history_family_id ON refresh_token_history(family_id);
+
+CREATE TABLE security_events(
+    id INT GENERATED ALWAYS AS IDENTITY
+        CONSTRAINT pk_security_events_id PRIMARY KEY,
+    user_id INT NULL,
+        CONSTRAINT fk_security_events_user_id FOREIGN KEY (user_id)
+            REFERENCES users(id),
+    event_type VARCHAR(64) NOT NULL
+        CONSTRAINT ck_security_events_event_type_length CHECK (LENGTH(TRIM(event_type)) > 0),
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX ix_security_events_user_id ON security_events(user_id);
+COMMIT;
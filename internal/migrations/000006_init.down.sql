@@ -0,0 +1,16 @@
+BEGIN;
+DELETE FROM refresh_token_history;
+DELETE FROM refresh_token_whitelist;
+
+ALTER TABLE refresh_token_history
+    DROP COLUMN IF EXISTS refresh_token_hash;
+ALTER TABLE refresh_token_history
+    ADD COLUMN refresh_token UUID NOT NULL
+        CONSTRAINT uq_refresh_token_history_refresh_token UNIQUE;
+
+ALTER TABLE refresh_token_whitelist
+    DROP COLUMN IF EXISTS refresh_token_hash;
+ALTER TABLE refresh_token_whitelist
+    ADD COLUMN refresh_token UUID NOT NULL
+        CONSTRAINT uq_refresh_token_whitelist_refresh_token UNIQUE;
+COMMIT;
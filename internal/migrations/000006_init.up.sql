@@ -0,0 +1,23 @@
+BEGIN;
+-- refresh tokens were saved in plaintext, they can't be hashed back so every
+-- existing session is invalidated and the users have to login again
+DELETE FROM refresh_token_history;
+DELETE FROM refresh_token_whitelist;
+
+ALTER TABLE refresh_token_whitelist
+    DROP CONSTRAINT uq_refresh_token_whitelist_refresh_token;
+ALTER TABLE refresh_token_whitelist
+    DROP COLUMN refresh_token;
+ALTER TABLE refresh_token_whitelist
+    ADD COLUMN refresh_token_hash BYTEA NOT NULL
+        CONSTRAINT uq_refresh_token_whitelist_refresh_token_hash UNIQUE
+        CONSTRAINT ck_refresh_token_whitelist_refresh_token_hash_length CHECK (LENGTH(refresh_token_hash) = 32);
+
+ALTER TABLE refresh_token_history
+    DROP CONSTRAINT uq_refresh_token_history_refresh_token;
+ALTER TABLE refresh_token_history
+    DROP COLUMN refresh_token;
+ALTER TABLE refresh_token_history
+    ADD COLUMN refresh_token_hash BYTEA NOT NULL
+        CONSTRAINT uq_refresh_token_history_refresh_token_hash UNIQUE;
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+ALTER TABLE refresh_token_whitelist
+    DROP COLUMN IF EXISTS lifetime_key,
+    DROP COLUMN IF EXISTS absolute_expires_at;
+
+ALTER TABLE refresh_token_whitelist
+    ALTER COLUMN expires_at SET DEFAULT NOW() + INTERVAL '10 second';
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS role;
+COMMIT;
@@ -0,0 +1,18 @@
+BEGIN;
+ALTER TABLE users
+    ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'user'
+        CONSTRAINT ck_users_role_length CHECK (LENGTH(TRIM(role)) > 0);
+
+-- lifetime of the session is set by the service, not by the database
+ALTER TABLE refresh_token_whitelist
+    ALTER COLUMN expires_at DROP DEFAULT;
+
+ALTER TABLE refresh_token_whitelist
+    ADD COLUMN lifetime_key VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN absolute_expires_at TIMESTAMP NULL;
+
+UPDATE refresh_token_whitelist SET absolute_expires_at = expires_at;
+
+ALTER TABLE refresh_token_whitelist
+    ALTER COLUMN absolute_expires_at SET NOT NULL;
+COMMIT;
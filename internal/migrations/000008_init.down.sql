@@ -0,0 +1,15 @@
+BEGIN;
+DROP INDEX IF EXISTS uq_sec_m_active;
+
+DELETE FROM sec_m WHERE status <> 'active';
+
+ALTER TABLE sec_m
+    DROP CONSTRAINT IF EXISTS ck_sec_m_status,
+    DROP CONSTRAINT IF EXISTS pk_sec_m,
+    ALTER COLUMN private_key DROP NOT NULL,
+    ALTER COLUMN private_key SET DEFAULT NULL,
+    DROP COLUMN IF EXISTS retired_at,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS status,
+    DROP COLUMN IF EXISTS kid;
+COMMIT;
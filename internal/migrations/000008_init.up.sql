@@ -0,0 +1,23 @@
+BEGIN;
+DELETE FROM sec_m WHERE private_key IS NULL;
+
+-- every key has id (kid) that is put in the token header, so the token can be
+-- verified with the right key after the key is rotated
+ALTER TABLE sec_m
+    ADD COLUMN kid VARCHAR(64) NULL,
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active',
+    ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    ADD COLUMN retired_at TIMESTAMP NULL;
+
+UPDATE sec_m SET kid = gen_random_uuid()::TEXT;
+
+ALTER TABLE sec_m
+    ALTER COLUMN kid SET NOT NULL,
+    ALTER COLUMN private_key DROP DEFAULT,
+    ALTER COLUMN private_key SET NOT NULL,
+    ADD CONSTRAINT pk_sec_m PRIMARY KEY (kid),
+    ADD CONSTRAINT ck_sec_m_status CHECK (status IN ('active', 'verifying', 'retired'));
+
+-- only one key is used to sign new token
+CREATE UNIQUE INDEX uq_sec_m_active ON sec_m(status) WHERE status = 'active';
+COMMIT;
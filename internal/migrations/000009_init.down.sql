@@ -0,0 +1,7 @@
+BEGIN;
+-- only RSA key can be used without alg
+DELETE FROM sec_m WHERE alg NOT IN ('RS256', 'PS256');
+
+ALTER TABLE sec_m
+    DROP COLUMN IF EXISTS alg;
+COMMIT;
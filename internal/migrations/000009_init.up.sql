@@ -0,0 +1,9 @@
+BEGIN;
+-- key that is saved before this migration is RSA key used with RS256
+ALTER TABLE sec_m
+    ADD COLUMN alg VARCHAR(16) NOT NULL DEFAULT 'RS256'
+        CONSTRAINT ck_sec_m_alg CHECK (alg IN ('RS256', 'PS256', 'ES256', 'EdDSA'));
+
+ALTER TABLE sec_m
+    ALTER COLUMN alg DROP DEFAULT;
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+-- encrypted key can't be decrypted by the database, new key is created when
+-- the service start
+DELETE FROM sec_m WHERE encrypted_dek IS NOT NULL;
+
+ALTER TABLE sec_m
+    DROP CONSTRAINT IF EXISTS ck_sec_m_encrypted_dek,
+    DROP COLUMN IF EXISTS encrypted_dek,
+    DROP COLUMN IF EXISTS kek_id;
+COMMIT;
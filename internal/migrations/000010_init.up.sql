@@ -0,0 +1,9 @@
+BEGIN;
+-- private key is encrypted with data-encryption key (DEK), and the DEK is
+-- encrypted with key-encryption key (KEK) that is not saved in the database.
+-- Key that is saved in plaintext before is encrypted when the service start.
+ALTER TABLE sec_m
+    ADD COLUMN encrypted_dek BYTEA NULL,
+    ADD COLUMN kek_id VARCHAR(64) NULL,
+    ADD CONSTRAINT ck_sec_m_encrypted_dek CHECK ((encrypted_dek IS NULL) = (kek_id IS NULL));
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+CREATE TABLE oauth_clients(
+    id INT GENERATED ALWAYS AS IDENTITY
+        CONSTRAINT pk_oauth_clients_id PRIMARY KEY,
+    client_id VARCHAR(64) NOT NULL
+        CONSTRAINT uq_oauth_clients_client_id UNIQUE,
+    client_secret_hash BYTEA NOT NULL
+        CONSTRAINT ck_oauth_clients_client_secret_hash_length CHECK (LENGTH(client_secret_hash) = 32),
+    name VARCHAR(255) NOT NULL
+        CONSTRAINT ck_oauth_clients_name_length CHECK (LENGTH(TRIM(name)) > 0),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP NULL
+);
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+DROP TABLE IF EXISTS oauth_consents;
+
+DELETE FROM oauth_clients WHERE is_public;
+
+ALTER TABLE oauth_clients
+    DROP CONSTRAINT IF EXISTS ck_oauth_clients_client_secret_hash,
+    DROP COLUMN IF EXISTS redirect_uris,
+    DROP COLUMN IF EXISTS is_public,
+    ALTER COLUMN client_secret_hash SET NOT NULL,
+    ADD CONSTRAINT ck_oauth_clients_client_secret_hash_length CHECK (LENGTH(client_secret_hash) = 32);
+COMMIT;
@@ -0,0 +1,28 @@
+BEGIN;
+-- public client (e.g. single page app) can't keep secret, it's authenticated
+-- with PKCE only
+ALTER TABLE oauth_clients
+    ADD COLUMN redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN is_public BOOLEAN NOT NULL DEFAULT FALSE,
+    ALTER COLUMN client_secret_hash DROP NOT NULL,
+    DROP CONSTRAINT IF EXISTS ck_oauth_clients_client_secret_hash_length,
+    ADD CONSTRAINT ck_oauth_clients_client_secret_hash CHECK (
+        (is_public AND client_secret_hash IS NULL) OR
+        (NOT is_public AND LENGTH(client_secret_hash) = 32)
+    );
+
+CREATE TABLE oauth_consents(
+    id INT GENERATED ALWAYS AS IDENTITY
+        CONSTRAINT pk_oauth_consents_id PRIMARY KEY,
+    user_id INT NOT NULL,
+        CONSTRAINT fk_oauth_consents_user_id FOREIGN KEY (user_id)
+            REFERENCES users(id),
+    client_id VARCHAR(64) NOT NULL,
+        CONSTRAINT fk_oauth_consents_client_id FOREIGN KEY (client_id)
+            REFERENCES oauth_clients(client_id),
+    scope TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT uq_oauth_consents_user_id_client_id UNIQUE(user_id, client_id)
+);
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+ALTER TABLE oauth_clients
+    DROP CONSTRAINT IF EXISTS ck_oauth_clients_public_client_credentials,
+    DROP CONSTRAINT IF EXISTS ck_oauth_clients_grant_types,
+    DROP COLUMN IF EXISTS allowed_scopes,
+    DROP COLUMN IF EXISTS grant_types;
+COMMIT;
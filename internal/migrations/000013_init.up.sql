@@ -0,0 +1,13 @@
+BEGIN;
+-- client that is allowed to use client_credentials grant is a service account,
+-- token of the client is issued without user and only has allowed scopes
+ALTER TABLE oauth_clients
+    ADD COLUMN grant_types TEXT[] NOT NULL DEFAULT '{authorization_code}',
+    ADD COLUMN allowed_scopes TEXT[] NOT NULL DEFAULT '{}',
+    ADD CONSTRAINT ck_oauth_clients_grant_types CHECK (
+        grant_types <@ ARRAY['authorization_code', 'client_credentials']::TEXT[]
+    ),
+    ADD CONSTRAINT ck_oauth_clients_public_client_credentials CHECK (
+        NOT (is_public AND 'client_credentials' = ANY(grant_types))
+    );
+COMMIT;
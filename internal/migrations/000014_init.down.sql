@@ -0,0 +1,15 @@
+BEGIN;
+UPDATE oauth_clients
+SET grant_types = array_remove(grant_types, 'urn:ietf:params:oauth:grant-type:token-exchange');
+
+ALTER TABLE oauth_clients
+    DROP CONSTRAINT IF EXISTS ck_oauth_clients_public_grant_types,
+    ADD CONSTRAINT ck_oauth_clients_public_client_credentials CHECK (
+        NOT (is_public AND 'client_credentials' = ANY(grant_types))
+    ),
+    DROP CONSTRAINT IF EXISTS ck_oauth_clients_grant_types,
+    ADD CONSTRAINT ck_oauth_clients_grant_types CHECK (
+        grant_types <@ ARRAY['authorization_code', 'client_credentials']::TEXT[]
+    ),
+    DROP COLUMN IF EXISTS allowed_audiences;
+COMMIT;
@@ -0,0 +1,22 @@
+BEGIN;
+-- client that is allowed to use token exchange grant can swap token of the user
+-- for narrower token, the audience of the new token must be one of allowed
+-- audiences of the client
+ALTER TABLE oauth_clients
+    ADD COLUMN allowed_audiences TEXT[] NOT NULL DEFAULT '{}',
+    DROP CONSTRAINT ck_oauth_clients_grant_types,
+    ADD CONSTRAINT ck_oauth_clients_grant_types CHECK (
+        grant_types <@ ARRAY[
+            'authorization_code',
+            'client_credentials',
+            'urn:ietf:params:oauth:grant-type:token-exchange'
+        ]::TEXT[]
+    ),
+    DROP CONSTRAINT ck_oauth_clients_public_client_credentials,
+    ADD CONSTRAINT ck_oauth_clients_public_grant_types CHECK (
+        NOT (is_public AND grant_types && ARRAY[
+            'client_credentials',
+            'urn:ietf:params:oauth:grant-type:token-exchange'
+        ]::TEXT[])
+    );
+COMMIT;
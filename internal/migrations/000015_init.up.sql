@@ -0,0 +1,6 @@
+BEGIN;
+-- email is verified when the user open the link in verification email, the
+-- existing users are not verified either
+ALTER TABLE users
+    ADD COLUMN email_verified_at TIMESTAMP NULL;
+COMMIT;
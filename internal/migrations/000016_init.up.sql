@@ -0,0 +1,6 @@
+BEGIN;
+-- login of the user is refused until locked_until after too many failed
+-- login, null when the user is not locked
+ALTER TABLE users
+    ADD COLUMN locked_until TIMESTAMP NULL;
+COMMIT;
@@ -0,0 +1,4 @@
+BEGIN;
+DROP TABLE IF EXISTS mfa_recovery_codes;
+DROP TABLE IF EXISTS user_totp;
+COMMIT;
@@ -0,0 +1,34 @@
+BEGIN;
+-- TOTP secret of the user, it's sealed with random DEK and the DEK is wrapped
+-- with the key-encryption key like the jwt private key in sec_m. MFA is
+-- enabled after the secret is confirmed with the first code.
+CREATE TABLE user_totp(
+    user_id INT NOT NULL
+        CONSTRAINT pk_user_totp_user_id PRIMARY KEY,
+        CONSTRAINT fk_user_totp_user_id FOREIGN KEY (user_id)
+            REFERENCES users(id),
+    secret BYTEA NOT NULL,
+    encrypted_dek BYTEA NOT NULL,
+    kek_id VARCHAR(64) NOT NULL,
+    -- the last time step that the code is accepted, older code is rejected
+    -- so the code can't be used twice
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    confirmed_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- one-time recovery codes, only SHA-256 digest of the code is saved. They're
+-- deleted with the TOTP secret when MFA is disabled.
+CREATE TABLE mfa_recovery_codes(
+    id INT GENERATED ALWAYS AS IDENTITY
+        CONSTRAINT pk_mfa_recovery_codes_id PRIMARY KEY,
+    user_id INT NOT NULL,
+        CONSTRAINT fk_mfa_recovery_codes_user_id FOREIGN KEY (user_id)
+            REFERENCES user_totp(user_id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+        CONSTRAINT ck_mfa_recovery_codes_code_hash_length CHECK (LENGTH(code_hash) = 32),
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT uq_mfa_recovery_codes_user_id_code_hash UNIQUE(user_id, code_hash)
+);
+COMMIT;
@@ -0,0 +1,25 @@
+BEGIN;
+-- passkey (WebAuthn credential) of the user, public_key is COSE key. The user
+-- can have many passkeys, the credential ID is unique in every user.
+CREATE TABLE webauthn_credentials(
+    id INT GENERATED ALWAYS AS IDENTITY
+        CONSTRAINT pk_webauthn_credentials_id PRIMARY KEY,
+    user_id INT NOT NULL,
+        CONSTRAINT fk_webauthn_credentials_user_id FOREIGN KEY (user_id)
+            REFERENCES users(id),
+    credential_id BYTEA NOT NULL,
+        CONSTRAINT uq_webauthn_credentials_credential_id UNIQUE(credential_id),
+    public_key BYTEA NOT NULL,
+    -- signature counter of the authenticator, it's 0 when the authenticator
+    -- doesn't count
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports VARCHAR(32)[] NOT NULL DEFAULT '{}',
+    name VARCHAR(255) NOT NULL,
+    aaguid BYTEA NULL,
+    -- the passkey can be synced to other devices
+    backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+    last_used_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX ix_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+COMMIT;
@@ -0,0 +1,3 @@
+BEGIN;
+ALTER TABLE refresh_token_whitelist DROP COLUMN IF EXISTS client_id;
+COMMIT;
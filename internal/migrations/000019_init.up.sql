@@ -0,0 +1,6 @@
+BEGIN;
+-- oauth client that the session is issued to, it's empty for first party
+-- login. Only the client of the session can revoke its refresh token.
+ALTER TABLE refresh_token_whitelist
+    ADD COLUMN client_id VARCHAR(255) NOT NULL DEFAULT '';
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+ALTER TABLE refresh_token_whitelist
+    DROP COLUMN IF EXISTS scope,
+    DROP COLUMN IF EXISTS auth_time,
+    DROP COLUMN IF EXISTS amr;
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+-- claims of the session that are put in every access token, so the session
+-- can be refreshed by oauth client without the old access token
+ALTER TABLE refresh_token_whitelist
+    ADD COLUMN scope TEXT NOT NULL DEFAULT '',
+    ADD COLUMN auth_time TIMESTAMP NULL,
+    ADD COLUMN amr TEXT[] NOT NULL DEFAULT '{}';
+COMMIT;
@@ -5,25 +5,76 @@ INSERT INTO users(
     hashed_password
 ) VALUES (
     $1, $2, $3
-) RETURNING *;
+) RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until;
 
 -- name: GetUserByEmail :one
-SELECT * FROM users WHERE email = $1 AND is_deleted = FALSE;
+SELECT
+    id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until
+FROM
+    users
+WHERE email = $1;
+
+-- name: GetUserByID :one
+SELECT
+    id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until
+FROM
+    users
+WHERE id = $1;
 
 -- name: UpdateUser :one
 UPDATE
     users
 SET
-    username = coalesce($1, username),
-    hashed_password = coalesce($2, hashed_password)
+    username = coalesce(NULLIF($1::VARCHAR, ''), username),
+    hashed_password = coalesce(NULLIF($2::VARCHAR, ''), hashed_password)
 WHERE
     id = $3
 AND (
-    $1::VARCHAR IS NOT NULL AND $1 IS DISTINCT FROM username OR
-    $2::VARCHAR IS NOT NULL AND $2 IS DISTINCT FROM hashed_password
-) AND 
+    $1::VARCHAR <> '' AND $1 IS DISTINCT FROM username OR
+    $2::VARCHAR <> '' AND $2 IS DISTINCT FROM hashed_password
+) AND
     is_deleted = FALSE
-RETURNING *;
+RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until;
+
+-- name: VerifyUserEmail :one
+UPDATE
+    users
+SET
+    email_verified_at = NOW()
+WHERE
+    id = $1
+AND email = $2
+AND is_deleted = FALSE
+AND email_verified_at IS NULL
+RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until;
+
+-- name: UpdateUserPassword :one
+UPDATE
+    users
+SET
+    hashed_password = $2
+WHERE
+    id = $1
+AND is_deleted = FALSE
+RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until;
+
+-- name: LockUser :exec
+UPDATE
+    users
+SET
+    locked_until = $2
+WHERE
+    id = $1
+AND is_deleted = FALSE;
+
+-- name: UnlockUser :exec
+UPDATE
+    users
+SET
+    locked_until = NULL
+WHERE
+    id = $1
+AND is_deleted = FALSE;
 
 -- name: SoftDeleteUser :exec
 UPDATE
@@ -33,26 +84,360 @@ SET
     deleted_at = NOW()
 WHERE
     id = $1
-AND email = $2;
+AND email = $2
+AND is_deleted = FALSE;
+
+-- name: LoadKey :one
+SELECT
+    kid, alg, private_key, encrypted_dek, kek_id, status, created_at, retired_at
+FROM
+    sec_m
+WHERE
+    status = 'active';
+
+-- name: ListSigningKeys :many
+SELECT
+    kid, alg, private_key, encrypted_dek, kek_id, status, created_at, retired_at
+FROM
+    sec_m
+ORDER BY
+    created_at DESC;
 
--- name: InsertRefreshToken :exec
-INSERT INTO 
-    refresh_token_whitelist(user_id, refresh_token, expires_at) 
+-- name: ListVerificationKeys :many
+SELECT
+    kid, alg, private_key, encrypted_dek, kek_id, status, created_at, retired_at
+FROM
+    sec_m
+WHERE
+    status IN ('active', 'verifying')
+ORDER BY
+    created_at DESC;
+
+-- name: DemoteActiveSigningKey :exec
+UPDATE
+    sec_m
+SET
+    status = 'verifying'
+WHERE
+    status = 'active';
+
+-- name: InsertSigningKey :one
+INSERT INTO sec_m(
+    kid,
+    alg,
+    private_key,
+    encrypted_dek,
+    kek_id,
+    status
+) VALUES (
+    $1, $2, $3, $4, $5, 'active'
+) RETURNING kid, alg, private_key, encrypted_dek, kek_id, status, created_at, retired_at;
+
+-- name: RetireSigningKey :exec
+UPDATE
+    sec_m
+SET
+    status = 'retired',
+    retired_at = NOW()
+WHERE
+    kid = $1
+AND status = 'verifying';
+
+-- name: InsertRefreshToken :one
+INSERT INTO
+    refresh_token_whitelist(user_id, refresh_token_hash, expires_at, device_name, user_agent, ip_address, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr)
 VALUES(
-    $1, $2, NOW() + INTERVAL '5 minute'
-);
+    $1, $2, NOW() + LEAST($7::INTERVAL, $8::INTERVAL), $3, $4, $5, COALESCE($6::UUID, gen_random_uuid()), $9, NOW() + $8::INTERVAL, $10, $11, $12, COALESCE($13::TEXT[], '{}')
+) RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr;
 
 -- name: GetRefreshToken :one
-SELECT * FROM refresh_token_whitelist WHERE user_id = $1 AND refresh_token = $2;
+SELECT
+    id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr
+FROM
+    refresh_token_whitelist
+WHERE user_id = $1 AND refresh_token_hash = $2;
+
+-- name: GetRefreshTokenByHash :one
+SELECT
+    id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr
+FROM
+    refresh_token_whitelist
+WHERE refresh_token_hash = $1;
+
+-- name: ListRefreshTokenByUserID :many
+SELECT
+    id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr
+FROM
+    refresh_token_whitelist
+WHERE user_id = $1 AND expires_at > NOW()
+ORDER BY last_used_at DESC;
 
 -- name: DeleteRefreshToken :exec
 DELETE FROM refresh_token_whitelist WHERE user_id = $1;
 
+-- name: DeleteRefreshTokenByID :one
+DELETE FROM refresh_token_whitelist WHERE id = $1 AND user_id = $2
+RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr;
+
+-- name: DeleteOtherRefreshToken :many
+DELETE FROM refresh_token_whitelist WHERE user_id = $2 AND id <> $1
+RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr;
+
+-- name: DeleteAllRefreshToken :many
+DELETE FROM refresh_token_whitelist WHERE user_id = $1
+RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr;
+
+-- name: UpdateRefreshToken :exec
+UPDATE
+    refresh_token_whitelist
+SET
+    refresh_token_hash = $4,
+    expires_at = LEAST(NOW() + $7::INTERVAL, absolute_expires_at),
+    last_used_at = NOW(),
+    access_token_id = $5,
+    access_token_expires_at = $6
+WHERE
+    id = $1
+AND user_id = $2
+AND refresh_token_hash = $3;
+
+-- name: InsertRefreshTokenHistory :exec
+INSERT INTO
+    refresh_token_history(user_id, family_id, refresh_token_hash)
+VALUES(
+    $1, $2, $3
+);
+
+-- name: GetRotatedRefreshToken :one
+SELECT
+    id, user_id, family_id, refresh_token_hash, rotated_at
+FROM
+    refresh_token_history
+WHERE user_id = $1 AND refresh_token_hash = $2;
+
+-- name: GetRotatedRefreshTokenByHash :one
+SELECT
+    id, user_id, family_id, refresh_token_hash, rotated_at
+FROM
+    refresh_token_history
+WHERE refresh_token_hash = $1;
+
+-- name: RevokeRefreshTokenFamily :many
+DELETE FROM refresh_token_whitelist WHERE user_id = $1 AND family_id = $2
+RETURNING id, user_id, refresh_token_hash, expires_at, created_at, device_name, user_agent, ip_address, last_used_at, access_token_id, access_token_expires_at, family_id, lifetime_key, absolute_expires_at, client_id, scope, auth_time, amr;
+
+-- name: InsertSecurityEvent :exec
+INSERT INTO
+    security_events(user_id, event_type, description)
+VALUES(
+    $1, $2, $3
+);
+
+-- name: UpdateSessionAccessToken :exec
+UPDATE
+    refresh_token_whitelist
+SET
+    access_token_id = $3,
+    access_token_expires_at = $4
+WHERE
+    id = $1
+AND user_id = $2;
+
 -- name: UpdateUserIsDeleted :one
 UPDATE
     users
 SET
-    is_deleted = FALSE
+    is_deleted = FALSE,
+    username = $1,
+    hashed_password = $2,
+    created_at = NOW(),
+    email_verified_at = NULL,
+    locked_until = NULL
+WHERE
+    email = $3
+AND
+    is_deleted = TRUE
+RETURNING id, username, email, hashed_password, created_at, is_deleted, deleted_at, role, email_verified_at, locked_until;
+
+-- name: CreateOAuthClient :one
+INSERT INTO oauth_clients(
+    client_id,
+    client_secret_hash,
+    name,
+    redirect_uris,
+    is_public,
+    grant_types,
+    allowed_scopes,
+    allowed_audiences
+) VALUES (
+    $1, $2, $3, $4, $5, COALESCE($6::TEXT[], '{authorization_code}'), COALESCE($7::TEXT[], '{}'), COALESCE($8::TEXT[], '{}')
+) RETURNING id, client_id, client_secret_hash, name, created_at, revoked_at, redirect_uris, is_public, grant_types, allowed_scopes, allowed_audiences;
+
+-- name: GetOAuthClient :one
+SELECT
+    id, client_id, client_secret_hash, name, created_at, revoked_at, redirect_uris, is_public, grant_types, allowed_scopes, allowed_audiences
+FROM
+    oauth_clients
+WHERE client_id = $1 AND revoked_at IS NULL;
+
+-- name: ListOAuthClients :many
+SELECT
+    id, client_id, client_secret_hash, name, created_at, revoked_at, redirect_uris, is_public, grant_types, allowed_scopes, allowed_audiences
+FROM
+    oauth_clients
+ORDER BY created_at DESC;
+
+-- name: RevokeOAuthClient :exec
+UPDATE
+    oauth_clients
+SET
+    revoked_at = NOW()
+WHERE client_id = $1 AND revoked_at IS NULL;
+
+-- name: GetOAuthConsent :one
+SELECT
+    id, user_id, client_id, scope, created_at, updated_at
+FROM
+    oauth_consents
+WHERE user_id = $1 AND client_id = $2;
+
+-- name: UpsertOAuthConsent :one
+INSERT INTO oauth_consents(
+    user_id,
+    client_id,
+    scope
+) VALUES (
+    $1, $2, $3
+) ON CONFLICT (user_id, client_id) DO UPDATE SET
+    scope = EXCLUDED.scope,
+    updated_at = NOW()
+RETURNING id, user_id, client_id, scope, created_at, updated_at;
+
+-- name: UpsertTOTP :exec
+INSERT INTO user_totp(
+    user_id,
+    secret,
+    encrypted_dek,
+    kek_id
+) VALUES (
+    $1, $2, $3, $4
+) ON CONFLICT (user_id) DO UPDATE SET
+    secret = EXCLUDED.secret,
+    encrypted_dek = EXCLUDED.encrypted_dek,
+    kek_id = EXCLUDED.kek_id,
+    last_used_step = 0,
+    created_at = NOW()
+WHERE
+    user_totp.confirmed_at IS NULL;
+
+-- name: GetTOTP :one
+SELECT
+    user_id, secret, encrypted_dek, kek_id, last_used_step, confirmed_at, created_at
+FROM
+    user_totp
+WHERE
+    user_id = $1;
+
+-- name: ConfirmTOTP :exec
+UPDATE
+    user_totp
+SET
+    confirmed_at = NOW(),
+    last_used_step = $2
+WHERE
+    user_id = $1
+AND confirmed_at IS NULL
+AND last_used_step < $2;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM
+    mfa_recovery_codes
+WHERE
+    user_id = $1;
+
+-- name: InsertRecoveryCodes :exec
+INSERT INTO mfa_recovery_codes(
+    user_id,
+    code_hash
+) SELECT
+    $1, UNNEST($2::BYTEA[]);
+
+-- name: UpdateTOTPLastUsedStep :exec
+UPDATE
+    user_totp
+SET
+    last_used_step = $2
+WHERE
+    user_id = $1
+AND confirmed_at IS NOT NULL
+AND last_used_step < $2;
+
+-- name: UseRecoveryCode :exec
+UPDATE
+    mfa_recovery_codes
+SET
+    used_at = NOW()
+WHERE
+    user_id = $1
+AND code_hash = $2
+AND used_at IS NULL;
+
+-- name: DeleteTOTP :exec
+DELETE FROM
+    user_totp
+WHERE
+    user_id = $1;
+
+-- name: InsertWebAuthnCredential :one
+INSERT INTO webauthn_credentials(
+    user_id,
+    credential_id,
+    public_key,
+    sign_count,
+    transports,
+    name,
+    aaguid,
+    backup_eligible
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8
+) RETURNING id, user_id, credential_id, public_key, sign_count, transports, name, aaguid, backup_eligible, last_used_at, created_at;
+
+-- name: GetWebAuthnCredential :one
+SELECT
+    id, user_id, credential_id, public_key, sign_count, transports, name, aaguid, backup_eligible, last_used_at, created_at
+FROM
+    webauthn_credentials
+WHERE
+    credential_id = $1;
+
+-- name: ListWebAuthnCredentials :many
+SELECT
+    id, user_id, credential_id, public_key, sign_count, transports, name, aaguid, backup_eligible, last_used_at, created_at
+FROM
+    webauthn_credentials
+WHERE
+    user_id = $1
+ORDER BY id;
+
+-- name: UpdateWebAuthnCredentialUsage :exec
+UPDATE
+    webauthn_credentials
+SET
+    sign_count = $2,
+    last_used_at = NOW()
+WHERE
+    id = $1
+AND (sign_count < $2 OR $2 = 0);
+
+-- name: DeleteWebAuthnCredential :exec
+DELETE FROM
+    webauthn_credentials
+WHERE
+    id = $1
+AND user_id = $2;
+
+-- name: DeleteUserWebAuthnCredentials :exec
+DELETE FROM
+    webauthn_credentials
 WHERE
-    email = $1
-RETURNING *;
+    user_id = $1;
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer return mailer that save every email as .eml file in the
+// directory instead of sending it, it's used in development.
+func NewFileMailer(dir, from string) Mailer {
+	return &fileMailer{
+		dir:  dir,
+		from: from,
+	}
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg Message) error {
+	err := validate(msg)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(m.dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to create mail directory, msg: %v", err)
+	}
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405.000000000"), uuid.NewString())
+	// the email may contain token, so only the owner can read it
+	err = os.WriteFile(filepath.Join(m.dir, name), format(m.from, msg, now), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to save email, msg: %v", err)
+	}
+
+	return nil
+}
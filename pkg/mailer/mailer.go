@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message is plain text email
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Mailer send email, the implementation is picked by MAILER config, so the
+// service doesn't know how the email is delivered.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// name of the mailer implementation in MAILER config
+const (
+	DriverSMTP   = "smtp"
+	DriverFile   = "file"
+	DriverMemory = "memory"
+)
+
+// format return the message in RFC 5322 format, it's sent by SMTP mailer and
+// saved by file mailer.
+func format(from string, msg Message, date time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
+
+// validate reject message without recipient and header injection in the
+// recipient or subject.
+func validate(msg Message) error {
+	if len(msg.To) == 0 {
+		return fmt.Errorf("email doesn't have recipient")
+	}
+	for _, v := range append([]string{msg.Subject}, msg.To...) {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("email header must not contain new line")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var messageTest = Message{
+	To:      []string{"grace@mail.com"},
+	Subject: "Verify your email",
+	Body:    "Hi Grace,\nthe code is 123456\n",
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		desc string
+		msg  Message
+		err  bool
+	}{
+		{
+			desc: "success",
+			msg:  messageTest,
+		}, {
+			desc: "failed_without_recipient",
+			msg:  Message{Subject: "subject"},
+			err:  true,
+		}, {
+			desc: "failed_header_injection_subject",
+			msg:  Message{To: []string{"grace@mail.com"}, Subject: "subject\r\nBcc: evil@mail.com"},
+			err:  true,
+		}, {
+			desc: "failed_header_injection_recipient",
+			msg:  Message{To: []string{"grace@mail.com\nBcc: evil@mail.com"}},
+			err:  true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := validate(tC.msg)
+			if tC.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := NewMemoryMailer()
+
+	err := mailer.Send(context.Background(), messageTest)
+	require.NoError(t, err)
+	err = mailer.Send(context.Background(), Message{To: []string{"other@mail.com"}, Subject: "other"})
+	require.NoError(t, err)
+
+	res := mailer.Messages("grace@mail.com")
+	require.Len(t, res, 1)
+	assert.Equal(t, messageTest, res[0])
+
+	assert.Empty(t, mailer.Messages("unknown@mail.com"))
+
+	err = mailer.Send(context.Background(), Message{})
+	require.Error(t, err)
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mails")
+	mailer := NewFileMailer(dir, "no-reply@ran.com")
+
+	err := mailer.Send(context.Background(), messageTest)
+	require.NoError(t, err)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0].Name(), ".eml"))
+
+	info, err := files[0].Info()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	content, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "From: no-reply@ran.com\r\n")
+	assert.Contains(t, string(content), "To: grace@mail.com\r\n")
+	assert.Contains(t, string(content), "Subject: Verify your email\r\n")
+	assert.Contains(t, string(content), "the code is 123456\r\n")
+}
+
+// fakeSMTPServer accept one email without auth and send the DATA of the email
+// to the channel
+func fakeSMTPServer(t *testing.T) (addr string, data chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	data = make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		write := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		write("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				write("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				write("354 end data with <CR><LF>.<CR><LF>")
+				var body strings.Builder
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					body.WriteString(line)
+				}
+				data <- body.String()
+				write("250 OK")
+			case strings.HasPrefix(cmd, "QUIT"):
+				write("221 bye")
+				return
+			default:
+				write("250 OK")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), data
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, data := fakeSMTPServer(t)
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	mailer := NewSMTPMailer(host, port, "", "", "no-reply@ran.com")
+	err = mailer.Send(context.Background(), messageTest)
+	require.NoError(t, err)
+
+	res := <-data
+	assert.Contains(t, res, "To: grace@mail.com\r\n")
+	assert.Contains(t, res, "Subject: Verify your email\r\n")
+	assert.Contains(t, res, "the code is 123456\r\n")
+
+	// server is not running
+	mailer = NewSMTPMailer("127.0.0.1", "1", "", "", "no-reply@ran.com")
+	err = mailer.Send(context.Background(), messageTest)
+	require.Error(t, err)
+}
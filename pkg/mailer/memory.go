@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryMailer keep the sent emails in memory, it's used in test.
+type MemoryMailer struct {
+	messages []Message
+	mutex    sync.Mutex
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, msg Message) error {
+	err := validate(msg)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = append(m.messages, msg)
+
+	return nil
+}
+
+// Messages return the emails that is sent to the address, oldest first.
+func (m *MemoryMailer) Messages(to string) []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var res []Message
+	for _, msg := range m.messages {
+		for _, v := range msg.To {
+			if v == to {
+				res = append(res, msg)
+				break
+			}
+		}
+	}
+
+	return res
+}
@@ -2,22 +2,26 @@ package middleware
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
+	"crypto"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 	response "github.com/dwiw96/ran-user-management/pkg/utils/responses"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
@@ -26,7 +30,9 @@ type ContextKey string
 
 var PayloadKey ContextKey = "payload"
 
-func AuthMiddleware(ctx context.Context, pool *pgxpool.Pool, client *redis.Client) gin.HandlerFunc {
+// AuthMiddleware verify the access token and set its payload in payloadKey,
+// the token must be issued for the audience.
+func AuthMiddleware(ctx context.Context, pool *pgxpool.Pool, client *redis.Client, kek *password.KeyEncryptionKey, audience string) gin.HandlerFunc {
 	return (func(c *gin.Context) {
 		if c.Request.RequestURI == "/api/v1/auth/signup" {
 			c.Next()
@@ -41,23 +47,23 @@ func AuthMiddleware(ctx context.Context, pool *pgxpool.Pool, client *redis.Clien
 			return
 		}
 
-		key, err := LoadKey(ctx, pool)
+		authHeader, err := GetTokenHeader(c.Request)
 		if err != nil {
 			log.Println(err)
-			response.ErrorJSON(c, 500, []string{err.Error()}, c.Request.RemoteAddr)
+			response.ErrorJSON(c, 401, []string{err.Error()}, c.Request.RemoteAddr)
 			c.Abort()
 			return
 		}
 
-		authHeader, err := GetTokenHeader(c.Request)
+		keys, err := LoadKeySet(ctx, pool, kek, TokenKid(authHeader))
 		if err != nil {
 			log.Println(err)
-			response.ErrorJSON(c, 401, []string{err.Error()}, c.Request.RemoteAddr)
+			response.ErrorJSON(c, 500, []string{err.Error()}, c.Request.RemoteAddr)
 			c.Abort()
 			return
 		}
 
-		isVerified, err := VerifyToken(authHeader, key)
+		isVerified, err := VerifyToken(authHeader, keys)
 		if err != nil {
 			response.ErrorJSON(c, 401, []string{err.Error()}, c.Request.RemoteAddr)
 			c.Abort()
@@ -69,13 +75,20 @@ func AuthMiddleware(ctx context.Context, pool *pgxpool.Pool, client *redis.Clien
 			return
 		}
 
-		payload, err := ReadToken(authHeader, key)
+		payload, err := ReadToken(authHeader, keys)
 		if err != nil {
 			response.ErrorJSON(c, 401, []string{err.Error()}, c.Request.RemoteAddr)
 			c.Abort()
 			return
 		}
 
+		// token for other service can't be used here
+		if !slices.Contains(payload.Audience, audience) {
+			response.ErrorJSON(c, 401, []string{"token is not issued for this service"}, c.Request.RemoteAddr)
+			c.Abort()
+			return
+		}
+
 		err = CheckBlockedToken(client, ctx, payload.ID)
 		if err != nil {
 			response.ErrorJSON(c, 401, []string{err.Error()}, c.Request.RemoteAddr)
@@ -83,7 +96,21 @@ func AuthMiddleware(ctx context.Context, pool *pgxpool.Pool, client *redis.Clien
 			return
 		}
 
-		err = PayloadVerification(ctx, pool, payload.Email, payload.Name)
+		// token that is bound to DPoP key can't be used without proof of the key
+		err = verifyDPoP(ctx, client, c.Request, authHeader, payload)
+		if err != nil {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`DPoP error=%q, algs=%q`, auth.OAuthErrInvalidDPoPProof, strings.Join(DPoPSigningAlgs(), " ")))
+			response.ErrorJSON(c, 401, []string{err.Error()}, c.Request.RemoteAddr)
+			c.Abort()
+			return
+		}
+
+		// token of service account doesn't belong to user
+		if payload.IsServiceAccount() {
+			err = ServiceAccountVerification(ctx, pool, payload.ClientID)
+		} else {
+			err = PayloadVerification(ctx, pool, payload.UserID, payload.Email)
+		}
 		if err != nil {
 			response.ErrorJSON(c, 401, []string{err.Error()}, c.Request.RemoteAddr)
 			c.Abort()
@@ -106,46 +133,276 @@ func GetTokenHeader(r *http.Request) (token string, err error) {
 	return tokenString, nil
 }
 
-func CreateToken(reqData auth.User, minute int, key *rsa.PrivateKey) (token string, err error) {
+// CreateToken create signed access token for the user that valid for ttl,
+// sessionID is the id of refresh token row (session) that own the access token.
+// claims is the claims of the session, they're kept when the token is refreshed.
+// The token is signed with the algorithm of the key, and the token header carry
+// the kid of the key, so it's verified with the same key after the key is rotated.
+// The payload is returned so the caller can keep track of the token id and expiration.
+// Token that is bound to DPoP key (claims.Cnf) has "DPoP " prefix instead of "Bearer ".
+func CreateToken(reqData auth.User, sessionID int32, claims auth.SessionClaims, ttl time.Duration, key *auth.SigningKey) (token string, payload *auth.JwtPayload, err error) {
+	payload = &auth.JwtPayload{
+		UserID:    reqData.ID,
+		SessionID: sessionID,
+		Name:      reqData.Username,
+		Email:     reqData.Email,
+		ClientID:  claims.ClientID,
+		Scope:     claims.Scope,
+		AuthTime:  claims.AuthTime,
+		AMR:       claims.AMR,
+		Act:       claims.Act,
+		Cnf:       claims.Cnf,
+	}
+	payload.Subject = strconv.Itoa(int(reqData.ID))
+	payload.Audience = claims.Audience
+
+	token, payload, err = signToken(payload, ttl, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// token that is bound to DPoP key is sent with DPoP scheme
+	if payload.Cnf != nil {
+		token = auth.AuthSchemeDPoP + " " + strings.TrimPrefix(token, auth.AuthSchemeBearer+" ")
+	}
+
+	return token, payload, nil
+}
+
+// CreateClientToken create signed access token for oauth client as service
+// account, the subject of the token is the client and the token doesn't
+// belong to any user or session.
+func CreateClientToken(client auth.OAuthClient, scope string, audience []string, ttl time.Duration, key *auth.SigningKey) (token string, payload *auth.JwtPayload, err error) {
+	payload = &auth.JwtPayload{
+		Name:     client.Name,
+		ClientID: client.ClientID,
+		Scope:    scope,
+	}
+	payload.Subject = client.ClientID
+	payload.Audience = audience
+
+	return signToken(payload, ttl, key)
+}
+
+func signToken(payload *auth.JwtPayload, ttl time.Duration, key *auth.SigningKey) (token string, res *auth.JwtPayload, err error) {
 	nowTime := time.Now().UTC()
-	expTime := nowTime.Add(time.Minute * time.Duration(minute))
+	expTime := nowTime.Add(ttl)
 
 	id, err := uuid.NewRandom()
 	if err != nil {
-		return "", fmt.Errorf("failed to generate uuid, err: %v", err)
+		return "", nil, fmt.Errorf("failed to generate uuid, err: %v", err)
 	}
 
-	t := jwt.NewWithClaims(jwt.SigningMethodRS256,
-		auth.JwtPayload{
-			ID:     id,
-			UserID: reqData.ID,
-			Name:   reqData.Username,
-			Email:  reqData.Email,
-			Iat:    nowTime.Unix(),
-			Exp:    expTime.Unix(),
-		})
+	payload.ID = id
+	payload.Iat = nowTime.Unix()
+	payload.Exp = expTime.Unix()
 
-	token, err = t.SignedString(key)
+	token, err = signClaims(payload, "", key)
+	if err != nil {
+		return "", nil, err
+	}
 
 	token = "Bearer " + token
 
-	return
+	return token, payload, nil
+}
+
+// CreateIDToken create OpenID Connect ID token that valid for ttl, the caller
+// set iss, sub, aud and the authentication claims. ID token is not bearer
+// token, so it doesn't have "Bearer " prefix.
+func CreateIDToken(payload *auth.IDTokenPayload, ttl time.Duration, key *auth.SigningKey) (token string, res *auth.IDTokenPayload, err error) {
+	nowTime := time.Now().UTC()
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate uuid, err: %v", err)
+	}
+
+	payload.ID = id.String()
+	payload.IssuedAt = jwt.NewNumericDate(nowTime)
+	payload.ExpiresAt = jwt.NewNumericDate(nowTime.Add(ttl))
+
+	token, err = signClaims(payload, "", key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, payload, nil
+}
+
+// ReadIDToken verify ID token that is issued by CreateIDToken and return its
+// payload, expired token is rejected.
+func ReadIDToken(token string, keys KeySet) (*auth.IDTokenPayload, error) {
+	var payload auth.IDTokenPayload
+
+	jwtToken, err := jwt.ParseWithClaims(token, &payload, keys.keyFunc, jwt.WithValidMethods(validMethods()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse id token, msg: %v", err)
+	}
+
+	if !jwtToken.Valid {
+		return nil, fmt.Errorf("id token is not valid")
+	}
+
+	return &payload, nil
 }
 
-func VerifyToken(authHeader string, key *rsa.PrivateKey) (bool, error) {
+// emailVerificationTokenType is typ header of email verification token, so
+// the token can't be read as access token
+const emailVerificationTokenType = "email-verification+jwt"
+
+// CreateEmailVerificationToken create token that is sent to the email of the
+// user to verify it, the caller set sub and email. The token doesn't have
+// "Bearer " prefix because it's not used to access the service.
+func CreateEmailVerificationToken(payload *auth.EmailVerificationPayload, ttl time.Duration, key *auth.SigningKey) (token string, res *auth.EmailVerificationPayload, err error) {
+	nowTime := time.Now().UTC()
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate uuid, err: %v", err)
+	}
+
+	payload.ID = id.String()
+	payload.IssuedAt = jwt.NewNumericDate(nowTime)
+	payload.ExpiresAt = jwt.NewNumericDate(nowTime.Add(ttl))
+
+	token, err = signClaims(payload, emailVerificationTokenType, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, payload, nil
+}
+
+// ReadEmailVerificationToken verify email verification token that is issued
+// by CreateEmailVerificationToken and return its payload, expired token and
+// other type of token is rejected.
+func ReadEmailVerificationToken(token string, keys KeySet) (*auth.EmailVerificationPayload, error) {
+	var payload auth.EmailVerificationPayload
+
+	jwtToken, err := jwt.ParseWithClaims(token, &payload, keys.keyFunc, jwt.WithValidMethods(validMethods()), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email verification token, msg: %v", err)
+	}
+
+	if typ, _ := jwtToken.Header["typ"].(string); !jwtToken.Valid || typ != emailVerificationTokenType {
+		return nil, fmt.Errorf("email verification token is not valid")
+	}
+
+	return &payload, nil
+}
+
+// signClaims sign the claims with the key, the token header carry the kid of
+// the key. typ header is JWT when typ is empty.
+func signClaims(claims jwt.Claims, typ string, key *auth.SigningKey) (string, error) {
+	method, err := SigningMethod(key.Alg)
+	if err != nil {
+		return "", err
+	}
+
+	t := jwt.NewWithClaims(method, claims)
+	t.Header["kid"] = key.Kid
+	if typ != "" {
+		t.Header["typ"] = typ
+	}
+
+	return t.SignedString(key.PrivateKey)
+}
+
+// signingMethods is the only algorithms that token can be signed with, any
+// other algorithm (e.g. HS256 or none) is rejected before the key is picked.
+var signingMethods = map[string]jwt.SigningMethod{
+	password.SigningAlgRS256: jwt.SigningMethodRS256,
+	password.SigningAlgPS256: jwt.SigningMethodPS256,
+	password.SigningAlgES256: jwt.SigningMethodES256,
+	password.SigningAlgEdDSA: jwt.SigningMethodEdDSA,
+}
+
+func SigningMethod(alg string) (jwt.SigningMethod, error) {
+	method, ok := signingMethods[alg]
+	if !ok {
+		return nil, fmt.Errorf("signing algorithm %q is not supported", alg)
+	}
+
+	return method, nil
+}
+
+func validMethods() []string {
+	res := make([]string, 0, len(signingMethods))
+	for alg := range signingMethods {
+		res = append(res, alg)
+	}
+
+	return res
+}
+
+// VerificationKey is public key and the only algorithm it's used with
+type VerificationKey struct {
+	Alg       string
+	PublicKey crypto.PublicKey
+}
+
+// KeySet is public keys that token can be verified with, indexed by kid
+type KeySet map[string]VerificationKey
+
+func NewKeySet(keys ...auth.SigningKey) KeySet {
+	keySet := make(KeySet, len(keys))
+	for _, v := range keys {
+		keySet[v.Kid] = VerificationKey{
+			Alg:       v.Alg,
+			PublicKey: v.PrivateKey.Public(),
+		}
+	}
+
+	return keySet
+}
+
+// keyFunc pick the key to verify the token by kid in the token header. The alg
+// in the token header must be the alg of the key, so the token can't make the
+// key used with other algorithm (algorithm confusion).
+func (k KeySet) keyFunc(jwtToken *jwt.Token) (interface{}, error) {
+	kid, ok := jwtToken.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, errors.New("token doesn't has kid header")
+	}
+
+	key, ok := k[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+
+	if jwtToken.Method.Alg() != key.Alg {
+		return nil, fmt.Errorf("unexpected signing method: %v, key is used with %s", jwtToken.Header["alg"], key.Alg)
+	}
+
+	return key.PublicKey, nil
+}
+
+// TokenKid read kid from the token header without verifying the token, it's
+// empty if the token can't be parsed.
+func TokenKid(authHeader string) string {
+	userToken := strings.Split(authHeader, " ")
+	if len(userToken) != 2 {
+		return ""
+	}
+
+	jwtToken, _, err := jwt.NewParser().ParseUnverified(userToken[1], jwt.MapClaims{})
+	if err != nil {
+		return ""
+	}
+
+	kid, _ := jwtToken.Header["kid"].(string)
+	return kid
+}
+
+func VerifyToken(authHeader string, keys KeySet) (bool, error) {
 	userToken := strings.Split(authHeader, " ")
 
 	if len(userToken) != 2 {
 		return false, fmt.Errorf("authorization header format is wrong, ether doesn't has bearer or token")
 	}
 
-	jwtToken, err := jwt.Parse(userToken[1], func(jwtToken *jwt.Token) (interface{}, error) {
-		if _, ok := jwtToken.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", jwtToken.Header["alg"])
-		}
-
-		return &key.PublicKey, nil
-	})
+	jwtToken, err := jwt.Parse(userToken[1], keys.keyFunc, jwt.WithValidMethods(validMethods()))
 
 	if err != nil {
 		return false, fmt.Errorf("failed to parse token when verifying, err: %v", err)
@@ -160,17 +417,11 @@ func VerifyToken(authHeader string, key *rsa.PrivateKey) (bool, error) {
 	return true, nil
 }
 
-func ReadToken(authHeader string, key *rsa.PrivateKey) (*auth.JwtPayload, error) {
+func ReadToken(authHeader string, keys KeySet) (*auth.JwtPayload, error) {
 	var payload auth.JwtPayload
 	userToken := strings.Split(authHeader, " ")
 
-	jwtToken, err := jwt.ParseWithClaims(userToken[1], &payload, func(jwtToken *jwt.Token) (interface{}, error) {
-		if _, ok := jwtToken.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", jwtToken.Header["alg"])
-		}
-
-		return &key.PublicKey, nil
-	})
+	jwtToken, err := jwt.ParseWithClaims(userToken[1], &payload, keys.keyFunc, jwt.WithValidMethods(validMethods()))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token, msg: %v", err)
@@ -180,56 +431,168 @@ func ReadToken(authHeader string, key *rsa.PrivateKey) (*auth.JwtPayload, error)
 		return nil, fmt.Errorf("failed to parse token when read the token")
 	}
 
+	// other token that is signed with the same key can't be used as access token
+	if typ, ok := jwtToken.Header["typ"]; ok && typ != "JWT" {
+		return nil, fmt.Errorf("token is not access token")
+	}
+
 	return &payload, err
 }
 
+const (
+	loadKeyQuery  = "select kid, alg, private_key, encrypted_dek, kek_id from sec_m where status = 'active'"
+	loadKeysQuery = "select kid, alg, private_key, encrypted_dek, kek_id from sec_m where status in ('active', 'verifying')"
+)
+
+// LoadKey return the active key that is used to sign new token, the private
+// key is decrypted with the kek.
+func LoadKey(ctx context.Context, conn *pgxpool.Pool, kek *password.KeyEncryptionKey) (key *auth.SigningKey, err error) {
+	var keyBytes, wrappedDEK []byte
+	var kekID pgtype.Text
+	key = &auth.SigningKey{Status: auth.SigningKeyStatusActive}
+	err = conn.QueryRow(ctx, loadKeyQuery).Scan(&key.Kid, &key.Alg, &keyBytes, &wrappedDEK, &kekID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errors.New("no private key found in database")
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	key.PrivateKey, err = kek.OpenPrivateKey(key.Kid, kekID.String, keyBytes, wrappedDEK)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	return key, nil
+}
+
 type KeyCache struct {
-	key        *rsa.PrivateKey
+	keys       KeySet
 	expiration time.Time
-	mutex      sync.Mutex
+	// unknown kid doesn't reload the keys before this time
+	reloadAt time.Time
+	// unknown kids that are not found in the last reload
+	misses map[string]struct{}
+	mutex  sync.Mutex
 }
 
 var keyCache = &KeyCache{
-	key:        nil,
+	keys:       nil,
 	expiration: time.Now(),
 }
 
-func LoadKey(ctx context.Context, conn *pgxpool.Pool) (key *rsa.PrivateKey, err error) {
-	if keyCache.key != nil && time.Now().Before(keyCache.expiration) {
-		return keyCache.key, nil
+// keyCacheDuration is how long the keys is cached, retired key is still
+// accepted by the cache at most for this duration. keyReloadInterval is the
+// minimum time between two reloads, so token with unknown kid can't make every
+// request load and decrypt the keys.
+const (
+	keyCacheDuration  = 5 * time.Minute
+	keyReloadInterval = 10 * time.Second
+)
+
+// get return the cached keys, isReload is true when the keys must be loaded
+// from the database. Only one caller reload the keys in every interval, the
+// other callers keep using the cached keys until the reload is finished.
+func (k *KeyCache) get(kid string, now time.Time) (keys KeySet, isReload bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.keys == nil {
+		return nil, true
+	}
+
+	if now.Before(k.expiration) {
+		if _, ok := k.keys[kid]; ok || kid == "" {
+			return k.keys, false
+		}
+		if _, ok := k.misses[kid]; ok || now.Before(k.reloadAt) {
+			return k.keys, false
+		}
+	}
+
+	k.reloadAt = now.Add(keyReloadInterval)
+	if !now.Before(k.expiration) {
+		k.expiration = k.reloadAt
+	}
+
+	return k.keys, true
+}
+
+func (k *KeyCache) set(keys KeySet, kid string, now time.Time) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.keys = keys
+	k.expiration = now.Add(keyCacheDuration)
+	k.reloadAt = now.Add(keyReloadInterval)
+	k.misses = make(map[string]struct{})
+	if _, ok := keys[kid]; !ok && kid != "" {
+		k.misses[kid] = struct{}{}
+	}
+}
+
+// LoadKeySet return the keys that token can be verified with. The keys is
+// cached, and reloaded when the cache is expired or the kid is unknown, so
+// token signed with new rotated key is accepted right away. Unknown kid is
+// cached as miss and the keys is reloaded at most once per keyReloadInterval.
+func LoadKeySet(ctx context.Context, conn *pgxpool.Pool, kek *password.KeyEncryptionKey, kid string) (keys KeySet, err error) {
+	now := time.Now()
+	keys, isReload := keyCache.get(kid, now)
+	if !isReload {
+		return keys, nil
+	}
+
+	keys, err = loadKeySet(ctx, conn, kek)
+	if err != nil {
+		return nil, err
 	}
 
-	query := "select private_key from sec_m"
-	var keyBytes []byte
-	rows, err := conn.Query(ctx, query)
+	keyCache.set(keys, kid, now)
+
+	return keys, nil
+}
+
+func loadKeySet(ctx context.Context, conn *pgxpool.Pool, kek *password.KeyEncryptionKey) (keys KeySet, err error) {
+	rows, err := conn.Query(ctx, loadKeysQuery)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 	defer rows.Close()
 
-	if rows.Next() {
-		err = rows.Scan(&keyBytes)
+	keys = make(KeySet)
+	for rows.Next() {
+		var keyID, alg string
+		var keyBytes, wrappedDEK []byte
+		var kekID pgtype.Text
+		err = rows.Scan(&keyID, &alg, &keyBytes, &wrappedDEK, &kekID)
 		if err != nil {
 			log.Println(err)
 			return nil, err
 		}
 
-		privateKey, err := x509.ParsePKCS1PrivateKey(keyBytes)
+		privateKey, err := kek.OpenPrivateKey(keyID, kekID.String, keyBytes, wrappedDEK)
 		if err != nil {
 			log.Println(err)
 			return nil, err
 		}
 
-		keyCache.mutex.Lock()
-		defer keyCache.mutex.Unlock()
-		keyCache.key = key
-		keyCache.expiration = time.Now().Add(time.Hour)
+		keys[keyID] = VerificationKey{
+			Alg:       alg,
+			PublicKey: privateKey.Public(),
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-		return privateKey, nil
+	if len(keys) == 0 {
+		return nil, errors.New("no private key found in database")
 	}
 
-	return nil, errors.New("no private key found in database")
+	return keys, nil
 }
 
 func CheckBlockedToken(redis *redis.Client, ctx context.Context, tokenID uuid.UUID) error {
@@ -244,18 +607,40 @@ func CheckBlockedToken(redis *redis.Client, ctx context.Context, tokenID uuid.UU
 	return nil
 }
 
-func PayloadVerification(ctx context.Context, pool *pgxpool.Pool, email, username string) error {
-	query := "SELECT COUNT(*) FROM users WHERE email = $1 AND username = $2;"
+// PayloadVerification check the user of the token is still exists and not
+// deleted. The user is identified by its id and email, username is not checked
+// because it can be changed while the token is live, the name claim is updated
+// when the token is refreshed.
+func PayloadVerification(ctx context.Context, pool *pgxpool.Pool, userID int32, email string) error {
+	query := "SELECT COUNT(*) FROM users WHERE id = $1 AND email = $2 AND is_deleted = FALSE;"
 
 	var isOk int64
-	err := pool.QueryRow(ctx, query, email, username).Scan(&isOk)
+	err := pool.QueryRow(ctx, query, userID, email).Scan(&isOk)
 	if err != nil {
 		return fmt.Errorf("failed to verify token payload")
 	}
 
 	if isOk == 0 {
-		return fmt.Errorf("token payload is wrong, email and username doesn't match")
+		return fmt.Errorf("token payload is wrong, user is not found")
 	}
 
 	return err
 }
+
+// ServiceAccountVerification check the oauth client of service account token is
+// still registered and not revoked.
+func ServiceAccountVerification(ctx context.Context, pool *pgxpool.Pool, clientID string) error {
+	query := "SELECT COUNT(*) FROM oauth_clients WHERE client_id = $1 AND revoked_at IS NULL;"
+
+	var isOk int64
+	err := pool.QueryRow(ctx, query, clientID).Scan(&isOk)
+	if err != nil {
+		return fmt.Errorf("failed to verify token payload")
+	}
+
+	if isOk == 0 {
+		return fmt.Errorf("token payload is wrong, client is not found or revoked")
+	}
+
+	return nil
+}
@@ -2,9 +2,11 @@ package middleware
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto/x509"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +15,8 @@ import (
 	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 	testUtils "github.com/dwiw96/ran-user-management/testutils"
 
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
@@ -35,7 +39,7 @@ func TestMain(m *testing.M) {
 
 	schemaCleanup := testUtils.SetupDB("test_middleware_auth")
 
-	password.JwtInit(poolTest, ctxTest)
+	password.JwtInit(poolTest, ctxTest, password.DefaultSigningAlg, testUtils.GetKeyEncryptionKey())
 
 	var cancel context.CancelFunc
 	ctxTest, cancel = context.WithTimeout(context.Background(), 1000*time.Second)
@@ -48,8 +52,8 @@ func TestMain(m *testing.M) {
 	os.Exit(exitTest)
 }
 
-func createTokenAndKey(t *testing.T) (string, pUsers.User, *rsa.PrivateKey) {
-	key, err := LoadKey(ctxTest, poolTest)
+func createTokenAndKey(t *testing.T) (string, pUsers.User, KeySet) {
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
 	require.NoError(t, err)
 	require.NotNil(t, key)
 
@@ -59,11 +63,11 @@ func createTokenAndKey(t *testing.T) (string, pUsers.User, *rsa.PrivateKey) {
 		Email:    generator.CreateRandomEmail(firstname),
 	}
 
-	token, err := CreateToken(payload, 5, key)
+	token, _, err := CreateToken(payload, 0, pUsers.SessionClaims{}, 5*time.Minute, key)
 	require.NoError(t, err)
 	require.NotEmpty(t, token)
 
-	return token, payload, key
+	return token, payload, NewKeySet(*key)
 }
 
 func TestCreateToken(t *testing.T) {
@@ -103,10 +107,166 @@ func TestReadToken(t *testing.T) {
 	})
 }
 
+func TestVerifyTokenKid(t *testing.T) {
+	token, _, keys := createTokenAndKey(t)
+
+	t.Run("unknown_kid", func(t *testing.T) {
+		res, err := VerifyToken(token, KeySet{})
+		require.Error(t, err)
+		require.False(t, res)
+	})
+
+	t.Run("other_key_with_same_kid", func(t *testing.T) {
+		privateKey, _, err := password.GenerateSigningKey(password.SigningAlgRS256)
+		require.NoError(t, err)
+
+		otherKeys := KeySet{TokenKid(token): {Alg: password.SigningAlgRS256, PublicKey: privateKey.Public()}}
+		res, err := VerifyToken(token, otherKeys)
+		require.Error(t, err)
+		require.False(t, res)
+	})
+
+	t.Run("no_kid", func(t *testing.T) {
+		key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+		require.NoError(t, err)
+
+		noKidKey := *key
+		noKidKey.Kid = ""
+		noKidToken, _, err := CreateToken(pUsers.User{Username: "name", Email: "name@mail.com"}, 0, pUsers.SessionClaims{}, 5*time.Minute, &noKidKey)
+		require.NoError(t, err)
+
+		res, err := VerifyToken(noKidToken, keys)
+		require.Error(t, err)
+		require.False(t, res)
+	})
+}
+
 func TestLoadKey(t *testing.T) {
-	res, err := LoadKey(ctxTest, poolTest)
+	res, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
 	require.NoError(t, err)
 	require.NotNil(t, res)
+	assert.NotEmpty(t, res.Kid)
+	assert.Equal(t, pUsers.SigningKeyStatusActive, res.Status)
+}
+
+func TestLoadKeySet(t *testing.T) {
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+	require.NoError(t, err)
+
+	res, err := LoadKeySet(ctxTest, poolTest, testUtils.GetKeyEncryptionKey(), key.Kid)
+	require.NoError(t, err)
+	require.Contains(t, res, key.Kid)
+	assert.Equal(t, key.Alg, res[key.Kid].Alg)
+	assert.Equal(t, key.PrivateKey.Public(), res[key.Kid].PublicKey)
+}
+
+func TestLoadKeySetUnknownKid(t *testing.T) {
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+	require.NoError(t, err)
+
+	// clear the cache, so the keys is loaded from the database
+	keyCache.set(nil, "", time.Now().Add(-keyCacheDuration))
+	res, err := LoadKeySet(ctxTest, poolTest, testUtils.GetKeyEncryptionKey(), "unknown-kid-1")
+	require.NoError(t, err)
+	require.Contains(t, res, key.Kid)
+	require.NotContains(t, res, "unknown-kid-1")
+
+	// the keys was just reloaded, so nil pool is not used to load the keys
+	// again for the same or other unknown kid
+	for _, kid := range []string{"unknown-kid-1", "unknown-kid-2", key.Kid} {
+		res, err = LoadKeySet(ctxTest, nil, nil, kid)
+		require.NoError(t, err)
+		require.Contains(t, res, key.Kid)
+	}
+
+	// other unknown kid reload the keys after the reload interval
+	keyCache.mutex.Lock()
+	keyCache.reloadAt = time.Now()
+	keyCache.mutex.Unlock()
+	res, err = LoadKeySet(ctxTest, poolTest, testUtils.GetKeyEncryptionKey(), "unknown-kid-2")
+	require.NoError(t, err)
+	require.Contains(t, res, key.Kid)
+	keyCache.mutex.Lock()
+	assert.Contains(t, keyCache.misses, "unknown-kid-2")
+	keyCache.mutex.Unlock()
+}
+
+func TestCreateTokenAlgorithms(t *testing.T) {
+	user := pUsers.User{
+		ID:       generator.RandomInt32(1, 100),
+		Username: generator.CreateRandomString(7),
+		Email:    generator.CreateRandomEmail(generator.CreateRandomString(5)),
+	}
+
+	algs := []string{password.SigningAlgRS256, password.SigningAlgPS256, password.SigningAlgES256, password.SigningAlgEdDSA}
+	for _, alg := range algs {
+		t.Run(alg, func(t *testing.T) {
+			privateKey, kid, err := password.GenerateSigningKey(alg)
+			require.NoError(t, err)
+			key := pUsers.SigningKey{Kid: kid, Alg: alg, PrivateKey: privateKey}
+
+			token, _, err := CreateToken(user, 0, pUsers.SessionClaims{}, 5*time.Minute, &key)
+			require.NoError(t, err)
+
+			res, err := VerifyToken(token, NewKeySet(key))
+			require.NoError(t, err)
+			require.True(t, res)
+
+			payload, err := ReadToken(token, NewKeySet(key))
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, payload.UserID)
+		})
+	}
+}
+
+func TestVerifyTokenAlgorithmConfusion(t *testing.T) {
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+	require.NoError(t, err)
+	keys := NewKeySet(*key)
+
+	claims := jwt.MapClaims{
+		"user_id": 1,
+		"exp":     time.Now().Add(5 * time.Minute).Unix(),
+	}
+
+	t.Run("hmac_with_public_key_as_secret", func(t *testing.T) {
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(key.PrivateKey.Public())
+		require.NoError(t, err)
+
+		jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		jwtToken.Header["kid"] = key.Kid
+		token, err := jwtToken.SignedString(publicKeyBytes)
+		require.NoError(t, err)
+
+		res, err := VerifyToken("Bearer "+token, keys)
+		require.Error(t, err)
+		require.False(t, res)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		jwtToken := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+		jwtToken.Header["kid"] = key.Kid
+		token, err := jwtToken.SignedString(jwt.UnsafeAllowNoneSignatureType)
+		require.NoError(t, err)
+
+		res, err := VerifyToken("Bearer "+token, keys)
+		require.Error(t, err)
+		require.False(t, res)
+	})
+
+	t.Run("other_algorithm_of_the_same_key", func(t *testing.T) {
+		privateKey, kid, err := password.GenerateSigningKey(password.SigningAlgRS256)
+		require.NoError(t, err)
+		rs256Key := pUsers.SigningKey{Kid: kid, Alg: password.SigningAlgRS256, PrivateKey: privateKey}
+		ps256Key := pUsers.SigningKey{Kid: kid, Alg: password.SigningAlgPS256, PrivateKey: privateKey}
+
+		token, _, err := CreateToken(pUsers.User{Username: "name", Email: "name@mail.com"}, 0, pUsers.SessionClaims{}, 5*time.Minute, &ps256Key)
+		require.NoError(t, err)
+
+		res, err := VerifyToken(token, NewKeySet(rs256Key))
+		require.Error(t, err)
+		require.False(t, res)
+	})
 }
 
 func TestCheckBlockedToken(t *testing.T) {
@@ -169,6 +329,198 @@ func TestPayloadVerification(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotZero(t, user.ID)
 
-	err = PayloadVerification(ctxTest, poolTest, user.Email, user.Username)
+	err = PayloadVerification(ctxTest, poolTest, user.ID, user.Email)
+	require.NoError(t, err)
+
+	// username can be changed while the token is live
+	_, err = poolTest.Exec(ctxTest, "UPDATE users SET username = $1 WHERE id = $2;", "a"+user.Username, user.ID)
+	require.NoError(t, err)
+	err = PayloadVerification(ctxTest, poolTest, user.ID, user.Email)
+	require.NoError(t, err)
+
+	err = PayloadVerification(ctxTest, poolTest, user.ID, "a"+user.Email)
+	require.Error(t, err)
+
+	_, err = poolTest.Exec(ctxTest, "UPDATE users SET is_deleted = TRUE, deleted_at = NOW() WHERE id = $1;", user.ID)
+	require.NoError(t, err)
+	err = PayloadVerification(ctxTest, poolTest, user.ID, user.Email)
+	require.Error(t, err)
+}
+
+func TestCreateClientToken(t *testing.T) {
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+	require.NoError(t, err)
+
+	client := pUsers.OAuthClient{
+		ClientID: generator.CreateRandomString(10),
+		Name:     generator.CreateRandomString(7),
+	}
+
+	token, payload, err := CreateClientToken(client, "users:read", []string{"ran-user-management"}, 5*time.Minute, key)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	assert.True(t, payload.IsServiceAccount())
+
+	res, err := ReadToken(token, NewKeySet(*key))
+	require.NoError(t, err)
+	assert.True(t, res.IsServiceAccount())
+	assert.Zero(t, res.UserID)
+	assert.Equal(t, client.ClientID, res.Subject)
+	assert.Equal(t, client.ClientID, res.ClientID)
+	assert.Equal(t, client.Name, res.Name)
+	assert.Equal(t, "users:read", res.Scope)
+	assert.Equal(t, jwt.ClaimStrings{"ran-user-management"}, res.Audience)
+}
+
+func TestServiceAccountVerification(t *testing.T) {
+	clientID := generator.CreateRandomString(10)
+
+	query := `
+	INSERT INTO oauth_clients(
+		client_id,
+		client_secret_hash,
+		name,
+		grant_types
+	) VALUES 
+		($1, $2, $3, '{client_credentials}');`
+
+	_, err := poolTest.Exec(ctxTest, query, clientID, password.HashClientSecret(generator.CreateRandomString(10)), generator.CreateRandomString(7))
+	require.NoError(t, err)
+
+	err = ServiceAccountVerification(ctxTest, poolTest, clientID)
+	require.NoError(t, err)
+
+	_, err = poolTest.Exec(ctxTest, "UPDATE oauth_clients SET revoked_at = NOW() WHERE client_id = $1;", clientID)
+	require.NoError(t, err)
+
+	err = ServiceAccountVerification(ctxTest, poolTest, clientID)
+	require.Error(t, err)
+
+	err = ServiceAccountVerification(ctxTest, poolTest, generator.CreateRandomString(10))
+	require.Error(t, err)
+}
+
+func TestCreateIDToken(t *testing.T) {
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+	require.NoError(t, err)
+
+	authTime := time.Now().Add(-time.Hour).Unix()
+	arg := &pUsers.IDTokenPayload{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   "http://localhost:8080",
+			Subject:  "1",
+			Audience: jwt.ClaimStrings{"client"},
+		},
+		Nonce:    "nonce",
+		AuthTime: authTime,
+		AMR:      []string{pUsers.AMRPassword},
+	}
+
+	token, _, err := CreateIDToken(arg, 5*time.Minute, key)
+	require.NoError(t, err)
+	assert.Equal(t, key.Kid, TokenKid("Bearer "+token))
+
+	res, err := ReadIDToken(token, NewKeySet(*key))
+	require.NoError(t, err)
+	assert.Equal(t, arg.Issuer, res.Issuer)
+	assert.Equal(t, arg.Subject, res.Subject)
+	assert.Equal(t, arg.Audience, res.Audience)
+	assert.Equal(t, "nonce", res.Nonce)
+	assert.Equal(t, authTime, res.AuthTime)
+	assert.Equal(t, arg.AMR, res.AMR)
+	assert.NotEmpty(t, res.ID)
+
+	// expired id token is rejected
+	token, _, err = CreateIDToken(arg, -time.Minute, key)
+	require.NoError(t, err)
+	_, err = ReadIDToken(token, NewKeySet(*key))
+	require.Error(t, err)
+}
+
+func TestCreateEmailVerificationToken(t *testing.T) {
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+	require.NoError(t, err)
+
+	arg := &pUsers.EmailVerificationPayload{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "1"},
+		Email:            "grace@mail.com",
+	}
+	token, _, err := CreateEmailVerificationToken(arg, 5*time.Minute, key)
+	require.NoError(t, err)
+
+	res, err := ReadEmailVerificationToken(token, NewKeySet(*key))
+	require.NoError(t, err)
+	assert.Equal(t, "1", res.Subject)
+	assert.Equal(t, "grace@mail.com", res.Email)
+	assert.NotEmpty(t, res.ID)
+
+	// verification token is not access token
+	_, err = ReadToken("Bearer "+token, NewKeySet(*key))
+	require.Error(t, err)
+
+	// access token is not verification token
+	accessToken, _, err := CreateToken(pUsers.User{ID: 1, Email: "grace@mail.com"}, 0, pUsers.SessionClaims{}, 5*time.Minute, key)
 	require.NoError(t, err)
+	_, err = ReadEmailVerificationToken(strings.TrimPrefix(accessToken, "Bearer "), NewKeySet(*key))
+	require.Error(t, err)
+
+	// expired token is rejected
+	token, _, err = CreateEmailVerificationToken(arg, -time.Minute, key)
+	require.NoError(t, err)
+	_, err = ReadEmailVerificationToken(token, NewKeySet(*key))
+	require.Error(t, err)
+}
+
+func TestAuthMiddlewareAudience(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+	require.NoError(t, err)
+
+	user := pUsers.User{
+		Username: generator.CreateRandomString(7),
+		Email:    generator.CreateRandomEmail(generator.CreateRandomString(5)),
+	}
+	row := poolTest.QueryRow(ctxTest, "INSERT INTO users(email, username, hashed_password) VALUES ($1, $2, $3) RETURNING id;", user.Email, user.Username, generator.CreateRandomString(10))
+	err = row.Scan(&user.ID)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.GET("/", AuthMiddleware(ctxTest, poolTest, clientTest, testUtils.GetKeyEncryptionKey(), "ran-user-management"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	testCases := []struct {
+		desc     string
+		audience []string
+		code     int
+	}{
+		{
+			desc:     "success",
+			audience: []string{"ran-user-management"},
+			code:     http.StatusOK,
+		}, {
+			desc:     "failed_other_audience",
+			audience: []string{"analytics"},
+			code:     http.StatusUnauthorized,
+		}, {
+			desc: "failed_without_audience",
+			code: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			token, _, err := CreateToken(user, 0, pUsers.SessionClaims{Audience: tC.audience}, 5*time.Minute, key)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			// the token already has "Bearer " prefix, the header prefix is removed by GetTokenHeader
+			req.Header.Set("Authorization", "Bearer "+token)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tC.code, w.Code)
+		})
+	}
 }
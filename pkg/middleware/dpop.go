@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DPoPHeader is the request header that carry DPoP proof
+	DPoPHeader = "DPoP"
+	// typ header of DPoP proof
+	dpopProofType = "dpop+jwt"
+	// DPoPProofLifetime is how long DPoP proof is accepted after it's created,
+	// jti of the proof is kept for the same duration to detect replay
+	DPoPProofLifetime = 5 * time.Minute
+	// dpopClockSkew is how far iat of the proof can be in the future
+	dpopClockSkew = 30 * time.Second
+)
+
+// DPoPSigningAlgs return the algorithms that DPoP proof can be signed with,
+// they're the same as the algorithms of access token.
+func DPoPSigningAlgs() []string {
+	algs := validMethods()
+	slices.Sort(algs)
+
+	return algs
+}
+
+// CreateDPoPProof create DPoP proof as the client does, the proof is signed
+// with the private key and carry its public key. accessToken is the token
+// that the proof is sent with, it's empty when the proof is sent to get token.
+func CreateDPoPProof(privateKey crypto.Signer, alg, method, htu, accessToken string) (string, error) {
+	signingMethod, err := SigningMethod(alg)
+	if err != nil {
+		return "", err
+	}
+
+	jwk, err := password.PublicJWK("", "", privateKey.Public())
+	if err != nil {
+		return "", err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate uuid, err: %v", err)
+	}
+
+	claims := auth.DPoPProofPayload{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       id.String(),
+			IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
+		},
+		HTM: method,
+		HTU: htu,
+	}
+	if accessToken != "" {
+		claims.ATH = DPoPAccessTokenHash(accessToken)
+	}
+
+	t := jwt.NewWithClaims(signingMethod, claims)
+	t.Header["typ"] = dpopProofType
+	t.Header["jwk"] = jwk
+
+	return t.SignedString(privateKey)
+}
+
+// DPoPAccessTokenHash return ath claim of the access token, it's base64url of
+// SHA-256 of the token.
+func DPoPAccessTokenHash(accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// ReadDPoPProof verify DPoP proof (RFC 9449 section 4.3) that is sent with the
+// request of the method to the url, and return its claims. The proof is
+// signed with the key in its jwk header, JKT of the result is the thumbprint
+// of that key. accessToken is the token that the proof is sent with, it's
+// empty when the proof is sent to get token. Replay of the proof is not
+// checked here.
+func ReadDPoPProof(proof, method, htu, accessToken string) (*auth.DPoPProofPayload, error) {
+	var payload auth.DPoPProofPayload
+
+	keyFunc := func(jwtToken *jwt.Token) (interface{}, error) {
+		if typ, _ := jwtToken.Header["typ"].(string); typ != dpopProofType {
+			return nil, fmt.Errorf("dpop proof typ must be %s", dpopProofType)
+		}
+
+		rawJWK, ok := jwtToken.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("dpop proof doesn't has jwk header")
+		}
+		if _, ok := rawJWK["d"]; ok {
+			return nil, errors.New("jwk of dpop proof must not contain private key")
+		}
+
+		jwkBytes, err := json.Marshal(rawJWK)
+		if err != nil {
+			return nil, err
+		}
+		var jwk auth.JWK
+		err = json.Unmarshal(jwkBytes, &jwk)
+		if err != nil {
+			return nil, fmt.Errorf("jwk of dpop proof is invalid, msg: %v", err)
+		}
+
+		publicKey, err := password.ParseJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+
+		payload.JKT, err = password.KeyID(publicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return publicKey, nil
+	}
+
+	jwtToken, err := jwt.ParseWithClaims(proof, &payload, keyFunc, jwt.WithValidMethods(validMethods()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dpop proof, msg: %v", err)
+	}
+	if !jwtToken.Valid {
+		return nil, errors.New("dpop proof is not valid")
+	}
+
+	if payload.ID == "" {
+		return nil, errors.New("dpop proof doesn't has jti")
+	}
+	if payload.HTM != method {
+		return nil, errors.New("htm of dpop proof doesn't match the request method")
+	}
+	if normalizeHTU(payload.HTU) == "" || normalizeHTU(payload.HTU) != normalizeHTU(htu) {
+		return nil, errors.New("htu of dpop proof doesn't match the request url")
+	}
+
+	if payload.IssuedAt == nil {
+		return nil, errors.New("dpop proof doesn't has iat")
+	}
+	now := time.Now().UTC()
+	if payload.IssuedAt.After(now.Add(dpopClockSkew)) || payload.IssuedAt.Before(now.Add(-DPoPProofLifetime)) {
+		return nil, errors.New("dpop proof is expired or issued in the future")
+	}
+
+	if accessToken != "" && payload.ATH != DPoPAccessTokenHash(accessToken) {
+		return nil, errors.New("ath of dpop proof doesn't match the access token")
+	}
+
+	return &payload, nil
+}
+
+// normalizeHTU return the url without query and fragment, scheme and host is
+// case insensitive. Empty string is returned when the url is not absolute.
+func normalizeHTU(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath()
+}
+
+// DPoPRequestURL return the url of the request that is compared with htu of
+// DPoP proof, the scheme is taken from X-Forwarded-Proto when the service is
+// behind proxy.
+func DPoPRequestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host + r.URL.EscapedPath()
+}
+
+// CheckDPoPProofReplay save jti of DPoP proof, it return error when the proof
+// has been used before.
+func CheckDPoPProofReplay(client *redis.Client, ctx context.Context, jti string) error {
+	isNew, err := client.SetNX(ctx, "dpop "+jti, 1, DPoPProofLifetime+dpopClockSkew).Result()
+	if err != nil {
+		return err
+	}
+	if !isNew {
+		return errors.New("dpop proof has been used")
+	}
+
+	return nil
+}
+
+// verifyDPoP check the access token is sent with the right scheme, token that
+// is bound to DPoP key must be sent with DPoP scheme and valid proof of the
+// key, bearer token keep working without proof.
+func verifyDPoP(ctx context.Context, client *redis.Client, r *http.Request, authHeader string, payload *auth.JwtPayload) error {
+	scheme, token, _ := strings.Cut(authHeader, " ")
+
+	if payload.Cnf == nil {
+		if scheme == auth.AuthSchemeDPoP {
+			return errors.New("token is not bound to dpop key")
+		}
+		return nil
+	}
+
+	if scheme != auth.AuthSchemeDPoP {
+		return errors.New("token is bound to dpop key, it must be sent with DPoP scheme")
+	}
+
+	proof := r.Header.Get(DPoPHeader)
+	if proof == "" {
+		return errors.New("dpop proof is required")
+	}
+
+	dpopProof, err := ReadDPoPProof(proof, r.Method, DPoPRequestURL(r), token)
+	if err != nil {
+		return err
+	}
+	if dpopProof.JKT != payload.Cnf.JKT {
+		return errors.New("dpop proof is not signed with the key that the token is bound to")
+	}
+
+	return CheckDPoPProofReplay(client, ctx, dpopProof.ID)
+}
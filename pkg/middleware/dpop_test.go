@@ -0,0 +1,304 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
+	testUtils "github.com/dwiw96/ran-user-management/testutils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const htuTest = "https://auth.example.com/api/v1/auth/login"
+
+func TestReadDPoPProof(t *testing.T) {
+	for _, alg := range []string{password.SigningAlgES256, password.SigningAlgRS256, password.SigningAlgEdDSA} {
+		t.Run("success_"+alg, func(t *testing.T) {
+			privateKey, kid, err := password.GenerateSigningKey(alg)
+			require.NoError(t, err)
+
+			proof, err := CreateDPoPProof(privateKey, alg, http.MethodPost, htuTest, "")
+			require.NoError(t, err)
+
+			res, err := ReadDPoPProof(proof, http.MethodPost, htuTest, "")
+			require.NoError(t, err)
+			// kid of the key is its thumbprint too
+			assert.Equal(t, kid, res.JKT)
+			assert.NotEmpty(t, res.ID)
+			assert.Equal(t, http.MethodPost, res.HTM)
+			assert.Equal(t, htuTest, res.HTU)
+		})
+	}
+
+	privateKey, _, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+	otherKey, _, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+
+	t.Run("success_query_is_ignored", func(t *testing.T) {
+		proof, err := CreateDPoPProof(privateKey, password.SigningAlgES256, http.MethodGet, "HTTPS://Auth.Example.com/api/v1/auth/login", "")
+		require.NoError(t, err)
+
+		_, err = ReadDPoPProof(proof, http.MethodGet, htuTest+"?state=abc", "")
+		require.NoError(t, err)
+	})
+
+	t.Run("success_access_token_hash", func(t *testing.T) {
+		proof, err := CreateDPoPProof(privateKey, password.SigningAlgES256, http.MethodGet, htuTest, "access-token")
+		require.NoError(t, err)
+
+		res, err := ReadDPoPProof(proof, http.MethodGet, htuTest, "access-token")
+		require.NoError(t, err)
+		assert.Equal(t, DPoPAccessTokenHash("access-token"), res.ATH)
+
+		_, err = ReadDPoPProof(proof, http.MethodGet, htuTest, "other-access-token")
+		require.Error(t, err)
+	})
+
+	// signProof sign the claims with the header, so the proof can be made wrong
+	signProof := func(t *testing.T, claims pUsers.DPoPProofPayload, header map[string]interface{}) string {
+		jwk, err := password.PublicJWK("", "", privateKey.Public())
+		require.NoError(t, err)
+
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["typ"] = "dpop+jwt"
+		token.Header["jwk"] = jwk
+		for k, v := range header {
+			token.Header[k] = v
+		}
+		proof, err := token.SignedString(privateKey)
+		require.NoError(t, err)
+
+		return proof
+	}
+	validClaims := func() pUsers.DPoPProofPayload {
+		return pUsers.DPoPProofPayload{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:       generator.CreateRandomString(16),
+				IssuedAt: jwt.NewNumericDate(time.Now()),
+			},
+			HTM: http.MethodPost,
+			HTU: htuTest,
+		}
+	}
+
+	otherJWK, err := password.PublicJWK("", "", otherKey.Public())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc   string
+		claims func(claims *pUsers.DPoPProofPayload)
+		header map[string]interface{}
+		method string
+		htu    string
+	}{
+		{
+			desc:   "failed_method",
+			method: http.MethodGet,
+		}, {
+			desc: "failed_htu",
+			htu:  "https://auth.example.com/api/v1/auth/refresh_token",
+		}, {
+			desc: "failed_htu_other_host",
+			htu:  "https://evil.example.com/api/v1/auth/login",
+		}, {
+			desc:   "failed_without_jti",
+			claims: func(claims *pUsers.DPoPProofPayload) { claims.ID = "" },
+		}, {
+			desc:   "failed_without_iat",
+			claims: func(claims *pUsers.DPoPProofPayload) { claims.IssuedAt = nil },
+		}, {
+			desc: "failed_iat_too_old",
+			claims: func(claims *pUsers.DPoPProofPayload) {
+				claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(-DPoPProofLifetime - time.Minute))
+			},
+		}, {
+			desc: "failed_iat_in_the_future",
+			claims: func(claims *pUsers.DPoPProofPayload) {
+				claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(5 * time.Minute))
+			},
+		}, {
+			desc:   "failed_typ",
+			header: map[string]interface{}{"typ": "JWT"},
+		}, {
+			desc:   "failed_without_jwk",
+			header: map[string]interface{}{"jwk": nil},
+		}, {
+			desc:   "failed_jwk_of_other_key",
+			header: map[string]interface{}{"jwk": otherJWK},
+		}, {
+			desc: "failed_jwk_with_private_key",
+			header: map[string]interface{}{"jwk": map[string]interface{}{
+				"kty": "EC", "crv": "P-256", "x": "x", "y": "y", "d": "d",
+			}},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			claims := validClaims()
+			if tC.claims != nil {
+				tC.claims(&claims)
+			}
+			method, htu := http.MethodPost, htuTest
+			if tC.method != "" {
+				method = tC.method
+			}
+			if tC.htu != "" {
+				htu = tC.htu
+			}
+
+			res, err := ReadDPoPProof(signProof(t, claims, tC.header), method, htu, "")
+			require.Error(t, err)
+			assert.Nil(t, res)
+		})
+	}
+
+	t.Run("failed_hmac_proof", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+		token.Header["typ"] = "dpop+jwt"
+		proof, err := token.SignedString([]byte("secret"))
+		require.NoError(t, err)
+
+		_, err = ReadDPoPProof(proof, http.MethodPost, htuTest, "")
+		require.Error(t, err)
+	})
+}
+
+func TestDPoPRequestURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://auth.example.com/api/v1/auth/sessions?page=1", nil)
+	assert.Equal(t, "http://auth.example.com/api/v1/auth/sessions", DPoPRequestURL(req))
+
+	req.TLS = &tls.ConnectionState{}
+	assert.Equal(t, "https://auth.example.com/api/v1/auth/sessions", DPoPRequestURL(req))
+
+	req.TLS = nil
+	req.Header.Set("X-Forwarded-Proto", "https")
+	assert.Equal(t, "https://auth.example.com/api/v1/auth/sessions", DPoPRequestURL(req))
+}
+
+func TestAuthMiddlewareDPoP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	key, err := LoadKey(ctxTest, poolTest, testUtils.GetKeyEncryptionKey())
+	require.NoError(t, err)
+
+	user := pUsers.User{
+		Username: generator.CreateRandomString(7),
+		Email:    generator.CreateRandomEmail(generator.CreateRandomString(5)),
+	}
+	row := poolTest.QueryRow(ctxTest, "INSERT INTO users(email, username, hashed_password) VALUES ($1, $2, $3) RETURNING id;", user.Email, user.Username, generator.CreateRandomString(10))
+	err = row.Scan(&user.ID)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.GET("/api/v1/auth/sessions", AuthMiddleware(ctxTest, poolTest, clientTest, testUtils.GetKeyEncryptionKey(), "ran-user-management"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	htu := "http://example.com/api/v1/auth/sessions"
+
+	dpopKey, jkt, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+	otherKey, _, err := password.GenerateSigningKey(password.SigningAlgES256)
+	require.NoError(t, err)
+
+	claims := pUsers.SessionClaims{
+		Audience: []string{"ran-user-management"},
+		Cnf:      &pUsers.Confirmation{JKT: jkt},
+	}
+	dpopToken, _, err := CreateToken(user, 0, claims, 5*time.Minute, key)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(dpopToken, "DPoP "))
+	rawDPoPToken := strings.TrimPrefix(dpopToken, "DPoP ")
+
+	bearerToken, _, err := CreateToken(user, 0, pUsers.SessionClaims{Audience: claims.Audience}, 5*time.Minute, key)
+	require.NoError(t, err)
+
+	newProof := func(t *testing.T, privateKey crypto.Signer, method, accessToken string) string {
+		proof, err := CreateDPoPProof(privateKey, password.SigningAlgES256, method, htu, accessToken)
+		require.NoError(t, err)
+		return proof
+	}
+
+	replayedProof := newProof(t, dpopKey, http.MethodGet, rawDPoPToken)
+
+	testCases := []struct {
+		desc          string
+		authorization string
+		proof         string
+		code          int
+	}{
+		{
+			desc:          "success",
+			authorization: dpopToken,
+			proof:         replayedProof,
+			code:          http.StatusOK,
+		}, {
+			desc:          "success_bearer_token_without_proof",
+			authorization: "Bearer " + bearerToken,
+			code:          http.StatusOK,
+		}, {
+			desc:          "failed_replayed_proof",
+			authorization: dpopToken,
+			proof:         replayedProof,
+			code:          http.StatusUnauthorized,
+		}, {
+			desc:          "failed_without_proof",
+			authorization: dpopToken,
+			code:          http.StatusUnauthorized,
+		}, {
+			desc:          "failed_dpop_token_as_bearer",
+			authorization: "Bearer Bearer " + rawDPoPToken,
+			proof:         newProof(t, dpopKey, http.MethodGet, rawDPoPToken),
+			code:          http.StatusUnauthorized,
+		}, {
+			desc:          "failed_proof_of_other_key",
+			authorization: dpopToken,
+			proof:         newProof(t, otherKey, http.MethodGet, rawDPoPToken),
+			code:          http.StatusUnauthorized,
+		}, {
+			desc:          "failed_proof_of_other_method",
+			authorization: dpopToken,
+			proof:         newProof(t, dpopKey, http.MethodPost, rawDPoPToken),
+			code:          http.StatusUnauthorized,
+		}, {
+			desc:          "failed_proof_of_other_token",
+			authorization: dpopToken,
+			proof:         newProof(t, dpopKey, http.MethodGet, "other-access-token"),
+			code:          http.StatusUnauthorized,
+		}, {
+			desc:          "failed_bearer_token_with_dpop_scheme",
+			authorization: "DPoP " + strings.TrimPrefix(bearerToken, "Bearer "),
+			proof:         newProof(t, dpopKey, http.MethodGet, strings.TrimPrefix(bearerToken, "Bearer ")),
+			code:          http.StatusUnauthorized,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, htu, nil)
+			req.Header.Set("Authorization", tC.authorization)
+			if tC.proof != "" {
+				req.Header.Set(DPoPHeader, tC.proof)
+			}
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tC.code, w.Code)
+			if tC.code == http.StatusUnauthorized {
+				assert.Contains(t, w.Header().Get("WWW-Authenticate"), `DPoP error="invalid_dpop_proof"`)
+			}
+		})
+	}
+}
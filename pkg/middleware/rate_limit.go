@@ -0,0 +1,250 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	response "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitKeyFunc return the identity of the request that is limited.
+type RateLimitKeyFunc func(c *gin.Context) string
+
+// RateLimitByIP limit the request by IP of the client.
+func RateLimitByIP(c *gin.Context) string {
+	return "ip " + c.ClientIP()
+}
+
+// RateLimitByUser limit the request by user ID in payloadKey, it must be used
+// after AuthMiddleware. The request is limited by IP when there is no payload.
+func RateLimitByUser(c *gin.Context) string {
+	payload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+	if !isExists {
+		return RateLimitByIP(c)
+	}
+
+	return fmt.Sprintf("user %d", payload.UserID)
+}
+
+// RateLimitByClient limit the request by client ID in basic authentication or
+// in the form together with IP of the client. The client is not authenticated
+// yet, so the IP is part of the key, otherwise anyone can use the limit of
+// other client or send every request with new client ID. The request is
+// limited by IP when there is no client ID.
+func RateLimitByClient(c *gin.Context) string {
+	clientID, _, ok := c.Request.BasicAuth()
+	if !ok {
+		clientID = c.PostForm("client_id")
+	}
+	if clientID == "" {
+		return RateLimitByIP(c)
+	}
+
+	return "client " + clientID + " " + RateLimitByIP(c)
+}
+
+// rateLimitResult is the result of one request, Remaining is requests that
+// still can be sent at once, ResetAfter is the time until the limit is full
+// again and RetryAfter is the time until the denied request can be sent.
+type rateLimitResult struct {
+	Allowed    bool
+	Remaining  int64
+	ResetAfter time.Duration
+	RetryAfter time.Duration
+}
+
+// emissionInterval return time between two requests when the requests is
+// spread evenly, and the tolerance that allow Burst requests at once.
+func emissionInterval(limit cfg.RateLimit) (interval, tolerance time.Duration) {
+	interval = limit.Period / time.Duration(limit.Limit)
+	if interval <= 0 {
+		interval = time.Microsecond
+	}
+
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.Limit
+	}
+
+	return interval, interval * time.Duration(burst)
+}
+
+// gcra is generic cell rate algorithm, theoretical arrival time (TAT) of the
+// next request is saved instead of counter. Time is in microseconds from the
+// clock of redis, so every instance of the service use the same clock.
+var gcra = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if not tat or tat < now then
+	tat = now
+end
+local newTat = tat + interval
+local allowAt = newTat - tolerance
+if now < allowAt then
+	return {0, 0, tat - now, allowAt - now}
+end
+redis.call("SET", KEYS[1], newTat, "PX", math.ceil((newTat - now) / 1000))
+return {1, math.floor((now - allowAt) / interval), newTat - now, 0}
+`)
+
+// memoryRateLimiter is GCRA in the memory of the process, it's used when
+// redis is unreachable. Every instance of the service has its own limit.
+type memoryRateLimiter struct {
+	mu  sync.Mutex
+	tat map[string]time.Time
+	// time of the next cleanup of expired TAT
+	cleanupAt time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{tat: make(map[string]time.Time)}
+}
+
+func (m *memoryRateLimiter) allow(key string, limit cfg.RateLimit, now time.Time) rateLimitResult {
+	interval, tolerance := emissionInterval(limit)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.After(m.cleanupAt) {
+		for k, v := range m.tat {
+			if v.Before(now) {
+				delete(m.tat, k)
+			}
+		}
+		m.cleanupAt = now.Add(time.Minute)
+	}
+
+	tat, isExists := m.tat[key]
+	if !isExists || tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(interval)
+	allowAt := newTat.Add(-tolerance)
+	if now.Before(allowAt) {
+		return rateLimitResult{
+			ResetAfter: tat.Sub(now),
+			RetryAfter: allowAt.Sub(now),
+		}
+	}
+
+	m.tat[key] = newTat
+	return rateLimitResult{
+		Allowed:    true,
+		Remaining:  int64(now.Sub(allowAt) / interval),
+		ResetAfter: newTat.Sub(now),
+	}
+}
+
+// redis is not used for rateLimitRetryRedis after it fail, so every request
+// doesn't wait for the timeout when redis is down
+const (
+	rateLimitRedisTimeout = 200 * time.Millisecond
+	rateLimitRetryRedis   = 5 * time.Second
+)
+
+// RateLimiter limit the requests of route group in redis, the limit is
+// counted in the memory of the process when redis is unreachable.
+type RateLimiter struct {
+	client *redis.Client
+	limits cfg.RateLimitConfig
+	memory *memoryRateLimiter
+
+	mu sync.Mutex
+	// redis is skipped until this time after it fail
+	redisDownUntil time.Time
+}
+
+func NewRateLimiter(client *redis.Client, limits cfg.RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		client: client,
+		limits: limits,
+		memory: newMemoryRateLimiter(),
+	}
+}
+
+func (l *RateLimiter) allow(ctx context.Context, key string, limit cfg.RateLimit) rateLimitResult {
+	now := time.Now()
+	l.mu.Lock()
+	isRedisDown := now.Before(l.redisDownUntil)
+	l.mu.Unlock()
+	if isRedisDown {
+		return l.memory.allow(key, limit, now)
+	}
+
+	interval, tolerance := emissionInterval(limit)
+	ctx, cancel := context.WithTimeout(ctx, rateLimitRedisTimeout)
+	defer cancel()
+
+	values, err := gcra.Run(ctx, l.client, []string{key}, interval.Microseconds(), tolerance.Microseconds()).Int64Slice()
+	if err == nil && len(values) != 4 {
+		err = fmt.Errorf("unexpected result %v", values)
+	}
+	if err != nil {
+		log.Println("rate limit fall back to memory, redis err:", err)
+		l.mu.Lock()
+		l.redisDownUntil = now.Add(rateLimitRetryRedis)
+		l.mu.Unlock()
+		return l.memory.allow(key, limit, now)
+	}
+
+	return rateLimitResult{
+		Allowed:    values[0] == 1,
+		Remaining:  values[1],
+		ResetAfter: time.Duration(values[2]) * time.Microsecond,
+		RetryAfter: time.Duration(values[3]) * time.Microsecond,
+	}
+}
+
+// Limit limit the requests of the route group by identity that is returned by
+// key. RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset header is sent
+// in every response, the request over the limit is rejected with 429 and
+// Retry-After header. The request is not limited when the route group
+// doesn't have rate limit.
+func (l *RateLimiter) Limit(group string, key RateLimitKeyFunc) gin.HandlerFunc {
+	limit := l.limits[group]
+
+	return func(c *gin.Context) {
+		if limit.Limit <= 0 {
+			c.Next()
+			return
+		}
+
+		res := l.allow(c.Request.Context(), "rate_limit "+group+" "+key(c), limit)
+
+		burst := limit.Burst
+		if burst <= 0 {
+			burst = limit.Limit
+		}
+		c.Header("RateLimit-Limit", strconv.FormatInt(burst, 10))
+		c.Header("RateLimit-Remaining", strconv.FormatInt(res.Remaining, 10))
+		c.Header("RateLimit-Reset", strconv.FormatInt(ceilSeconds(res.ResetAfter), 10))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", limit.Limit, ceilSeconds(limit.Period), burst))
+
+		if !res.Allowed {
+			c.Header("Retry-After", strconv.FormatInt(max(ceilSeconds(res.RetryAfter), 1), 10))
+			response.ErrorJSON(c, 429, []string{"too many requests, please try again later"}, c.Request.RemoteAddr)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
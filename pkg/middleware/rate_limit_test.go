@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cfg "github.com/dwiw96/ran-user-management/config"
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+	generator "github.com/dwiw96/ran-user-management/pkg/utils/generator"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := newMemoryRateLimiter()
+	limit := cfg.RateLimit{Limit: 60, Period: time.Minute, Burst: 3}
+	now := time.Now()
+
+	// burst is allowed at once
+	for i := int64(2); i >= 0; i-- {
+		res := limiter.allow("key", limit, now)
+		require.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+
+	res := limiter.allow("key", limit, now)
+	require.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.ResetAfter)
+
+	// other key has its own limit
+	res = limiter.allow("other", limit, now)
+	assert.True(t, res.Allowed)
+
+	// one request is allowed again every interval
+	res = limiter.allow("key", limit, now.Add(time.Second))
+	require.True(t, res.Allowed)
+	assert.Zero(t, res.Remaining)
+
+	// the limit is full again after the reset
+	res = limiter.allow("key", limit, now.Add(time.Minute))
+	require.True(t, res.Allowed)
+	assert.Equal(t, int64(2), res.Remaining)
+}
+
+func rateLimitRouterTest(limiter *RateLimiter, key RateLimitKeyFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/", limiter.Limit(cfg.RateLimitGroupAuth, key), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	return router
+}
+
+func sendRateLimitRequestTest(router *gin.Engine, ip, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.RemoteAddr = ip + ":1234"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	limits := cfg.RateLimitConfig{cfg.RateLimitGroupAuth: {Limit: 2, Period: time.Hour}}
+	unreachableClient := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer unreachableClient.Close()
+
+	testCases := []struct {
+		desc   string
+		client *redis.Client
+	}{
+		{
+			desc:   "redis",
+			client: clientTest,
+		}, {
+			desc:   "fallback_memory",
+			client: unreachableClient,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			limiter := NewRateLimiter(tC.client, limits)
+			router := rateLimitRouterTest(limiter, RateLimitByIP)
+			ip := fmt.Sprintf("10.0.0.%d", generator.RandomInt32(1, 254))
+			if tC.client == clientTest {
+				require.NoError(t, clientTest.Del(ctxTest, "rate_limit auth ip "+ip).Err())
+			}
+
+			w := sendRateLimitRequestTest(router, ip, "")
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+			assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+			assert.Equal(t, "1800", w.Header().Get("RateLimit-Reset"))
+			assert.Equal(t, "2;w=3600;burst=2", w.Header().Get("RateLimit-Policy"))
+
+			w = sendRateLimitRequestTest(router, ip, "")
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+			w = sendRateLimitRequestTest(router, ip, "")
+			require.Equal(t, http.StatusTooManyRequests, w.Code)
+			assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+			assert.Equal(t, "1800", w.Header().Get("Retry-After"))
+
+			// other IP has its own limit
+			w = sendRateLimitRequestTest(router, "10.0.1.1", "")
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := NewRateLimiter(clientTest, cfg.RateLimitConfig{})
+	router := rateLimitRouterTest(limiter, RateLimitByIP)
+
+	for i := 0; i < 5; i++ {
+		w := sendRateLimitRequestTest(router, "10.0.2.1", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		desc   string
+		key    RateLimitKeyFunc
+		userID int32
+		ip     string
+		body   string
+		ans    string
+	}{
+		{
+			desc: "ip",
+			key:  RateLimitByIP,
+			ans:  "ip 10.0.3.1",
+		}, {
+			desc:   "user",
+			key:    RateLimitByUser,
+			userID: 3,
+			ans:    "user 3",
+		}, {
+			desc: "user_without_payload",
+			key:  RateLimitByUser,
+			ans:  "ip 10.0.3.1",
+		}, {
+			desc: "client",
+			key:  RateLimitByClient,
+			body: "client_id=web&client_secret=secret",
+			ans:  "client web ip 10.0.3.1",
+		}, {
+			desc: "client_other_ip",
+			key:  RateLimitByClient,
+			ip:   "10.0.3.2",
+			body: "client_id=web&client_secret=secret",
+			ans:  "client web ip 10.0.3.2",
+		}, {
+			desc: "client_without_client_id",
+			key:  RateLimitByClient,
+			ans:  "ip 10.0.3.1",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var res string
+			router := gin.New()
+			router.POST("/", func(c *gin.Context) {
+				if tC.userID != 0 {
+					c.Set("payloadKey", &pUsers.JwtPayload{UserID: tC.userID})
+				}
+				res = tC.key(c)
+			})
+
+			ip := tC.ip
+			if ip == "" {
+				ip = "10.0.3.1"
+			}
+			sendRateLimitRequestTest(router, ip, tC.body)
+			assert.Equal(t, tC.ans, res)
+		})
+	}
+}
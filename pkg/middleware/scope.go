@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+	response "github.com/dwiw96/ran-user-management/pkg/utils/responses"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireScopes allow the request only when the access token is granted all
+// the scopes, it must be used after AuthMiddleware. Token that doesn't have
+// the scopes is rejected with 403 (RFC 6750 section 3.1).
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+	required := strings.Join(scopes, " ")
+
+	return func(c *gin.Context) {
+		payload, isExists := c.Keys["payloadKey"].(*auth.JwtPayload)
+		if !isExists {
+			response.ErrorJSON(c, 401, []string{"token is wrong"}, c.Request.RemoteAddr)
+			c.Abort()
+			return
+		}
+
+		missing := MissingScopes(payload.Scope, scopes...)
+		if len(missing) > 0 {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, required))
+			response.ErrorJSON(c, 403, []string{fmt.Sprintf("token doesn't have required scope: %s", strings.Join(missing, " "))}, c.Request.RemoteAddr)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// MissingScopes return the scopes that is not in the space separated granted
+// scopes.
+func MissingScopes(granted string, scopes ...string) []string {
+	grantedScopes := strings.Fields(granted)
+
+	var res []string
+	for _, v := range scopes {
+		if !slices.Contains(grantedScopes, v) {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pUsers "github.com/dwiw96/ran-user-management/internal/features/users"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	testCases := []struct {
+		desc    string
+		payload *pUsers.JwtPayload
+		scopes  []string
+		code    int
+	}{
+		{
+			desc:    "success",
+			payload: &pUsers.JwtPayload{Scope: "users:read users:write"},
+			scopes:  []string{"users:write"},
+			code:    http.StatusOK,
+		}, {
+			desc:    "success_all_scopes",
+			payload: &pUsers.JwtPayload{Scope: "users:read users:write"},
+			scopes:  []string{"users:read", "users:write"},
+			code:    http.StatusOK,
+		}, {
+			desc:    "failed_missing_scope",
+			payload: &pUsers.JwtPayload{Scope: "users:read"},
+			scopes:  []string{"users:write"},
+			code:    http.StatusForbidden,
+		}, {
+			desc:    "failed_without_scope",
+			payload: &pUsers.JwtPayload{},
+			scopes:  []string{"users:read"},
+			code:    http.StatusForbidden,
+		}, {
+			desc:   "failed_without_payload",
+			scopes: []string{"users:read"},
+			code:   http.StatusUnauthorized,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", func(c *gin.Context) {
+				if tC.payload != nil {
+					c.Set("payloadKey", tC.payload)
+				}
+			}, RequireScopes(tC.scopes...), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tC.code, w.Code)
+			if tC.code == http.StatusForbidden {
+				assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+				assert.Contains(t, w.Body.String(), "token doesn't have required scope")
+			}
+		})
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	assert.Empty(t, MissingScopes("users:read users:write", "users:write"))
+	assert.Equal(t, []string{"admin"}, MissingScopes("users:read", "users:read", "admin"))
+	assert.Equal(t, []string{"users:read"}, MissingScopes("", "users:read"))
+}
@@ -0,0 +1,154 @@
+package password
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// cborMaxDepth is the deepest nested array and map that is decoded, WebAuthn
+// data is only few levels deep
+const cborMaxDepth = 16
+
+var errCBORTruncated = errors.New("cbor data is truncated")
+
+// decodeCBOR decode one CBOR (RFC 8949) item at the start of data and return
+// the bytes after it. Only the subset that WebAuthn use is supported: integer
+// as int64, byte string as []byte, text string as string, array as []any, map
+// as map[any]any with int64 or string key, bool and nil. Indefinite length
+// and float are rejected because CTAP2 canonical CBOR doesn't use them.
+func decodeCBOR(data []byte) (value any, rest []byte, err error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (value any, rest []byte, err error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor data is nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("cbor simple value %d is not supported", info)
+		}
+	}
+
+	arg, data, err := decodeCBORArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor integer is too large")
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor integer is too large")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return append([]byte(nil), data[:arg]...), data[arg:], nil
+	case 4:
+		// every item is at least one byte, so longer array is truncated
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		array := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			item, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, item)
+		}
+		return array, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, item any
+			key, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor map key %T is not supported", key)
+			}
+			if _, isExists := m[key]; isExists {
+				return nil, nil, fmt.Errorf("cbor map key %v is duplicated", key)
+			}
+			item, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = item
+		}
+		return m, data, nil
+	default:
+		return nil, nil, fmt.Errorf("cbor major type %d is not supported", major)
+	}
+}
+
+// decodeCBORArgument return the argument of the item head, it's the value of
+// integer or the length of string, array and map.
+func decodeCBORArgument(info byte, data []byte) (arg uint64, rest []byte, err error) {
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, nil, fmt.Errorf("cbor additional information %d is not supported", info)
+	}
+	if len(data) < size {
+		return 0, nil, errCBORTruncated
+	}
+
+	switch size {
+	case 1:
+		arg = uint64(data[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(data))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(data))
+	default:
+		arg = binary.BigEndian.Uint64(data)
+	}
+
+	return arg, data[size:], nil
+}
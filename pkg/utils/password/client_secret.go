@@ -0,0 +1,49 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// clientIDLength is number of random bytes in client id, client id is public
+// so it only need to be unique.
+const clientIDLength = 16
+
+// GenerateClientCredential return new client id and client secret of oauth
+// client. Client secret has the same entropy as refresh token, and only the
+// digest of the secret (HashClientSecret) must be saved.
+func GenerateClientCredential() (clientID, clientSecret string, err error) {
+	b := make([]byte, clientIDLength)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate client id, msg: %v", err)
+	}
+
+	clientSecret, err = GenerateRefreshToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate client secret, msg: %v", err)
+	}
+
+	return hex.EncodeToString(b), clientSecret, nil
+}
+
+// HashClientSecret return SHA-256 digest of client secret, the secret is
+// random generated so it doesn't need slow hash like user password.
+func HashClientSecret(clientSecret string) []byte {
+	digest := sha256.Sum256([]byte(clientSecret))
+	return digest[:]
+}
+
+// VerifyClientSecret compare the client secret with the saved digest in
+// constant time.
+func VerifyClientSecret(clientSecret string, hashedSecret []byte) error {
+	if clientSecret == "" || subtle.ConstantTimeCompare(HashClientSecret(clientSecret), hashedSecret) != 1 {
+		return errors.New("client secret is wrong")
+	}
+
+	return nil
+}
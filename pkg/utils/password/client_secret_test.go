@@ -0,0 +1,73 @@
+package password
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateClientCredential(t *testing.T) {
+	clientIDs := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		clientID, clientSecret, err := GenerateClientCredential()
+		require.NoError(t, err)
+
+		decoded, err := hex.DecodeString(clientID)
+		require.NoError(t, err)
+		assert.Len(t, decoded, clientIDLength)
+		assert.NotEmpty(t, clientSecret)
+		assert.NotEqual(t, clientID, clientSecret)
+
+		assert.False(t, clientIDs[clientID])
+		clientIDs[clientID] = true
+	}
+}
+
+func TestVerifyClientSecret(t *testing.T) {
+	_, clientSecret, err := GenerateClientCredential()
+	require.NoError(t, err)
+	hashed := HashClientSecret(clientSecret)
+	assert.Len(t, hashed, 32)
+
+	testCases := []struct {
+		desc   string
+		secret string
+		hashed []byte
+		err    bool
+	}{
+		{
+			desc:   "success",
+			secret: clientSecret,
+			hashed: hashed,
+			err:    false,
+		}, {
+			desc:   "failed_wrong_secret",
+			secret: clientSecret + "a",
+			hashed: hashed,
+			err:    true,
+		}, {
+			desc:   "failed_empty_secret",
+			secret: "",
+			hashed: HashClientSecret(""),
+			err:    true,
+		}, {
+			desc:   "failed_empty_hash",
+			secret: clientSecret,
+			hashed: nil,
+			err:    true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := VerifyClientSecret(tC.secret, tC.hashed)
+			if !tC.err {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -2,65 +2,413 @@ package password
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
+	"strconv"
 
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func JwtInit(conn *pgxpool.Pool, ctx context.Context) {
+// supported algorithm to sign jwt
+const (
+	SigningAlgRS256 = "RS256"
+	SigningAlgPS256 = "PS256"
+	SigningAlgES256 = "ES256"
+	SigningAlgEdDSA = "EdDSA"
+
+	DefaultSigningAlg = SigningAlgRS256
+)
+
+// JwtInit make sure there is active key to sign jwt with the algorithm alg.
+// When the active key is using other algorithm, the key is rotated, so token
+// signed with the previous key is still valid. Private key is saved encrypted
+// with the kek, key that is saved in plaintext before is encrypted here.
+func JwtInit(conn *pgxpool.Pool, ctx context.Context, alg string, kek *KeyEncryptionKey) {
 	var err error
-	privateKey, err := loadKey(conn, ctx) // temporary-should make as method
-	if privateKey == nil {
-		jwtSetPrivKey(conn, ctx)
+	err = sealPlaintextKeys(conn, ctx, kek)
+	if err != nil {
+		log.Println("--- [error](JwtInit) Failed to encrypt plaintext private key, msg:", err)
 	}
+
+	privateKey, keyAlg, err := loadKey(conn, ctx, kek) // temporary-should make as method
 	if err != nil {
 		log.Println(err)
 	}
+	if privateKey == nil {
+		jwtSetPrivKey(conn, ctx, alg, kek)
+		return
+	}
+
+	if keyAlg != alg {
+		log.Printf("signing algorithm is changed from %s to %s, rotate private key\n", keyAlg, alg)
+		jwtSetPrivKey(conn, ctx, alg, kek)
+		return
+	}
 
 	log.Println("private key already created")
 }
 
-func loadKey(conn *pgxpool.Pool, ctx context.Context) (key *rsa.PrivateKey, err error) {
-	q := "select private_key from sec_m"
-	var keyBytes []byte
+func loadKey(conn *pgxpool.Pool, ctx context.Context, kek *KeyEncryptionKey) (key crypto.Signer, alg string, err error) {
+	q := "select kid, alg, private_key, encrypted_dek, kek_id from sec_m where status = 'active'"
+	var kid, kekID string
+	var keyBytes, wrappedDEK []byte
 	rows := conn.QueryRow(ctx, q)
-	rows.Scan(&keyBytes)
+	rows.Scan(&kid, &alg, &keyBytes, &wrappedDEK, &kekID)
 	if keyBytes == nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return x509.ParsePKCS1PrivateKey(keyBytes)
+	key, err = kek.OpenPrivateKey(kid, kekID, keyBytes, wrappedDEK)
+	return key, alg, err
 }
 
-func jwtSetPrivKey(conn *pgxpool.Pool, ctx context.Context) {
+// sealPlaintextKeys encrypt private keys that is saved before the key is
+// encrypted at rest.
+func sealPlaintextKeys(conn *pgxpool.Pool, ctx context.Context, kek *KeyEncryptionKey) (err error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "SELECT kid, private_key FROM sec_m WHERE encrypted_dek IS NULL FOR UPDATE;")
+	if err != nil {
+		return err
+	}
+
+	plaintextKeys := make(map[string][]byte)
+	for rows.Next() {
+		var kid string
+		var keyBytes []byte
+		err = rows.Scan(&kid, &keyBytes)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		plaintextKeys[kid] = keyBytes
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for kid, keyBytes := range plaintextKeys {
+		privateKey, err := ParsePrivateKey(keyBytes)
+		if err != nil {
+			return err
+		}
+
+		sealedKey, wrappedDEK, err := kek.SealPrivateKey(kid, privateKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE sec_m SET private_key = $2, encrypted_dek = $3, kek_id = $4 WHERE kid = $1;", kid, sealedKey, wrappedDEK, kek.ID)
+		if err != nil {
+			return err
+		}
+		log.Println("private key is encrypted, kid:", kid)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RewrapKeys re-encrypt the DEK of all private keys and TOTP secrets from kek
+// to newKEK. After it's done, the service must be started with newKEK.
+func RewrapKeys(conn *pgxpool.Pool, ctx context.Context, kek, newKEK *KeyEncryptionKey) (count int, err error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	keyCount, err := rewrapRows(tx, ctx, kek, newKEK,
+		"SELECT kid, encrypted_dek, kek_id FROM sec_m WHERE kek_id <> $1 FOR UPDATE;",
+		"UPDATE sec_m SET encrypted_dek = $2, kek_id = $3 WHERE kid = $1;",
+		func(kid string) string { return kid })
+	if err != nil {
+		return 0, err
+	}
+
+	secretCount, err := rewrapRows(tx, ctx, kek, newKEK,
+		"SELECT user_id::TEXT, encrypted_dek, kek_id FROM user_totp WHERE kek_id <> $1 FOR UPDATE;",
+		"UPDATE user_totp SET encrypted_dek = $2, kek_id = $3 WHERE user_id = $1::INT;",
+		func(userID string) string {
+			id, _ := strconv.ParseInt(userID, 10, 32)
+			return TOTPSecretID(int32(id))
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return keyCount + secretCount, nil
+}
+
+// rewrapRows re-encrypt the DEK of every row that is selected by selectQuery,
+// the row is the key of the row, the wrapped DEK and the KEK ID. sealedID
+// return the id that the secret of the row is sealed with.
+func rewrapRows(tx pgx.Tx, ctx context.Context, kek, newKEK *KeyEncryptionKey, selectQuery, updateQuery string, sealedID func(key string) string) (count int, err error) {
+	rows, err := tx.Query(ctx, selectQuery, newKEK.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	type wrappedKey struct {
+		key        string
+		wrappedDEK []byte
+		kekID      string
+	}
+	var wrappedKeys []wrappedKey
+	for rows.Next() {
+		var i wrappedKey
+		err = rows.Scan(&i.key, &i.wrappedDEK, &i.kekID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		wrappedKeys = append(wrappedKeys, i)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, v := range wrappedKeys {
+		newWrappedDEK, err := kek.Rewrap(sealedID(v.key), v.kekID, v.wrappedDEK, newKEK)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.Exec(ctx, updateQuery, v.key, newWrappedDEK, newKEK.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(wrappedKeys), nil
+}
+
+func jwtSetPrivKey(conn *pgxpool.Pool, ctx context.Context, alg string, kek *KeyEncryptionKey) {
 	log.Println("Set private key for jwt")
-	privateKeyTest := generatePrivateKey()
-	err := insertKeyToDatabase(privateKeyTest, conn, ctx)
+	privateKeyTest, kid, err := GenerateSigningKey(alg)
+	if err != nil {
+		log.Println("--- [error](JwtSetPrivKey) Failed to generate private key, msg:", err)
+		return
+	}
+	err = insertKeyToDatabase(kid, alg, privateKeyTest, kek, conn, ctx)
 	if err != nil {
 		log.Println("--- [error](JwtSetPrivKey) Failed to insert private key to database, msg:", err)
 	}
 }
 
-func generatePrivateKey() *rsa.PrivateKey {
-	log.Println("<- generate private key")
-	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// GenerateSigningKey generate new private key with the type that is needed by
+// the algorithm alg and its key id (kid)
+func GenerateSigningKey(alg string) (privateKey crypto.Signer, kid string, err error) {
+	log.Println("<- generate private key, alg:", alg)
+	switch alg {
+	case SigningAlgRS256, SigningAlgPS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case SigningAlgES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case SigningAlgEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("signing algorithm %q is not supported", alg)
+	}
 	if err != nil {
-		log.Println("--- [error](GeneratePrivateKey) :", err)
+		log.Println("--- [error](GenerateSigningKey) :", err)
+		return nil, "", err
 	}
 	log.Println("-> generate private key is done")
-	return privKey
+
+	kid, err = KeyID(privateKey.Public())
+	if err != nil {
+		return nil, "", err
+	}
+
+	return privateKey, kid, nil
+}
+
+// MarshalPrivateKey encode the private key in PKCS8 form to be saved
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+// ParsePrivateKey decode private key that is saved in PKCS8 form, key that is
+// saved in PKCS1 form before PKCS8 is used is still accepted.
+func ParsePrivateKey(keyBytes []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	if err != nil {
+		rsaKey, errPKCS1 := x509.ParsePKCS1PrivateKey(keyBytes)
+		if errPKCS1 != nil {
+			return nil, fmt.Errorf("failed to parse private key, msg: %v", err)
+		}
+		return rsaKey, nil
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key can't be used to sign")
+	}
+
+	return signer, nil
+}
+
+// PublicJWK return the public key in JWK format (RFC 7517)
+func PublicJWK(kid, alg string, publicKey crypto.PublicKey) (jwk auth.JWK, err error) {
+	jwk = auth.JWK{
+		Use: "sig",
+		Alg: alg,
+		Kid: kid,
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return jwk, errors.New("only P-256 curve is supported")
+		}
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return jwk, err
+		}
+		// uncompressed point is 0x04 || x || y
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(point[1 : 1+size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(point[1+size:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		return jwk, fmt.Errorf("public key type %T is not supported", publicKey)
+	}
+
+	return jwk, nil
 }
 
-func insertKeyToDatabase(privateKey *rsa.PrivateKey, conn *pgxpool.Pool, ctx context.Context) (err error) {
-	query := "INSERT INTO sec_m(private_key) VALUES($1);"
+// ParseJWK return the public key of the JWK, it's the reverse of PublicJWK.
+func ParseJWK(jwk auth.JWK) (publicKey crypto.PublicKey, err error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil || len(n) == 0 {
+			return nil, errors.New("rsa jwk has invalid n")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("rsa jwk has invalid e")
+		}
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("rsa key must be at least 2048 bits")
+		}
+		return key, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errors.New("only P-256 curve is supported")
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("ec jwk has invalid x or y")
+		}
+		// the point must be on the curve
+		_, err = ecdh.P256().NewPublicKey(append(append([]byte{0x04}, x...), y...))
+		if err != nil {
+			return nil, fmt.Errorf("ec jwk is not valid, msg: %v", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, errors.New("only Ed25519 curve is supported")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("okp jwk has invalid x")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("jwk key type %q is not supported", jwk.Kty)
+	}
+}
 
-	newKeyInbyte := x509.MarshalPKCS1PrivateKey(privateKey)
+// KeyID return the JWK thumbprint (RFC 7638) of the public key, it's used as
+// kid so the same key always has the same id.
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	jwk, err := PublicJWK("", "", publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	// only required members, in lexicographic order and without whitespace
+	var members string
+	switch jwk.Kty {
+	case "RSA":
+		members = `{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`
+	case "EC":
+		members = `{"crv":"` + jwk.Crv + `","kty":"EC","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`
+	case "OKP":
+		members = `{"crv":"` + jwk.Crv + `","kty":"OKP","x":"` + jwk.X + `"}`
+	}
+	thumbprint := sha256.Sum256([]byte(members))
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:]), nil
+}
+
+func insertKeyToDatabase(kid, alg string, privateKey crypto.Signer, kek *KeyEncryptionKey, conn *pgxpool.Pool, ctx context.Context) (err error) {
+	newKeyInbyte, wrappedDEK, err := kek.SealPrivateKey(kid, privateKey)
+	if err != nil {
+		return err
+	}
 
-	res, err := conn.Exec(ctx, query, newKeyInbyte)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// previous active key is kept to verify token that signed with it
+	_, err = tx.Exec(ctx, "UPDATE sec_m SET status = 'verifying' WHERE status = 'active';")
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO sec_m(kid, private_key, encrypted_dek, kek_id, alg, status) VALUES($1, $2, $3, $4, $5, 'active');"
+	res, err := tx.Exec(ctx, query, kid, newKeyInbyte, wrappedDEK, kek.ID, alg)
 	if err != nil {
 		log.Println(err.Error())
 		return err
@@ -71,6 +419,11 @@ func insertKeyToDatabase(privateKey *rsa.PrivateKey, conn *pgxpool.Pool, ctx con
 		return fmt.Errorf("no rows affected")
 	}
 
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
 	log.Println("private key saved!")
 
 	return err
@@ -0,0 +1,143 @@
+package password
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	auth "github.com/dwiw96/ran-user-management/internal/features/users"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyID(t *testing.T) {
+	t.Run("rsa", func(t *testing.T) {
+		// example key of RFC 7638 section 3.1
+		n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+		require.NoError(t, err)
+
+		publicKey := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: 65537,
+		}
+
+		res, err := KeyID(publicKey)
+		require.NoError(t, err)
+		assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", res)
+	})
+
+	t.Run("ed25519", func(t *testing.T) {
+		// example key of RFC 8037 appendix A.3
+		x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+		require.NoError(t, err)
+
+		res, err := KeyID(ed25519.PublicKey(x))
+		require.NoError(t, err)
+		assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", res)
+	})
+}
+
+func TestGenerateSigningKey(t *testing.T) {
+	testCases := []struct {
+		alg string
+		kty string
+		err bool
+	}{
+		{alg: SigningAlgRS256, kty: "RSA"},
+		{alg: SigningAlgPS256, kty: "RSA"},
+		{alg: SigningAlgES256, kty: "EC"},
+		{alg: SigningAlgEdDSA, kty: "OKP"},
+		{alg: "HS256", err: true},
+		{alg: "none", err: true},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.alg, func(t *testing.T) {
+			key, kid, err := GenerateSigningKey(tC.alg)
+			if tC.err {
+				require.Error(t, err)
+				assert.Nil(t, key)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, key)
+
+			keyID, err := KeyID(key.Public())
+			require.NoError(t, err)
+			assert.Equal(t, keyID, kid)
+
+			jwk, err := PublicJWK(kid, tC.alg, key.Public())
+			require.NoError(t, err)
+			assert.Equal(t, tC.kty, jwk.Kty)
+			assert.Equal(t, tC.alg, jwk.Alg)
+			assert.Equal(t, kid, jwk.Kid)
+
+			publicKey, err := ParseJWK(jwk)
+			require.NoError(t, err)
+			assert.Equal(t, key.Public(), publicKey)
+
+			// key is saved in PKCS8 form
+			keyBytes, err := MarshalPrivateKey(key)
+			require.NoError(t, err)
+			res, err := ParsePrivateKey(keyBytes)
+			require.NoError(t, err)
+			assert.Equal(t, key.Public(), res.Public())
+		})
+	}
+}
+
+func TestParseJWK(t *testing.T) {
+	testCases := []struct {
+		desc string
+		jwk  auth.JWK
+	}{
+		{
+			desc: "failed_unknown_kty",
+			jwk:  auth.JWK{Kty: "oct"},
+		}, {
+			desc: "failed_rsa_without_n",
+			jwk:  auth.JWK{Kty: "RSA", E: "AQAB"},
+		}, {
+			desc: "failed_rsa_short_key",
+			jwk:  auth.JWK{Kty: "RSA", N: base64.RawURLEncoding.EncodeToString(make([]byte, 64)), E: "AQAB"},
+		}, {
+			desc: "failed_ec_other_curve",
+			jwk:  auth.JWK{Kty: "EC", Crv: "P-384"},
+		}, {
+			desc: "failed_ec_point_not_on_curve",
+			jwk: auth.JWK{
+				Kty: "EC",
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(make([]byte, 32)),
+				Y:   base64.RawURLEncoding.EncodeToString(make([]byte, 32)),
+			},
+		}, {
+			desc: "failed_okp_invalid_x",
+			jwk:  auth.JWK{Kty: "OKP", Crv: "Ed25519", X: "AQAB"},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, err := ParseJWK(tC.jwk)
+			require.Error(t, err)
+			assert.Nil(t, res)
+		})
+	}
+}
+
+func TestParsePrivateKeyPKCS1(t *testing.T) {
+	key, _, err := GenerateSigningKey(SigningAlgRS256)
+	require.NoError(t, err)
+
+	res, err := ParsePrivateKey(x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey)))
+	require.NoError(t, err)
+	assert.Equal(t, key.Public(), res.Public())
+
+	_, err = ParsePrivateKey([]byte("not a key"))
+	require.Error(t, err)
+}
@@ -0,0 +1,199 @@
+package password
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// kekLength is the length of key-encryption key, 32 bytes is AES-256
+const kekLength = 32
+
+// KeyEncryptionKey (KEK) encrypt the data-encryption key (DEK) of every jwt
+// private key in sec_m (envelope encryption), so the private key is never
+// saved in plaintext and the KEK can be changed by re-wrapping only the DEK.
+type KeyEncryptionKey struct {
+	// ID is saved with the wrapped DEK to know which KEK is used to wrap it
+	ID   string
+	aead cipher.AEAD
+}
+
+func NewKeyEncryptionKey(key []byte) (*KeyEncryptionKey, error) {
+	if len(key) != kekLength {
+		return nil, fmt.Errorf("key-encryption key must be %d bytes, got %d bytes", kekLength, len(key))
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(key)
+
+	return &KeyEncryptionKey{
+		ID:   hex.EncodeToString(digest[:8]),
+		aead: aead,
+	}, nil
+}
+
+// LoadKeyEncryptionKey read base64 encoded KEK from value, or from the file at
+// path when value is empty.
+func LoadKeyEncryptionKey(value, path string) (*KeyEncryptionKey, error) {
+	if value == "" && path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key-encryption key file, msg: %v", err)
+		}
+		value = string(content)
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, errors.New("key-encryption key is not set")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("key-encryption key must be base64 encoded, msg: %v", err)
+	}
+
+	return NewKeyEncryptionKey(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypt the plaintext with AES-GCM, the result is nonce || ciphertext.
+// kid is used as additional data so sealed value can't be moved to other key.
+func seal(aead cipher.AEAD, plaintext []byte, kid string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, []byte(kid)), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, kid string) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(kid))
+}
+
+// SealSecret encrypt the secret with new random DEK, and the DEK is encrypted
+// (wrapped) with the KEK. id is used as additional data, so the sealed secret
+// can only be opened with the same id.
+func (k *KeyEncryptionKey) SealSecret(id string, secret []byte) (sealed, wrappedDEK []byte, err error) {
+	dek := make([]byte, kekLength)
+	_, err = rand.Read(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dekAEAD, err := newAEAD(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed, err = seal(dekAEAD, secret, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrappedDEK, err = seal(k.aead, dek, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sealed, wrappedDEK, nil
+}
+
+// OpenSecret decrypt the secret that is sealed by SealSecret, kekID is the ID
+// of the KEK that wrapped the DEK.
+func (k *KeyEncryptionKey) OpenSecret(id, kekID string, sealed, wrappedDEK []byte) ([]byte, error) {
+	err := k.checkID(id, kekID)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := open(k.aead, wrappedDEK, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data-encryption key, id: %s, msg: %v", id, err)
+	}
+
+	dekAEAD, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := open(dekAEAD, sealed, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret, id: %s, msg: %v", id, err)
+	}
+
+	return secret, nil
+}
+
+// SealPrivateKey encrypt the private key with SealSecret, kid is the id of the
+// sealed key.
+func (k *KeyEncryptionKey) SealPrivateKey(kid string, privateKey crypto.Signer) (sealedKey, wrappedDEK []byte, err error) {
+	keyBytes, err := MarshalPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return k.SealSecret(kid, keyBytes)
+}
+
+func (k *KeyEncryptionKey) checkID(id, kekID string) error {
+	if kekID != k.ID {
+		return fmt.Errorf("%s is wrapped with other key-encryption key (%s), current key-encryption key is %s", id, kekID, k.ID)
+	}
+
+	return nil
+}
+
+// OpenPrivateKey decrypt the private key that is sealed by SealPrivateKey,
+// kekID is the ID of the KEK that wrapped the DEK.
+func (k *KeyEncryptionKey) OpenPrivateKey(kid, kekID string, sealedKey, wrappedDEK []byte) (crypto.Signer, error) {
+	keyBytes, err := k.OpenSecret(kid, kekID, sealedKey, wrappedDEK)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePrivateKey(keyBytes)
+}
+
+// Rewrap decrypt the DEK with the KEK and encrypt it with newKEK, the sealed
+// private key or secret is not changed.
+func (k *KeyEncryptionKey) Rewrap(id, kekID string, wrappedDEK []byte, newKEK *KeyEncryptionKey) ([]byte, error) {
+	err := k.checkID(id, kekID)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := open(k.aead, wrappedDEK, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data-encryption key, id: %s, msg: %v", id, err)
+	}
+
+	return seal(newKEK.aead, dek, id)
+}
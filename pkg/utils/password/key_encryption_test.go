@@ -0,0 +1,174 @@
+package password
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKeyEncryptionKeyTest(t *testing.T) *KeyEncryptionKey {
+	key := make([]byte, kekLength)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	kek, err := NewKeyEncryptionKey(key)
+	require.NoError(t, err)
+	require.NotEmpty(t, kek.ID)
+
+	return kek
+}
+
+func TestLoadKeyEncryptionKey(t *testing.T) {
+	key := make([]byte, kekLength)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	path := filepath.Join(t.TempDir(), "kek")
+	err = os.WriteFile(path, []byte(encoded+"\n"), 0600)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		value string
+		path  string
+		err   bool
+	}{
+		{
+			name:  "success_value",
+			value: encoded,
+			err:   false,
+		}, {
+			name: "success_file",
+			path: path,
+			err:  false,
+		}, {
+			name:  "success_value_is_prioritized",
+			value: encoded,
+			path:  filepath.Join(t.TempDir(), "not_exists"),
+			err:   false,
+		}, {
+			name: "error_empty",
+			err:  true,
+		}, {
+			name: "error_file_not_exists",
+			path: filepath.Join(t.TempDir(), "not_exists"),
+			err:  true,
+		}, {
+			name:  "error_not_base64",
+			value: "not base64 !",
+			err:   true,
+		}, {
+			name:  "error_wrong_length",
+			value: base64.StdEncoding.EncodeToString(key[:16]),
+			err:   true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.name, func(t *testing.T) {
+			res, err := LoadKeyEncryptionKey(tC.value, tC.path)
+			if !tC.err {
+				require.NoError(t, err)
+				require.NotNil(t, res)
+			} else {
+				require.Error(t, err)
+				assert.Nil(t, res)
+			}
+		})
+	}
+}
+
+func TestSealPrivateKey(t *testing.T) {
+	kek := newKeyEncryptionKeyTest(t)
+
+	privateKey, kid, err := GenerateSigningKey(SigningAlgES256)
+	require.NoError(t, err)
+
+	sealedKey, wrappedDEK, err := kek.SealPrivateKey(kid, privateKey)
+	require.NoError(t, err)
+
+	// private key is not saved in plaintext
+	_, err = ParsePrivateKey(sealedKey)
+	require.Error(t, err)
+
+	t.Run("success", func(t *testing.T) {
+		res, err := kek.OpenPrivateKey(kid, kek.ID, sealedKey, wrappedDEK)
+		require.NoError(t, err)
+		assert.Equal(t, privateKey.Public(), res.Public())
+	})
+
+	t.Run("error_other_kid", func(t *testing.T) {
+		res, err := kek.OpenPrivateKey("other", kek.ID, sealedKey, wrappedDEK)
+		require.Error(t, err)
+		assert.Nil(t, res)
+	})
+
+	t.Run("error_other_kek", func(t *testing.T) {
+		otherKEK := newKeyEncryptionKeyTest(t)
+
+		res, err := otherKEK.OpenPrivateKey(kid, kek.ID, sealedKey, wrappedDEK)
+		require.Error(t, err)
+		assert.Nil(t, res)
+
+		res, err = otherKEK.OpenPrivateKey(kid, otherKEK.ID, sealedKey, wrappedDEK)
+		require.Error(t, err)
+		assert.Nil(t, res)
+	})
+
+	t.Run("error_tampered", func(t *testing.T) {
+		tampered := append([]byte{}, sealedKey...)
+		tampered[len(tampered)-1] ^= 1
+
+		res, err := kek.OpenPrivateKey(kid, kek.ID, tampered, wrappedDEK)
+		require.Error(t, err)
+		assert.Nil(t, res)
+	})
+}
+
+func TestSealSecret(t *testing.T) {
+	kek := newKeyEncryptionKeyTest(t)
+	secret := []byte("12345678901234567890")
+
+	sealed, wrappedDEK, err := kek.SealSecret(TOTPSecretID(1), secret)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), string(secret))
+
+	res, err := kek.OpenSecret(TOTPSecretID(1), kek.ID, sealed, wrappedDEK)
+	require.NoError(t, err)
+	assert.Equal(t, secret, res)
+
+	// sealed secret can't be moved to other user
+	res, err = kek.OpenSecret(TOTPSecretID(2), kek.ID, sealed, wrappedDEK)
+	require.Error(t, err)
+	assert.Nil(t, res)
+}
+
+func TestRewrap(t *testing.T) {
+	kek := newKeyEncryptionKeyTest(t)
+	newKEK := newKeyEncryptionKeyTest(t)
+
+	privateKey, kid, err := GenerateSigningKey(SigningAlgEdDSA)
+	require.NoError(t, err)
+
+	sealedKey, wrappedDEK, err := kek.SealPrivateKey(kid, privateKey)
+	require.NoError(t, err)
+
+	newWrappedDEK, err := kek.Rewrap(kid, kek.ID, wrappedDEK, newKEK)
+	require.NoError(t, err)
+
+	res, err := newKEK.OpenPrivateKey(kid, newKEK.ID, sealedKey, newWrappedDEK)
+	require.NoError(t, err)
+	assert.Equal(t, privateKey.Public(), res.Public())
+
+	_, err = kek.OpenPrivateKey(kid, kek.ID, sealedKey, newWrappedDEK)
+	require.Error(t, err)
+
+	_, err = newKEK.Rewrap(kid, kek.ID, wrappedDEK, kek)
+	require.Error(t, err)
+}
@@ -0,0 +1,44 @@
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// LoginCodeDigits is number of digits of the code in magic link email
+const LoginCodeDigits = 6
+
+// GenerateLoginCode return random numeric code that is typed by the user, the
+// code has leading zero so it's always LoginCodeDigits long.
+func GenerateLoginCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < LoginCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate login code, msg: %v", err)
+	}
+
+	return fmt.Sprintf("%0*d", LoginCodeDigits, n), nil
+}
+
+// HashLoginCode return HMAC-SHA256 of the code with the key. The code is short
+// so it's keyed by the digest of the magic link token, then the digest of the
+// code can't be looked up in table of all codes without the token.
+func HashLoginCode(key []byte, code string) []byte {
+	code = strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(code))
+	return mac.Sum(nil)
+}
+
+// VerifyLoginCode check the code with the digest in constant time.
+func VerifyLoginCode(key []byte, code string, codeHash []byte) bool {
+	return hmac.Equal(HashLoginCode(key, code), codeHash)
+}
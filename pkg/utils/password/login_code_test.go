@@ -0,0 +1,55 @@
+package password
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginCode(t *testing.T) {
+	codes := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		code, err := GenerateLoginCode()
+		require.NoError(t, err)
+		assert.Regexp(t, `^[0-9]{6}$`, code)
+		codes[code] = true
+	}
+	assert.Greater(t, len(codes), 1)
+
+	key := HashRefreshToken("token")
+	codeHash := HashLoginCode(key, "012345")
+
+	testCases := []struct {
+		desc string
+		key  []byte
+		code string
+		ok   bool
+	}{
+		{
+			desc: "success",
+			key:  key,
+			code: "012345",
+			ok:   true,
+		}, {
+			desc: "success_formatted",
+			key:  key,
+			code: " 012-345 ",
+			ok:   true,
+		}, {
+			desc: "failed_wrong_code",
+			key:  key,
+			code: "012346",
+		}, {
+			desc: "failed_wrong_key",
+			key:  HashRefreshToken("other token"),
+			code: "012345",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, tC.ok, VerifyLoginCode(tC.key, tC.code, codeHash))
+		})
+	}
+}
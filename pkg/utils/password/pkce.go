@@ -0,0 +1,64 @@
+package password
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// CodeChallengeMethodS256 is the only PKCE method that is supported, plain
+// method is not allowed by OAuth 2.1.
+const CodeChallengeMethodS256 = "S256"
+
+// code verifier and S256 code challenge use unreserved characters and must be
+// 43-128 characters long (RFC 7636 section 4.1)
+var pkceValue = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// GenerateAuthorizationCode return new one-time authorization code, it has
+// the same entropy as refresh token and only its digest must be saved.
+func GenerateAuthorizationCode() (string, error) {
+	code, err := GenerateRefreshToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate authorization code, msg: %v", err)
+	}
+
+	return code, nil
+}
+
+// ValidateCodeChallenge check the code challenge that is sent in authorization request.
+func ValidateCodeChallenge(challenge, method string) error {
+	if method != CodeChallengeMethodS256 {
+		return fmt.Errorf("code challenge method must be %s", CodeChallengeMethodS256)
+	}
+	if !pkceValue.MatchString(challenge) {
+		return errors.New("code challenge is not valid")
+	}
+
+	return nil
+}
+
+// CodeChallengeS256 return S256 code challenge of the code verifier.
+func CodeChallengeS256(verifier string) string {
+	digest := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// VerifyCodeVerifier check the code verifier that is sent in token request
+// against the code challenge of the authorization code.
+func VerifyCodeVerifier(verifier, challenge, method string) error {
+	if !pkceValue.MatchString(verifier) {
+		return errors.New("code verifier is not valid")
+	}
+	if method != CodeChallengeMethodS256 {
+		return fmt.Errorf("code challenge method must be %s", CodeChallengeMethodS256)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(CodeChallengeS256(verifier)), []byte(challenge)) != 1 {
+		return errors.New("code verifier doesn't match code challenge")
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeChallengeS256(t *testing.T) {
+	// example from RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallengeS256(verifier))
+}
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	verifier, err := GenerateAuthorizationCode()
+	require.NoError(t, err)
+	challenge := CodeChallengeS256(verifier)
+
+	err = ValidateCodeChallenge(challenge, CodeChallengeMethodS256)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc      string
+		verifier  string
+		challenge string
+		method    string
+		err       bool
+	}{
+		{
+			desc:      "success",
+			verifier:  verifier,
+			challenge: challenge,
+			method:    CodeChallengeMethodS256,
+			err:       false,
+		}, {
+			desc:      "failed_wrong_verifier",
+			verifier:  verifier[1:] + "a",
+			challenge: challenge,
+			method:    CodeChallengeMethodS256,
+			err:       true,
+		}, {
+			desc:      "failed_plain_method",
+			verifier:  verifier,
+			challenge: verifier,
+			method:    "plain",
+			err:       true,
+		}, {
+			desc:      "failed_short_verifier",
+			verifier:  verifier[:42],
+			challenge: CodeChallengeS256(verifier[:42]),
+			method:    CodeChallengeMethodS256,
+			err:       true,
+		}, {
+			desc:      "failed_long_verifier",
+			verifier:  strings.Repeat("a", 129),
+			challenge: CodeChallengeS256(strings.Repeat("a", 129)),
+			method:    CodeChallengeMethodS256,
+			err:       true,
+		}, {
+			desc:      "failed_invalid_character",
+			verifier:  verifier[1:] + "+",
+			challenge: CodeChallengeS256(verifier[1:] + "+"),
+			method:    CodeChallengeMethodS256,
+			err:       true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := VerifyCodeVerifier(tC.verifier, tC.challenge, tC.method)
+			if !tC.err {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	err = ValidateCodeChallenge(verifier, "plain")
+	assert.Error(t, err)
+	err = ValidateCodeChallenge("abc", CodeChallengeMethodS256)
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// length of password is limited by bcrypt, bcrypt ignore bytes after the 72nd
+// byte, so longer password would be accepted with only its prefix.
+const (
+	PasswordMinLength = 8
+	PasswordMaxLength = 72
+)
+
+// commonPasswords is the passwords that are tried first by password guessing,
+// they're rejected even when they're long enough
+var commonPasswords = map[string]bool{
+	"password":    true,
+	"password1":   true,
+	"password123": true,
+	"12345678":    true,
+	"123456789":   true,
+	"1234567890":  true,
+	"qwertyuiop":  true,
+	"qwerty123":   true,
+	"iloveyou":    true,
+	"11111111":    true,
+	"00000000":    true,
+	"abc12345":    true,
+	"letmein1":    true,
+	"welcome1":    true,
+	"admin123":    true,
+	"sunshine":    true,
+	"football":    true,
+	"baseball":    true,
+	"superman":    true,
+	"trustno1":    true,
+}
+
+// ValidatePasswordPolicy check new password of the user. Password is checked
+// by its length instead of its characters, but it must not be common password
+// or the same as personal info of the user such as username or email.
+func ValidatePasswordPolicy(password string, personalInfo ...string) error {
+	if len([]rune(password)) < PasswordMinLength {
+		return fmt.Errorf("password must be at least %d characters", PasswordMinLength)
+	}
+	if len(password) > PasswordMaxLength {
+		return fmt.Errorf("password must be at most %d bytes", PasswordMaxLength)
+	}
+	if strings.TrimFunc(password, unicode.IsSpace) == "" {
+		return errors.New("password must not be only spaces")
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return errors.New("password is too common")
+	}
+	for _, v := range personalInfo {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		// local part of email is checked too
+		if local, _, ok := strings.Cut(v, "@"); ok && lower == local {
+			return errors.New("password must not be the same as username or email")
+		}
+		if lower == v {
+			return errors.New("password must not be the same as username or email")
+		}
+	}
+
+	return nil
+}
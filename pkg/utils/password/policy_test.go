@@ -0,0 +1,68 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePasswordPolicy(t *testing.T) {
+	personalInfo := []string{"gracehopper", "grace.hopper@mail.com"}
+
+	testCases := []struct {
+		desc     string
+		password string
+		err      bool
+	}{
+		{
+			desc:     "success",
+			password: "correct horse battery",
+		}, {
+			desc:     "success_max_length",
+			password: strings.Repeat("a", PasswordMaxLength),
+		}, {
+			desc:     "success_multibyte",
+			password: "pässwörd-ü",
+		}, {
+			desc:     "failed_too_short",
+			password: "abc123",
+			err:      true,
+		}, {
+			desc:     "failed_too_long",
+			password: strings.Repeat("a", PasswordMaxLength+1),
+			err:      true,
+		}, {
+			desc:     "failed_only_spaces",
+			password: strings.Repeat(" ", PasswordMinLength),
+			err:      true,
+		}, {
+			desc:     "failed_common_password",
+			password: "Password123",
+			err:      true,
+		}, {
+			desc:     "failed_same_as_username",
+			password: "GraceHopper",
+			err:      true,
+		}, {
+			desc:     "failed_same_as_email",
+			password: "grace.hopper@mail.com",
+			err:      true,
+		}, {
+			desc:     "failed_same_as_email_local_part",
+			password: "Grace.Hopper",
+			err:      true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := ValidatePasswordPolicy(tC.password, personalInfo...)
+			if tC.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"strings"
+)
+
+const (
+	// RecoveryCodeCount is number of recovery codes that is generated when
+	// MFA is enabled
+	RecoveryCodeCount = 10
+	// recoveryCodeLength is number of random bytes in recovery code, 10 bytes
+	// is 80 bits of entropy and 16 characters in base32
+	recoveryCodeLength = 10
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes return n one-time recovery codes with format
+// xxxx-xxxx-xxxx-xxxx. Only the digest of the codes (HashRecoveryCode) must be saved.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	b := make([]byte, recoveryCodeLength)
+	for i := range codes {
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code, msg: %v", err)
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+	}
+
+	return codes, nil
+}
+
+// HashRecoveryCode return SHA-256 digest of the recovery code, the code is
+// normalized first so it can be typed in upper case and without dash.
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	digest := sha256.Sum256([]byte(code))
+	return digest[:]
+}
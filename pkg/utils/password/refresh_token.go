@@ -0,0 +1,32 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// refreshTokenLength is number of random bytes in refresh token, 32 bytes is
+// 256 bits of entropy.
+const refreshTokenLength = 32
+
+// GenerateRefreshToken return new opaque refresh token that is sent to the
+// client. Only the digest of the token (HashRefreshToken) must be saved.
+func GenerateRefreshToken() (string, error) {
+	b := make([]byte, refreshTokenLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate refresh token, msg: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashRefreshToken return SHA-256 digest of refresh token. Refresh token has
+// high entropy so plain digest without salt is enough, and it makes the token
+// can be looked up by its digest.
+func HashRefreshToken(refreshToken string) []byte {
+	digest := sha256.Sum256([]byte(refreshToken))
+	return digest[:]
+}
@@ -0,0 +1,35 @@
+package password
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateRefreshToken(t *testing.T) {
+	tokens := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		res, err := GenerateRefreshToken()
+		require.NoError(t, err)
+
+		decoded, err := base64.RawURLEncoding.DecodeString(res)
+		require.NoError(t, err)
+		assert.Len(t, decoded, refreshTokenLength)
+
+		assert.False(t, tokens[res])
+		tokens[res] = true
+	}
+}
+
+func TestHashRefreshToken(t *testing.T) {
+	token, err := GenerateRefreshToken()
+	require.NoError(t, err)
+
+	res := HashRefreshToken(token)
+	assert.Len(t, res, 32)
+	assert.Equal(t, res, HashRefreshToken(token))
+	assert.NotEqual(t, res, HashRefreshToken(token+"a"))
+	assert.NotContains(t, string(res), token)
+}
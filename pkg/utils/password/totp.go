@@ -0,0 +1,116 @@
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP (RFC 6238) parameters, they're the default of authenticator app so
+// they're not sent in the otpauth URI
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+	// totpSecretLength is 160 bits, it's the length of HMAC-SHA1 output that
+	// RFC 4226 section 4 recommend
+	totpSecretLength = 20
+	// totpSkew is number of periods before and after now that is accepted, so
+	// small clock drift of the device doesn't reject the code
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret return new random TOTP secret.
+func GenerateTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretLength)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate totp secret, msg: %v", err)
+	}
+
+	return secret, nil
+}
+
+// EncodeTOTPSecret return the secret in base32 that is typed into
+// authenticator app.
+func EncodeTOTPSecret(secret []byte) string {
+	return totpEncoding.EncodeToString(secret)
+}
+
+// TOTPURI return otpauth URI of the secret that is shown as QR code, the
+// account is shown in authenticator app under the issuer.
+func TOTPURI(issuer, account string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", EncodeTOTPSecret(secret))
+	query.Set("issuer", issuer)
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+
+	return uri.String()
+}
+
+// TOTPStep return the time step of t, it's the counter of HOTP.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+// HOTP return the code of the counter (RFC 4226 section 5.3).
+func HOTP(secret []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// VerifyTOTP check the code against the steps around t, step that is not
+// after lastStep is rejected so the code can't be used twice. The step of the
+// code is returned, it must be saved as the new lastStep.
+func VerifyTOTP(secret []byte, code string, t time.Time, lastStep int64) (step int64, ok bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	now := TOTPStep(t)
+	for i := now - totpSkew; i <= now+totpSkew; i++ {
+		if i <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(HOTP(secret, i, TOTPDigits)), []byte(code)) == 1 {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// TOTPSecretID return the id that TOTP secret of the user is sealed with, so
+// the sealed secret can't be moved to other user.
+func TOTPSecretID(userID int32) string {
+	return fmt.Sprintf("user_totp %d", userID)
+}
@@ -0,0 +1,118 @@
+package password
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// secret of the test vectors in RFC 6238 appendix B
+var totpSecretTest = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	// test vectors of RFC 4226 appendix D
+	ans := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for i, v := range ans {
+		assert.Equal(t, v, HOTP(totpSecretTest, int64(i), 6))
+	}
+
+	// test vectors of RFC 6238 appendix B with SHA1
+	testCases := []struct {
+		time int64
+		ans  string
+	}{
+		{time: 59, ans: "94287082"},
+		{time: 1111111109, ans: "07081804"},
+		{time: 1111111111, ans: "14050471"},
+		{time: 1234567890, ans: "89005924"},
+		{time: 2000000000, ans: "69279037"},
+		{time: 20000000000, ans: "65353130"},
+	}
+	for _, tC := range testCases {
+		assert.Equal(t, tC.ans, HOTP(totpSecretTest, TOTPStep(time.Unix(tC.time, 0)), 8))
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := TOTPStep(now)
+
+	testCases := []struct {
+		desc     string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{
+			desc: "success",
+			code: HOTP(totpSecretTest, step, TOTPDigits),
+			step: step,
+			ok:   true,
+		}, {
+			desc: "success_previous_period",
+			code: HOTP(totpSecretTest, step-1, TOTPDigits),
+			step: step - 1,
+			ok:   true,
+		}, {
+			desc: "success_next_period",
+			code: HOTP(totpSecretTest, step+1, TOTPDigits),
+			step: step + 1,
+			ok:   true,
+		}, {
+			desc: "failed_expired",
+			code: HOTP(totpSecretTest, step-2, TOTPDigits),
+		}, {
+			desc:     "failed_used",
+			code:     HOTP(totpSecretTest, step, TOTPDigits),
+			lastStep: step,
+		}, {
+			desc: "failed_wrong_code",
+			code: "000000",
+		}, {
+			desc: "failed_wrong_length",
+			code: "12345",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, ok := VerifyTOTP(totpSecretTest, tC.code, now, tC.lastStep)
+			assert.Equal(t, tC.ok, ok)
+			assert.Equal(t, tC.step, res)
+		})
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	require.NoError(t, err)
+	require.Len(t, secret, 20)
+
+	res, err := url.Parse(TOTPURI("ran", "grace@mail.com", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", res.Scheme)
+	assert.Equal(t, "totp", res.Host)
+	assert.Equal(t, "/ran:grace@mail.com", res.Path)
+	assert.Equal(t, EncodeTOTPSecret(secret), res.Query().Get("secret"))
+	assert.Equal(t, "ran", res.Query().Get("issuer"))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	require.NoError(t, err)
+	require.Len(t, codes, RecoveryCodeCount)
+
+	hashes := make(map[string]bool)
+	for _, v := range codes {
+		assert.Regexp(t, `^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`, v)
+		hashes[string(HashRecoveryCode(v))] = true
+	}
+	assert.Len(t, hashes, RecoveryCodeCount)
+
+	// code is normalized before it's hashed
+	assert.Equal(t, HashRecoveryCode("abcd-efgh-ijkl-mnop"), HashRecoveryCode(" ABCDEFGH IJKL-MNOP "))
+}
@@ -0,0 +1,502 @@
+package password
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// type of WebAuthn ceremony in client data, it's create for registration and
+// get for login
+const (
+	WebAuthnCeremonyCreate = "webauthn.create"
+	WebAuthnCeremonyGet    = "webauthn.get"
+)
+
+// COSE algorithm (RFC 9053) of passkey public key that is supported
+const (
+	COSEAlgES256 int64 = -7
+	COSEAlgEdDSA int64 = -8
+	COSEAlgRS256 int64 = -257
+)
+
+// WebAuthnAlgorithms is the algorithms that are sent in pubKeyCredParams,
+// in order of preference
+var WebAuthnAlgorithms = []int64{COSEAlgES256, COSEAlgEdDSA, COSEAlgRS256}
+
+const (
+	webAuthnChallengeLength = 32
+	// webAuthnMaxCredentialIDLength is the longest credential ID that is
+	// allowed by WebAuthn level 2
+	webAuthnMaxCredentialIDLength = 1023
+	webAuthnMinRSABits            = 2048
+)
+
+// flags of authenticator data
+const (
+	authDataFlagUserPresent    = 0x01
+	authDataFlagUserVerified   = 0x04
+	authDataFlagBackupEligible = 0x08
+	authDataFlagAttested       = 0x40
+	authDataFlagExtension      = 0x80
+)
+
+// ErrWebAuthnSignCount is returned when the sign count of the assertion is not
+// bigger than the saved sign count, it's the sign that the authenticator is
+// cloned.
+var ErrWebAuthnSignCount = errors.New("sign count of the passkey is not increased, the passkey may be cloned")
+
+var webAuthnEncoding = base64.RawURLEncoding
+
+// GenerateWebAuthnChallenge return new random challenge of the ceremony.
+func GenerateWebAuthnChallenge() ([]byte, error) {
+	challenge := make([]byte, webAuthnChallengeLength)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate webauthn challenge, msg: %v", err)
+	}
+
+	return challenge, nil
+}
+
+// DecodeWebAuthnBase64 decode base64url that is used by WebAuthn JSON, the
+// padding is optional.
+func DecodeWebAuthnBase64(s string) ([]byte, error) {
+	return webAuthnEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// EncodeWebAuthnBase64 encode the bytes to base64url without padding.
+func EncodeWebAuthnBase64(b []byte) string {
+	return webAuthnEncoding.EncodeToString(b)
+}
+
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// WebAuthnClientChallenge return the challenge in clientDataJSON without
+// verifying it, so the ceremony of the challenge can be loaded before the
+// response is verified.
+func WebAuthnClientChallenge(clientDataJSON []byte) ([]byte, error) {
+	var clientData collectedClientData
+	err := json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return nil, fmt.Errorf("client data is not valid, msg: %v", err)
+	}
+
+	challenge, err := DecodeWebAuthnBase64(clientData.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, errors.New("challenge of client data is not valid")
+	}
+
+	return challenge, nil
+}
+
+// WebAuthnRelyingParty is the service that the passkey is created for.
+//   - ID is the RP ID, the domain that the passkey is bound to.
+//   - Origins is the pages that are allowed to run the ceremony.
+//   - RequireUserVerification reject the response that the user isn't
+//     verified by the authenticator with PIN or biometric.
+type WebAuthnRelyingParty struct {
+	ID                      string
+	Origins                 []string
+	RequireUserVerification bool
+}
+
+// WebAuthnRegistration is the response of navigator.credentials.create() and
+// the challenge that is sent to it.
+type WebAuthnRegistration struct {
+	Challenge         []byte
+	ClientDataJSON    []byte
+	AttestationObject []byte
+}
+
+// WebAuthnCredential is the passkey that is created by registration,
+// PublicKey is COSE key.
+type WebAuthnCredential struct {
+	ID             []byte
+	PublicKey      []byte
+	SignCount      uint32
+	AAGUID         []byte
+	UserVerified   bool
+	BackupEligible bool
+}
+
+// WebAuthnAssertion is the response of navigator.credentials.get(), the
+// challenge that is sent to it, and the public key and the sign count of the
+// passkey that is saved.
+type WebAuthnAssertion struct {
+	Challenge         []byte
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	PublicKey         []byte
+	SignCount         uint32
+}
+
+// WebAuthnAssertionResult is the new sign count of the passkey and whether
+// the user is verified by the authenticator.
+type WebAuthnAssertionResult struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// VerifyRegistration verify the registration ceremony (WebAuthn level 2
+// section 7.1) and return the new passkey. Only none attestation and packed
+// attestation are accepted, the certificate of packed attestation is not
+// checked with trust anchor because the attestation is not requested.
+func (rp WebAuthnRelyingParty) VerifyRegistration(arg WebAuthnRegistration) (*WebAuthnCredential, error) {
+	clientDataHash, err := rp.verifyClientData(arg.ClientDataJSON, WebAuthnCeremonyCreate, arg.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	value, rest, err := decodeCBOR(arg.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("attestation object is not valid, msg: %v", err)
+	}
+	attestation, ok := value.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("attestation object is not valid")
+	}
+	format, _ := attestation["fmt"].(string)
+	attStmt, _ := attestation["attStmt"].(map[any]any)
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if attStmt == nil || rawAuthData == nil {
+		return nil, errors.New("attestation object is not valid")
+	}
+
+	authData, err := rp.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.CredentialID == nil {
+		return nil, errors.New("authenticator data doesn't have attested credential")
+	}
+
+	alg, publicKey, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyAttestationStatement(format, attStmt, append(append([]byte(nil), rawAuthData...), clientDataHash...), alg, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCredential{
+		ID:             authData.CredentialID,
+		PublicKey:      authData.PublicKey,
+		SignCount:      authData.SignCount,
+		AAGUID:         authData.AAGUID,
+		UserVerified:   authData.Flags&authDataFlagUserVerified != 0,
+		BackupEligible: authData.Flags&authDataFlagBackupEligible != 0,
+	}, nil
+}
+
+// VerifyAssertion verify the authentication ceremony (WebAuthn level 2
+// section 7.2) with the saved public key. ErrWebAuthnSignCount is returned
+// when the sign count is not increased, authenticator that doesn't count
+// always send 0.
+func (rp WebAuthnRelyingParty) VerifyAssertion(arg WebAuthnAssertion) (*WebAuthnAssertionResult, error) {
+	clientDataHash, err := rp.verifyClientData(arg.ClientDataJSON, WebAuthnCeremonyGet, arg.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	authData, err := rp.verifyAuthenticatorData(arg.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, publicKey, err := parseCOSEKey(arg.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	message := append(append([]byte(nil), arg.AuthenticatorData...), clientDataHash...)
+	err = verifyCOSESignature(alg, publicKey, message, arg.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if (authData.SignCount != 0 || arg.SignCount != 0) && authData.SignCount <= arg.SignCount {
+		return nil, ErrWebAuthnSignCount
+	}
+
+	return &WebAuthnAssertionResult{
+		SignCount:    authData.SignCount,
+		UserVerified: authData.Flags&authDataFlagUserVerified != 0,
+	}, nil
+}
+
+// verifyClientData check the type, challenge and origin of clientDataJSON,
+// and return its hash that is signed by the authenticator.
+func (rp WebAuthnRelyingParty) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) (clientDataHash []byte, err error) {
+	var clientData collectedClientData
+	err = json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return nil, fmt.Errorf("client data is not valid, msg: %v", err)
+	}
+
+	if clientData.Type != ceremony {
+		return nil, fmt.Errorf("type of client data must be %s", ceremony)
+	}
+
+	clientChallenge, err := DecodeWebAuthnBase64(clientData.Challenge)
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(clientChallenge, challenge) != 1 {
+		return nil, errors.New("challenge of client data is wrong")
+	}
+
+	if !slices.Contains(rp.Origins, clientData.Origin) {
+		return nil, fmt.Errorf("origin %q is not allowed", clientData.Origin)
+	}
+	if clientData.CrossOrigin {
+		return nil, errors.New("cross origin ceremony is not allowed")
+	}
+
+	hash := sha256.Sum256(clientDataJSON)
+	return hash[:], nil
+}
+
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// attested credential data, it's only sent by registration
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// verifyAuthenticatorData parse the authenticator data, and check the RP ID
+// and the user presence and verification.
+func (rp WebAuthnRelyingParty) verifyAuthenticatorData(data []byte) (*authenticatorData, error) {
+	authData, err := parseAuthenticatorData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(authData.RPIDHash, rpIDHash[:]) != 1 {
+		return nil, errors.New("rp id hash of authenticator data is wrong")
+	}
+	if authData.Flags&authDataFlagUserPresent == 0 {
+		return nil, errors.New("user is not present")
+	}
+	if rp.RequireUserVerification && authData.Flags&authDataFlagUserVerified == 0 {
+		return nil, errors.New("user is not verified by the authenticator")
+	}
+
+	return authData, nil
+}
+
+// parseAuthenticatorData parse authenticator data (WebAuthn level 2 section
+// 6.1), the extensions are skipped.
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	errInvalid := errors.New("authenticator data is not valid")
+	if len(data) < 37 {
+		return nil, errInvalid
+	}
+
+	res := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if res.Flags&authDataFlagAttested != 0 {
+		if len(rest) < 18 {
+			return nil, errInvalid
+		}
+		res.AAGUID = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || idLength > webAuthnMaxCredentialIDLength || idLength > len(rest) {
+			return nil, errInvalid
+		}
+		res.CredentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, afterKey, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("credential public key is not valid, msg: %v", err)
+		}
+		res.PublicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+
+	if res.Flags&authDataFlagExtension != 0 {
+		value, afterExtension, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("extensions of authenticator data is not valid, msg: %v", err)
+		}
+		if _, ok := value.(map[any]any); !ok {
+			return nil, errInvalid
+		}
+		rest = afterExtension
+	}
+
+	if len(rest) != 0 {
+		return nil, errInvalid
+	}
+
+	return res, nil
+}
+
+// verifyAttestationStatement verify none and packed attestation statement
+// (WebAuthn level 2 section 8.2 and 8.7), signedData is authenticator data
+// and client data hash.
+func verifyAttestationStatement(format string, attStmt map[any]any, signedData []byte, credentialAlg int64, credentialKey crypto.PublicKey) error {
+	switch format {
+	case "none":
+		if len(attStmt) != 0 {
+			return errors.New("none attestation statement must be empty")
+		}
+		return nil
+	case "packed":
+		alg, _ := attStmt["alg"].(int64)
+		sig, _ := attStmt["sig"].([]byte)
+		if sig == nil {
+			return errors.New("packed attestation statement is not valid")
+		}
+
+		x5c, isExists := attStmt["x5c"].([]any)
+		if !isExists {
+			// self attestation is signed with the credential key
+			if alg != credentialAlg {
+				return errors.New("algorithm of self attestation must be the algorithm of the credential")
+			}
+			return verifyCOSESignature(alg, credentialKey, signedData, sig)
+		}
+
+		if len(x5c) == 0 {
+			return errors.New("packed attestation statement is not valid")
+		}
+		der, _ := x5c[0].([]byte)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("attestation certificate is not valid, msg: %v", err)
+		}
+		switch alg {
+		case COSEAlgES256, COSEAlgEdDSA, COSEAlgRS256:
+		default:
+			return fmt.Errorf("algorithm %d is not supported", alg)
+		}
+		return verifyCOSESignature(alg, cert.PublicKey, signedData, sig)
+	default:
+		return fmt.Errorf("attestation format %q is not supported", format)
+	}
+}
+
+// COSE key parameters (RFC 9052 and RFC 9053)
+const (
+	coseKeyKty int64 = 1
+	coseKeyAlg int64 = 3
+	// crv of EC2 and OKP, n of RSA
+	coseKeyCrvOrN int64 = -1
+	// x of EC2 and OKP, e of RSA
+	coseKeyXOrE int64 = -2
+	coseKeyY    int64 = -3
+
+	coseKtyOKP int64 = 1
+	coseKtyEC2 int64 = 2
+	coseKtyRSA int64 = 3
+
+	coseCrvP256    int64 = 1
+	coseCrvEd25519 int64 = 6
+)
+
+// parseCOSEKey return the algorithm and the public key of COSE key, only
+// ES256 with P-256, EdDSA with Ed25519 and RS256 are supported.
+func parseCOSEKey(data []byte) (alg int64, publicKey crypto.PublicKey, err error) {
+	value, rest, err := decodeCBOR(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("public key is not valid, msg: %v", err)
+	}
+	key, ok := value.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return 0, nil, errors.New("public key is not valid")
+	}
+
+	kty, _ := key[coseKeyKty].(int64)
+	alg, _ = key[coseKeyAlg].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == COSEAlgES256:
+		crv, _ := key[coseKeyCrvOrN].(int64)
+		x, _ := key[coseKeyXOrE].([]byte)
+		y, _ := key[coseKeyY].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("ES256 public key is not valid")
+		}
+		// ecdh check that the point is on the curve
+		_, err = ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return 0, nil, errors.New("ES256 public key is not valid")
+		}
+		return alg, &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case kty == coseKtyOKP && alg == COSEAlgEdDSA:
+		crv, _ := key[coseKeyCrvOrN].(int64)
+		x, _ := key[coseKeyXOrE].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("EdDSA public key is not valid")
+		}
+		return alg, ed25519.PublicKey(x), nil
+	case kty == coseKtyRSA && alg == COSEAlgRS256:
+		n, _ := key[coseKeyCrvOrN].([]byte)
+		e, _ := key[coseKeyXOrE].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("RS256 public key is not valid")
+		}
+		publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if publicKey.N.BitLen() < webAuthnMinRSABits || publicKey.E < 3 {
+			return 0, nil, errors.New("RS256 public key is not valid")
+		}
+		return alg, publicKey, nil
+	default:
+		return 0, nil, fmt.Errorf("public key type %d with algorithm %d is not supported", kty, alg)
+	}
+}
+
+// verifyCOSESignature verify WebAuthn signature, ES256 signature is ASN.1 DER.
+func verifyCOSESignature(alg int64, publicKey crypto.PublicKey, message, sig []byte) error {
+	hash := sha256.Sum256(message)
+	ok := false
+
+	switch alg {
+	case COSEAlgES256:
+		key, isECDSA := publicKey.(*ecdsa.PublicKey)
+		ok = isECDSA && ecdsa.VerifyASN1(key, hash[:], sig)
+	case COSEAlgEdDSA:
+		key, isEd25519 := publicKey.(ed25519.PublicKey)
+		ok = isEd25519 && ed25519.Verify(key, message, sig)
+	case COSEAlgRS256:
+		key, isRSA := publicKey.(*rsa.PublicKey)
+		ok = isRSA && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	}
+	if !ok {
+		return errors.New("signature is wrong")
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package password
+
+import (
+	"testing"
+
+	"github.com/dwiw96/ran-user-management/testutils/authenticator"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var rpTest = WebAuthnRelyingParty{
+	ID:      "localhost",
+	Origins: []string{"http://localhost:8080"},
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		input []byte
+		ans   any
+		err   bool
+	}{
+		{
+			desc:  "success_uint",
+			input: []byte{0x19, 0x01, 0x00},
+			ans:   int64(256),
+		}, {
+			desc:  "success_negative",
+			input: []byte{0x38, 0x18},
+			ans:   int64(-25),
+		}, {
+			desc:  "success_map",
+			input: []byte{0xa2, 0x01, 0x42, 0xab, 0xcd, 0x63, 'f', 'm', 't', 0x82, 0xf5, 0xf6},
+			ans:   map[any]any{int64(1): []byte{0xab, 0xcd}, "fmt": []any{true, nil}},
+		}, {
+			desc:  "failed_truncated",
+			input: []byte{0x45, 0x01},
+			err:   true,
+		}, {
+			desc:  "failed_indefinite_length",
+			input: []byte{0x5f, 0x41, 0x01, 0xff},
+			err:   true,
+		}, {
+			desc:  "failed_duplicated_key",
+			input: []byte{0xa2, 0x01, 0x01, 0x01, 0x02},
+			err:   true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			res, rest, err := decodeCBOR(tC.input)
+			if tC.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Empty(t, rest)
+			assert.Equal(t, tC.ans, res)
+		})
+	}
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	challenge, err := GenerateWebAuthnChallenge()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc     string
+		rp       WebAuthnRelyingParty
+		origin   string
+		rpID     string
+		modify   func(auth *authenticator.Authenticator)
+		expected []byte
+		err      bool
+	}{
+		{
+			desc: "success_none_attestation",
+			rp:   rpTest,
+		}, {
+			desc:   "success_self_attestation",
+			rp:     rpTest,
+			modify: func(auth *authenticator.Authenticator) { auth.SelfAttestation = true },
+		}, {
+			desc:   "failed_origin",
+			rp:     rpTest,
+			origin: "http://evil.com",
+			err:    true,
+		}, {
+			desc: "failed_rp_id",
+			rp:   rpTest,
+			rpID: "evil.com",
+			err:  true,
+		}, {
+			desc:     "failed_challenge",
+			rp:       rpTest,
+			expected: []byte("other challenge"),
+			err:      true,
+		}, {
+			desc:   "failed_user_verification",
+			rp:     WebAuthnRelyingParty{ID: rpTest.ID, Origins: rpTest.Origins, RequireUserVerification: true},
+			modify: func(auth *authenticator.Authenticator) { auth.UserVerified = false },
+			err:    true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			auth := authenticator.New(rpTest.ID, rpTest.Origins[0])
+			if tC.origin != "" {
+				auth.Origin = tC.origin
+			}
+			if tC.rpID != "" {
+				auth.RPID = tC.rpID
+			}
+			if tC.modify != nil {
+				tC.modify(auth)
+			}
+			expected := challenge
+			if tC.expected != nil {
+				expected = tC.expected
+			}
+
+			reg, err := auth.Create(challenge, []byte("1"))
+			require.NoError(t, err)
+
+			clientChallenge, err := WebAuthnClientChallenge(reg.ClientDataJSON)
+			require.NoError(t, err)
+			assert.Equal(t, challenge, clientChallenge)
+
+			res, err := tC.rp.VerifyRegistration(WebAuthnRegistration{
+				Challenge:         expected,
+				ClientDataJSON:    reg.ClientDataJSON,
+				AttestationObject: reg.AttestationObject,
+			})
+			if tC.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, reg.CredentialID, res.ID)
+			assert.NotEmpty(t, res.PublicKey)
+			assert.Zero(t, res.SignCount)
+			assert.True(t, res.UserVerified)
+
+			alg, _, err := parseCOSEKey(res.PublicKey)
+			require.NoError(t, err)
+			assert.Equal(t, COSEAlgES256, alg)
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	auth := authenticator.New(rpTest.ID, rpTest.Origins[0])
+	challenge, err := GenerateWebAuthnChallenge()
+	require.NoError(t, err)
+
+	reg, err := auth.Create(challenge, []byte("1"))
+	require.NoError(t, err)
+	cred, err := rpTest.VerifyRegistration(WebAuthnRegistration{Challenge: challenge, ClientDataJSON: reg.ClientDataJSON, AttestationObject: reg.AttestationObject})
+	require.NoError(t, err)
+
+	other := authenticator.New(rpTest.ID, rpTest.Origins[0])
+	_, err = other.Create(challenge, []byte("2"))
+	require.NoError(t, err)
+
+	verify := func(auth *authenticator.Authenticator, publicKey []byte, signCount uint32) (*WebAuthnAssertionResult, error) {
+		assertion, err := auth.Get(challenge, nil)
+		require.NoError(t, err)
+
+		return rpTest.VerifyAssertion(WebAuthnAssertion{
+			Challenge:         challenge,
+			ClientDataJSON:    assertion.ClientDataJSON,
+			AuthenticatorData: assertion.AuthenticatorData,
+			Signature:         assertion.Signature,
+			PublicKey:         publicKey,
+			SignCount:         signCount,
+		})
+	}
+
+	t.Run("success", func(t *testing.T) {
+		clone := auth.Clone()
+
+		res, err := verify(auth, cred.PublicKey, cred.SignCount)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), res.SignCount)
+		assert.True(t, res.UserVerified)
+
+		// the clone send the same sign count again
+		_, err = verify(clone, cred.PublicKey, res.SignCount)
+		require.ErrorIs(t, err, ErrWebAuthnSignCount)
+	})
+
+	t.Run("success_zero_sign_count", func(t *testing.T) {
+		zero := authenticator.New(rpTest.ID, rpTest.Origins[0])
+		zero.ZeroSignCount = true
+		zero.UserVerified = false
+		reg, err := zero.Create(challenge, []byte("3"))
+		require.NoError(t, err)
+		zeroCred, err := rpTest.VerifyRegistration(WebAuthnRegistration{Challenge: challenge, ClientDataJSON: reg.ClientDataJSON, AttestationObject: reg.AttestationObject})
+		require.NoError(t, err)
+
+		// authenticator that doesn't count always send 0
+		for i := 0; i < 2; i++ {
+			res, err := verify(zero, zeroCred.PublicKey, zeroCred.SignCount)
+			require.NoError(t, err)
+			assert.Zero(t, res.SignCount)
+			assert.False(t, res.UserVerified)
+		}
+	})
+
+	t.Run("failed_other_key", func(t *testing.T) {
+		_, err := verify(other, cred.PublicKey, 0)
+		require.Error(t, err)
+	})
+
+	t.Run("failed_ceremony", func(t *testing.T) {
+		reg, err := auth.Create(challenge, []byte("1"))
+		require.NoError(t, err)
+
+		_, err = rpTest.VerifyAssertion(WebAuthnAssertion{
+			Challenge:      challenge,
+			ClientDataJSON: reg.ClientDataJSON,
+			PublicKey:      cred.PublicKey,
+		})
+		require.Error(t, err)
+	})
+}
@@ -11,7 +11,11 @@ var (
 	CodeFailedUser         = 400 // 400, Bad Request
 	CodeFailedValidation   = 422 // 422, Unprocessably Entity
 	CodeFailedUnauthorized = 401 // 401, Unauthorized
+	CodeFailedForbidden    = 403 // 403, Forbidden
+	CodeFailedNotFound     = 404 // 404, Not Found
 	CodeFailedDuplicated   = 409 // 409, Conflict
+	CodeFailedLocked       = 423 // 423, Locked
+	CodeFailedTooMany      = 429 // 429, Too Many Requests
 )
 
 var (
@@ -16,6 +16,10 @@ var errorMsg = map[int]string{
 	500: "Internal Server Error",
 	400: "Bad Request",
 	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	423: "Locked",
+	429: "Too Many Requests",
 }
 
 func ErrorJSON(c *gin.Context, code int, desc []string, remoteAddr string) {
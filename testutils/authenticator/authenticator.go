@@ -0,0 +1,249 @@
+// Package authenticator is software WebAuthn authenticator, it's used to test
+// passkey registration and login without browser. The passkey is ES256 key in
+// memory and the attestation is none or packed self attestation.
+package authenticator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+
+	coseAlgES256 = -7
+)
+
+type credential struct {
+	id         []byte
+	key        *ecdsa.PrivateKey
+	userHandle []byte
+	signCount  uint32
+}
+
+// Authenticator create and use passkeys of the RP ID, the client data is
+// created with the origin like the browser.
+//   - UserVerified set the user verified flag.
+//   - SelfAttestation return packed self attestation instead of none.
+//   - ZeroSignCount doesn't count the signature, like synced passkey.
+type Authenticator struct {
+	RPID            string
+	Origin          string
+	UserVerified    bool
+	SelfAttestation bool
+	ZeroSignCount   bool
+
+	credentials []*credential
+}
+
+func New(rpID, origin string) *Authenticator {
+	return &Authenticator{
+		RPID:         rpID,
+		Origin:       origin,
+		UserVerified: true,
+	}
+}
+
+// Clone return copy of the authenticator with the same passkeys and sign
+// count, it's used to test cloned authenticator.
+func (a *Authenticator) Clone() *Authenticator {
+	res := *a
+	res.credentials = nil
+	for _, v := range a.credentials {
+		c := *v
+		res.credentials = append(res.credentials, &c)
+	}
+
+	return &res
+}
+
+// Registration is the response of navigator.credentials.create().
+type Registration struct {
+	CredentialID      []byte
+	ClientDataJSON    []byte
+	AttestationObject []byte
+}
+
+// Create create new passkey of the user and return the attestation.
+func (a *Authenticator) Create(challenge, userHandle []byte) (*Registration, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &credential{id: id, key: key, userHandle: userHandle}
+	clientDataJSON, clientDataHash := a.clientData("webauthn.create", challenge)
+
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	publicKey := encodeMap(map[any]any{1: 2, 3: coseAlgES256, -1: 1, -2: x, -3: y})
+
+	authData := a.authData(flagAttested, 0)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(id)))
+	authData = append(authData, id...)
+	authData = append(authData, publicKey...)
+
+	format := "none"
+	attStmt := map[any]any{}
+	if a.SelfAttestation {
+		sig, err := sign(key, append(append([]byte(nil), authData...), clientDataHash...))
+		if err != nil {
+			return nil, err
+		}
+		format = "packed"
+		attStmt = map[any]any{"alg": coseAlgES256, "sig": sig}
+	}
+
+	a.credentials = append(a.credentials, cred)
+
+	return &Registration{
+		CredentialID:      id,
+		ClientDataJSON:    clientDataJSON,
+		AttestationObject: encodeMap(map[any]any{"fmt": format, "attStmt": attStmt, "authData": authData}),
+	}, nil
+}
+
+// Assertion is the response of navigator.credentials.get().
+type Assertion struct {
+	CredentialID      []byte
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	UserHandle        []byte
+}
+
+// Get sign the challenge with the passkey in allowCredentials, the latest
+// passkey is used when allowCredentials is empty like discoverable credential.
+func (a *Authenticator) Get(challenge []byte, allowCredentials [][]byte) (*Assertion, error) {
+	var cred *credential
+	for i := len(a.credentials) - 1; i >= 0 && cred == nil; i-- {
+		if len(allowCredentials) == 0 {
+			cred = a.credentials[i]
+		}
+		for _, id := range allowCredentials {
+			if string(id) == string(a.credentials[i].id) {
+				cred = a.credentials[i]
+			}
+		}
+	}
+	if cred == nil {
+		return nil, errors.New("passkey is not found")
+	}
+
+	if !a.ZeroSignCount {
+		cred.signCount++
+	}
+	clientDataJSON, clientDataHash := a.clientData("webauthn.get", challenge)
+	authData := a.authData(0, cred.signCount)
+
+	sig, err := sign(cred.key, append(append([]byte(nil), authData...), clientDataHash...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Assertion{
+		CredentialID:      cred.id,
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: authData,
+		Signature:         sig,
+		UserHandle:        cred.userHandle,
+	}, nil
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) (clientDataJSON, clientDataHash []byte) {
+	clientDataJSON, _ = json.Marshal(map[string]any{
+		"type":        ceremony,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	hash := sha256.Sum256(clientDataJSON)
+
+	return clientDataJSON, hash[:]
+}
+
+func (a *Authenticator) authData(flags byte, signCount uint32) []byte {
+	flags |= flagUserPresent
+	if a.UserVerified {
+		flags |= flagUserVerified
+	}
+
+	rpIDHash := sha256.Sum256([]byte(a.RPID))
+	data := append(rpIDHash[:], flags)
+
+	return binary.BigEndian.AppendUint32(data, signCount)
+}
+
+func sign(key *ecdsa.PrivateKey, message []byte) ([]byte, error) {
+	hash := sha256.Sum256(message)
+	return ecdsa.SignASN1(rand.Reader, key, hash[:])
+}
+
+// encodeMap encode CBOR map with int, string and []byte value, the keys are
+// sorted so the encoding is deterministic.
+func encodeMap(m map[any]any) []byte {
+	keys := make([]any, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return string(encode(keys[i])) < string(encode(keys[j]))
+	})
+
+	res := head(5, uint64(len(m)))
+	for _, k := range keys {
+		res = append(res, encode(k)...)
+		res = append(res, encode(m[k])...)
+	}
+
+	return res
+}
+
+func encode(value any) []byte {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case map[any]any:
+		return encodeMap(v)
+	default:
+		panic("authenticator: cbor type is not supported")
+	}
+}
+
+func head(major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return []byte{major | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major | 25}, uint16(arg))
+	default:
+		return binary.BigEndian.AppendUint32([]byte{major | 26}, uint32(arg))
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 	cfg "github.com/dwiw96/ran-user-management/config"
 	pg "github.com/dwiw96/ran-user-management/pkg/driver/postgresql"
+	password "github.com/dwiw96/ran-user-management/pkg/utils/password"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/pgx/v5"
@@ -59,6 +60,17 @@ func GetContext() context.Context {
 	return ctx
 }
 
+// GetKeyEncryptionKey return the key-encryption key of jwt private key that
+// is set in .env
+func GetKeyEncryptionKey() *password.KeyEncryptionKey {
+	kek, err := cfg.GetEnvConfig().GetKeyEncryptionKey()
+	if err != nil {
+		log.Fatal("failed to load key-encryption key, err:", err)
+	}
+
+	return kek
+}
+
 func SetupDB(schemaName string) func() {
 	var err error
 
@@ -122,6 +134,13 @@ func DeleteSchemaTestData(pool *pgxpool.Pool) error {
 
 	const query = `
 	TRUNCATE TABLE
+		webauthn_credentials,
+		mfa_recovery_codes,
+		user_totp,
+		oauth_consents,
+		oauth_clients,
+		security_events,
+		refresh_token_history,
 		refresh_token_whitelist,
 		users
 	RESTART IDENTITY CASCADE;